@@ -0,0 +1,78 @@
+package main
+
+// recording-tool generates recording key pairs and
+// decrypts session logs written by a proxy with a
+// RecordingRecipientFile configured.
+//
+// generate keys:
+//   go run _example/recording-tool/recording-tool.go -genkey x25519 -private recording.key -public recording.pub
+// decrypt a log:
+//   go run _example/recording-tool/recording-tool.go -identity recording.key -in session.log.json.enc -out session.log.json
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	. "github.com/bja2142/sshproxyplus"
+)
+
+func main() {
+	genkey := flag.String("genkey", "", "generate a new key pair of this type (x25519 or rsa-oaep) instead of decrypting")
+	privateFile := flag.String("private", "recording.key", "where to write the private key when generating keys")
+	publicFile := flag.String("public", "recording.pub", "where to write the public key when generating keys")
+	identityFile := flag.String("identity", "", "private key used to decrypt the recording")
+	inFile := flag.String("in", "-", "encrypted recording to read; defaults to stdin")
+	outFile := flag.String("out", "-", "where to write the decrypted recording; defaults to stdout")
+	flag.Parse()
+
+	if *genkey != "" {
+		privatePEM, publicPEM, err := GenerateRecordingKeyPair(*genkey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(*privateFile, privatePEM, 0600); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(*publicFile, publicPEM, 0644); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote private key to %v and public key to %v\n", *privateFile, *publicFile)
+		return
+	}
+
+	var identity *RecordingIdentity
+	if *identityFile != "" {
+		var err error
+		identity, err = LoadRecordingIdentity(*identityFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	in := os.Stdin
+	if *inFile != "-" {
+		fd, err := os.Open(*inFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fd.Close()
+		in = fd
+	}
+	out := os.Stdout
+	if *outFile != "-" {
+		fd, err := os.OpenFile(*outFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fd.Close()
+		out = fd
+	}
+
+	reader, err := NewRecordingReader(in, identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -35,13 +35,24 @@ func main() {
 
 	args := parseArgs()
 
+	if *args["validate"].(*bool) {
+		os.Exit(validateConfigFiles(args))
+	}
+
 	var err error
 	var controller *ProxyController
 
 	if *args["controller_config_file"].(*string) != "" {
 		err, controller = LoadControllerConfigFromFile(*args["controller_config_file"].(*string),args["default_private_key"].(ssh.Signer))
+	} else if *args["state_file"].(*string) != "" {
+		if _, stat_err := os.Stat(*args["state_file"].(*string)); stat_err == nil {
+			err, controller = LoadControllerConfigFromFile(*args["state_file"].(*string),args["default_private_key"].(ssh.Signer))
+		}
 	}
 
+	if err != nil {
+		logger.Println("Unable to load config:", err)
+	}
 	if err != nil || controller == nil {
 		logger.Println("Using Default Controller.")
 		controller = &ProxyController{
@@ -56,6 +67,13 @@ func main() {
 			Log: logger,
 			BaseURI: args["base_URI"].(string),
 			DefaultSigner: args["default_private_key"].(ssh.Signer),
+			RecordingIdentityFile: *args["recording_identity"].(*string),
+			APIToken: *args["api_token"].(*string),
+			GRPCHost: *args["grpc_host"].(*string),
+			GRPCCert: *args["grpc_cert"].(*string),
+			GRPCKey: *args["grpc_key"].(*string),
+			GRPCClientCA: *args["grpc_client_ca"].(*string),
+			AuditLogFile: *args["audit_log"].(*string),
 		}	
 
 		cur_proxy := useArgsForNewProxyContext(args)
@@ -71,9 +89,19 @@ func main() {
 		controller.ActivateProxy(proxyID)
 	}
 
+	if *args["state_file"].(*string) != "" {
+		controller.StateFile = *args["state_file"].(*string)
+	}
+
 	controller.Listen()
 	defer controller.Stop()
+	if controller.ConfigFile != "" {
+		controller.ReloadOnSignal()
+	}
 	go controller.StartWebServer()
+	if controller.GRPCHost != "" {
+		go controller.StartGRPCServer()
+	}
 
 	for index,_ := range controller.Proxies {
 		controller.ActivateProxy(index)
@@ -151,7 +179,7 @@ func main() {
 }
 
 func makeNewViewersForAllUsers(proxy * ProxyContext, proxyID uint64) {
-	for key,user := range proxy.Users {
+	for key,user := range proxy.ListProxyUsers() {
 		logger.Println(key)
 		err, viewer := proxy.MakeSessionViewerForUser(user.Username,user.Password)
 		if (err == nil) {
@@ -201,9 +229,20 @@ func parseArgs() map[string]interface{} {
 	args["server_version"] = flag.String("server-version", "SSH-2.0-OpenSSH_7.9p1 Raspbian-10", "server version to use")
 	args["base_URI_option"] = flag.String("base-uri","auto","override base URI when crafting signed URLs; default is to auto-detect")
 	args["public_access"] = flag.Bool("public-view", true, "allow viewers to query sessions without secret URL")
-	args["controller_config_file"] = flag.String("config", "", "path to a config file for controller to load. otherwise a hardcoded default is used.")
+	args["controller_config_file"] = flag.String("config", "", "path to a JSON, YAML or TOML config file for controller to load. otherwise a hardcoded default is used.")
 	args["controller.Listen_host"] = flag.String("controller-listen-host", "127.0.0.1:9999", "host for controller port to listen on.")
 	args["controller_web_static_dir"] = flag.String("controller-web-static-dir", "./html", "host for controller port to listen on.")
+	args["recording_recipient"] = flag.String("recording-recipient", "", "PEM public key to encrypt session logs for; logs are written in cleartext if empty")
+	args["recording_identity"] = flag.String("recording-identity", "", "PEM private key the web server uses to decrypt session logs for viewers")
+	args["api_token"] = flag.String("api-token", "", "bearer token for the REST API under /api/v1; the API is off if empty")
+	args["grpc_host"] = flag.String("grpc-host", "", "host for the gRPC control plane to listen on; off if empty")
+	args["grpc_cert"] = flag.String("grpc-cert", "", "TLS certificate of the gRPC control plane")
+	args["grpc_key"] = flag.String("grpc-key", "", "TLS key of the gRPC control plane")
+	args["grpc_client_ca"] = flag.String("grpc-client-ca", "", "CA that gRPC client certificates must be signed by")
+	args["audit_log"] = flag.String("audit-log", "", "file to append a record of every controller message to; off if empty")
+	args["state_file"] = flag.String("state-file", "", "file the controller is saved to after every change and loaded from at start; off if empty")
+	args["observer_key"] = flag.String("observer-key", "", "password that lets watch+<session> logins observe any session; viewer secrets also work")
+	args["validate"] = flag.Bool("validate", false, "check the config and state files, print every problem found and exit")
 	flag.Parse()
 
 	var err error
@@ -273,6 +312,31 @@ func parseArgs() map[string]interface{} {
 	return args
 }
 
+// validateConfigFiles prints the problems in the
+// config and state files and returns the exit
+// status
+func validateConfigFiles(args map[string]interface{}) int {
+	status := 0
+	for _, path := range []string{*args["controller_config_file"].(*string), *args["state_file"].(*string)} {
+		if path == "" {
+			continue
+		}
+		err, problems := ValidateControllerConfigFile(path)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, problem := range problems {
+			fmt.Printf("%v: %v\n", path, problem)
+		}
+		if len(problems) > 0 {
+			status = 1
+		} else {
+			fmt.Printf("%v: ok\n", path)
+		}
+	}
+	return status
+}
+
 func useArgsForNewProxyContext(args map[string]interface{}) *ProxyContext {
 
 	// https://freshman.tech/snippets/go/create-directory-if-not-exist/
@@ -302,6 +366,8 @@ func useArgsForNewProxyContext(args map[string]interface{}) *ProxyContext {
 	proxy.RequireValidPassword = *args["require_valid_password"].(*bool)
 	proxy.BaseURI = args["base_URI"].(string)
 	proxy.PublicAccess = *args["public_access"].(*bool)
+	proxy.RecordingRecipientFile = *args["recording_recipient"].(*string)
+	proxy.ObserverKey = *args["observer_key"].(*string)
 	proxy.Log = logger
 
 	return proxy
@@ -3,19 +3,22 @@ package sshproxyplus
 
 import (
 	"sync"
+	"net"
 	"net/http"
 	"strconv"
 	"log"
 	"encoding/json"
 	"os"
+	"io"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
 	"fmt"
 	"encoding/pem"
-	"errors"
+	"strings"
 )
 
 
@@ -44,6 +47,8 @@ import (
 */
 type ProxyController struct {
 	Proxies				map[uint64]*ProxyContext
+	// the ID of the next proxy; when it is left
+	// out of a config the highest ID + 1 is used
 	ProxyCounter		uint64
 	// Used to authenticate commands 
 	// sent over the controller socket
@@ -61,8 +66,49 @@ type ProxyController struct {
 	BaseURI				string
 	Log					LoggerInterface	`json:"-"`
 	DefaultSigner		ssh.Signer	`json:"-"`
-	channelFilters		map[string]*ChannelFilterFunc
-	EventCallbacks		map[string]*EventCallback
+	// filters and callbacks added through the
+	// controller by key; the ones built from specs
+	// are saved with their ProxyUser
+	ChannelFilters		map[string]*ChannelFilterFunc `json:"-"`
+	EventCallbacks		map[string]*EventCallback `json:"-"`
+	// path to the PEM private key used by the
+	// web server to decrypt recordings for
+	// authorized viewers
+	RecordingIdentityFile	string
+	// bearer token for the REST API under
+	// /api/v1; the API is off while it is empty
+	APIToken			string `json:",omitempty"`
+	// listener of the gRPC control plane, its
+	// server key pair and the CA that client
+	// certificates must be signed by
+	GRPCHost			string `json:",omitempty"`
+	GRPCCert			string `json:",omitempty"`
+	GRPCKey				string `json:",omitempty"`
+	GRPCClientCA		string `json:",omitempty"`
+	grpcServer			*grpc.Server
+	// how far the timestamp of a signed message
+	// may be from the controller's clock; 0 means
+	// CONTROLLER_DEFAULT_CLOCK_SKEW
+	MessageClockSkewSeconds	int `json:",omitempty"`
+	// named keys that may sign messages besides
+	// PresharedKey, each limited to what its role
+	// or allow-list permits
+	Keys				map[string]*ControllerKey `json:",omitempty"`
+	// append-only JSON lines file recording every
+	// controller message; off while empty
+	AuditLogFile		string `json:",omitempty"`
+	auditLog			auditLog
+	replay				replayGuard
+	// rewritten with the whole controller after
+	// every change made by a message; off while
+	// empty
+	StateFile			string `json:",omitempty"`
+	stateMutex			sync.Mutex
+	// the file the controller was loaded from,
+	// which reload-config and SIGHUP read again
+	ConfigFile			string `json:"-"`
+	reloadMutex			sync.Mutex
+	reloadSignals		chan os.Signal
 }
 
 
@@ -72,6 +118,10 @@ type ProxyController struct {
 
 
 func (controller *ProxyController) clientHandler(client ProxyControllerSocketClient, socket ProxyControllerSocket) {
+	source := ""
+	if addressed, ok := client.(interface{ RemoteAddr() net.Addr }); ok {
+		source = addressed.RemoteAddr().String()
+	}
 	for {
 		data, err := client.ReadLine()
 		if (err != nil) {
@@ -80,11 +130,17 @@ func (controller *ProxyController) clientHandler(client ProxyControllerSocketCli
 		messageWrapper :=ControllerHMAC{}
 		err = json.Unmarshal(data,&messageWrapper)
 		if(err == nil) {
-			err, message := messageWrapper.Verify([]byte(controller.PresharedKey))
+			identity := auditKeyIdentity(messageWrapper.KeyName)
+			err, message, key := controller.verifyMessage(&messageWrapper)
 			if (err == nil) {
-				data = message.HandleMessage(controller)
+				data = message.handleMessageAs(controller, key, identity, source)
 			} else {
 				controller.Log.Println("error during verify", err)
+				controller.audit(&ControllerMessage{}, identity, source, nil, err)
+				data, _ = json.Marshal(map[string]interface{}{
+					"MessageType": "error",
+					"Error": fmt.Sprintf("%s", err),
+				})
 			}
 		}  else {
 			controller.Log.Println("error during unmarshal",err)
@@ -113,32 +169,168 @@ func (controller *ProxyController) handleWebProxyRequest(w http.ResponseWriter,
 		proxyWebHandler := &proxyWebServer{
 			proxy:proxy,
 			BaseURI: controller.BaseURI,
+			recordingIdentityFile: controller.RecordingIdentityFile,
 		}
 		proxyWebHandler.socketHandler(w,r)
 	}
 	
 }
 
+/*
+ handleRecordingRequest serves the decrypted
+ log of a session to the holder of a viewer
+ secret that covers the session. 
+ Sessions still being recorded get a conflict.
+
+ /recording/?id=<proxyID>&viewer=<secret>&session=<key>
+*/
+func (controller *ProxyController) handleRecordingRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	numericID,err := strconv.ParseUint(query.Get("id"), 10, 64)
+	if err != nil {
+		numericID = 0
+	}
+	proxy, err := controller.GetProxy(numericID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	viewer := proxy.GetSessionViewer(query.Get("viewer"))
+	if viewer == nil {
+		http.Error(w, "invalid viewer secret", http.StatusForbidden)
+		return
+	}
+	session, ok := viewer.getSession(query.Get("session"))
+	if !ok {
+		http.Error(w, "could not find session", http.StatusNotFound)
+		return
+	}
+	if session.isRecording() {
+		http.Error(w, "session is still being recorded", http.StatusConflict)
+		return
+	}
+	identity, err := controller.loadRecordingIdentity()
+	if err != nil {
+		controller.Log.Println("error loading recording identity:", err)
+		http.Error(w, "unable to load recording identity", http.StatusInternalServerError)
+		return
+	}
+	store, err := proxy.GetRecordingStore()
+	if err != nil {
+		controller.Log.Println("error opening recording store:", err)
+		http.Error(w, "could not open recording", http.StatusInternalServerError)
+		return
+	}
+	fd, err := store.Open(session.getFilename())
+	if err != nil {
+		http.Error(w, "could not open recording", http.StatusNotFound)
+		return
+	}
+	defer fd.Close()
+	reader, err := NewRecordingReader(fd, identity)
+	if err != nil {
+		controller.Log.Println("error decrypting recording:", err)
+		http.Error(w, "unable to decrypt recording", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		controller.Log.Println("error sending recording:", err)
+		// the status is already sent, so cut the
+		// response off rather than let a truncated
+		// recording look complete
+		panic(http.ErrAbortHandler)
+	}
+}
+
+/*
+ handleSearchRequest searches the sessions of a
+ proxy and returns the matches as JSON.
+
+ /search/?id=<proxyID>&viewer=<secret>&q=<text>
+   &user=<username>&host=<host>&since=<unix>
+   &until=<unix>&limit=<n>
+
+ With a viewer secret only the sessions of that
+ viewer are searched. Without one the proxy must
+ allow PublicAccess.
+*/
+func (controller *ProxyController) handleSearchRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	numericID,err := strconv.ParseUint(query.Get("id"), 10, 64)
+	if err != nil {
+		numericID = 0
+	}
+	proxy, err := controller.GetProxy(numericID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var allowed map[string]*SessionContext
+	if query.Get("viewer") != "" {
+		viewer := proxy.GetSessionViewer(query.Get("viewer"))
+		if viewer == nil {
+			http.Error(w, "invalid viewer secret", http.StatusForbidden)
+			return
+		}
+		allowed, _ = viewer.getSessions()
+	} else if !proxy.isPublic() {
+		http.Error(w, "public query disabled", http.StatusForbidden)
+		return
+	}
+	search := &SessionSearchQuery{
+		Text: query.Get("q"),
+		Username: query.Get("user"),
+		Host: query.Get("host"),
+	}
+	search.Since, _ = strconv.ParseInt(query.Get("since"), 10, 64)
+	search.Until, _ = strconv.ParseInt(query.Get("until"), 10, 64)
+	search.Limit, _ = strconv.Atoi(query.Get("limit"))
+
+	err, results := controller.searchSessions(numericID, search, allowed)
+	if err != nil {
+		controller.Log.Println("error searching sessions:", err)
+		http.Error(w, "unable to search sessions", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		controller.Log.Println("Error during marshaling json: ", err)
+		http.Error(w, "unable to search sessions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
 func (controller *ProxyController) StartWebServer() error {
 	
+	controller.mutex.Lock()
 	if controller.webServer == nil {
 		serverMux := http.NewServeMux()
 		fileServe := http.FileServer(http.Dir(controller.WebStaticDir))
 
 		serverMux.Handle("/",fileServe)
 		serverMux.HandleFunc("/proxysocket/", controller.handleWebProxyRequest)
+		serverMux.HandleFunc("/recording/", controller.handleRecordingRequest)
+		serverMux.HandleFunc("/search/", controller.handleSearchRequest)
+		serverMux.HandleFunc(CONTROLLER_API_PREFIX+"/", controller.handleAPIRequest)
 		controller.webServer = &http.Server{
 			Handler: serverMux,
 			Addr:	controller.WebHost,
 		}
 	}
+	webServer := controller.webServer
+	socket := controller.socket
+	controller.mutex.Unlock()
 	var err error
-	if controller.socket.IsPlaintext() {
+	if socket.IsPlaintext() {
 		controller.Log.Printf("Starting plaintext web server: %v\n",controller.WebHost)
-		err = controller.webServer.ListenAndServe()
+		err = webServer.ListenAndServe()
 	} else {
 		controller.Log.Printf("Starting TLS web server: %v\n",controller.WebHost)
-		err = controller.webServer.ListenAndServeTLS(controller.TLSCert, controller.TLSKey)
+		err = webServer.ListenAndServeTLS(controller.TLSCert, controller.TLSKey)
 	}
 
 	if (err != nil)	{
@@ -157,10 +349,15 @@ func (controller *ProxyController) ExportControllerAsJSON() ([]byte, error) {
 	return data, err
 }
 
+// WriteControllerConfigToFile writes JSON, YAML
+// or TOML depending on the file extension
 func (controller *ProxyController) WriteControllerConfigToFile(filepath string) error {
 	data, err := controller.ExportControllerAsJSON()
 	if err == nil {
-		err = os.WriteFile(filepath, data, 0600)
+		data, err = encodeConfig(filepath, data)
+	}
+	if err == nil {
+		err = writeFileAtomic(filepath, data)
 		if(err != nil) {
 			controller.Log.Println("Error writing to file:",err)
 		} else {
@@ -174,24 +371,29 @@ func (controller *ProxyController) WriteControllerConfigToFile(filepath string)
 
 // TODO: when writing test cases, see if a ProxyUser is created if it exists in the viewer but not 
 // in the proxy already
+
+/*
+ LoadControllerConfigFromFile loads a JSON, YAML
+ or TOML config, picked by the file extension.
+ The config is validated first and nothing is
+ started when it has problems; the error then
+ lists all of them.
+*/
 func LoadControllerConfigFromFile(filepath string, signer ssh.Signer) (error, *ProxyController) {
-	data, err := os.ReadFile(filepath)
-	if(err != nil) {
-		return err,nil
+	err, controller, problems := readControllerConfig(filepath)
+	if err != nil {
+		return err, nil
 	}
-	controller := &ProxyController{}
-	err = json.Unmarshal(data,controller)
-
-	if err == nil {
-		if signer != nil {
-			controller.DefaultSigner = signer
-		}
-
-		controller.Initialize()
-
-		
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config %v: %v", filepath, strings.Join(problems, "; ")), nil
+	}
+	controller.ConfigFile = filepath
+	if signer != nil {
+		controller.DefaultSigner = signer
 	}
-	return err, controller
+
+	controller.Initialize()
+	return nil, controller
 }
 
 //
@@ -213,9 +415,12 @@ func (controller *ProxyController) UseNewLogger(logger LoggerInterface) {
 
 
 func (controller *ProxyController) StopWebServer() {
-	if controller.webServer != nil {
-		controller.webServer.Close()
-		controller.webServer = nil
+	controller.mutex.Lock()
+	webServer := controller.webServer
+	controller.webServer = nil
+	controller.mutex.Unlock()
+	if webServer != nil {
+		webServer.Close()
 	}
 }
 
@@ -225,8 +430,8 @@ func (controller *ProxyController) Initialize() {
 		controller.UseNewLogger(log.Default())
 	}
 
-	if controller.channelFilters == nil {
-		controller.channelFilters = make(map[string]*ChannelFilterFunc)
+	if controller.ChannelFilters == nil {
+		controller.ChannelFilters = make(map[string]*ChannelFilterFunc)
 	}
 	if controller.EventCallbacks == nil {
 		controller.EventCallbacks = make(map[string]*EventCallback)
@@ -243,14 +448,23 @@ func (controller *ProxyController) Initialize() {
 		}
 	}
 
-	for _, proxy := range controller.Proxies {
+	for proxy_id, proxy := range controller.Proxies {
+		proxy.setID(proxy_id)
+		proxy.setIdentityLoader(controller.loadRecordingIdentity)
 		proxy.Initialize(controller.DefaultSigner)
+		// configs may leave ProxyCounter out
+		if controller.ProxyCounter <= proxy_id {
+			controller.ProxyCounter = proxy_id + 1
+		}
 	}
 	controller.UpdateProxiesWithCurrentLogger(false)
+	controller.registerSpecKeys()
 	
 }
 
 func (controller *ProxyController) InitializeSocket() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
 	if(controller.socket == nil) {
 		switch controller.SocketType {
 		case PROXY_CONTROLLER_SOCKET_PLAIN:
@@ -268,15 +482,23 @@ func (controller *ProxyController) InitializeSocket() {
 }
 func (controller *ProxyController) Listen() {
 	controller.InitializeSocket()
-	go controller.socket.ListenAndServe(controller.SocketHost, controller.clientHandler)
+	controller.mutex.Lock()
+	socket := controller.socket
+	controller.mutex.Unlock()
+	go socket.ListenAndServe(controller.SocketHost, controller.clientHandler)
 }
 
 func (controller *ProxyController) Stop() {
-	if controller.socket != nil {
-		controller.socket.Stop()
+	controller.mutex.Lock()
+	socket := controller.socket
+	controller.mutex.Unlock()
+	if socket != nil {
+		socket.Stop()
 	}
+	controller.stopReloadOnSignal()
 	controller.StopProxies()
 	controller.StopWebServer()
+	controller.StopGRPCServer()
 	
 }
 
@@ -304,13 +526,13 @@ func (controller *ProxyController) AddProxyFromJSON(data []byte) (error,uint64)
 func (controller *ProxyController) DestroyProxy(proxyID uint64) (err error) {
 	controller.mutex.Lock()
 		if proxy, ok := controller.Proxies[proxyID]; ok {
-			if(proxy.running) {
+			if(proxy.isRunning()) {
 				proxy.Stop()
 			}
 			
 			delete(controller.Proxies, proxyID)
 		} else {
-			err = errors.New(fmt.Sprintf("No proxy with this ID exists: %v", proxyID))
+			err = newKindError(ErrNotFound, "No proxy with this ID exists: %v", proxyID)
 		}
 	controller.mutex.Unlock()
 	return err
@@ -328,7 +550,27 @@ func (controller *ProxyController) AddUserToProxy(proxyID uint64, user *ProxyUse
 	proxy, err := controller.GetProxy(proxyID)
 	var key string
 	if (proxy != nil) {
+		// specs the user came with are added like
+		// any other so they get keys
+		filters, callbacks := user.FilterSpecs, user.CallbackSpecs
+		user.FilterSpecs, user.CallbackSpecs = nil, nil
+		for _, spec := range filters {
+			if err, _ = spec.build(); err != nil {
+				return err, ""
+			}
+		}
+		for _, spec := range callbacks {
+			if err, _ = spec.build(); err != nil {
+				return err, ""
+			}
+		}
 		key = proxy.AddProxyUser(user)
+		for _, spec := range filters {
+			controller.AddChannelFilterSpecToUser(proxyID, user.Username, user.Password, spec)
+		}
+		for _, spec := range callbacks {
+			controller.AddEventCallbackSpecToUser(proxyID, user.Username, user.Password, spec)
+		}
 	}
 	return err, key
 }
@@ -350,6 +592,132 @@ func (controller *ProxyController) DeactivateProxy(proxyID uint64) error {
 	return err
 }
 
+/*
+ SetProxyRedaction replaces the redaction config
+ of a proxy. A nil config turns redaction off.
+ Events that were already recorded are not changed.
+*/
+func (controller *ProxyController) SetProxyRedaction(proxyID uint64, config *RedactionConfig) error {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy != nil {
+		err = proxy.SetRedaction(config)
+	}
+	return err
+}
+
+/*
+ SetProxyRetention replaces the retention policy
+ of a proxy. A nil policy keeps recordings forever.
+*/
+func (controller *ProxyController) SetProxyRetention(proxyID uint64, policy *RetentionPolicy) error {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy != nil {
+		err = proxy.SetRetention(policy)
+	}
+	return err
+}
+
+/*
+ ApplyProxyRetention runs the retention policy of
+ a proxy right away. With dryRun set the report
+ lists what would be deleted without deleting it.
+*/
+func (controller *ProxyController) ApplyProxyRetention(proxyID uint64, dryRun bool) (error, *RetentionReport) {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy != nil {
+		return proxy.ApplyRetention(dryRun)
+	}
+	return err, nil
+}
+
+/*
+ SearchSessions searches the live and archived
+ sessions of a proxy. Encrypted recordings are
+ decrypted with the RecordingIdentityFile.
+*/
+func (controller *ProxyController) SearchSessions(proxyID uint64, query *SessionSearchQuery) (error, []SessionSearchResult) {
+	return controller.searchSessions(proxyID, query, nil)
+}
+
+// searchSessions only searches the sessions in
+// allowed, unless it is nil
+func (controller *ProxyController) searchSessions(proxyID uint64, query *SessionSearchQuery, allowed map[string]*SessionContext) (error, []SessionSearchResult) {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy == nil {
+		return err, nil
+	}
+	identity, err := controller.loadRecordingIdentity()
+	if err != nil {
+		return err, nil
+	}
+	return nil, proxy.searchSessions(query, identity, allowed)
+}
+
+// GetSession finds a session of a proxy by its
+// ID or address key
+func (controller *ProxyController) GetSession(proxyID uint64, sessionKey string) (error, *SessionContext) {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy == nil {
+		return err, nil
+	}
+	session, ok := proxy.sessions.get(sessionKey)
+	if !ok {
+		return newKindError(ErrNotFound, "could not find session"), nil
+	}
+	return nil, session
+}
+
+/*
+ TerminateSession kicks the user out of a live
+ session of a proxy. The notice, if not empty,
+ is shown in the user's terminal first.
+*/
+func (controller *ProxyController) TerminateSession(proxyID uint64, sessionKey string, terminatedBy string, reason string, notice string) error {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy != nil {
+		err = proxy.TerminateSession(sessionKey, terminatedBy, reason, notice)
+	}
+	return err
+}
+
+/*
+ ApproveSession lets a session that is waiting
+ for approval through; approver is recorded in
+ the session log.
+*/
+func (controller *ProxyController) ApproveSession(proxyID uint64, sessionKey string, approver string, reason string) error {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy != nil {
+		err = proxy.DecideSession(sessionKey, true, approver, reason)
+	}
+	return err
+}
+
+// DenySession closes a session that is waiting
+// for approval
+func (controller *ProxyController) DenySession(proxyID uint64, sessionKey string, approver string, reason string) error {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy != nil {
+		err = proxy.DecideSession(sessionKey, false, approver, reason)
+	}
+	return err
+}
+
+func (controller *ProxyController) ListPendingSessions(proxyID uint64) (error, []string) {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy != nil {
+		return nil, proxy.ListPendingSessions()
+	}
+	return err, nil
+}
+
+func (controller *ProxyController) loadRecordingIdentity() (*RecordingIdentity, error) {
+	if controller.RecordingIdentityFile == "" {
+		return nil, nil
+	}
+	return LoadRecordingIdentity(controller.RecordingIdentityFile)
+}
+
 func (controller *ProxyController) GetProxy(proxyID uint64) (proxy *ProxyContext, err error) {
 	proxy = nil
 	err = nil
@@ -357,7 +725,7 @@ func (controller *ProxyController) GetProxy(proxyID uint64) (proxy *ProxyContext
 		if val, ok := controller.Proxies[proxyID]; ok {
 			proxy = val
 		} else {
-			err = errors.New(fmt.Sprintf("Cannot find proxy with ID: %v", proxyID))
+			err = newKindError(ErrNotFound, "Cannot find proxy with ID: %v", proxyID)
 		}
 	controller.mutex.Unlock()
 	return proxy, err
@@ -371,6 +739,8 @@ func (controller *ProxyController) AddProxy(proxy *ProxyContext) uint64 {
 
 func (controller *ProxyController) AddExistingProxy(proxy *ProxyContext) uint64 {
 	proxy_id := controller.GetNextProxyID()
+	proxy.setID(proxy_id)
+	proxy.setIdentityLoader(controller.loadRecordingIdentity)
 	controller.mutex.Lock()
 	controller.Proxies[proxy_id] = proxy
 	controller.mutex.Unlock()
@@ -411,24 +781,42 @@ func (controller *ProxyController) AddEventCallbackToUser(proxyID uint64, userna
 		if (err == nil) {
 			index := user.AddEventCallback(callback)
 			key = fmt.Sprintf("callback-proxy%v-%s-%s-%v",proxyID,username,password,index)
+			controller.mutex.Lock()
 			_, ok := controller.EventCallbacks[key];
 			for ok {
 				key = key + "."
 				_, ok = controller.EventCallbacks[key];
 			}
 			controller.EventCallbacks[key] = callback
+			if callback.spec != nil {
+				callback.spec.Key = key
+			}
+			controller.mutex.Unlock()
 		}
 	}
 	return err, key
 }
 
+// AddEventCallbackSpecToUser builds the callback
+// a spec describes and adds it to the user
+func (controller *ProxyController) AddEventCallbackSpecToUser(proxyID uint64, username, password string, spec *EventCallbackSpec) (error, string) {
+	err, callback := spec.build()
+	if err != nil {
+		return err, ""
+	}
+	return controller.AddEventCallbackToUser(proxyID, username, password, callback)
+}
+
 func (controller *ProxyController) RemoveEventCallbackFromUserByKey(proxyID uint64, username, password, key string) error  {
 	var err error
-	if _, ok := controller.EventCallbacks[key]; ok {
-		err = controller.RemoveEventCallbackFromUser(proxyID, username, password, controller.EventCallbacks[key])
-		delete(controller.EventCallbacks, key)
+	controller.mutex.Lock()
+	callback, ok := controller.EventCallbacks[key]
+	delete(controller.EventCallbacks, key)
+	controller.mutex.Unlock()
+	if ok {
+		err = controller.RemoveEventCallbackFromUser(proxyID, username, password, callback)
 	} else {
-		err = errors.New("could not find channel filter key")
+		err = newKindError(ErrNotFound, "could not find channel filter key")
 	}
 	return err
 }
@@ -450,7 +838,7 @@ func (controller *ProxyController) GetProxyViewers(proxyID uint64) (error, map[s
 	proxy, err := controller.GetProxy(proxyID)
 	if err == nil {
 		proxy.RemoveExpiredSessions()
-		return err, proxy.Viewers
+		return err, proxy.ListSessionViewers()
 	} else {
 		return err, make(map[string]*proxySessionViewer)
 	}
@@ -462,7 +850,7 @@ func (controller *ProxyController) GetProxyViewerByViewerKey(proxyID uint64, vie
 	if (err == nil) {
 		viewer = proxy.GetSessionViewer(viewerKey)
 		if (viewer == nil) {
-			err = errors.New("Could not find viewer with that key.")
+			err = newKindError(ErrNotFound, "Could not find viewer with that key.")
 		}
 	}
 	return err, viewer
@@ -564,6 +952,19 @@ func (controller *ProxyController) CreateUserSessionViewer(proxyID uint64, usern
 	return err, viewer
 }
 
+/*
+ SetViewerOperator lets a viewer take over the
+ live sessions it can see from the web viewer,
+ with operator recorded as who typed.
+*/
+func (controller *ProxyController) SetViewerOperator(proxyID uint64, viewerKey string, operator string) error {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy != nil {
+		err = proxy.SetSessionViewerOperator(viewerKey, operator)
+	}
+	return err
+}
+
 //TODO add getProxyUserClone
 
 
@@ -576,23 +977,41 @@ func (controller *ProxyController) AddChannelFilterToUser(proxyID uint64, userna
 		if (err == nil) {
 			index := user.AddChannelFilter(function)
 			key = fmt.Sprintf("filter-proxy%v-%s-%s-%v",proxyID,username,password,index)
-			_, ok := controller.channelFilters[key];
+			controller.mutex.Lock()
+			_, ok := controller.ChannelFilters[key];
 			for  ok {
 				key = key + "."
-				_, ok = controller.channelFilters[key];
+				_, ok = controller.ChannelFilters[key];
 			}
-			controller.channelFilters[key] = function
+			controller.ChannelFilters[key] = function
+			if function.spec != nil {
+				function.spec.Key = key
+			}
+			controller.mutex.Unlock()
 		}
 	}
 	return err, key
 }
+// AddChannelFilterSpecToUser builds the filter
+// a spec describes and adds it to the user
+func (controller *ProxyController) AddChannelFilterSpecToUser(proxyID uint64, username, password string, spec *ChannelFilterSpec) (error, string) {
+	err, filter := spec.build()
+	if err != nil {
+		return err, ""
+	}
+	return controller.AddChannelFilterToUser(proxyID, username, password, filter)
+}
+
 func (controller *ProxyController) RemoveChannelFilterFromUserByKey(proxyID uint64, username, password, key string) error {
 	var err error
-	if _, ok := controller.channelFilters[key]; ok {
-		err = controller.RemoveChannelFilterFromUser(proxyID, username, password, controller.channelFilters[key])
-		delete(controller.channelFilters, key)
+	controller.mutex.Lock()
+	function, ok := controller.ChannelFilters[key]
+	delete(controller.ChannelFilters, key)
+	controller.mutex.Unlock()
+	if ok {
+		err = controller.RemoveChannelFilterFromUser(proxyID, username, password, function)
 	} else {
-		err = errors.New("could not find channel filter key")
+		err = newKindError(ErrNotFound, "could not find channel filter key")
 	}
 	return err
 }
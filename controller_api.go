@@ -0,0 +1,722 @@
+package sshproxyplus
+
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const CONTROLLER_API_PREFIX		string = "/api/v1"
+const CONTROLLER_API_VERSION	string = "1.0.0"
+// selects a ProxyUser by password; passwords are
+// kept out of URLs, which end up in logs
+const CONTROLLER_API_PASSWORD_HEADER	string = "X-Proxy-User-Password"
+// selects a viewer by its secret, for the same
+// reason
+const CONTROLLER_API_VIEWER_SECRET_HEADER	string = "X-Viewer-Secret"
+// the largest request body the API reads
+const CONTROLLER_API_MAX_BODY_BYTES	int64 = 1 << 20
+
+/*
+ apiRequest is what a route gets to build its
+ controller message from: the path parameters,
+ the query string, the headers and the raw
+ request body.
+*/
+type apiRequest struct {
+	params	map[string]string
+	query	url.Values
+	header	http.Header
+	body	[]byte
+}
+
+/*
+ apiMessageBody holds the fields routes read
+ from a JSON body. Strings are used where the
+ controller message has []byte fields, so
+ clients don't have to base64 them. Passwords
+ come from CONTROLLER_API_PASSWORD_HEADER, not
+ the body.
+*/
+type apiMessageBody struct {
+	Username		string `json:",omitempty"`
+	SessionKey		string `json:",omitempty"`
+	Operator		string `json:",omitempty"`
+	Reason			string `json:",omitempty"`
+	Notice			string `json:",omitempty"`
+	TerminatedBy	string `json:",omitempty"`
+	FindString		string `json:",omitempty"`
+	ReplaceString	string `json:",omitempty"`
+	CallbackURL		string `json:",omitempty"`
+	ChannelFilter	*ChannelFilterSpec `json:",omitempty"`
+	EventCallback	*EventCallbackSpec `json:",omitempty"`
+}
+
+type apiError struct {
+	Error	string `json:"error"`
+}
+
+/*
+ apiRoute maps a method and path onto a
+ controller message. The reply field named by
+ result is returned as the body; without one
+ the route replies 204 No Content. body and
+ response are zero values of the request and
+ response types, used for the OpenAPI document.
+*/
+type apiRoute struct {
+	method		string
+	path		string
+	summary		string
+	status		int
+	result		string
+	body		interface{}
+	response	interface{}
+	// reads the ProxyUser password from
+	// CONTROLLER_API_PASSWORD_HEADER
+	password	bool
+	// reads the viewer secret from
+	// CONTROLLER_API_VIEWER_SECRET_HEADER
+	viewerSecret	bool
+	build		func(*apiRequest) (*ControllerMessage, error)
+}
+
+func (request *apiRequest) proxyID() uint64 {
+	proxyID, _ := strconv.ParseUint(request.params["id"], 10, 64)
+	return proxyID
+}
+
+func (request *apiRequest) password() string {
+	return request.header.Get(CONTROLLER_API_PASSWORD_HEADER)
+}
+
+func (request *apiRequest) viewerSecret() (string, error) {
+	secret := request.header.Get(CONTROLLER_API_VIEWER_SECRET_HEADER)
+	if secret == "" {
+		return "", errors.New("Missing " + CONTROLLER_API_VIEWER_SECRET_HEADER + " header")
+	}
+	return secret, nil
+}
+
+func (request *apiRequest) messageBody() (*apiMessageBody, error) {
+	body := &apiMessageBody{}
+	if len(request.body) == 0 {
+		return body, nil
+	}
+	if err := json.Unmarshal(request.body, body); err != nil {
+		return nil, errors.New("invalid request body: " + err.Error())
+	}
+	fields := make(map[string]json.RawMessage)
+	json.Unmarshal(request.body, &fields)
+	if _, ok := fields["Password"]; ok {
+		return nil, errors.New("send the password in the " + CONTROLLER_API_PASSWORD_HEADER + " header, not the body")
+	}
+	return body, nil
+}
+
+// decodeBody reads the request body into value,
+// which must not be empty
+func (request *apiRequest) decodeBody(value interface{}) error {
+	if len(request.body) == 0 {
+		return errors.New("no request body provided")
+	}
+	if err := json.Unmarshal(request.body, value); err != nil {
+		return errors.New("invalid request body: " + err.Error())
+	}
+	return nil
+}
+
+// proxyMessage builds a message that only needs
+// the proxy ID
+func proxyMessage(messageType string) func(*apiRequest) (*ControllerMessage, error) {
+	return func(request *apiRequest) (*ControllerMessage, error) {
+		return &ControllerMessage{MessageType: messageType, ProxyID: request.proxyID()}, nil
+	}
+}
+
+// sessionDecision builds an approve or deny
+// message for the session in the path
+func sessionDecision(messageType string) func(*apiRequest) (*ControllerMessage, error) {
+	return func(request *apiRequest) (*ControllerMessage, error) {
+		body, err := request.messageBody()
+		if err != nil {
+			return nil, err
+		}
+		return &ControllerMessage{
+			MessageType: messageType,
+			ProxyID: request.proxyID(),
+			SessionKey: request.params["session"],
+			Operator: body.Operator,
+			Reason: body.Reason,
+		}, nil
+	}
+}
+
+var controllerAPIRoutes = []apiRoute{
+	{
+		method: http.MethodGet, path: "/proxies", summary: "List proxies",
+		status: http.StatusOK, result: "Proxies", response: map[string]*ProxyContext{},
+		build: proxyMessage(CONTROLLER_MESSAGE_LIST_PROXIES),
+	},
+	{
+		method: http.MethodPost, path: "/proxies", summary: "Create a proxy",
+		status: http.StatusCreated, result: "ProxyID", body: ProxyContext{}, response: uint64(0),
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			if len(request.body) == 0 {
+				return nil, errors.New("No ProxyData provided")
+			}
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_CREATE_PROXY, ProxyData: request.body}, nil
+		},
+	},
+	{
+		method: http.MethodGet, path: "/proxies/{id}", summary: "Get a proxy",
+		status: http.StatusOK, result: "Proxy", response: ProxyContext{},
+		build: proxyMessage(CONTROLLER_MESSAGE_GET_PROXY_INFO),
+	},
+	{
+		method: http.MethodPatch, path: "/proxies/{id}", summary: "Change the proxy settings in the body and keep the rest; ?dry_run=true only validates",
+		status: http.StatusOK, result: "Update", body: ProxyContext{}, response: SettingsUpdate{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			if len(request.body) == 0 {
+				return nil, errors.New("No ProxyData provided")
+			}
+			dryRun, _ := strconv.ParseBool(request.query.Get("dry_run"))
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY, ProxyID: request.proxyID(), ProxyData: request.body, DryRun: dryRun}, nil
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/proxies/{id}", summary: "Stop and remove a proxy",
+		status: http.StatusNoContent,
+		build: proxyMessage(CONTROLLER_MESSAGE_DESTROY_PROXY),
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/start", summary: "Start a proxy",
+		status: http.StatusNoContent,
+		build: proxyMessage(CONTROLLER_MESSAGE_START_PROXY),
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/stop", summary: "Stop a proxy",
+		status: http.StatusNoContent,
+		build: proxyMessage(CONTROLLER_MESSAGE_STOP_PROXY),
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/activate", summary: "Start forwarding sessions",
+		status: http.StatusNoContent,
+		build: proxyMessage(CONTROLLER_MESSAGE_ACTIVATE_PROXY),
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/deactivate", summary: "Hold new sessions",
+		status: http.StatusNoContent,
+		build: proxyMessage(CONTROLLER_MESSAGE_DEACTIVATE_PROXY),
+	},
+	{
+		method: http.MethodPut, path: "/proxies/{id}/redaction", summary: "Set the redaction rules",
+		status: http.StatusNoContent, body: RedactionConfig{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			config := &RedactionConfig{}
+			if err := request.decodeBody(config); err != nil {
+				return nil, err
+			}
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_SET_PROXY_REDACTION, ProxyID: request.proxyID(), Redaction: config}, nil
+		},
+	},
+	{
+		method: http.MethodPut, path: "/proxies/{id}/retention", summary: "Set the retention policy",
+		status: http.StatusNoContent, body: RetentionPolicy{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			policy := &RetentionPolicy{}
+			if err := request.decodeBody(policy); err != nil {
+				return nil, err
+			}
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_SET_PROXY_RETENTION, ProxyID: request.proxyID(), Retention: policy}, nil
+		},
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/retention/apply", summary: "Apply the retention policy now; ?dry_run=true only reports",
+		status: http.StatusOK, result: "Report", response: RetentionReport{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			dryRun, _ := strconv.ParseBool(request.query.Get("dry_run"))
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_APPLY_PROXY_RETENTION, ProxyID: request.proxyID(), DryRun: dryRun}, nil
+		},
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/users", summary: "Add a user",
+		status: http.StatusCreated, result: "UserKey", body: ProxyUser{}, response: "",
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			user := &ProxyUser{}
+			if err := request.decodeBody(user); err != nil {
+				return nil, err
+			}
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_ADD_PROXY_USER, ProxyID: request.proxyID(), ProxyUser: user}, nil
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/proxies/{id}/users/{username}", summary: "Remove a user",
+		status: http.StatusNoContent, password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_REMOVE_PROXY_USER,
+				ProxyID: request.proxyID(),
+				Username: request.params["username"],
+				Password: request.password(),
+			}, nil
+		},
+	},
+	{
+		method: http.MethodPatch, path: "/proxies/{id}/users/{username}", summary: "Change the user fields in the body and keep the rest; ?dry_run=true only validates",
+		status: http.StatusOK, result: "Update", body: ProxyUser{}, response: SettingsUpdate{}, password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			if len(request.body) == 0 {
+				return nil, errors.New("Missing Username or UserData")
+			}
+			dryRun, _ := strconv.ParseBool(request.query.Get("dry_run"))
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY_USER,
+				ProxyID: request.proxyID(),
+				Username: request.params["username"],
+				Password: request.password(),
+				UserData: request.body,
+				DryRun: dryRun,
+			}, nil
+		},
+	},
+	{
+		method: http.MethodGet, path: "/proxies/{id}/users/{username}/filters", summary: "List the user's channel filters",
+		status: http.StatusOK, result: "ChannelFilters", response: []*ChannelFilterSpec{}, password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_LIST_CHANNEL_FILTERS,
+				ProxyID: request.proxyID(),
+				Username: request.params["username"],
+				Password: request.password(),
+			}, nil
+		},
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/users/{username}/filters", summary: "Add a ChannelFilter spec, or replace FindString with ReplaceString in the user's channel data",
+		status: http.StatusCreated, result: "FilterKey", body: apiMessageBody{}, response: "", password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			body, err := request.messageBody()
+			if err != nil {
+				return nil, err
+			}
+			if body.FindString == "" && body.ChannelFilter == nil {
+				return nil, errors.New("Missing Username, FindString or ReplaceString")
+			}
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER,
+				ProxyID: request.proxyID(),
+				Username: request.params["username"],
+				Password: request.password(),
+				FindString: []byte(body.FindString),
+				ReplaceString: []byte(body.ReplaceString),
+				ChannelFilter: body.ChannelFilter,
+			}, nil
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/proxies/{id}/users/{username}/filters/{key}", summary: "Remove a channel filter",
+		status: http.StatusNoContent, password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_REMOVE_CHANNEL_FILTER,
+				ProxyID: request.proxyID(),
+				Username: request.params["username"],
+				Password: request.password(),
+				FilterKey: request.params["key"],
+			}, nil
+		},
+	},
+	{
+		method: http.MethodGet, path: "/proxies/{id}/users/{username}/callbacks", summary: "List the user's event callbacks",
+		status: http.StatusOK, result: "EventCallbacks", response: []*EventCallbackSpec{}, password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_LIST_USER_CALLBACKS,
+				ProxyID: request.proxyID(),
+				Username: request.params["username"],
+				Password: request.password(),
+			}, nil
+		},
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/users/{username}/callbacks", summary: "Add an EventCallback spec, or post events whose data contains FindString to CallbackURL",
+		status: http.StatusCreated, result: "CallbackKey", body: apiMessageBody{}, response: "", password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			body, err := request.messageBody()
+			if err != nil {
+				return nil, err
+			}
+			if body.FindString == "" && body.EventCallback == nil {
+				return nil, errors.New("Missing Username, FindString, or CallbackURL ")
+			}
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_ADD_USER_CALLBACK,
+				ProxyID: request.proxyID(),
+				Username: request.params["username"],
+				Password: request.password(),
+				FindString: []byte(body.FindString),
+				CallbackURL: body.CallbackURL,
+				EventCallback: body.EventCallback,
+			}, nil
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/proxies/{id}/users/{username}/callbacks/{key}", summary: "Remove an event callback",
+		status: http.StatusNoContent, password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_REMOVE_USER_CALLBACK,
+				ProxyID: request.proxyID(),
+				Username: request.params["username"],
+				Password: request.password(),
+				CallbackKey: request.params["key"],
+			}, nil
+		},
+	},
+	{
+		method: http.MethodGet, path: "/proxies/{id}/viewers", summary: "List viewers; ?session= or ?username= narrows the list",
+		status: http.StatusOK, result: "Viewers", response: []*proxySessionViewer{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_GET_PROXY_VIEWERS,
+				ProxyID: request.proxyID(),
+				SessionKey: request.query.Get("session"),
+				Username: request.query.Get("username"),
+			}, nil
+		},
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/viewers", summary: "Create a viewer for a user, or for one session with SessionKey",
+		status: http.StatusCreated, result: "Viewer", body: apiMessageBody{}, response: proxySessionViewer{}, password: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			body, err := request.messageBody()
+			if err != nil {
+				return nil, err
+			}
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_NEW_PROXY_VIEWER,
+				ProxyID: request.proxyID(),
+				Username: body.Username,
+				Password: request.password(),
+				SessionKey: body.SessionKey,
+				Operator: body.Operator,
+			}, nil
+		},
+	},
+	{
+		method: http.MethodGet, path: "/proxies/{id}/viewers/by-secret", summary: "Get the viewer whose secret is in the X-Viewer-Secret header",
+		status: http.StatusOK, result: "Viewer", response: proxySessionViewer{}, viewerSecret: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			secret, err := request.viewerSecret()
+			if err != nil {
+				return nil, err
+			}
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_GET_PROXY_VIEWER,
+				ProxyID: request.proxyID(),
+				ViewerSecret: secret,
+			}, nil
+		},
+	},
+	{
+		method: http.MethodPut, path: "/proxies/{id}/viewers/by-secret/operator", summary: "Set or clear the operator of the viewer whose secret is in the X-Viewer-Secret header",
+		status: http.StatusNoContent, body: apiMessageBody{}, viewerSecret: true,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			secret, err := request.viewerSecret()
+			if err != nil {
+				return nil, err
+			}
+			body, err := request.messageBody()
+			if err != nil {
+				return nil, err
+			}
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_SET_VIEWER_OPERATOR,
+				ProxyID: request.proxyID(),
+				ViewerSecret: secret,
+				Operator: body.Operator,
+			}, nil
+		},
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/sessions/search", summary: "Search sessions",
+		status: http.StatusOK, result: "Results", body: SessionSearchQuery{}, response: []SessionSearchResult{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			search := &SessionSearchQuery{}
+			if len(request.body) > 0 {
+				if err := request.decodeBody(search); err != nil {
+					return nil, err
+				}
+			}
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_SEARCH_SESSIONS, ProxyID: request.proxyID(), Search: search}, nil
+		},
+	},
+	{
+		method: http.MethodGet, path: "/proxies/{id}/sessions/pending", summary: "List sessions waiting for approval",
+		status: http.StatusOK, result: "Sessions", response: []string{},
+		build: proxyMessage(CONTROLLER_MESSAGE_LIST_PENDING_SESSIONS),
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/sessions/{session}/approve", summary: "Approve a pending session",
+		status: http.StatusNoContent, body: apiMessageBody{},
+		build: sessionDecision(CONTROLLER_MESSAGE_APPROVE_SESSION),
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/sessions/{session}/deny", summary: "Deny a pending session",
+		status: http.StatusNoContent, body: apiMessageBody{},
+		build: sessionDecision(CONTROLLER_MESSAGE_DENY_SESSION),
+	},
+	{
+		method: http.MethodPost, path: "/proxies/{id}/sessions/{session}/kill", summary: "Terminate a live session",
+		status: http.StatusNoContent, body: apiMessageBody{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			body, err := request.messageBody()
+			if err != nil {
+				return nil, err
+			}
+			return &ControllerMessage{
+				MessageType: CONTROLLER_MESSAGE_KILL_SESSION,
+				ProxyID: request.proxyID(),
+				SessionKey: request.params["session"],
+				TerminatedBy: body.TerminatedBy,
+				Reason: body.Reason,
+				Notice: body.Notice,
+			}, nil
+		},
+	},
+	{
+		method: http.MethodGet, path: "/keys", summary: "List controller keys without their secrets",
+		status: http.StatusOK, result: "ControllerKeys", response: []*ControllerKey{},
+		build: proxyMessage(CONTROLLER_MESSAGE_LIST_CONTROLLER_KEYS),
+	},
+	{
+		method: http.MethodPost, path: "/keys", summary: "Create a controller key; the reply holds its secret",
+		status: http.StatusCreated, result: "ControllerKey", body: ControllerKey{}, response: ControllerKey{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			key := &ControllerKey{}
+			if err := request.decodeBody(key); err != nil {
+				return nil, err
+			}
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY, ControllerKey: key}, nil
+		},
+	},
+	{
+		method: http.MethodPost, path: "/keys/{name}/rotate", summary: "Give a controller key a new secret",
+		status: http.StatusOK, result: "ControllerKey", response: ControllerKey{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_ROTATE_CONTROLLER_KEY, KeyName: request.params["name"]}, nil
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/keys/{name}", summary: "Revoke a controller key",
+		status: http.StatusNoContent,
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_REVOKE_CONTROLLER_KEY, KeyName: request.params["name"]}, nil
+		},
+	},
+	{
+		method: http.MethodGet, path: "/audit", summary: "Read the audit log; ?type=, ?identity=, ?source=, ?since=, ?until=, ?errors=true and ?limit= filter it",
+		status: http.StatusOK, result: "Entries", response: []*AuditEntry{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			query := &AuditQuery{
+				MessageType: request.query.Get("type"),
+				Identity: request.query.Get("identity"),
+				Source: request.query.Get("source"),
+			}
+			query.Since, _ = strconv.ParseInt(request.query.Get("since"), 10, 64)
+			query.Until, _ = strconv.ParseInt(request.query.Get("until"), 10, 64)
+			query.ErrorsOnly, _ = strconv.ParseBool(request.query.Get("errors"))
+			query.Limit, _ = strconv.Atoi(request.query.Get("limit"))
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_QUERY_AUDIT_LOG, Audit: query}, nil
+		},
+	},
+	{
+		method: http.MethodPost, path: "/reload", summary: "Reload the config file the controller was loaded from; ?dry_run=true only reports the changes",
+		status: http.StatusOK, result: "Diff", response: ConfigDiff{},
+		build: func(request *apiRequest) (*ControllerMessage, error) {
+			dryRun, _ := strconv.ParseBool(request.query.Get("dry_run"))
+			return &ControllerMessage{MessageType: CONTROLLER_MESSAGE_RELOAD_CONFIG, DryRun: dryRun}, nil
+		},
+	},
+}
+
+/*
+ matchAPIRoute finds the route for a path below
+ the API prefix. It returns the route, its path
+ parameters and whether the path exists with
+ another method.
+*/
+func matchAPIRoute(method string, path string) (*apiRoute, map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	path_found := false
+	for index := range controllerAPIRoutes {
+		route := &controllerAPIRoutes[index]
+		pattern := strings.Split(strings.Trim(route.path, "/"), "/")
+		if len(pattern) != len(segments) {
+			continue
+		}
+		params := make(map[string]string)
+		matched := true
+		for position, part := range pattern {
+			if strings.HasPrefix(part, "{") {
+				value, err := url.PathUnescape(segments[position])
+				if err != nil || value == "" {
+					matched = false
+					break
+				}
+				params[strings.Trim(part, "{}")] = value
+			} else if part != segments[position] {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if route.method == method {
+			return route, params, true
+		}
+		path_found = true
+	}
+	return nil, nil, path_found
+}
+
+// apiErrorStatus picks a status code for an
+// error from the controller by its kind
+func apiErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrUnsupported):
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadRequest
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "unable to encode reply", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, &apiError{Error: message})
+}
+
+/*
+ apiCaller finds who the bearer token belongs
+ to. APIToken may do anything; the secret of a
+ controller key has that key's permissions. It
+ returns false for any other token.
+*/
+func (controller *ProxyController) apiCaller(r *http.Request) (bool, *ControllerKey, string) {
+	if controller.APIToken == "" {
+		return false, nil, ""
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(controller.APIToken)) == 1 {
+		return true, nil, AUDIT_IDENTITY_API_TOKEN
+	}
+	if key := controller.keyBySecret(token); key != nil {
+		return true, key, auditKeyIdentity(key.Name)
+	}
+	return false, nil, ""
+}
+
+/*
+ handleAPIRequest serves the REST API. Every
+ route but the OpenAPI document and the config
+ schema needs the header
+ "Authorization: Bearer <APIToken>", or the
+ secret of a controller key in place of the
+ APIToken; the API is off while APIToken is
+ empty.
+*/
+func (controller *ProxyController) handleAPIRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, CONTROLLER_API_PREFIX)
+	if path == "/openapi.json" && r.Method == http.MethodGet {
+		writeAPIJSON(w, http.StatusOK, buildOpenAPIDocument(controller.BaseURI))
+		return
+	}
+	if path == "/config-schema.json" && r.Method == http.MethodGet {
+		schema, _ := ControllerConfigSchema()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(schema)
+		return
+	}
+	authorized, key, identity := controller.apiCaller(r)
+	if !authorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "invalid or missing API token")
+		return
+	}
+	route, params, path_found := matchAPIRoute(r.Method, path)
+	if route == nil {
+		if path_found {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		} else {
+			writeAPIError(w, http.StatusNotFound, "no such endpoint")
+		}
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, CONTROLLER_API_MAX_BODY_BYTES))
+	if err != nil {
+		// the reader stops with an error at the limit
+		if int64(len(body)) >= CONTROLLER_API_MAX_BODY_BYTES {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+		} else {
+			writeAPIError(w, http.StatusBadRequest, "unable to read request body")
+		}
+		return
+	}
+	request := &apiRequest{params: params, query: r.URL.Query(), header: r.Header, body: body}
+	if request.query.Has("password") {
+		writeAPIError(w, http.StatusBadRequest, "send the password in the " + CONTROLLER_API_PASSWORD_HEADER + " header, not the query string")
+		return
+	}
+	if _, ok := params["id"]; ok {
+		if _, err := strconv.ParseUint(params["id"], 10, 64); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid proxy id")
+			return
+		}
+	}
+	message, err := route.build(request)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the route, not the path, which may hold
+	// usernames and session keys
+	controller.Log.Printf("api: %v %v\n", r.Method, route.path)
+	reply, err := controller.dispatch(message, key, identity, r.RemoteAddr)
+	if err != nil {
+		writeAPIError(w, apiErrorStatus(err), err.Error())
+		return
+	}
+	if route.result == "" {
+		w.WriteHeader(route.status)
+		return
+	}
+	result := reply[route.result]
+	// structured results are JSON already
+	if data, ok := result.([]byte); ok {
+		result = json.RawMessage(data)
+	}
+	writeAPIJSON(w, route.status, result)
+}
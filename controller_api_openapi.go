@@ -0,0 +1,198 @@
+package sshproxyplus
+
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ buildOpenAPIDocument describes the REST API in
+ OpenAPI 3. Paths come from controllerAPIRoutes
+ and schemas from the Go types the routes read
+ and return, so the document follows the code.
+*/
+func buildOpenAPIDocument(baseURI string) map[string]interface{} {
+	schemas := &openAPISchemas{components: make(map[string]interface{}), refPrefix: "#/components/schemas/"}
+	paths := make(map[string]interface{})
+	for _, route := range controllerAPIRoutes {
+		item, ok := paths[route.path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[route.path] = item
+		}
+		item[strings.ToLower(route.method)] = schemas.operation(&route)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title": "sshproxyplus controller API",
+			"version": CONTROLLER_API_VERSION,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": strings.TrimRight(baseURI, "/") + CONTROLLER_API_PREFIX},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+			"schemas": schemas.components,
+		},
+	}
+}
+
+type openAPISchemas struct {
+	components	map[string]interface{}
+	// where references to the components point
+	refPrefix	string
+}
+
+func (schemas *openAPISchemas) operation(route *apiRoute) map[string]interface{} {
+	operation := map[string]interface{}{
+		"summary": route.summary,
+	}
+	parameters := make([]interface{}, 0)
+	for _, part := range strings.Split(route.path, "/") {
+		if strings.HasPrefix(part, "{") {
+			parameters = append(parameters, map[string]interface{}{
+				"name": strings.Trim(part, "{}"),
+				"in": "path",
+				"required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	if route.password {
+		parameters = append(parameters, map[string]interface{}{
+			"name": CONTROLLER_API_PASSWORD_HEADER,
+			"in": "header",
+			"description": "selects the user when the proxy checks passwords",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if route.viewerSecret {
+		parameters = append(parameters, map[string]interface{}{
+			"name": CONTROLLER_API_VIEWER_SECRET_HEADER,
+			"in": "header",
+			"required": true,
+			"description": "selects the viewer",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+	if route.body != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": schemas.schemaFor(reflect.TypeOf(route.body)),
+				},
+			},
+		}
+	}
+	success := map[string]interface{}{"description": http.StatusText(route.status)}
+	if route.response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": schemas.schemaFor(reflect.TypeOf(route.response)),
+			},
+		}
+	}
+	errorSchema := map[string]interface{}{
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": schemas.schemaFor(reflect.TypeOf(apiError{})),
+			},
+		},
+	}
+	responses := map[string]interface{}{
+		strconv.Itoa(route.status): success,
+	}
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict} {
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		for key, value := range errorSchema {
+			response[key] = value
+		}
+		responses[strconv.Itoa(status)] = response
+	}
+	operation["responses"] = responses
+	return operation
+}
+
+/*
+ schemaFor describes how encoding/json writes a
+ Go type. Named structs go in the components and
+ are referenced, which also ends recursion.
+*/
+func (schemas *openAPISchemas) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemas.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemas.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return schemas.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := schemas.components[name]; !ok {
+			// placeholder so a type that refers to
+			// itself ends here
+			schemas.components[name] = map[string]interface{}{}
+			schemas.components[name] = schemas.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": schemas.refPrefix + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (schemas *openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for index := 0; index < t.NumField(); index++ {
+		field := t.Field(index)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if tag_name := strings.Split(tag, ",")[0]; tag_name != "" {
+			name = tag_name
+		}
+		switch field.Type.Kind() {
+		case reflect.Func, reflect.Chan:
+			continue
+		}
+		properties[name] = schemas.schemaFor(field.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
@@ -0,0 +1,256 @@
+package sshproxyplus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+
+func apiCall(controller *ProxyController, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	return apiCallWithPassword(controller, method, path, token, "", body)
+}
+
+func apiCallWithPassword(controller *ProxyController, method string, path string, token string, password string, body string) *httptest.ResponseRecorder {
+	return apiCallWithHeader(controller, method, path, token, CONTROLLER_API_PASSWORD_HEADER, password, body)
+}
+
+func apiCallWithHeader(controller *ProxyController, method string, path string, token string, header string, value string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, CONTROLLER_API_PREFIX+path, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	if value != "" {
+		request.Header.Set(header, value)
+	}
+	recorder := httptest.NewRecorder()
+	controller.handleAPIRequest(recorder, request)
+	return recorder
+}
+
+func TestControllerAPI(t *testing.T) {
+	controller := makeNewController()
+	controller.APIToken = "token"
+	var logged bytes.Buffer
+	controller.Log = log.New(&logged, "", 0)
+
+	if reply := apiCall(controller, http.MethodGet, "/proxies", "", ""); reply.Code != http.StatusUnauthorized {
+		t.Errorf("handleAPIRequest() without a token = %v, expected 401", reply.Code)
+	}
+	if reply := apiCall(controller, http.MethodGet, "/proxies", "wrong", ""); reply.Code != http.StatusUnauthorized {
+		t.Errorf("handleAPIRequest() with a wrong token = %v, expected 401", reply.Code)
+	}
+
+	reply := apiCall(controller, http.MethodPost, "/proxies", "token", `{"ListenPort": 2222, "DefaultRemotePort": 22}`)
+	if reply.Code != http.StatusCreated {
+		t.Fatalf("POST /proxies = %v %s, expected 201", reply.Code, reply.Body)
+	}
+	var proxyID uint64
+	json.Unmarshal(reply.Body.Bytes(), &proxyID)
+	proxyPath := "/proxies/" + strconv.FormatUint(proxyID, 10)
+
+	reply = apiCall(controller, http.MethodGet, proxyPath, "token", "")
+	var proxyInfo map[string]interface{}
+	json.Unmarshal(reply.Body.Bytes(), &proxyInfo)
+	if reply.Code != http.StatusOK || proxyInfo["ListenPort"] != float64(2222) {
+		t.Errorf("GET %v = %v %s, expected the proxy", proxyPath, reply.Code, reply.Body)
+	}
+
+	reply = apiCall(controller, http.MethodPost, proxyPath+"/users", "token", `{"Username": "user", "Password": "password", "RemoteHost": "127.0.0.1:22"}`)
+	if reply.Code != http.StatusCreated || !strings.Contains(reply.Body.String(), "user") {
+		t.Errorf("POST %v/users = %v %s, expected the user key", proxyPath, reply.Code, reply.Body)
+	}
+	reply = apiCallWithPassword(controller, http.MethodPost, proxyPath+"/viewers", "token", "password", `{"Username": "user", "Operator": "alice"}`)
+	var viewer proxySessionViewer
+	json.Unmarshal(reply.Body.Bytes(), &viewer)
+	if reply.Code != http.StatusCreated || viewer.Secret == "" || viewer.Operator != "alice" {
+		t.Fatalf("POST %v/viewers = %v %s, expected a viewer", proxyPath, reply.Code, reply.Body)
+	}
+	reply = apiCallWithHeader(controller, http.MethodGet, proxyPath+"/viewers/by-secret", "token", CONTROLLER_API_VIEWER_SECRET_HEADER, viewer.Secret, "")
+	if reply.Code != http.StatusOK || !strings.Contains(reply.Body.String(), viewer.Secret) {
+		t.Errorf("GET %v/viewers/by-secret = %v %s, expected the viewer", proxyPath, reply.Code, reply.Body)
+	}
+	if reply = apiCall(controller, http.MethodGet, proxyPath+"/viewers/by-secret", "token", ""); reply.Code != http.StatusBadRequest {
+		t.Errorf("GET %v/viewers/by-secret without a secret = %v %s, expected 400", proxyPath, reply.Code, reply.Body)
+	}
+	if reply = apiCall(controller, http.MethodGet, proxyPath+"/viewers/"+viewer.Secret, "token", ""); reply.Code != http.StatusNotFound {
+		t.Errorf("GET %v/viewers/<secret> = %v %s, expected 404", proxyPath, reply.Code, reply.Body)
+	}
+	reply = apiCallWithHeader(controller, http.MethodPut, proxyPath+"/viewers/by-secret/operator", "token", CONTROLLER_API_VIEWER_SECRET_HEADER, viewer.Secret, `{"Operator": "bob"}`)
+	if reply.Code != http.StatusNoContent {
+		t.Errorf("PUT %v/viewers/by-secret/operator = %v %s, expected 204", proxyPath, reply.Code, reply.Body)
+	}
+	if strings.Contains(logged.String(), viewer.Secret) {
+		t.Errorf("handleAPIRequest() logged a viewer secret: %s", logged.String())
+	}
+	reply = apiCall(controller, http.MethodPost, proxyPath+"/users/user/filters", "token", `{"Password": "password", "FindString": "secret", "ReplaceString": "******"}`)
+	if reply.Code != http.StatusBadRequest {
+		t.Errorf("POST %v/users/user/filters with a password in the body = %v %s, expected 400", proxyPath, reply.Code, reply.Body)
+	}
+	reply = apiCallWithPassword(controller, http.MethodPost, proxyPath+"/users/user/filters", "token", "password", `{"FindString": "secret", "ReplaceString": "******"}`)
+	var filterKey string
+	json.Unmarshal(reply.Body.Bytes(), &filterKey)
+	if reply.Code != http.StatusCreated || filterKey == "" {
+		t.Errorf("POST %v/users/user/filters = %v %s, expected a filter key", proxyPath, reply.Code, reply.Body)
+	}
+	reply = apiCall(controller, http.MethodDelete, proxyPath+"/users/user/filters/"+filterKey+"?password=password", "token", "")
+	if reply.Code != http.StatusBadRequest {
+		t.Errorf("DELETE %v/users/user/filters/<key>?password= = %v %s, expected 400", proxyPath, reply.Code, reply.Body)
+	}
+	reply = apiCallWithPassword(controller, http.MethodDelete, proxyPath+"/users/user/filters/"+filterKey, "token", "password", "")
+	if reply.Code != http.StatusNoContent {
+		t.Errorf("DELETE %v/users/user/filters/<key> = %v %s, expected 204", proxyPath, reply.Code, reply.Body)
+	}
+	reply = apiCall(controller, http.MethodGet, proxyPath+"/sessions/pending", "token", "")
+	if reply.Code != http.StatusOK || strings.TrimSpace(reply.Body.String()) != "[]" {
+		t.Errorf("GET %v/sessions/pending = %v %s, expected an empty list", proxyPath, reply.Code, reply.Body)
+	}
+
+	if reply = apiCall(controller, http.MethodPost, proxyPath+"/sessions/missing/kill", "token", ""); reply.Code != http.StatusNotFound {
+		t.Errorf("killing a missing session = %v %s, expected 404", reply.Code, reply.Body)
+	}
+	if reply = apiCall(controller, http.MethodGet, "/proxies/99", "token", ""); reply.Code != http.StatusNotFound {
+		t.Errorf("GET /proxies/99 = %v %s, expected 404", reply.Code, reply.Body)
+	}
+	if reply = apiCall(controller, http.MethodPost, proxyPath+"/users", "token", ""); reply.Code != http.StatusBadRequest {
+		t.Errorf("POST %v/users without a body = %v %s, expected 400", proxyPath, reply.Code, reply.Body)
+	}
+	if reply = apiCall(controller, http.MethodPut, proxyPath, "token", ""); reply.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT %v = %v, expected 405", proxyPath, reply.Code)
+	}
+	if reply = apiCall(controller, http.MethodGet, "/nothing", "token", ""); reply.Code != http.StatusNotFound {
+		t.Errorf("GET /nothing = %v, expected 404", reply.Code)
+	}
+	if reply = apiCall(controller, http.MethodDelete, proxyPath, "token", ""); reply.Code != http.StatusNoContent {
+		t.Errorf("DELETE %v = %v %s, expected 204", proxyPath, reply.Code, reply.Body)
+	}
+	if _, err := controller.GetProxy(proxyID); err == nil {
+		t.Errorf("DELETE %v did not remove the proxy", proxyPath)
+	}
+}
+
+func TestControllerAPIOpenAPIDocument(t *testing.T) {
+	controller := makeNewController()
+	reply := apiCall(controller, http.MethodGet, "/openapi.json", "", "")
+	if reply.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json = %v, expected 200", reply.Code)
+	}
+	var document struct {
+		OpenAPI		string `json:"openapi"`
+		Paths		map[string]map[string]interface{} `json:"paths"`
+		Components	struct {
+			Schemas	map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(reply.Body.Bytes(), &document); err != nil {
+		t.Fatalf("buildOpenAPIDocument() did not produce JSON: %v", err)
+	}
+	for _, route := range controllerAPIRoutes {
+		operation, ok := document.Paths[route.path][strings.ToLower(route.method)].(map[string]interface{})
+		if !ok {
+			t.Errorf("buildOpenAPIDocument() is missing %v %v", route.method, route.path)
+			continue
+		}
+		parameters, _ := json.Marshal(operation["parameters"])
+		if route.password != strings.Contains(string(parameters), CONTROLLER_API_PASSWORD_HEADER) {
+			t.Errorf("buildOpenAPIDocument() %v %v parameters = %s, expected the password header: %v", route.method, route.path, parameters, route.password)
+		}
+	}
+	for _, path := range []string{"/proxies/{id}/users/{username}/filters", "/proxies/{id}/users/{username}/callbacks", "/proxies/{id}/viewers"} {
+		if route, _, _ := matchAPIRoute(http.MethodPost, strings.ReplaceAll(strings.ReplaceAll(path, "{id}", "0"), "{username}", "user")); route == nil || !route.password {
+			t.Errorf("POST %v does not read the password header", path)
+		}
+	}
+	user, ok := document.Components.Schemas["ProxyUser"]
+	if !ok {
+		t.Fatalf("buildOpenAPIDocument() is missing the ProxyUser schema")
+	}
+	properties, _ := user["properties"].(map[string]interface{})
+	if _, ok := properties["RequireApproval"]; !ok {
+		t.Errorf("ProxyUser schema does not follow the struct: %v", properties)
+	}
+	if _, ok := properties["EventCallbacks"]; ok {
+		t.Errorf("ProxyUser schema lists a field json skips")
+	}
+}
+
+func TestControllerAPIKeys(t *testing.T) {
+	controller := makeNewController()
+	controller.APIToken = "token"
+	_, reader := controller.CreateControllerKey(&ControllerKey{Name: "reader", Role: CONTROLLER_ROLE_READ_ONLY})
+	proxyID := controller.CreateProxy()
+	controller.AddUserToProxy(proxyID, &ProxyUser{Username: "user", Password: "pass", RemoteHost: "127.0.0.1:22"})
+	controller.CreateUserSessionViewer(proxyID, "user", "pass")
+
+	response := apiCall(controller, http.MethodGet, fmt.Sprintf("/proxies/%v/viewers", proxyID), reader.Key, "")
+	if response.Code != http.StatusOK || strings.Contains(response.Body.String(), `"pass"`) || !strings.Contains(response.Body.String(), AUDIT_REDACTED) {
+		t.Errorf("GET /proxies/{id}/viewers as a read-only key = %v %v, expected secrets redacted", response.Code, response.Body.String())
+	}
+	for _, path := range []string{fmt.Sprintf("/proxies/%v", proxyID), "/proxies"} {
+		response = apiCall(controller, http.MethodGet, path, reader.Key, "")
+		var proxies map[string]interface{}
+		json.Unmarshal(response.Body.Bytes(), &proxies)
+		if path == "/proxies" {
+			proxies, _ = proxies[strconv.FormatUint(proxyID, 10)].(map[string]interface{})
+		}
+		users, _ := proxies["Users"].(map[string]interface{})
+		viewers, _ := proxies["Viewers"].(map[string]interface{})
+		if response.Code != http.StatusOK || len(users) != 1 || len(viewers) != 1 {
+			t.Fatalf("GET %v as a read-only key = %v %v, expected the proxy", path, response.Code, response.Body.String())
+		}
+		for name := range users {
+			if strings.Contains(name, "pass") {
+				t.Errorf("GET %v as a read-only key keyed Users by password: %v", path, name)
+			}
+		}
+		for name := range viewers {
+			if name != AUDIT_REDACTED+"-1" {
+				t.Errorf("GET %v as a read-only key keyed Viewers by secret: %v", path, name)
+			}
+		}
+	}
+	response = apiCall(controller, http.MethodDelete, fmt.Sprintf("/proxies/%v", proxyID), reader.Key, "")
+	if response.Code != http.StatusForbidden {
+		t.Errorf("DELETE /proxies/{id} as a read-only key = %v, expected %v", response.Code, http.StatusForbidden)
+	}
+	if _, err := controller.GetProxy(proxyID); err != nil {
+		t.Errorf("a read-only key destroyed a proxy through the API")
+	}
+}
+
+func TestAPIErrorStatus(t *testing.T) {
+	controller := makeNewController()
+	_, missing := controller.GetProxy(99)
+	statuses := map[error]int{
+		missing: http.StatusNotFound,
+		fmt.Errorf("terminating: %w", newKindError(ErrConflict, "session is not active")): http.StatusConflict,
+		newKindError(ErrPermissionDenied, "key %v may not send %v messages", "reader", "destroy-proxy"): http.StatusForbidden,
+		newKindError(ErrUnsupported, "unsupported message type"): http.StatusNotImplemented,
+		// the message alone doesn't decide the status
+		errors.New("could not find session"): http.StatusBadRequest,
+	}
+	for err, expected := range statuses {
+		if status := apiErrorStatus(err); status != expected {
+			t.Errorf("apiErrorStatus(%q) = %v, expected %v", err, status, expected)
+		}
+	}
+}
+
+func TestControllerAPIBodyLimit(t *testing.T) {
+	controller := makeNewController()
+	controller.APIToken = "token"
+	body := `{"ListenPort": 2222, "ServerVersion": "` + strings.Repeat("x", int(CONTROLLER_API_MAX_BODY_BYTES)) + `"}`
+	if reply := apiCall(controller, http.MethodPost, "/proxies", "token", body); reply.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /proxies with a %v byte body = %v, expected %v", len(body), reply.Code, http.StatusRequestEntityTooLarge)
+	}
+	if len(controller.Proxies) != 0 {
+		t.Errorf("POST /proxies with a body over the limit created a proxy")
+	}
+}
@@ -0,0 +1,332 @@
+package sshproxyplus
+
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// who sent a message, as written in the audit
+// log; named keys are recorded as "key:<name>"
+const AUDIT_IDENTITY_PRESHARED_KEY	string = "preshared-key"
+const AUDIT_IDENTITY_API_TOKEN		string = "api-token"
+const AUDIT_IDENTITY_LOCAL			string = "local"
+const AUDIT_IDENTITY_SIGNAL			string = "signal"
+
+const AUDIT_REDACTED			string = "[redacted]"
+const AUDIT_DEFAULT_QUERY_LIMIT	int = 100
+
+// fields whose values never go in the audit log
+var auditSecretFields = map[string]bool{
+	"Password": true,
+	"RemotePassword": true,
+	"OverridePassword": true,
+	// the S3 secret of a RecordingStorage, and the
+	// key that lets anyone observe sessions
+	"SecretKey": true,
+	"ObserverKey": true,
+	"PresharedKey": true,
+	"APIToken": true,
+	"ViewerSecret": true,
+	"Secret": true,
+	"Key": true,
+	// a user key is the username and password
+	"UserKey": true,
+}
+
+/*
+ An AuditEntry records one controller message:
+ who sent it and from where, its parameters with
+ secrets redacted, and how it ended. Result holds
+ the plain values of the reply, like a new
+ ProxyID or FilterKey.
+*/
+type AuditEntry struct {
+	Time		int64
+	MessageType	string `json:",omitempty"`
+	Identity	string
+	Source		string `json:",omitempty"`
+	Parameters	json.RawMessage `json:",omitempty"`
+	Result		map[string]interface{} `json:",omitempty"`
+	Error		string `json:",omitempty"`
+}
+
+/*
+ An AuditQuery selects entries of the audit
+ log. Empty fields match everything; Since and
+ Until are unix seconds. The newest Limit
+ matching entries are returned, oldest first.
+*/
+type AuditQuery struct {
+	MessageType	string `json:",omitempty"`
+	Identity	string `json:",omitempty"`
+	Source		string `json:",omitempty"`
+	Since		int64 `json:",omitempty"`
+	Until		int64 `json:",omitempty"`
+	ErrorsOnly	bool `json:",omitempty"`
+	Limit		int `json:",omitempty"`
+}
+
+func (query *AuditQuery) matches(entry *AuditEntry) bool {
+	switch {
+	case query.MessageType != "" && entry.MessageType != query.MessageType,
+		query.Identity != "" && entry.Identity != query.Identity,
+		query.Source != "" && entry.Source != query.Source,
+		query.Since != 0 && entry.Time < query.Since,
+		query.Until != 0 && entry.Time > query.Until,
+		query.ErrorsOnly && entry.Error == "":
+		return false
+	}
+	return true
+}
+
+type auditLog struct {
+	mutex	sync.Mutex
+}
+
+func auditKeyIdentity(name string) string {
+	if name == "" {
+		return AUDIT_IDENTITY_PRESHARED_KEY
+	}
+	return "key:" + name
+}
+
+// maps whose keys are secrets: Users is keyed by
+// username and password, Viewers by secret
+var auditSecretKeyedFields = map[string]bool{
+	"Users": true,
+	"Viewers": true,
+}
+
+// redactAuditKeys renames the keys of a map to
+// numbered placeholders, in the order of the
+// original keys, and redacts its values
+func redactAuditKeys(keyed map[string]interface{}) map[string]interface{} {
+	names := make([]string, 0, len(keyed))
+	for name := range keyed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	redacted := make(map[string]interface{}, len(keyed))
+	for index, name := range names {
+		redacted[fmt.Sprintf("%v-%v", AUDIT_REDACTED, index+1)] = redactAuditValue(keyed[name])
+	}
+	return redacted
+}
+
+// redactAuditValue blanks secret fields anywhere
+// in a decoded JSON value
+func redactAuditValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for field, inner := range typed {
+			if auditSecretFields[field] {
+				if inner != nil && inner != "" {
+					typed[field] = AUDIT_REDACTED
+				}
+				continue
+			}
+			if keyed, ok := inner.(map[string]interface{}); ok && auditSecretKeyedFields[field] {
+				typed[field] = redactAuditKeys(keyed)
+				continue
+			}
+			typed[field] = redactAuditValue(inner)
+		}
+	case []interface{}:
+		for index, inner := range typed {
+			typed[index] = redactAuditValue(inner)
+		}
+	}
+	return value
+}
+
+/*
+ auditParameters encodes a message for the log
+ with its secrets redacted. ProxyData and
+ UserData are JSON, so they are decoded and
+ redacted too rather than kept as opaque bytes.
+*/
+func auditParameters(message *ControllerMessage) json.RawMessage {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	delete(fields, "MessageType")
+	if len(message.ProxyData) > 0 {
+		var proxy interface{}
+		if json.Unmarshal(message.ProxyData, &proxy) == nil {
+			fields["ProxyData"] = proxy
+		}
+	}
+	if len(message.UserData) > 0 {
+		var user interface{}
+		if json.Unmarshal(message.UserData, &user) == nil {
+			fields["UserData"] = user
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	data, err = json.Marshal(redactAuditValue(fields))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// auditResult keeps the plain values of a reply,
+// redacted; structured results are left out
+func auditResult(reply map[string]interface{}) map[string]interface{} {
+	var result map[string]interface{}
+	for field, value := range reply {
+		switch value.(type) {
+		case string, uint64, int, bool:
+			if result == nil {
+				result = make(map[string]interface{})
+			}
+			result[field] = value
+		}
+	}
+	redactAuditValue(result)
+	return result
+}
+
+/*
+ audit appends an entry for a message to
+ AuditLogFile. Nothing is written while it is
+ unset. The file is only ever appended to.
+*/
+func (controller *ProxyController) audit(message *ControllerMessage, identity string, source string, reply map[string]interface{}, err error) {
+	if controller.AuditLogFile == "" {
+		return
+	}
+	entry := &AuditEntry{
+		Time: time.Now().Unix(),
+		MessageType: message.MessageType,
+		Identity: identity,
+		Source: source,
+		Parameters: auditParameters(message),
+		Result: auditResult(reply),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	data, marshal_err := json.Marshal(entry)
+	if marshal_err != nil {
+		controller.Log.Println("unable to encode audit entry:", marshal_err)
+		return
+	}
+	controller.auditLog.mutex.Lock()
+	defer controller.auditLog.mutex.Unlock()
+	file, open_err := os.OpenFile(controller.AuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if open_err != nil {
+		controller.Log.Println("unable to open audit log:", open_err)
+		return
+	}
+	defer file.Close()
+	if _, write_err := file.Write(append(data, '\n')); write_err != nil {
+		controller.Log.Println("unable to write audit log:", write_err)
+	}
+}
+
+/*
+ redactReplySecrets blanks the secret fields in
+ the structured results of a reply, for keys
+ that may not see them.
+*/
+func redactReplySecrets(reply map[string]interface{}) {
+	for field, value := range reply {
+		data, ok := value.([]byte)
+		if !ok {
+			continue
+		}
+		var decoded interface{}
+		if json.Unmarshal(data, &decoded) != nil {
+			continue
+		}
+		if redacted, err := json.Marshal(redactAuditValue(decoded)); err == nil {
+			reply[field] = redacted
+		}
+	}
+}
+
+/*
+ dispatch carries out a message on behalf of
+ identity, connecting from source, records it
+ in the audit log and saves the state file if
+ the message changed anything. Every transport
+ goes through here, so key, the named key of the
+ sender or nil for full access, is enforced the
+ same way everywhere.
+*/
+func (controller *ProxyController) dispatch(message *ControllerMessage, key *ControllerKey, identity string, source string) (map[string]interface{}, error) {
+	reply := make(map[string]interface{})
+	err := key.allows(message)
+	if err == nil {
+		reply, err = message.handle(controller)
+		if !key.seesSecrets() {
+			redactReplySecrets(reply)
+		}
+	}
+	controller.audit(message, identity, source, reply, err)
+	if err == nil && !message.DryRun && !containsString(controllerStatelessMessages, message.MessageType) {
+		controller.persistState()
+	}
+	return reply, err
+}
+
+// QueryAuditLog reads back the entries of the
+// audit log that match the query
+func (controller *ProxyController) QueryAuditLog(query *AuditQuery) (error, []*AuditEntry) {
+	if controller.AuditLogFile == "" {
+		return errors.New("no AuditLogFile set"), nil
+	}
+	if query == nil {
+		query = &AuditQuery{}
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = AUDIT_DEFAULT_QUERY_LIMIT
+	}
+	controller.auditLog.mutex.Lock()
+	defer controller.auditLog.mutex.Unlock()
+	file, err := os.Open(controller.AuditLogFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, []*AuditEntry{}
+	} else if err != nil {
+		return err, nil
+	}
+	defer file.Close()
+	entries := make([]*AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return fmt.Errorf("audit log line %v: %v", line, err), nil
+		}
+		if !query.matches(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err, nil
+	}
+	return nil, entries
+}
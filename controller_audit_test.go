@@ -0,0 +1,134 @@
+package sshproxyplus
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+
+// scriptedClient feeds lines to clientHandler
+// and keeps what it sends back
+type scriptedClient struct {
+	lines	[][]byte
+	sent	[][]byte
+}
+
+func (client *scriptedClient) ReadLine() ([]byte, error) {
+	if len(client.lines) == 0 {
+		return nil, io.EOF
+	}
+	line := client.lines[0]
+	client.lines = client.lines[1:]
+	return line, nil
+}
+
+func (client *scriptedClient) SendLine(data []byte) error {
+	client.sent = append(client.sent, data)
+	return nil
+}
+
+func TestControllerAuditLog(t *testing.T) {
+	controller := makeNewController()
+	controller.APIToken = "token"
+	controller.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(`{"ListenPort": 2222, "Users": {"user:proxy-s3cret": {"Username": "user", "Password": "proxy-s3cret"}}}`),
+	}, controller, t)
+	proxyID := uint64(reply["ProxyID"].(float64))
+	simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_PROXY_USER,
+		ProxyID: proxyID,
+		ProxyUser: &ProxyUser{Username: "other", Password: "user-s3cret", RemoteHost: "127.0.0.1:22", RemotePassword: "remote-s3cret"},
+	}, controller, t)
+	apiCallWithPassword(controller, http.MethodPost, "/proxies/"+strconv.FormatUint(proxyID, 10)+"/viewers", "token", "user-s3cret", `{"Username": "other"}`)
+	simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_DESTROY_PROXY, ProxyID: 99}, controller, t)
+
+	forged := &ControllerMessage{MessageType: CONTROLLER_MESSAGE_DESTROY_PROXY, ProxyID: proxyID}
+	_, wrapper := forged.Sign([]byte("wrong key"))
+	line, _ := json.Marshal(wrapper)
+	client := &scriptedClient{lines: [][]byte{line}}
+	controller.clientHandler(client, nil)
+	if len(client.sent) != 1 || !strings.Contains(string(client.sent[0]), "hmac") {
+		t.Errorf("clientHandler() replied %q to a forged message", client.sent)
+	}
+
+	data, _ := os.ReadFile(controller.AuditLogFile)
+	for _, secret := range []string{"proxy-s3cret", "user-s3cret", "remote-s3cret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("audit() wrote a secret to the log: %s", data)
+		}
+	}
+
+	err, entries := controller.QueryAuditLog(nil)
+	if err != nil || len(entries) != 5 {
+		t.Fatalf("QueryAuditLog() = %v, %v entries, expected 5", err, len(entries))
+	}
+	if created := entries[0]; created.MessageType != CONTROLLER_MESSAGE_CREATE_PROXY || created.Result["ProxyID"] != float64(proxyID) {
+		t.Errorf("audit() entry = %+v, expected the created proxy and its ID", created)
+	}
+	if !strings.Contains(string(entries[0].Parameters), `"Users":{"`+AUDIT_REDACTED+`-1":{`) {
+		t.Errorf("audit() parameters = %s, expected the Users map re-keyed", entries[0].Parameters)
+	}
+	added := entries[1]
+	if added.MessageType != CONTROLLER_MESSAGE_ADD_PROXY_USER || added.Identity != AUDIT_IDENTITY_LOCAL {
+		t.Errorf("audit() entry = %+v, expected the added user", added)
+	}
+	if !strings.Contains(string(added.Parameters), `"Username":"other"`) || !strings.Contains(string(added.Parameters), AUDIT_REDACTED) {
+		t.Errorf("audit() parameters = %s, expected the user with a redacted password", added.Parameters)
+	}
+	viewer := entries[2]
+	if viewer.MessageType != CONTROLLER_MESSAGE_NEW_PROXY_VIEWER || viewer.Identity != AUDIT_IDENTITY_API_TOKEN || viewer.Source == "" {
+		t.Errorf("audit() entry = %+v, expected the viewer created through the REST API", viewer)
+	}
+	if forgedEntry := entries[4]; forgedEntry.Identity != AUDIT_IDENTITY_PRESHARED_KEY || forgedEntry.Error == "" || forgedEntry.Parameters != nil {
+		t.Errorf("audit() entry = %+v, expected the refused message without its parameters", forgedEntry)
+	}
+
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_QUERY_AUDIT_LOG,
+		Audit: &AuditQuery{ErrorsOnly: true, Limit: 1},
+	}, controller, t)
+	filtered := make([]*AuditEntry, 0)
+	replyField(reply, "Entries", &filtered)
+	if len(filtered) != 1 || filtered[0].Parameters != nil {
+		t.Errorf("query-audit-log with ErrorsOnly and Limit 1 = %+v, expected only the newest error", filtered)
+	}
+	err, entries = controller.QueryAuditLog(&AuditQuery{MessageType: CONTROLLER_MESSAGE_DESTROY_PROXY})
+	if err != nil || len(entries) != 1 || entries[0].Error == "" {
+		t.Errorf("QueryAuditLog() by type = %+v, %v, expected the failed destroy", entries, err)
+	}
+}
+
+func TestControllerAuditNestedSecrets(t *testing.T) {
+	controller := makeNewController()
+	controller.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	storage := `"RecordingStorage": {"Type": "s3", "Endpoint": "http://127.0.0.1:1", "Bucket": "recordings", "AccessKey": "access", "SecretKey": "s3-s3cret"}`
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(`{"ListenPort": 2222, "ObserverKey": "observer-s3cret", `+storage+`}`),
+	}, controller, t)
+	proxyID := uint64(reply["ProxyID"].(float64))
+	simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY,
+		ProxyID: proxyID,
+		ProxyData: []byte(`{`+storage+`}`),
+	}, controller, t)
+
+	data, _ := os.ReadFile(controller.AuditLogFile)
+	for _, secret := range []string{"s3-s3cret", "observer-s3cret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("audit() wrote a secret to the log: %s", data)
+		}
+	}
+	if strings.Count(string(data), `"Bucket":"recordings"`) != 2 {
+		t.Errorf("audit() left out the rest of the RecordingStorage: %s", data)
+	}
+}
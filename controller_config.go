@@ -0,0 +1,426 @@
+package sshproxyplus
+
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const CONFIG_FORMAT_JSON	string = "json"
+const CONFIG_FORMAT_YAML	string = "yaml"
+const CONFIG_FORMAT_TOML	string = "toml"
+
+// configFormat picks the format of a config file
+// from its extension; anything else is JSON
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return CONFIG_FORMAT_YAML
+	case ".toml":
+		return CONFIG_FORMAT_TOML
+	}
+	return CONFIG_FORMAT_JSON
+}
+
+/*
+ decodeConfig reads a config in any format into
+ the maps, slices and values encoding/json would
+ produce, so every format is loaded the same way.
+*/
+func decodeConfig(format string, data []byte) (interface{}, error) {
+	var config interface{}
+	var err error
+	switch format {
+	case CONFIG_FORMAT_YAML:
+		err = yaml.Unmarshal(data, &config)
+	case CONFIG_FORMAT_TOML:
+		table := make(map[string]interface{})
+		err = toml.Unmarshal(data, &table)
+		config = table
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %v config: %v", format, err)
+	}
+	return normalizeConfig(config), nil
+}
+
+// normalizeConfig gives every map string keys,
+// which YAML does not guarantee, turns numbers
+// into int64 where they fit and drops nulls,
+// which TOML can't hold
+func normalizeConfig(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			if item != nil {
+				normalized[key] = normalizeConfig(item)
+			}
+		}
+		return normalized
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			if item != nil {
+				normalized[fmt.Sprint(key)] = normalizeConfig(item)
+			}
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(value))
+		for index, item := range value {
+			normalized[index] = normalizeConfig(item)
+		}
+		return normalized
+	case []map[string]interface{}:
+		normalized := make([]interface{}, len(value))
+		for index, item := range value {
+			normalized[index] = normalizeConfig(item)
+		}
+		return normalized
+	case json.Number:
+		if number, err := value.Int64(); err == nil {
+			return number
+		}
+		if number, err := strconv.ParseUint(value.String(), 10, 64); err == nil {
+			return number
+		}
+		number, _ := value.Float64()
+		return number
+	}
+	return value
+}
+
+/*
+ encodeConfig turns an exported controller into
+ the format of path, so a config or state file
+ is written back the way it was read.
+*/
+func encodeConfig(path string, data []byte) ([]byte, error) {
+	format := configFormat(path)
+	if format == CONFIG_FORMAT_JSON {
+		return data, nil
+	}
+	config, err := decodeConfig(CONFIG_FORMAT_JSON, data)
+	if err != nil {
+		return nil, err
+	}
+	if format == CONFIG_FORMAT_YAML {
+		return yaml.Marshal(config)
+	}
+	var buffer bytes.Buffer
+	err = toml.NewEncoder(&buffer).Encode(config)
+	return buffer.Bytes(), err
+}
+
+/*
+ readControllerConfig decodes a config file
+ into a controller that has not been initialized
+ and lists every problem found in it. Nothing is
+ started or opened besides the files it checks.
+*/
+func readControllerConfig(path string) (error, *ProxyController, []string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err, nil, nil
+	}
+	config, err := decodeConfig(configFormat(path), data)
+	if err != nil {
+		return err, nil, nil
+	}
+	if _, ok := config.(map[string]interface{}); !ok {
+		return errors.New("the config must be an object"), nil, nil
+	}
+	problems := unknownConfigFields(config, reflect.TypeOf(ProxyController{}), "")
+	data, err = json.Marshal(config)
+	if err != nil {
+		return err, nil, nil
+	}
+	controller := &ProxyController{}
+	if err = json.Unmarshal(data, controller); err != nil {
+		return err, nil, nil
+	}
+	problems = append(problems, controller.validateConfig()...)
+	return nil, controller, problems
+}
+
+/*
+ ValidateControllerConfigFile checks a JSON,
+ YAML or TOML config file without loading it.
+ The error is set when the file can't be read or
+ parsed; otherwise every problem found is listed.
+*/
+func ValidateControllerConfigFile(path string) (error, []string) {
+	err, _, problems := readControllerConfig(path)
+	return err, problems
+}
+
+/*
+ ControllerConfigSchema returns a JSON Schema of
+ the config file, generated from the controller
+ types like the OpenAPI document.
+*/
+func ControllerConfigSchema() ([]byte, error) {
+	schemas := &openAPISchemas{components: make(map[string]interface{}), refPrefix: "#/$defs/"}
+	root := schemas.schemaFor(reflect.TypeOf(ProxyController{}))
+	return json.MarshalIndent(map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "sshproxyplus controller config",
+		"$ref": root["$ref"],
+		"$defs": schemas.components,
+	}, "", "    ")
+}
+
+// configFieldNames maps the lower case JSON
+// name of each field of a struct to its type,
+// matching field names the way encoding/json does
+func configFieldNames(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for index := 0; index < t.NumField(); index++ {
+		field := t.Field(index)
+		tag := field.Tag.Get("json")
+		if field.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name := field.Name
+		if tag_name := strings.Split(tag, ",")[0]; tag_name != "" {
+			name = tag_name
+		}
+		fields[strings.ToLower(name)] = field.Type
+	}
+	return fields
+}
+
+// unknownConfigFields lists the fields of a
+// decoded config that the controller types don't
+// have, which encoding/json would silently drop
+func unknownConfigFields(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var problems []string
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := configFieldNames(t)
+		for _, key := range sortedConfigKeys(object) {
+			field_type, ok := fields[strings.ToLower(key)]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%v: unknown field", path+key))
+				continue
+			}
+			problems = append(problems, unknownConfigFields(object[key], field_type, path+key+".")...)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, key := range sortedConfigKeys(object) {
+			problems = append(problems, unknownConfigFields(object[key], t.Elem(), path+key+".")...)
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for index, item := range items {
+			problems = append(problems, unknownConfigFields(item, t.Elem(), fmt.Sprintf("%v%v.", path, index))...)
+		}
+	}
+	return problems
+}
+
+func sortedConfigKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+ validateConfig checks what a config refers to
+ before anything is started: the TLS and key
+ files the controller will open, that no two
+ proxies listen on the same port, that each
+ proxy's SessionFolder exists, that each
+ RemoteHost is a host:port and that redaction,
+ retention and specs are valid.
+*/
+func (controller *ProxyController) validateConfig() []string {
+	var problems []string
+	if controller.SocketType == PROXY_CONTROLLER_SOCKET_TLS || controller.SocketType == PROXY_CONTROLLER_SOCKET_TLS_WEBSOCKET {
+		if _, err := tls.LoadX509KeyPair(controller.TLSCert, controller.TLSKey); err != nil {
+			problems = append(problems, fmt.Sprintf("TLSCert/TLSKey: %v", err))
+		}
+	}
+	if controller.GRPCHost != "" {
+		if _, err := tls.LoadX509KeyPair(controller.GRPCCert, controller.GRPCKey); err != nil {
+			problems = append(problems, fmt.Sprintf("GRPCCert/GRPCKey: %v", err))
+		}
+		problems = append(problems, checkReadableFile("GRPCClientCA", controller.GRPCClientCA)...)
+	}
+	if controller.RecordingIdentityFile != "" {
+		problems = append(problems, checkReadableFile("RecordingIdentityFile", controller.RecordingIdentityFile)...)
+	}
+
+	ids := make([]uint64, 0, len(controller.Proxies))
+	for id := range controller.Proxies {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	listeners := make(map[int][]uint64)
+	for _, id := range ids {
+		proxy := controller.Proxies[id]
+		prefix := fmt.Sprintf("Proxies.%v.", id)
+		if proxy == nil {
+			problems = append(problems, prefix[:len(prefix)-1]+": proxy is empty")
+			continue
+		}
+		for _, other := range listeners[proxy.ListenPort] {
+			if sameListenIP(proxy.ListenIP, controller.Proxies[other].ListenIP) {
+				problems = append(problems, fmt.Sprintf("%vListenPort: %v is also used by proxy %v", prefix, proxy.ListenPort, other))
+			}
+		}
+		if proxy.ListenPort != 0 {
+			listeners[proxy.ListenPort] = append(listeners[proxy.ListenPort], id)
+		}
+		problems = append(problems, proxy.validateConfig(prefix)...)
+	}
+	return problems
+}
+
+func (proxy *ProxyContext) validateConfig(prefix string) []string {
+	problems := proxy.validateSettings(prefix)
+	keys := make([]string, 0, len(proxy.Users))
+	for key := range proxy.Users {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		user := proxy.Users[key]
+		user_prefix := fmt.Sprintf("%vUsers.%v.", prefix, key)
+		if user == nil {
+			problems = append(problems, user_prefix[:len(user_prefix)-1]+": user is empty")
+			continue
+		}
+		problems = append(problems, user.validateConfig(user_prefix)...)
+	}
+	return problems
+}
+
+// validateSettings checks the proxy's own
+// settings, leaving out its users
+func (proxy *ProxyContext) validateSettings(prefix string) []string {
+	var problems []string
+	if proxy.ListenPort < 0 || proxy.ListenPort > 65535 {
+		problems = append(problems, fmt.Sprintf("%vListenPort: %v is not a port", prefix, proxy.ListenPort))
+	}
+	if proxy.ListenIP != "" && net.ParseIP(proxy.ListenIP) == nil {
+		problems = append(problems, fmt.Sprintf("%vListenIP: %q is not an IP address", prefix, proxy.ListenIP))
+	}
+	if proxy.RecordingStorage == nil || proxy.RecordingStorage.Type == "" || proxy.RecordingStorage.Type == RECORDING_STORE_FILESYSTEM {
+		if proxy.SessionFolder == "" {
+			problems = append(problems, prefix+"SessionFolder: not set")
+		} else if info, err := os.Stat(proxy.SessionFolder); err != nil {
+			problems = append(problems, fmt.Sprintf("%vSessionFolder: %v", prefix, err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%vSessionFolder: %v is not a directory", prefix, proxy.SessionFolder))
+		}
+	}
+	if proxy.RecordingRecipientFile != "" {
+		problems = append(problems, checkReadableFile(prefix+"RecordingRecipientFile", proxy.RecordingRecipientFile)...)
+	}
+	if proxy.DefaultRemoteIP != "" {
+		if err := checkRemoteHost(proxy.GetDefaultRemoteHost()); err != nil {
+			problems = append(problems, fmt.Sprintf("%vDefaultRemoteIP/DefaultRemotePort: %v", prefix, err))
+		}
+	}
+	if err := proxy.Redaction.clone().Compile(); err != nil {
+		problems = append(problems, fmt.Sprintf("%vRedaction: %v", prefix, err))
+	}
+	if err := proxy.Retention.Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("%vRetention: %v", prefix, err))
+	}
+	return problems
+}
+
+func (user *ProxyUser) validateConfig(prefix string) []string {
+	var problems []string
+	if user.RemoteHost != "" {
+		if err := checkRemoteHost(user.RemoteHost); err != nil {
+			problems = append(problems, fmt.Sprintf("%vRemoteHost: %v", prefix, err))
+		}
+	}
+	for index, spec := range user.FilterSpecs {
+		if err, _ := spec.build(); err != nil {
+			problems = append(problems, fmt.Sprintf("%vFilterSpecs.%v: %v", prefix, index, err))
+		}
+	}
+	for index, spec := range user.CallbackSpecs {
+		if err, _ := spec.build(); err != nil {
+			problems = append(problems, fmt.Sprintf("%vCallbackSpecs.%v: %v", prefix, index, err))
+		}
+	}
+	return problems
+}
+
+func checkReadableFile(name string, path string) []string {
+	if path == "" {
+		return []string{name + ": not set"}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return []string{fmt.Sprintf("%v: %v", name, err)}
+	}
+	file.Close()
+	return nil
+}
+
+// checkRemoteHost accepts host:port with a
+// port from 1 to 65535
+func checkRemoteHost(host string) error {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return fmt.Errorf("%q is not host:port", host)
+	}
+	if name == "" {
+		return fmt.Errorf("%q has no host", host)
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return fmt.Errorf("%q has no valid port", host)
+	}
+	return nil
+}
+
+// sameListenIP is true when two listeners on the
+// same port would collide
+func sameListenIP(a string, b string) bool {
+	unspecified := func(ip string) bool {
+		parsed := net.ParseIP(ip)
+		return ip == "" || (parsed != nil && parsed.IsUnspecified())
+	}
+	return a == b || unspecified(a) || unspecified(b)
+}
@@ -0,0 +1,139 @@
+package sshproxyplus
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+
+func TestControllerConfigFormats(t *testing.T) {
+	folder := t.TempDir()
+	configs := map[string]string{
+		"controller.yaml": fmt.Sprintf(`
+PresharedKey: key
+Proxies:
+  3:
+    ListenPort: 2222
+    SessionFolder: %q
+    Users:
+      "user:pass":
+        Username: user
+        Password: pass
+        RemoteHost: 127.0.0.1:22
+        FilterSpecs:
+          - Type: replace
+            Parameters: {find: secret, replace: hidden}
+`, folder),
+		"controller.toml": fmt.Sprintf(`
+PresharedKey = "key"
+[Proxies.3]
+ListenPort = 2222
+SessionFolder = %q
+[Proxies.3.Users."user:pass"]
+Username = "user"
+Password = "pass"
+RemoteHost = "127.0.0.1:22"
+[[Proxies.3.Users."user:pass".FilterSpecs]]
+Type = "replace"
+Parameters = {find = "secret", replace = "hidden"}
+`, folder),
+	}
+	for name, config := range configs {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatalf("unable to write config: %v", err)
+		}
+		err, controller := LoadControllerConfigFromFile(path, nil)
+		if err != nil {
+			t.Fatalf("LoadControllerConfigFromFile(%v) = %v", name, err)
+		}
+		proxy, err := controller.GetProxy(3)
+		if err != nil {
+			t.Fatalf("LoadControllerConfigFromFile(%v) lost the proxy: %v", name, err)
+		}
+		err, user, _ := proxy.GetProxyUser("user", "pass", false)
+		if err != nil || user.RemoteHost != "127.0.0.1:22" || len(user.getChannelFilters()) != 1 {
+			t.Errorf("LoadControllerConfigFromFile(%v) loaded user %+v", name, user)
+		}
+		if controller.ProxyCounter != 4 {
+			t.Errorf("LoadControllerConfigFromFile(%v) left ProxyCounter at %v, expected 4", name, controller.ProxyCounter)
+		}
+
+		// written back in the same format
+		if err := controller.WriteControllerConfigToFile(path); err != nil {
+			t.Fatalf("WriteControllerConfigToFile(%v) = %v", name, err)
+		}
+		err, reloaded := LoadControllerConfigFromFile(path, nil)
+		if err != nil {
+			t.Fatalf("LoadControllerConfigFromFile(%v) after writing = %v", name, err)
+		}
+		before, _ := controller.ExportControllerAsJSON()
+		after, _ := reloaded.ExportControllerAsJSON()
+		if string(before) != string(after) {
+			t.Errorf("WriteControllerConfigToFile(%v) did not round trip:\n%s\n%s", name, before, after)
+		}
+	}
+}
+
+func TestControllerConfigValidation(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(t.TempDir(), "controller.json")
+	config := fmt.Sprintf(`{
+		"SocketType": 2,
+		"TLSCert": "missing.crt",
+		"TLSKey": "missing.key",
+		"Proxies": {
+			"0": {"ListenIP": "0.0.0.0", "ListenPort": 2222, "SessionFolder": %q,
+				"Users": {"user:pass": {"Username": "user", "Password": "pass", "RemoteHost": "127.0.0.1"}}},
+			"1": {"ListenIP": "127.0.0.1", "ListenPort": 2222, "SessionFolder": %q, "ListenPrt": 2223}
+		}
+	}`, folder, filepath.Join(folder, "missing"))
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("unable to write config: %v", err)
+	}
+
+	err, problems := ValidateControllerConfigFile(path)
+	if err != nil {
+		t.Fatalf("ValidateControllerConfigFile() = %v", err)
+	}
+	for _, expected := range []string{
+		"TLSCert/TLSKey:",
+		"Proxies.1.ListenPort: 2222 is also used by proxy 0",
+		"Proxies.0.Users.user:pass.RemoteHost:",
+		"Proxies.1.SessionFolder:",
+		"Proxies.1.ListenPrt: unknown field",
+	} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.HasPrefix(problem, expected)
+		}
+		if !found {
+			t.Errorf("ValidateControllerConfigFile() did not report %q; got %q", expected, problems)
+		}
+	}
+	if len(problems) != 5 {
+		t.Errorf("ValidateControllerConfigFile() = %q, expected 5 problems", problems)
+	}
+
+	err, controller := LoadControllerConfigFromFile(path, nil)
+	if err == nil || controller != nil || !strings.Contains(err.Error(), "ListenPrt") {
+		t.Errorf("LoadControllerConfigFromFile() = %v, expected it to refuse the config", err)
+	}
+}
+
+func TestControllerConfigSchema(t *testing.T) {
+	schema, err := ControllerConfigSchema()
+	if err != nil {
+		t.Fatalf("ControllerConfigSchema() = %v", err)
+	}
+	committed, err := os.ReadFile("controller.schema.json")
+	if err != nil {
+		t.Fatalf("unable to read controller.schema.json: %v", err)
+	}
+	if strings.TrimSpace(string(committed)) != string(schema) {
+		t.Errorf("controller.schema.json is out of date; regenerate it with ControllerConfigSchema()")
+	}
+}
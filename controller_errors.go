@@ -0,0 +1,38 @@
+package sshproxyplus
+
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ The kinds of errors the controller returns.
+ The REST API and gRPC control plane pick their
+ status codes by testing for them with
+ errors.Is. Errors without a kind are bad
+ requests.
+*/
+var ErrNotFound = errors.New("not found")
+var ErrConflict = errors.New("conflict")
+var ErrPermissionDenied = errors.New("permission denied")
+var ErrUnsupported = errors.New("unsupported")
+
+// kindError keeps its message and unwraps to
+// its kind
+type kindError struct {
+	kind	error
+	message	string
+}
+
+func (err *kindError) Error() string {
+	return err.message
+}
+
+func (err *kindError) Unwrap() error {
+	return err.kind
+}
+
+func newKindError(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,860 @@
+package sshproxyplus
+
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/bja2142/sshproxyplus/controllerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+ controllerGRPCServer serves the gRPC control
+ plane. Each RPC is turned into a controller
+ message and carried out by the same code as
+ HandleMessage, so the transports can't drift
+ apart.
+*/
+type controllerGRPCServer struct {
+	controllerpb.UnimplementedProxyControllerServiceServer
+	controller	*ProxyController
+}
+
+// grpcStatus gives a controller error the status
+// code the REST API would use
+func grpcStatus(err error) error {
+	code := codes.InvalidArgument
+	switch apiErrorStatus(err) {
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusNotImplemented:
+		code = codes.Unimplemented
+	}
+	return status.Error(code, err.Error())
+}
+
+/*
+ grpcCaller names the client of a call for the
+ audit log by its certificate's common name. A
+ common name that is the Name of a controller key
+ limits the client to what that key may do;
+ other clients of GRPCClientCA may do anything.
+*/
+func (server *controllerGRPCServer) grpcCaller(ctx context.Context) (string, string, *ControllerKey) {
+	identity, source := "grpc", ""
+	client, ok := peer.FromContext(ctx)
+	if !ok {
+		return identity, source, nil
+	}
+	if client.Addr != nil {
+		source = client.Addr.String()
+	}
+	var key *ControllerKey
+	if info, ok := client.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+		name := info.State.PeerCertificates[0].Subject.CommonName
+		identity = "grpc:" + name
+		key = server.controller.namedKey(name)
+	}
+	return identity, source, key
+}
+
+func (server *controllerGRPCServer) handle(ctx context.Context, message *ControllerMessage) (map[string]interface{}, error) {
+	identity, source, key := server.grpcCaller(ctx)
+	reply, err := server.controller.dispatch(message, key, identity, source)
+	if err != nil {
+		return nil, grpcStatus(err)
+	}
+	return reply, nil
+}
+
+// run carries out a message that replies with
+// nothing but an error
+func (server *controllerGRPCServer) run(ctx context.Context, message *ControllerMessage) (*emptypb.Empty, error) {
+	if _, err := server.handle(ctx, message); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// decodeReply reads a JSON field of a reply
+func decodeReply(reply map[string]interface{}, field string, value interface{}) error {
+	data, ok := reply[field].([]byte)
+	if !ok {
+		return status.Error(codes.Internal, "reply has no "+field)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// replyKey reads a string field of a reply
+func replyKey(reply map[string]interface{}, field string) *controllerpb.Key {
+	key, _ := reply[field].(string)
+	return &controllerpb.Key{Key: key}
+}
+
+func viewerToProto(viewer *proxySessionViewer) *controllerpb.Viewer {
+	converted := &controllerpb.Viewer{
+		ViewerType: int64(viewer.ViewerType),
+		Secret: viewer.Secret,
+		SessionKey: viewer.SessionKey,
+		Operator: viewer.Operator,
+	}
+	if viewer.User != nil {
+		converted.Username = viewer.User.Username
+	}
+	return converted
+}
+
+func eventToProto(index int, event *SessionEvent) *controllerpb.SessionEvent {
+	return &controllerpb.SessionEvent{
+		Index: int64(index),
+		Type: event.Type,
+		Key: event.Key,
+		Start: event.StartTime,
+		Stop: event.StopTime,
+		Length: event.Length,
+		Offset: event.TimeOffset,
+		Direction: event.Direction,
+		Size: int64(event.Size),
+		Data: event.Data,
+		ClientHost: event.ClientHost,
+		ServerHost: event.ServHost,
+		Username: event.Username,
+		Password: event.Password,
+		TermRows: event.TermRows,
+		TermCols: event.TermCols,
+		ChannelType: event.ChannelType,
+		ChannelData: event.ChannelData,
+		RequestType: event.RequestType,
+		RequestPayload: event.RequestPayload,
+		ChannelId: int64(event.ChannelID),
+		RequestId: int64(event.RequestID),
+		TerminatedBy: event.TerminatedBy,
+		Reason: event.Reason,
+		Operator: event.Operator,
+		Exclusive: event.Exclusive,
+		Timeout: event.Timeout,
+		Limit: int64(event.Limit),
+		Sessions: event.Sessions,
+	}
+}
+
+func (server *controllerGRPCServer) CreateProxy(ctx context.Context, request *controllerpb.CreateProxyRequest) (*controllerpb.ProxyID, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_CREATE_PROXY, ProxyData: request.ProxyJson})
+	if err != nil {
+		return nil, err
+	}
+	proxyID, _ := reply["ProxyID"].(uint64)
+	return &controllerpb.ProxyID{ProxyId: proxyID}, nil
+}
+
+func (server *controllerGRPCServer) UpdateProxy(ctx context.Context, request *controllerpb.UpdateProxyRequest) (*controllerpb.SettingsUpdate, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY,
+		ProxyID: request.ProxyId,
+		ProxyData: request.ProxyJson,
+		DryRun: request.DryRun,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return settingsUpdateToProto(reply)
+}
+
+func settingsUpdateToProto(reply map[string]interface{}) (*controllerpb.SettingsUpdate, error) {
+	update := &SettingsUpdate{}
+	if err := decodeReply(reply, "Update", update); err != nil {
+		return nil, err
+	}
+	return &controllerpb.SettingsUpdate{Updated: update.Updated, Live: update.Live}, nil
+}
+
+func (server *controllerGRPCServer) StartProxy(ctx context.Context, request *controllerpb.ProxyID) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_START_PROXY, ProxyID: request.ProxyId})
+}
+
+func (server *controllerGRPCServer) StopProxy(ctx context.Context, request *controllerpb.ProxyID) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_STOP_PROXY, ProxyID: request.ProxyId})
+}
+
+func (server *controllerGRPCServer) DestroyProxy(ctx context.Context, request *controllerpb.ProxyID) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_DESTROY_PROXY, ProxyID: request.ProxyId})
+}
+
+func (server *controllerGRPCServer) ActivateProxy(ctx context.Context, request *controllerpb.ProxyID) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_ACTIVATE_PROXY, ProxyID: request.ProxyId})
+}
+
+func (server *controllerGRPCServer) DeactivateProxy(ctx context.Context, request *controllerpb.ProxyID) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_DEACTIVATE_PROXY, ProxyID: request.ProxyId})
+}
+
+func (server *controllerGRPCServer) ListProxies(ctx context.Context, request *emptypb.Empty) (*controllerpb.ProxyList, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_PROXIES})
+	if err != nil {
+		return nil, err
+	}
+	proxies := make(map[uint64]json.RawMessage)
+	if err := decodeReply(reply, "Proxies", &proxies); err != nil {
+		return nil, err
+	}
+	list := &controllerpb.ProxyList{Proxies: make(map[uint64]*controllerpb.ProxyInfo)}
+	for proxyID, data := range proxies {
+		list.Proxies[proxyID] = &controllerpb.ProxyInfo{ProxyJson: data}
+	}
+	return list, nil
+}
+
+func (server *controllerGRPCServer) GetProxyInfo(ctx context.Context, request *controllerpb.ProxyID) (*controllerpb.ProxyInfo, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_GET_PROXY_INFO, ProxyID: request.ProxyId})
+	if err != nil {
+		return nil, err
+	}
+	data, _ := reply["Proxy"].([]byte)
+	return &controllerpb.ProxyInfo{ProxyJson: data}, nil
+}
+
+func (server *controllerGRPCServer) AddProxyUser(ctx context.Context, request *controllerpb.AddProxyUserRequest) (*controllerpb.Key, error) {
+	user := request.User
+	if user == nil {
+		return nil, status.Error(codes.InvalidArgument, "No ProxyUser provided")
+	}
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_PROXY_USER,
+		ProxyID: request.ProxyId,
+		ProxyUser: &ProxyUser{
+			Username: user.Username,
+			Password: user.Password,
+			RemoteHost: user.RemoteHost,
+			RemoteUsername: user.RemoteUsername,
+			RemotePassword: user.RemotePassword,
+			RequireApproval: user.RequireApproval,
+			IdleTimeoutSeconds: user.IdleTimeoutSeconds,
+			MaxSessionSeconds: user.MaxSessionSeconds,
+			MaxSessions: int(user.MaxSessions),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replyKey(reply, "UserKey"), nil
+}
+
+func (server *controllerGRPCServer) RemoveProxyUser(ctx context.Context, request *controllerpb.UserRequest) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_REMOVE_PROXY_USER,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+	})
+}
+
+func (server *controllerGRPCServer) UpdateProxyUser(ctx context.Context, request *controllerpb.UpdateProxyUserRequest) (*controllerpb.SettingsUpdate, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY_USER,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+		UserData: request.UserJson,
+		DryRun: request.DryRun,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return settingsUpdateToProto(reply)
+}
+
+func (server *controllerGRPCServer) AddChannelFilter(ctx context.Context, request *controllerpb.AddChannelFilterRequest) (*controllerpb.Key, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+		FindString: request.Find,
+		ReplaceString: request.Replace,
+		ChannelFilter: channelFilterFromProto(request.Spec),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replyKey(reply, "FilterKey"), nil
+}
+
+func (server *controllerGRPCServer) RemoveChannelFilter(ctx context.Context, request *controllerpb.RemoveKeyRequest) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_REMOVE_CHANNEL_FILTER,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+		FilterKey: request.Key,
+	})
+}
+
+func (server *controllerGRPCServer) AddUserCallback(ctx context.Context, request *controllerpb.AddUserCallbackRequest) (*controllerpb.Key, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_USER_CALLBACK,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+		FindString: request.Find,
+		CallbackURL: request.CallbackUrl,
+		EventCallback: eventCallbackFromProto(request.Spec),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replyKey(reply, "CallbackKey"), nil
+}
+
+func (server *controllerGRPCServer) RemoveUserCallback(ctx context.Context, request *controllerpb.RemoveKeyRequest) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_REMOVE_USER_CALLBACK,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+		CallbackKey: request.Key,
+	})
+}
+
+func channelFilterFromProto(spec *controllerpb.ChannelFilterSpec) *ChannelFilterSpec {
+	if spec == nil {
+		return nil
+	}
+	return &ChannelFilterSpec{Key: spec.Key, Type: spec.Type, Parameters: spec.Parameters, Directions: spec.Directions}
+}
+
+func eventCallbackFromProto(spec *controllerpb.EventCallbackSpec) *EventCallbackSpec {
+	if spec == nil {
+		return nil
+	}
+	return &EventCallbackSpec{Key: spec.Key, Type: spec.Type, Parameters: spec.Parameters, Events: spec.Events}
+}
+
+func (server *controllerGRPCServer) ListChannelFilters(ctx context.Context, request *controllerpb.UserRequest) (*controllerpb.ChannelFilterList, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_LIST_CHANNEL_FILTERS,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	filters := make([]*ChannelFilterSpec, 0)
+	if err := decodeReply(reply, "ChannelFilters", &filters); err != nil {
+		return nil, err
+	}
+	list := &controllerpb.ChannelFilterList{}
+	for _, filter := range filters {
+		list.Filters = append(list.Filters, &controllerpb.ChannelFilterSpec{
+			Key: filter.Key,
+			Type: filter.Type,
+			Parameters: filter.Parameters,
+			Directions: filter.Directions,
+		})
+	}
+	return list, nil
+}
+
+func (server *controllerGRPCServer) ListUserCallbacks(ctx context.Context, request *controllerpb.UserRequest) (*controllerpb.EventCallbackList, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_LIST_USER_CALLBACKS,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	callbacks := make([]*EventCallbackSpec, 0)
+	if err := decodeReply(reply, "EventCallbacks", &callbacks); err != nil {
+		return nil, err
+	}
+	list := &controllerpb.EventCallbackList{}
+	for _, callback := range callbacks {
+		list.Callbacks = append(list.Callbacks, &controllerpb.EventCallbackSpec{
+			Key: callback.Key,
+			Type: callback.Type,
+			Parameters: callback.Parameters,
+			Events: callback.Events,
+		})
+	}
+	return list, nil
+}
+
+func (server *controllerGRPCServer) GetProxyViewer(ctx context.Context, request *controllerpb.GetProxyViewerRequest) (*controllerpb.Viewer, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_GET_PROXY_VIEWER,
+		ProxyID: request.ProxyId,
+		ViewerSecret: request.ViewerSecret,
+		SessionKey: request.SessionKey,
+		Username: request.Username,
+	})
+	if err != nil {
+		return nil, err
+	}
+	viewer := &proxySessionViewer{}
+	if err := decodeReply(reply, "Viewer", viewer); err != nil {
+		return nil, err
+	}
+	return viewerToProto(viewer), nil
+}
+
+func (server *controllerGRPCServer) GetProxyViewers(ctx context.Context, request *controllerpb.GetProxyViewersRequest) (*controllerpb.ViewerList, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_GET_PROXY_VIEWERS,
+		ProxyID: request.ProxyId,
+		SessionKey: request.SessionKey,
+		Username: request.Username,
+	})
+	if err != nil {
+		return nil, err
+	}
+	viewers := make([]*proxySessionViewer, 0)
+	if err := decodeReply(reply, "Viewers", &viewers); err != nil {
+		return nil, err
+	}
+	list := &controllerpb.ViewerList{}
+	for _, viewer := range viewers {
+		list.Viewers = append(list.Viewers, viewerToProto(viewer))
+	}
+	return list, nil
+}
+
+func (server *controllerGRPCServer) NewProxyViewer(ctx context.Context, request *controllerpb.NewProxyViewerRequest) (*controllerpb.Viewer, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_NEW_PROXY_VIEWER,
+		ProxyID: request.ProxyId,
+		Username: request.Username,
+		Password: request.Password,
+		SessionKey: request.SessionKey,
+		Operator: request.Operator,
+	})
+	if err != nil {
+		return nil, err
+	}
+	viewer := &proxySessionViewer{}
+	if err := decodeReply(reply, "Viewer", viewer); err != nil {
+		return nil, err
+	}
+	return viewerToProto(viewer), nil
+}
+
+func (server *controllerGRPCServer) SetViewerOperator(ctx context.Context, request *controllerpb.SetViewerOperatorRequest) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_SET_VIEWER_OPERATOR,
+		ProxyID: request.ProxyId,
+		ViewerSecret: request.ViewerSecret,
+		Operator: request.Operator,
+	})
+}
+
+func (server *controllerGRPCServer) SetProxyRedaction(ctx context.Context, request *controllerpb.SetProxyConfigRequest) (*emptypb.Empty, error) {
+	var config *RedactionConfig
+	if len(request.ConfigJson) > 0 {
+		config = &RedactionConfig{}
+		if err := json.Unmarshal(request.ConfigJson, config); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return server.run(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_SET_PROXY_REDACTION, ProxyID: request.ProxyId, Redaction: config})
+}
+
+func (server *controllerGRPCServer) SetProxyRetention(ctx context.Context, request *controllerpb.SetProxyConfigRequest) (*emptypb.Empty, error) {
+	var policy *RetentionPolicy
+	if len(request.ConfigJson) > 0 {
+		policy = &RetentionPolicy{}
+		if err := json.Unmarshal(request.ConfigJson, policy); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return server.run(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_SET_PROXY_RETENTION, ProxyID: request.ProxyId, Retention: policy})
+}
+
+func (server *controllerGRPCServer) ApplyProxyRetention(ctx context.Context, request *controllerpb.ApplyProxyRetentionRequest) (*controllerpb.RetentionReport, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_APPLY_PROXY_RETENTION,
+		ProxyID: request.ProxyId,
+		DryRun: request.DryRun,
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := &RetentionReport{}
+	if err := decodeReply(reply, "Report", report); err != nil {
+		return nil, err
+	}
+	converted := &controllerpb.RetentionReport{
+		DryRun: report.DryRun,
+		DeletedBytes: report.DeletedBytes,
+		KeptCount: int64(report.KeptCount),
+		KeptBytes: report.KeptBytes,
+		PrunedSessionList: int64(report.PrunedSessionList),
+		Errors: report.Errors,
+	}
+	for _, deletion := range report.Deleted {
+		converted.Deleted = append(converted.Deleted, &controllerpb.RetentionDeletion{
+			Name: deletion.Name,
+			Username: deletion.Username,
+			Size: deletion.Size,
+			ModTime: deletion.ModTime.Unix(),
+			Reason: deletion.Reason,
+		})
+	}
+	return converted, nil
+}
+
+func (server *controllerGRPCServer) SearchSessions(ctx context.Context, request *controllerpb.SearchSessionsRequest) (*controllerpb.SearchSessionsReply, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_SEARCH_SESSIONS,
+		ProxyID: request.ProxyId,
+		Search: &SessionSearchQuery{
+			Text: request.Text,
+			Username: request.Username,
+			Host: request.Host,
+			Since: request.Since,
+			Until: request.Until,
+			Limit: int(request.Limit),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]SessionSearchResult, 0)
+	if err := decodeReply(reply, "Results", &results); err != nil {
+		return nil, err
+	}
+	converted := &controllerpb.SearchSessionsReply{}
+	for _, result := range results {
+		item := &controllerpb.SearchResult{
+			SessionKey: result.SessionKey,
+			Username: result.Username,
+			ClientHost: result.ClientHost,
+			ServerHost: result.ServerHost,
+			Start: result.Start,
+			Stop: result.Stop,
+			Active: result.Active,
+		}
+		for _, hit := range result.Hits {
+			item.Hits = append(item.Hits, &controllerpb.SearchHit{
+				EventIndex: int64(hit.EventIndex),
+				Offset: hit.Offset,
+				Source: hit.Source,
+				ChannelId: int64(hit.ChannelID),
+				Text: hit.Text,
+			})
+		}
+		converted.Results = append(converted.Results, item)
+	}
+	return converted, nil
+}
+
+func (server *controllerGRPCServer) KillSession(ctx context.Context, request *controllerpb.KillSessionRequest) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_KILL_SESSION,
+		ProxyID: request.ProxyId,
+		SessionKey: request.SessionKey,
+		TerminatedBy: request.TerminatedBy,
+		Reason: request.Reason,
+		Notice: request.Notice,
+	})
+}
+
+func (server *controllerGRPCServer) ApproveSession(ctx context.Context, request *controllerpb.SessionDecisionRequest) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_APPROVE_SESSION,
+		ProxyID: request.ProxyId,
+		SessionKey: request.SessionKey,
+		Operator: request.Operator,
+		Reason: request.Reason,
+	})
+}
+
+func (server *controllerGRPCServer) DenySession(ctx context.Context, request *controllerpb.SessionDecisionRequest) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_DENY_SESSION,
+		ProxyID: request.ProxyId,
+		SessionKey: request.SessionKey,
+		Operator: request.Operator,
+		Reason: request.Reason,
+	})
+}
+
+func (server *controllerGRPCServer) ListPendingSessions(ctx context.Context, request *controllerpb.ProxyID) (*controllerpb.SessionKeys, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_PENDING_SESSIONS, ProxyID: request.ProxyId})
+	if err != nil {
+		return nil, err
+	}
+	keys := &controllerpb.SessionKeys{}
+	if err := decodeReply(reply, "Sessions", &keys.Keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func controllerKeyToProto(key *ControllerKey) *controllerpb.ControllerKey {
+	return &controllerpb.ControllerKey{
+		Name: key.Name,
+		Key: key.Key,
+		Role: key.Role,
+		AllowedMessages: key.AllowedMessages,
+		AllowedProxies: key.AllowedProxies,
+		Created: key.Created,
+		Rotated: key.Rotated,
+	}
+}
+
+func (server *controllerGRPCServer) controllerKeyReply(ctx context.Context, message *ControllerMessage) (*controllerpb.ControllerKey, error) {
+	reply, err := server.handle(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	key := &ControllerKey{}
+	if err := decodeReply(reply, "ControllerKey", key); err != nil {
+		return nil, err
+	}
+	return controllerKeyToProto(key), nil
+}
+
+func (server *controllerGRPCServer) CreateControllerKey(ctx context.Context, request *controllerpb.ControllerKey) (*controllerpb.ControllerKey, error) {
+	return server.controllerKeyReply(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY,
+		ControllerKey: &ControllerKey{
+			Name: request.Name,
+			Role: request.Role,
+			AllowedMessages: request.AllowedMessages,
+			AllowedProxies: request.AllowedProxies,
+		},
+	})
+}
+
+func (server *controllerGRPCServer) RotateControllerKey(ctx context.Context, request *controllerpb.KeyName) (*controllerpb.ControllerKey, error) {
+	return server.controllerKeyReply(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_ROTATE_CONTROLLER_KEY, KeyName: request.Name})
+}
+
+func (server *controllerGRPCServer) RevokeControllerKey(ctx context.Context, request *controllerpb.KeyName) (*emptypb.Empty, error) {
+	return server.run(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_REVOKE_CONTROLLER_KEY, KeyName: request.Name})
+}
+
+func (server *controllerGRPCServer) ListControllerKeys(ctx context.Context, request *emptypb.Empty) (*controllerpb.ControllerKeyList, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_CONTROLLER_KEYS})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*ControllerKey, 0)
+	if err := decodeReply(reply, "ControllerKeys", &keys); err != nil {
+		return nil, err
+	}
+	list := &controllerpb.ControllerKeyList{}
+	for _, key := range keys {
+		list.Keys = append(list.Keys, controllerKeyToProto(key))
+	}
+	return list, nil
+}
+
+func (server *controllerGRPCServer) QueryAuditLog(ctx context.Context, request *controllerpb.AuditQuery) (*controllerpb.AuditEntries, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_QUERY_AUDIT_LOG,
+		Audit: &AuditQuery{
+			MessageType: request.MessageType,
+			Identity: request.Identity,
+			Source: request.Source,
+			Since: request.Since,
+			Until: request.Until,
+			ErrorsOnly: request.ErrorsOnly,
+			Limit: int(request.Limit),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*AuditEntry, 0)
+	if err := decodeReply(reply, "Entries", &entries); err != nil {
+		return nil, err
+	}
+	list := &controllerpb.AuditEntries{}
+	for _, entry := range entries {
+		converted := &controllerpb.AuditEntry{
+			Time: entry.Time,
+			MessageType: entry.MessageType,
+			Identity: entry.Identity,
+			Source: entry.Source,
+			ParametersJson: entry.Parameters,
+			Error: entry.Error,
+		}
+		if entry.Result != nil {
+			converted.ResultJson, _ = json.Marshal(entry.Result)
+		}
+		list.Entries = append(list.Entries, converted)
+	}
+	return list, nil
+}
+
+func (server *controllerGRPCServer) ReloadConfig(ctx context.Context, request *controllerpb.ReloadConfigRequest) (*controllerpb.ConfigDiff, error) {
+	reply, err := server.handle(ctx, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_RELOAD_CONFIG, DryRun: request.DryRun})
+	if err != nil {
+		return nil, err
+	}
+	diff := &ConfigDiff{}
+	if err := decodeReply(reply, "Diff", diff); err != nil {
+		return nil, err
+	}
+	out := &controllerpb.ConfigDiff{
+		AddedProxies: diff.AddedProxies,
+		RemovedProxies: diff.RemovedProxies,
+		UpdatedProxies: make(map[uint64]*controllerpb.ProxyConfigDiff),
+		Errors: diff.Errors,
+	}
+	for id, proxyDiff := range diff.UpdatedProxies {
+		out.UpdatedProxies[id] = &controllerpb.ProxyConfigDiff{
+			AddedUsers: proxyDiff.AddedUsers,
+			RemovedUsers: proxyDiff.RemovedUsers,
+			UpdatedUsers: proxyDiff.UpdatedUsers,
+			UpdatedSettings: proxyDiff.UpdatedSettings,
+			MovedListener: proxyDiff.MovedListener,
+		}
+	}
+	return out, nil
+}
+
+/*
+ WatchSession streams the events of a session.
+ Events that have left memory are read back
+ from the recording; with follow set, new events
+ are sent as they happen until the session ends
+ or the client goes away.
+*/
+func (server *controllerGRPCServer) WatchSession(request *controllerpb.WatchSessionRequest, stream controllerpb.ProxyControllerService_WatchSessionServer) error {
+	_, err := server.handle(stream.Context(), &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_WATCH_SESSION,
+		ProxyID: request.ProxyId,
+		SessionKey: request.SessionKey,
+	})
+	if err != nil {
+		return err
+	}
+	err, session := server.controller.GetSession(request.ProxyId, request.SessionKey)
+	if err != nil {
+		return grpcStatus(err)
+	}
+	proxy := session.proxy
+	identity, err := server.controller.loadRecordingIdentity()
+	if err != nil {
+		return grpcStatus(err)
+	}
+	var signal chan int
+	if request.Follow {
+		// registered before the replay so no
+		// event falls in between
+		signal = session.MakeNewSignal()
+		defer session.RemoveSignal(signal)
+	}
+	send := func(index int, event *SessionEvent) error {
+		return stream.Send(eventToProto(index, event))
+	}
+	missed := func(count int, err error) {
+		proxy.Log.Printf("error reading session events from the recording, %v not sent: %v\n", count, err)
+	}
+	next, err := session.replayEventsFrom(identity, int(request.FromEvent), send, missed)
+	if err != nil || !request.Follow || !session.isActive() {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case value := <-signal:
+			if next, err = session.replayEventsFrom(identity, next, send, missed); err != nil {
+				return err
+			}
+			if value == SIGNAL_SESSION_END {
+				return nil
+			}
+		}
+	}
+}
+
+/*
+ grpcTLSConfig builds the mutual TLS settings of
+ the control plane: the server presents GRPCCert
+ and only clients with a certificate signed by
+ GRPCClientCA get in.
+*/
+func (controller *ProxyController) grpcTLSConfig() (*tls.Config, error) {
+	if controller.GRPCCert == "" || controller.GRPCKey == "" || controller.GRPCClientCA == "" {
+		return nil, errors.New("the gRPC control plane needs GRPCCert, GRPCKey and GRPCClientCA")
+	}
+	certificate, err := tls.LoadX509KeyPair(controller.GRPCCert, controller.GRPCKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(controller.GRPCClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found in GRPCClientCA")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+/*
+ StartGRPCServer serves the gRPC control plane
+ on GRPCHost until StopGRPCServer is called.
+*/
+func (controller *ProxyController) StartGRPCServer() error {
+	if controller.GRPCHost == "" {
+		return errors.New("no GRPCHost set")
+	}
+	config, err := controller.grpcTLSConfig()
+	if err != nil {
+		controller.Log.Println("unable to start the gRPC server:", err)
+		return err
+	}
+	listener, err := net.Listen("tcp", controller.GRPCHost)
+	if err != nil {
+		controller.Log.Println("unable to start the gRPC server:", err)
+		return err
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(config)))
+	controllerpb.RegisterProxyControllerServiceServer(server, &controllerGRPCServer{controller: controller})
+	controller.mutex.Lock()
+	controller.grpcServer = server
+	controller.mutex.Unlock()
+	controller.Log.Printf("Starting gRPC server: %v\n", controller.GRPCHost)
+	return server.Serve(listener)
+}
+
+func (controller *ProxyController) StopGRPCServer() {
+	controller.mutex.Lock()
+	server := controller.grpcServer
+	controller.grpcServer = nil
+	controller.mutex.Unlock()
+	if server != nil {
+		server.Stop()
+	}
+}
@@ -0,0 +1,278 @@
+package sshproxyplus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bja2142/sshproxyplus/controllerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+
+type testCertificate struct {
+	certificate	*x509.Certificate
+	key			*ecdsa.PrivateKey
+	der			[]byte
+}
+
+// makeTestCertificate signs a certificate for
+// name with parent, or self-signs a CA if parent
+// is nil
+func makeTestCertificate(t *testing.T, parent *testCertificate, usage x509.ExtKeyUsage, name string) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+	serialNumber, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{Organization: []string{"Acme Co"}, CommonName: name},
+		NotBefore: time.Now().Add(-time.Minute),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return &testCertificate{certificate: certificate, key: key, der: der}
+}
+
+func (cert *testCertificate) write(t *testing.T, name string) (string, string) {
+	certFile := filepath.Join(t.TempDir(), name+"-cert.pem")
+	keyFile := filepath.Join(t.TempDir(), name+"-key.pem")
+	keyBytes, _ := x509.MarshalPKCS8PrivateKey(cert.key)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600)
+	return certFile, keyFile
+}
+
+func dialTestGRPC(t *testing.T, host string, ca *testCertificate, client *testCertificate) (controllerpb.ProxyControllerServiceClient, func()) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	config := &tls.Config{RootCAs: pool}
+	if client != nil {
+		config.Certificates = []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, host, grpc.WithTransportCredentials(credentials.NewTLS(config)), grpc.WithBlock())
+	if err != nil {
+		return nil, func() {}
+	}
+	return controllerpb.NewProxyControllerServiceClient(conn), func() { conn.Close() }
+}
+
+func TestControllerGRPC(t *testing.T) {
+	ca := makeTestCertificate(t, nil, x509.ExtKeyUsageAny, "ca")
+	server := makeTestCertificate(t, ca, x509.ExtKeyUsageServerAuth, "server")
+	client := makeTestCertificate(t, ca, x509.ExtKeyUsageClientAuth, "admin")
+	caFile, _ := ca.write(t, "ca")
+
+	controller := makeNewController()
+	controller.GRPCHost = "127.0.0.1:"+newRandomPort().Text(10)
+	controller.GRPCCert, controller.GRPCKey = server.write(t, "server")
+	controller.GRPCClientCA = caFile
+	go controller.StartGRPCServer()
+	defer controller.Stop()
+	time.Sleep(500*time.Millisecond)
+
+	if stranger, closer := dialTestGRPC(t, controller.GRPCHost, ca, nil); stranger != nil {
+		defer closer()
+		if _, err := stranger.ListProxies(context.Background(), &emptypb.Empty{}); err == nil {
+			t.Errorf("StartGRPCServer() accepted a client without a certificate")
+		}
+	}
+	rpc, closer := dialTestGRPC(t, controller.GRPCHost, ca, client)
+	if rpc == nil {
+		t.Fatalf("StartGRPCServer() refused a client certificate signed by GRPCClientCA")
+	}
+	defer closer()
+	ctx := context.Background()
+
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	listenPort := int(newRandomPort().Int64())
+	created, err := rpc.CreateProxy(ctx, &controllerpb.CreateProxyRequest{
+		ProxyJson: []byte(`{"ListenIP": "127.0.0.1", "ListenPort": `+strconv.Itoa(listenPort)+`, "SessionFolder": "`+t.TempDir()+`"}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateProxy() = %v", err)
+	}
+	userKey, err := rpc.AddProxyUser(ctx, &controllerpb.AddProxyUserRequest{
+		ProxyId: created.ProxyId,
+		User: &controllerpb.ProxyUser{
+			Username: "user",
+			Password: "password",
+			RemoteHost: "127.0.0.1:"+dummyServer.port.Text(10),
+			RemoteUsername: "user",
+			RemotePassword: "password",
+		},
+	})
+	if err != nil || userKey.Key == "" {
+		t.Fatalf("AddProxyUser() = %v, %v", userKey, err)
+	}
+	viewer, err := rpc.NewProxyViewer(ctx, &controllerpb.NewProxyViewerRequest{
+		ProxyId: created.ProxyId,
+		Username: "user",
+		Password: "password",
+		Operator: "alice",
+	})
+	if err != nil || viewer.Secret == "" || viewer.Operator != "alice" || viewer.Username != "user" {
+		t.Errorf("NewProxyViewer() = %v, %v", viewer, err)
+	}
+	if _, err := rpc.GetProxyInfo(ctx, &controllerpb.ProxyID{ProxyId: created.ProxyId+1}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetProxyInfo() of a missing proxy = %v, expected NotFound", err)
+	}
+
+	if _, err := rpc.ActivateProxy(ctx, created); err != nil {
+		t.Fatalf("ActivateProxy() = %v", err)
+	}
+	if _, err := rpc.StartProxy(ctx, created); err != nil {
+		t.Fatalf("StartProxy() = %v", err)
+	}
+	time.Sleep(500*time.Millisecond)
+	shell, err := openTestShell(t, "127.0.0.1:"+strconv.Itoa(listenPort), "user", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer shell.close()
+	proxy, _ := controller.GetProxy(created.ProxyId)
+	var sessionKey string
+	for key := range proxy.sessions.snapshot() {
+		sessionKey = key
+	}
+
+	stream, err := rpc.WatchSession(ctx, &controllerpb.WatchSessionRequest{
+		ProxyId: created.ProxyId,
+		SessionKey: sessionKey,
+		Follow: true,
+	})
+	if err != nil {
+		t.Fatalf("WatchSession() = %v", err)
+	}
+	first, err := stream.Recv()
+	if err != nil || first.Type != EVENT_SESSION_START || first.Index != 0 {
+		t.Fatalf("WatchSession() first event = %v, %v, expected the session start", first, err)
+	}
+	io.WriteString(shell.stdin, "streamed")
+	found := false
+	for !found {
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("WatchSession() ended before the live input: %v", err)
+		}
+		found = event.Type == EVENT_MESSAGE && event.Direction == "outgoing" && string(event.Data) == "streamed"
+	}
+	shell.close()
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("WatchSession() did not end with the session: %v", err)
+		}
+	}
+}
+
+func TestControllerGRPCKeys(t *testing.T) {
+	ca := makeTestCertificate(t, nil, x509.ExtKeyUsageAny, "ca")
+	server := makeTestCertificate(t, ca, x509.ExtKeyUsageServerAuth, "server")
+	reader := makeTestCertificate(t, ca, x509.ExtKeyUsageClientAuth, "reader")
+	lister := makeTestCertificate(t, ca, x509.ExtKeyUsageClientAuth, "lister")
+	caFile, _ := ca.write(t, "ca")
+
+	controller := makeNewController()
+	controller.GRPCHost = "127.0.0.1:"+newRandomPort().Text(10)
+	controller.GRPCCert, controller.GRPCKey = server.write(t, "server")
+	controller.GRPCClientCA = caFile
+	controller.CreateControllerKey(&ControllerKey{Name: "reader", Role: CONTROLLER_ROLE_READ_ONLY})
+	controller.CreateControllerKey(&ControllerKey{Name: "lister", AllowedMessages: []string{CONTROLLER_MESSAGE_LIST_PROXIES}})
+	proxyID := controller.CreateProxy()
+	controller.AddUserToProxy(proxyID, &ProxyUser{Username: "user", Password: "pass", RemoteHost: "127.0.0.1:22"})
+	controller.CreateUserSessionViewer(proxyID, "user", "pass")
+	go controller.StartGRPCServer()
+	defer controller.Stop()
+	time.Sleep(500*time.Millisecond)
+
+	rpc, closer := dialTestGRPC(t, controller.GRPCHost, ca, reader)
+	if rpc == nil {
+		t.Fatalf("StartGRPCServer() refused a client certificate signed by GRPCClientCA")
+	}
+	defer closer()
+	ctx := context.Background()
+	if _, err := rpc.ListProxies(ctx, &emptypb.Empty{}); err != nil {
+		t.Errorf("ListProxies() as a read-only key = %v", err)
+	}
+	if _, err := rpc.DestroyProxy(ctx, &controllerpb.ProxyID{ProxyId: proxyID}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("DestroyProxy() as a read-only key = %v, expected PermissionDenied", err)
+	}
+	viewers, err := rpc.GetProxyViewers(ctx, &controllerpb.GetProxyViewersRequest{ProxyId: proxyID})
+	if err != nil || len(viewers.Viewers) != 1 || viewers.Viewers[0].Secret != AUDIT_REDACTED {
+		t.Errorf("GetProxyViewers() as a read-only key = %v, %v, expected the secret redacted", viewers, err)
+	}
+
+	limited, limited_closer := dialTestGRPC(t, controller.GRPCHost, ca, lister)
+	if limited == nil {
+		t.Fatalf("StartGRPCServer() refused a client certificate signed by GRPCClientCA")
+	}
+	defer limited_closer()
+	stream, err := limited.WatchSession(ctx, &controllerpb.WatchSessionRequest{ProxyId: proxyID, SessionKey: "missing"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("WatchSession() by a key that may only list proxies = %v, expected PermissionDenied", err)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	expected_codes := map[error]codes.Code{
+		newKindError(ErrNotFound, "could not find proxy"): codes.NotFound,
+		newKindError(ErrPermissionDenied, "key may not send messages"): codes.PermissionDenied,
+		newKindError(ErrConflict, "session is not active"): codes.FailedPrecondition,
+		newKindError(ErrUnsupported, "unsupported message type"): codes.Unimplemented,
+		errors.New("Missing Username"): codes.InvalidArgument,
+	}
+	for err, expected := range expected_codes {
+		if code := status.Code(grpcStatus(err)); code != expected {
+			t.Errorf("grpcStatus(%q) = %v, expected %v", err, code, expected)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package sshproxyplus
+
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const CONTROLLER_ROLE_READ_ONLY			string = "read-only"
+const CONTROLLER_ROLE_VIEWER_MANAGER	string = "viewer-manager"
+const CONTROLLER_ROLE_USER_ADMIN		string = "user-admin"
+const CONTROLLER_ROLE_FULL_ADMIN		string = "full-admin"
+
+var controllerReadOnlyMessages = []string{
+	CONTROLLER_MESSAGE_LIST_PROXIES,
+	CONTROLLER_MESSAGE_GET_PROXY_INFO,
+	CONTROLLER_MESSAGE_GET_PROXY_VIEWER,
+	CONTROLLER_MESSAGE_GET_PROXY_VIEWERS,
+	CONTROLLER_MESSAGE_SEARCH_SESSIONS,
+	CONTROLLER_MESSAGE_WATCH_SESSION,
+	CONTROLLER_MESSAGE_LIST_PENDING_SESSIONS,
+	CONTROLLER_MESSAGE_LIST_CHANNEL_FILTERS,
+	CONTROLLER_MESSAGE_LIST_USER_CALLBACKS,
+}
+
+var controllerViewerManagerMessages = append([]string{
+	CONTROLLER_MESSAGE_NEW_PROXY_VIEWER,
+	CONTROLLER_MESSAGE_SET_VIEWER_OPERATOR,
+	CONTROLLER_MESSAGE_APPROVE_SESSION,
+	CONTROLLER_MESSAGE_DENY_SESSION,
+}, controllerReadOnlyMessages...)
+
+var controllerUserAdminMessages = append([]string{
+	CONTROLLER_MESSAGE_ADD_PROXY_USER,
+	CONTROLLER_MESSAGE_REMOVE_PROXY_USER,
+	CONTROLLER_MESSAGE_UPDATE_PROXY_USER,
+	CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER,
+	CONTROLLER_MESSAGE_REMOVE_CHANNEL_FILTER,
+	CONTROLLER_MESSAGE_ADD_USER_CALLBACK,
+	CONTROLLER_MESSAGE_REMOVE_USER_CALLBACK,
+	CONTROLLER_MESSAGE_KILL_SESSION,
+}, controllerViewerManagerMessages...)
+
+// the message types each role may send; a
+// full-admin may send every type
+var controllerRoleMessages = map[string][]string{
+	CONTROLLER_ROLE_READ_ONLY: controllerReadOnlyMessages,
+	CONTROLLER_ROLE_VIEWER_MANAGER: controllerViewerManagerMessages,
+	CONTROLLER_ROLE_USER_ADMIN: controllerUserAdminMessages,
+	CONTROLLER_ROLE_FULL_ADMIN: controllerMessageTypes,
+}
+
+// message types that do not act on a single
+// proxy, so keys limited to some proxies can't
+// send them
+var controllerGlobalMessages = map[string]bool{
+	CONTROLLER_MESSAGE_CREATE_PROXY: true,
+	CONTROLLER_MESSAGE_LIST_PROXIES: true,
+	CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY: true,
+	CONTROLLER_MESSAGE_ROTATE_CONTROLLER_KEY: true,
+	CONTROLLER_MESSAGE_REVOKE_CONTROLLER_KEY: true,
+	CONTROLLER_MESSAGE_LIST_CONTROLLER_KEYS: true,
+	CONTROLLER_MESSAGE_QUERY_AUDIT_LOG: true,
+	CONTROLLER_MESSAGE_RELOAD_CONFIG: true,
+}
+
+/*
+ A ControllerKey is a named secret that signs
+ controller messages in place of PresharedKey.
+ What it may do is set by a Role or by an
+ explicit list of AllowedMessages; a non-empty
+ AllowedProxies also limits it to those proxies.
+*/
+type ControllerKey struct {
+	Name			string
+	Key				string `json:",omitempty"`
+	Role			string `json:",omitempty"`
+	AllowedMessages	[]string `json:",omitempty"`
+	AllowedProxies	[]uint64 `json:",omitempty"`
+	// unix time the key was created and last
+	// rotated
+	Created			int64 `json:",omitempty"`
+	Rotated			int64 `json:",omitempty"`
+}
+
+func (key *ControllerKey) clone() *ControllerKey {
+	copied := *key
+	copied.AllowedMessages = append([]string(nil), key.AllowedMessages...)
+	copied.AllowedProxies = append([]uint64(nil), key.AllowedProxies...)
+	return &copied
+}
+
+func (key *ControllerKey) validate() error {
+	if key.Name == "" {
+		return errors.New("a controller key needs a Name")
+	}
+	if (key.Role == "") == (len(key.AllowedMessages) == 0) {
+		return errors.New("a controller key needs either a Role or AllowedMessages")
+	}
+	if key.Role != "" {
+		if _, ok := controllerRoleMessages[key.Role]; !ok {
+			return fmt.Errorf("unknown role %v", key.Role)
+		}
+	}
+	for _, messageType := range key.AllowedMessages {
+		if !containsString(controllerMessageTypes, messageType) {
+			return fmt.Errorf("unknown message type %v", messageType)
+		}
+	}
+	return nil
+}
+
+// messages lists the message types the key may
+// send
+func (key *ControllerKey) messages() []string {
+	if len(key.AllowedMessages) > 0 {
+		return key.AllowedMessages
+	}
+	return controllerRoleMessages[key.Role]
+}
+
+/*
+ allows reports why the key may not send the
+ message, or nil if it may. A nil key stands for
+ PresharedKey, APIToken and the like, which may
+ send anything.
+*/
+func (key *ControllerKey) allows(message *ControllerMessage) error {
+	if key == nil {
+		return nil
+	}
+	if !containsString(key.messages(), message.MessageType) {
+		return newKindError(ErrPermissionDenied, "key %v may not send %v messages", key.Name, message.MessageType)
+	}
+	if message.MessageType == CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY && message.ControllerKey != nil {
+		if err := key.covers(message.ControllerKey); err != nil {
+			return err
+		}
+	}
+	if len(key.AllowedProxies) == 0 {
+		return nil
+	}
+	if !controllerGlobalMessages[message.MessageType] {
+		for _, proxyID := range key.AllowedProxies {
+			if proxyID == message.ProxyID {
+				return nil
+			}
+		}
+	}
+	return newKindError(ErrPermissionDenied, "key %v may not act on proxy %v", key.Name, message.ProxyID)
+}
+
+/*
+ covers reports why the key may not create
+ other, or nil if it may. A key can only hand
+ out what it has: the new key's message types
+ and proxies must be among its own.
+*/
+func (key *ControllerKey) covers(other *ControllerKey) error {
+	messages := key.messages()
+	for _, messageType := range other.messages() {
+		if !containsString(messages, messageType) {
+			return newKindError(ErrPermissionDenied, "key %v may not create a key that sends %v messages", key.Name, messageType)
+		}
+	}
+	if len(key.AllowedProxies) == 0 {
+		return nil
+	}
+	if len(other.AllowedProxies) == 0 {
+		return newKindError(ErrPermissionDenied, "key %v may not create a key for every proxy", key.Name)
+	}
+	for _, proxyID := range other.AllowedProxies {
+		allowed := false
+		for _, ownID := range key.AllowedProxies {
+			allowed = allowed || ownID == proxyID
+		}
+		if !allowed {
+			return newKindError(ErrPermissionDenied, "key %v may not create a key for proxy %v", key.Name, proxyID)
+		}
+	}
+	return nil
+}
+
+/*
+ seesSecrets reports whether replies to the key
+ may hold secrets, like viewer secrets and user
+ passwords. Only keys that can create viewers
+ get them; an operator's viewer secret would let
+ a read-only key take over sessions.
+*/
+func (key *ControllerKey) seesSecrets() bool {
+	return key == nil || containsString(key.messages(), CONTROLLER_MESSAGE_NEW_PROXY_VIEWER)
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ signingKey returns the secret for the key
+ named in a message envelope, and the key
+ itself. Messages without a name are signed
+ with PresharedKey and may do anything.
+*/
+func (controller *ProxyController) signingKey(name string) (error, []byte, *ControllerKey) {
+	if name == "" {
+		if controller.PresharedKey == "" {
+			return errors.New("no PresharedKey set; sign messages with a named key"), nil, nil
+		}
+		return nil, []byte(controller.PresharedKey), nil
+	}
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	key, ok := controller.Keys[name]
+	if !ok {
+		return fmt.Errorf("unknown controller key %v", name), nil, nil
+	}
+	return nil, []byte(key.Key), key.clone()
+}
+
+// namedKey returns the key with the given name,
+// or nil
+func (controller *ProxyController) namedKey(name string) *ControllerKey {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if key, ok := controller.Keys[name]; ok {
+		return key.clone()
+	}
+	return nil
+}
+
+// keyBySecret returns the key whose secret is
+// secret, or nil
+func (controller *ProxyController) keyBySecret(secret string) *ControllerKey {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	var found *ControllerKey
+	for _, key := range controller.Keys {
+		if key.Key != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(key.Key)) == 1 {
+			found = key.clone()
+		}
+	}
+	return found
+}
+
+/*
+ CreateControllerKey adds a named key and
+ returns it with its generated secret, which is
+ not shown again.
+*/
+func (controller *ProxyController) CreateControllerKey(key *ControllerKey) (error, *ControllerKey) {
+	if key == nil {
+		return errors.New("No ControllerKey provided"), nil
+	}
+	created := key.clone()
+	if err := created.validate(); err != nil {
+		return err, nil
+	}
+	secret, err := generateRandomString(32)
+	if err != nil {
+		return err, nil
+	}
+	created.Key = secret
+	created.Created = time.Now().Unix()
+	created.Rotated = 0
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if controller.Keys == nil {
+		controller.Keys = make(map[string]*ControllerKey)
+	}
+	if _, ok := controller.Keys[created.Name]; ok {
+		return newKindError(ErrConflict, "controller key %v already exists", created.Name), nil
+	}
+	controller.Keys[created.Name] = created
+	return nil, created.clone()
+}
+
+// RotateControllerKey gives a key a new secret;
+// messages signed with the old one are refused
+func (controller *ProxyController) RotateControllerKey(name string) (error, *ControllerKey) {
+	secret, err := generateRandomString(32)
+	if err != nil {
+		return err, nil
+	}
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	key, ok := controller.Keys[name]
+	if !ok {
+		return newKindError(ErrNotFound, "could not find controller key %v", name), nil
+	}
+	key.Key = secret
+	key.Rotated = time.Now().Unix()
+	return nil, key.clone()
+}
+
+func (controller *ProxyController) RevokeControllerKey(name string) error {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if _, ok := controller.Keys[name]; !ok {
+		return newKindError(ErrNotFound, "could not find controller key %v", name)
+	}
+	delete(controller.Keys, name)
+	return nil
+}
+
+// ListControllerKeys returns the keys without
+// their secrets
+func (controller *ProxyController) ListControllerKeys() []*ControllerKey {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	keys := make([]*ControllerKey, 0, len(controller.Keys))
+	for _, key := range controller.Keys {
+		listed := key.clone()
+		listed.Key = ""
+		keys = append(keys, listed)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
+}
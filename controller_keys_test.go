@@ -0,0 +1,150 @@
+package sshproxyplus
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+
+// replyField decodes a JSON field of a reply
+// that simulateMessage returned
+func replyField(reply map[string]interface{}, field string, value interface{}) {
+	encoded, _ := reply[field].(string)
+	data, _ := base64.StdEncoding.DecodeString(encoded)
+	json.Unmarshal(data, value)
+}
+
+func signedBy(controller *ProxyController, key *ControllerKey, message *ControllerMessage) error {
+	_, wrapper := message.SignAs(key.Name, []byte(key.Key))
+	err, verified, signer := controller.verifyMessage(&wrapper)
+	if err == nil {
+		err = signer.allows(&verified)
+	}
+	return err
+}
+
+func TestControllerKeys(t *testing.T) {
+	controller := makeNewController()
+
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY,
+		ControllerKey: &ControllerKey{Name: "reader", Role: CONTROLLER_ROLE_READ_ONLY},
+	}, controller, t)
+	reader := &ControllerKey{}
+	replyField(reply, "ControllerKey", reader)
+	if reader.Key == "" || reader.Created == 0 {
+		t.Fatalf("create-controller-key did not return a new secret: %+v", reader)
+	}
+	if err, _ := controller.CreateControllerKey(&ControllerKey{Name: "reader", Role: CONTROLLER_ROLE_FULL_ADMIN}); err == nil {
+		t.Errorf("CreateControllerKey() replaced an existing key")
+	}
+	for _, invalid := range []*ControllerKey{
+		{Name: "none"},
+		{Name: "both", Role: CONTROLLER_ROLE_READ_ONLY, AllowedMessages: []string{CONTROLLER_MESSAGE_LIST_PROXIES}},
+		{Name: "role", Role: "root"},
+		{Name: "message", AllowedMessages: []string{"format-disk"}},
+	} {
+		if err, _ := controller.CreateControllerKey(invalid); err == nil {
+			t.Errorf("CreateControllerKey(%+v) accepted an invalid key", invalid)
+		}
+	}
+
+	if err := signedBy(controller, reader, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_PROXIES}); err != nil {
+		t.Errorf("verifyMessage() refused a read-only key a list: %v", err)
+	}
+	if err := signedBy(controller, reader, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_DESTROY_PROXY}); err == nil {
+		t.Errorf("verifyMessage() let a read-only key destroy a proxy")
+	}
+	if err := signedBy(controller, reader, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY}); err == nil {
+		t.Errorf("verifyMessage() let a read-only key create keys")
+	}
+
+	err, scoped := controller.CreateControllerKey(&ControllerKey{
+		Name: "scoped",
+		AllowedMessages: []string{CONTROLLER_MESSAGE_KILL_SESSION, CONTROLLER_MESSAGE_LIST_PROXIES},
+		AllowedProxies: []uint64{4},
+	})
+	if err != nil {
+		t.Fatalf("CreateControllerKey() = %v", err)
+	}
+	if err := signedBy(controller, scoped, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_KILL_SESSION, ProxyID: 4}); err != nil {
+		t.Errorf("verifyMessage() refused an allowed message on an allowed proxy: %v", err)
+	}
+	if err := signedBy(controller, scoped, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_KILL_SESSION, ProxyID: 5}); err == nil {
+		t.Errorf("verifyMessage() let a key act on a proxy it is not allowed")
+	}
+	if err := signedBy(controller, scoped, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_PROXIES}); err == nil {
+		t.Errorf("verifyMessage() let a proxy-limited key list every proxy")
+	}
+	if err := signedBy(controller, scoped, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_STOP_PROXY, ProxyID: 4}); err == nil {
+		t.Errorf("verifyMessage() let a key send a message it is not allowed")
+	}
+
+	old := reader.clone()
+	reply = simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_ROTATE_CONTROLLER_KEY, KeyName: "reader"}, controller, t)
+	replyField(reply, "ControllerKey", reader)
+	if reader.Key == old.Key || reader.Rotated == 0 {
+		t.Errorf("rotate-controller-key did not change the secret")
+	}
+	if err := signedBy(controller, old, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_PROXIES}); err == nil {
+		t.Errorf("verifyMessage() accepted the secret a key had before rotation")
+	}
+	if err := signedBy(controller, reader, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_PROXIES}); err != nil {
+		t.Errorf("verifyMessage() refused a rotated key: %v", err)
+	}
+
+	reply = simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_CONTROLLER_KEYS}, controller, t)
+	listed := make([]*ControllerKey, 0)
+	replyField(reply, "ControllerKeys", &listed)
+	if len(listed) != 2 || listed[0].Name != "reader" || listed[0].Key != "" {
+		t.Errorf("list-controller-keys = %+v, expected both keys without secrets", listed)
+	}
+
+	simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_REVOKE_CONTROLLER_KEY, KeyName: "reader"}, controller, t)
+	if err := signedBy(controller, reader, &ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_PROXIES}); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("verifyMessage() of a revoked key = %v, expected an unknown key error", err)
+	}
+	if err := controller.RevokeControllerKey("reader"); err == nil {
+		t.Errorf("RevokeControllerKey() of a missing key did not fail")
+	}
+}
+
+func TestControllerKeyCannotCreateBroaderKey(t *testing.T) {
+	controller := makeNewController()
+	_, creator := controller.CreateControllerKey(&ControllerKey{
+		Name: "creator",
+		AllowedMessages: []string{CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY, CONTROLLER_MESSAGE_LIST_PROXIES},
+	})
+	for _, broader := range []*ControllerKey{
+		{Name: "admin", Role: CONTROLLER_ROLE_FULL_ADMIN},
+		{Name: "destroyer", AllowedMessages: []string{CONTROLLER_MESSAGE_DESTROY_PROXY}},
+	} {
+		message := &ControllerMessage{MessageType: CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY, ControllerKey: broader}
+		if err := signedBy(controller, creator, message); !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("verifyMessage() of a key creating %+v = %v, expected permission denied", broader, err)
+		}
+	}
+	narrower := &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY,
+		ControllerKey: &ControllerKey{Name: "lister", AllowedMessages: []string{CONTROLLER_MESSAGE_LIST_PROXIES}},
+	}
+	if err := signedBy(controller, creator, narrower); err != nil {
+		t.Errorf("verifyMessage() refused a key creating a narrower key: %v", err)
+	}
+
+	scoped := &ControllerKey{Name: "scoped", Role: CONTROLLER_ROLE_READ_ONLY, AllowedProxies: []uint64{4}}
+	for _, other := range []*ControllerKey{
+		{Name: "everywhere", AllowedMessages: []string{CONTROLLER_MESSAGE_LIST_PROXIES}},
+		{Name: "elsewhere", AllowedMessages: []string{CONTROLLER_MESSAGE_LIST_PROXIES}, AllowedProxies: []uint64{4, 5}},
+	} {
+		if err := scoped.covers(other); !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("covers(%+v) for a key limited to proxy 4 = %v, expected permission denied", other, err)
+		}
+	}
+	if err := scoped.covers(&ControllerKey{Name: "same", Role: CONTROLLER_ROLE_READ_ONLY, AllowedProxies: []uint64{4}}); err != nil {
+		t.Errorf("covers() of a key with the same scope = %v", err)
+	}
+}
@@ -7,40 +7,76 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"bytes"
-	"net/http"
+	"time"
 )
 
 
 /*
  A signed message for the controller.
  The Message is a JSON blob
- The HMAC is a signed hash of the Message
+ The HMAC is a signed hash of the Version,
+ Timestamp, Nonce and Message, so none of
+ them can be changed to replay a message.
 */
 type ControllerHMAC struct {
-	Message []byte
-	HMAC	[]byte
+	Version		int `json:",omitempty"`
+	// the ControllerKey that signed the message;
+	// empty for PresharedKey
+	KeyName		string `json:",omitempty"`
+	// unix time in nanoseconds
+	Timestamp	int64 `json:",omitempty"`
+	Nonce		string `json:",omitempty"`
+	Message		[]byte
+	HMAC		[]byte
 }
 
 /*
  A message for the controller.
  If a field isn't used for a particular 
  message type, it is omitted. 
+
+ The tags were once written json:"omitempty",
+ which names every such field "omitempty"; the
+ names clashed, so encoding/json dropped all of
+ them and only MessageType and ProxyData got
+ through. With json:",omitempty" each field is
+ sent under its Go name. Messages from older
+ senders, which never carried those fields,
+ decode just as before.
 */
 type ControllerMessage struct {
 	MessageType		string
 	ProxyData 		[]byte `json:"ProxyData,omitempty"`
-	ProxyID			uint64 `json:"omitempty"`
-	ViewerSecret	string `json:"omitempty"`
-	SessionKey		string `json:"omitempty"`
-	Username    	string `json:"omitempty"`
-	Password    	string `json:"omitempty"`
-	FilterKey    	string `json:"omitempty"`
-	CallbackKey    	string `json:"omitempty"`
-	CallbackURL    	string `json:"omitempty"`
-	ProxyUser		*ProxyUser `json:"omitempty"`
-	FindString		[]byte `json:"omitempty"`
-	ReplaceString	[]byte `json:"omitempty"`
+	ProxyID			uint64 `json:",omitempty"`
+	ViewerSecret	string `json:",omitempty"`
+	SessionKey		string `json:",omitempty"`
+	Username    	string `json:",omitempty"`
+	Password    	string `json:",omitempty"`
+	FilterKey    	string `json:",omitempty"`
+	CallbackKey    	string `json:",omitempty"`
+	CallbackURL    	string `json:",omitempty"`
+	ProxyUser		*ProxyUser `json:",omitempty"`
+	FindString		[]byte `json:",omitempty"`
+	ReplaceString	[]byte `json:",omitempty"`
+	// used by add-channel-filter and
+	// add-user-callback instead of FindString,
+	// ReplaceString and CallbackURL when set
+	ChannelFilter	*ChannelFilterSpec `json:",omitempty"`
+	EventCallback	*EventCallbackSpec `json:",omitempty"`
+	Redaction		*RedactionConfig `json:",omitempty"`
+	Retention		*RetentionPolicy `json:",omitempty"`
+	DryRun			bool `json:",omitempty"`
+	Search			*SessionSearchQuery `json:",omitempty"`
+	TerminatedBy	string `json:",omitempty"`
+	Reason			string `json:",omitempty"`
+	Notice			string `json:",omitempty"`
+	Operator		string `json:",omitempty"`
+	KeyName			string `json:",omitempty"`
+	ControllerKey	*ControllerKey `json:",omitempty"`
+	Audit			*AuditQuery `json:",omitempty"`
+	// the ProxyUser fields update-proxy-user
+	// changes, as a JSON object
+	UserData		[]byte `json:",omitempty"`
 }
 
 const CONTROLLER_MESSAGE_CREATE_PROXY			string = "create-proxy"
@@ -60,16 +96,93 @@ const CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER		string = "add-channel-filter"
 const CONTROLLER_MESSAGE_REMOVE_CHANNEL_FILTER 	string = "remove-channel-filter"
 const CONTROLLER_MESSAGE_ADD_USER_CALLBACK		string = "add-user-callback"
 const CONTROLLER_MESSAGE_REMOVE_USER_CALLBACK	string = "remove-user-callback"
+const CONTROLLER_MESSAGE_LIST_CHANNEL_FILTERS	string = "list-channel-filters"
+const CONTROLLER_MESSAGE_LIST_USER_CALLBACKS	string = "list-user-callbacks"
+const CONTROLLER_MESSAGE_SET_PROXY_REDACTION	string = "set-proxy-redaction"
+const CONTROLLER_MESSAGE_SET_PROXY_RETENTION	string = "set-proxy-retention"
+const CONTROLLER_MESSAGE_APPLY_PROXY_RETENTION	string = "apply-proxy-retention"
+const CONTROLLER_MESSAGE_SEARCH_SESSIONS		string = "search-sessions"
+const CONTROLLER_MESSAGE_KILL_SESSION			string = "kill-session"
+const CONTROLLER_MESSAGE_SET_VIEWER_OPERATOR	string = "set-viewer-operator"
+const CONTROLLER_MESSAGE_APPROVE_SESSION		string = "approve-session"
+const CONTROLLER_MESSAGE_DENY_SESSION			string = "deny-session"
+const CONTROLLER_MESSAGE_LIST_PENDING_SESSIONS	string = "list-pending-sessions"
+const CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY	string = "create-controller-key"
+const CONTROLLER_MESSAGE_ROTATE_CONTROLLER_KEY	string = "rotate-controller-key"
+const CONTROLLER_MESSAGE_REVOKE_CONTROLLER_KEY	string = "revoke-controller-key"
+const CONTROLLER_MESSAGE_LIST_CONTROLLER_KEYS	string = "list-controller-keys"
+const CONTROLLER_MESSAGE_QUERY_AUDIT_LOG		string = "query-audit-log"
+const CONTROLLER_MESSAGE_RELOAD_CONFIG			string = "reload-config"
+const CONTROLLER_MESSAGE_UPDATE_PROXY			string = "update-proxy"
+const CONTROLLER_MESSAGE_UPDATE_PROXY_USER		string = "update-proxy-user"
+const CONTROLLER_MESSAGE_WATCH_SESSION			string = "watch-session"
+
+var controllerMessageTypes = []string{
+	CONTROLLER_MESSAGE_CREATE_PROXY,
+	CONTROLLER_MESSAGE_START_PROXY,
+	CONTROLLER_MESSAGE_STOP_PROXY,
+	CONTROLLER_MESSAGE_DESTROY_PROXY,
+	CONTROLLER_MESSAGE_ACTIVATE_PROXY,
+	CONTROLLER_MESSAGE_DEACTIVATE_PROXY,
+	CONTROLLER_MESSAGE_LIST_PROXIES,
+	CONTROLLER_MESSAGE_GET_PROXY_INFO,
+	CONTROLLER_MESSAGE_GET_PROXY_VIEWER,
+	CONTROLLER_MESSAGE_GET_PROXY_VIEWERS,
+	CONTROLLER_MESSAGE_NEW_PROXY_VIEWER,
+	CONTROLLER_MESSAGE_ADD_PROXY_USER,
+	CONTROLLER_MESSAGE_REMOVE_PROXY_USER,
+	CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER,
+	CONTROLLER_MESSAGE_REMOVE_CHANNEL_FILTER,
+	CONTROLLER_MESSAGE_ADD_USER_CALLBACK,
+	CONTROLLER_MESSAGE_REMOVE_USER_CALLBACK,
+	CONTROLLER_MESSAGE_LIST_CHANNEL_FILTERS,
+	CONTROLLER_MESSAGE_LIST_USER_CALLBACKS,
+	CONTROLLER_MESSAGE_SET_PROXY_REDACTION,
+	CONTROLLER_MESSAGE_SET_PROXY_RETENTION,
+	CONTROLLER_MESSAGE_APPLY_PROXY_RETENTION,
+	CONTROLLER_MESSAGE_SEARCH_SESSIONS,
+	CONTROLLER_MESSAGE_KILL_SESSION,
+	CONTROLLER_MESSAGE_SET_VIEWER_OPERATOR,
+	CONTROLLER_MESSAGE_APPROVE_SESSION,
+	CONTROLLER_MESSAGE_DENY_SESSION,
+	CONTROLLER_MESSAGE_LIST_PENDING_SESSIONS,
+	CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY,
+	CONTROLLER_MESSAGE_ROTATE_CONTROLLER_KEY,
+	CONTROLLER_MESSAGE_REVOKE_CONTROLLER_KEY,
+	CONTROLLER_MESSAGE_LIST_CONTROLLER_KEYS,
+	CONTROLLER_MESSAGE_QUERY_AUDIT_LOG,
+	CONTROLLER_MESSAGE_RELOAD_CONFIG,
+	CONTROLLER_MESSAGE_UPDATE_PROXY,
+	CONTROLLER_MESSAGE_UPDATE_PROXY_USER,
+	CONTROLLER_MESSAGE_WATCH_SESSION,
+}
+
 
 
+// who is recorded as acting when a message
+// does not name an operator
+const CONTROLLER_OPERATOR	string = "controller"
+
+func messageOperator(message *ControllerMessage) string {
+	if message.Operator != "" {
+		return message.Operator
+	}
+	return CONTROLLER_OPERATOR
+}
+
+func (messageWrapper *ControllerHMAC) mac(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d\n%d\n%s\n", messageWrapper.Version, messageWrapper.Timestamp, messageWrapper.Nonce)
+	mac.Write(messageWrapper.Message)
+	return mac.Sum(nil)
+}
 
 func (messageWrapper *ControllerHMAC) Verify(key []byte) (error,ControllerMessage) {
 	var err error = nil
-	mac := hmac.New(sha256.New, key)
 	out_message := ControllerMessage{}
-	mac.Write(messageWrapper.Message)
-	expectedMAC := mac.Sum(nil)
-	if (hmac.Equal(messageWrapper.HMAC, expectedMAC)) {
+	if messageWrapper.Version != CONTROLLER_HMAC_VERSION {
+		err = fmt.Errorf("unsupported message version %v; messages must be signed as version %v with a Timestamp and Nonce", messageWrapper.Version, CONTROLLER_HMAC_VERSION)
+	} else if (hmac.Equal(messageWrapper.HMAC, messageWrapper.mac(key))) {
 		err = json.Unmarshal(messageWrapper.Message, &out_message)
 	} else {
 		err = errors.New("hmac does not match")
@@ -78,23 +191,70 @@ func (messageWrapper *ControllerHMAC) Verify(key []byte) (error,ControllerMessag
 }
 
 func (message *ControllerMessage) Sign(key []byte) (error,ControllerHMAC) {
+	return message.SignAs("", key)
+}
+
+// SignAs signs the message with the secret of
+// the named ControllerKey
+func (message *ControllerMessage) SignAs(keyName string, key []byte) (error,ControllerHMAC) {
 	var err error = nil
-	mac := hmac.New(sha256.New, key)
-	messageWrapper := ControllerHMAC{}
+	messageWrapper := ControllerHMAC{
+		Version: CONTROLLER_HMAC_VERSION,
+		KeyName: keyName,
+		Timestamp: time.Now().UnixNano(),
+	}
 	messageData, err := json.Marshal(message)
 	if (err == nil) {
-		mac.Write(messageData)
+		messageWrapper.Nonce, err = generateRandomString(16)
+	}
+	if (err == nil) {
 		messageWrapper.Message = messageData
-		messageWrapper.HMAC = mac.Sum(nil)
+		messageWrapper.HMAC = messageWrapper.mac(key)
 	}
 	return err, messageWrapper
 }
 
 
 func (message *ControllerMessage) HandleMessage(controller *ProxyController) []byte {
-	reply:= make(map[string]interface{})
+	return message.HandleMessageAs(controller, AUDIT_IDENTITY_LOCAL, "")
+}
+
+/*
+ HandleMessageAs handles the message and records
+ identity and source as its sender in the audit
+ log.
+*/
+func (message *ControllerMessage) HandleMessageAs(controller *ProxyController, identity string, source string) []byte {
+	return message.handleMessageAs(controller, nil, identity, source)
+}
+
+// handleMessageAs limits the message to what key
+// may do; a nil key may do anything
+func (message *ControllerMessage) handleMessageAs(controller *ProxyController, key *ControllerKey, identity string, source string) []byte {
+	reply, err := controller.dispatch(message, key, identity, source)
 
 	reply["MessageType"] = message.MessageType + "-reply"
+	if err != nil {
+		reply["Error"] = fmt.Sprintf("%s", err)
+	}
+	
+	replyData, err := json.Marshal(reply)
+	if (err == nil)	{
+		return replyData
+	} else {
+		return []byte("")
+	}
+	
+}
+
+/*
+ handle carries out the message and returns the
+ fields of the reply. Structured results are
+ JSON encoded into []byte fields.
+*/
+func (message *ControllerMessage) handle(controller *ProxyController) (map[string]interface{}, error) {
+	reply:= make(map[string]interface{})
+
 	var err error
 	switch message.MessageType {
 	case CONTROLLER_MESSAGE_CREATE_PROXY:
@@ -119,7 +279,9 @@ func (message *ControllerMessage) HandleMessage(controller *ProxyController) []b
 		err = controller.DeactivateProxy(message.ProxyID)
 	case CONTROLLER_MESSAGE_LIST_PROXIES:
 		var data []byte
+		controller.mutex.Lock()
 		data,err =json.Marshal(controller.Proxies)
+		controller.mutex.Unlock()
 		if (err == nil)	{
 			reply["Proxies"] = data
 		}
@@ -175,6 +337,9 @@ func (message *ControllerMessage) HandleMessage(controller *ProxyController) []b
 			} else {
 				err, viewer = controller.CreateUserSessionViewer(message.ProxyID, message.Username, message.Password)	
 			}
+			if err == nil && viewer != nil && message.Operator != "" {
+				err = controller.SetViewerOperator(message.ProxyID, viewer.Secret, message.Operator)
+			}
 			if err == nil {
 				var data []byte
 				data, err := json.Marshal(viewer)
@@ -199,13 +364,45 @@ func (message *ControllerMessage) HandleMessage(controller *ProxyController) []b
 		if message.Username != "" {
 			err = controller.RemoveUserFromProxy(message.ProxyID, message.Username, message.Password)
 		}
+	case CONTROLLER_MESSAGE_UPDATE_PROXY:
+		if message.ProxyData != nil {
+			var update *SettingsUpdate
+			err, update = controller.UpdateProxy(message.ProxyID, message.ProxyData, message.DryRun)
+			if err == nil {
+				var data []byte
+				data, err = json.Marshal(update)
+				if err == nil {
+					reply["Update"] = data
+				}
+			}
+		} else {
+			err = errors.New("No ProxyData provided")
+		}
+	case CONTROLLER_MESSAGE_UPDATE_PROXY_USER:
+		if message.Username != "" && message.UserData != nil {
+			var update *SettingsUpdate
+			err, update = controller.UpdateProxyUser(message.ProxyID, message.Username, message.Password, message.UserData, message.DryRun)
+			if err == nil {
+				var data []byte
+				data, err = json.Marshal(update)
+				if err == nil {
+					reply["Update"] = data
+				}
+			}
+		} else {
+			err = errors.New("Missing Username or UserData")
+		}
 	case CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER:
-		if message.FindString != nil && message.ReplaceString != nil && message.Username != "" {
+		spec := message.ChannelFilter
+		if spec == nil && message.FindString != nil && message.ReplaceString != nil {
+			spec = &ChannelFilterSpec{
+				Type: CHANNEL_FILTER_REPLACE,
+				Parameters: map[string]string{"find": string(message.FindString), "replace": string(message.ReplaceString)},
+			}
+		}
+		if spec != nil && message.Username != "" {
 			var key string
-			err, key = controller.AddChannelFilterToUser(message.ProxyID, message.Username, message.Password, &ChannelFilterFunc{fn: 
-				func(in_data []byte, wrapper *channelWrapper) []byte {
-					return bytes.Replace(in_data,message.FindString, message.ReplaceString,-1)
-				}})
+			err, key = controller.AddChannelFilterSpecToUser(message.ProxyID, message.Username, message.Password, spec)
 			reply["FilterKey"] = key
 		} else {
 			err = errors.New("Missing Username, FindString or ReplaceString")
@@ -218,23 +415,16 @@ func (message *ControllerMessage) HandleMessage(controller *ProxyController) []b
 		}
 	case CONTROLLER_MESSAGE_ADD_USER_CALLBACK:
 		var key string
-		if message.FindString != nil && message.CallbackURL != "" && message.Username != "" {
-			callback := &EventCallback{
-				events: map[string]bool{EVENT_MESSAGE: true},
-				handler: func(event SessionEvent) {
-					if bytes.Index(event.Data, message.FindString) != -1 {
-						data, err := json.Marshal(&event)
-						if err == nil {
-							responseBody := bytes.NewBuffer(data)
-							resp, err := http.Post(message.CallbackURL, "application/json",responseBody)
-							if err == nil {
-								defer resp.Body.Close()
-							}							
-						}
-					}
-				},
+		spec := message.EventCallback
+		if spec == nil && message.FindString != nil && message.CallbackURL != "" {
+			spec = &EventCallbackSpec{
+				Type: EVENT_CALLBACK_HTTP_POST,
+				Parameters: map[string]string{"find": string(message.FindString), "url": message.CallbackURL},
+				Events: []string{EVENT_MESSAGE},
 			}
-			err, key = controller.AddEventCallbackToUser(message.ProxyID, message.Username, message.Password, callback)
+		}
+		if spec != nil && message.Username != "" {
+			err, key = controller.AddEventCallbackSpecToUser(message.ProxyID, message.Username, message.Password, spec)
 			reply["CallbackKey"] = key
 		} else {
 			err = errors.New("Missing Username, FindString, or CallbackURL ")
@@ -245,19 +435,128 @@ func (message *ControllerMessage) HandleMessage(controller *ProxyController) []b
 		} else {
 			err = errors.New("Missing Username or CallbackKey")
 		}
+	case CONTROLLER_MESSAGE_LIST_CHANNEL_FILTERS:
+		var filters []*ChannelFilterSpec
+		err, filters = controller.ListChannelFilters(message.ProxyID, message.Username, message.Password)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(filters)
+			if err == nil {
+				reply["ChannelFilters"] = data
+			}
+		}
+	case CONTROLLER_MESSAGE_LIST_USER_CALLBACKS:
+		var callbacks []*EventCallbackSpec
+		err, callbacks = controller.ListEventCallbacks(message.ProxyID, message.Username, message.Password)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(callbacks)
+			if err == nil {
+				reply["EventCallbacks"] = data
+			}
+		}
+	case CONTROLLER_MESSAGE_SET_PROXY_REDACTION:
+		err = controller.SetProxyRedaction(message.ProxyID, message.Redaction)
+	case CONTROLLER_MESSAGE_SET_PROXY_RETENTION:
+		err = controller.SetProxyRetention(message.ProxyID, message.Retention)
+	case CONTROLLER_MESSAGE_APPLY_PROXY_RETENTION:
+		var report *RetentionReport
+		err, report = controller.ApplyProxyRetention(message.ProxyID, message.DryRun)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(report)
+			if err == nil {
+				reply["Report"] = data
+			}
+		}
+	case CONTROLLER_MESSAGE_SEARCH_SESSIONS:
+		var results []SessionSearchResult
+		err, results = controller.SearchSessions(message.ProxyID, message.Search)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(results)
+			if err == nil {
+				reply["Results"] = data
+			}
+		}
+	case CONTROLLER_MESSAGE_WATCH_SESSION:
+		// the events are streamed by the gRPC
+		// WatchSession; the message only checks the
+		// session, so watching is allowed and
+		// audited like any other message
+		err, _ = controller.GetSession(message.ProxyID, message.SessionKey)
+	case CONTROLLER_MESSAGE_APPROVE_SESSION:
+		err = controller.ApproveSession(message.ProxyID, message.SessionKey, messageOperator(message), message.Reason)
+	case CONTROLLER_MESSAGE_DENY_SESSION:
+		err = controller.DenySession(message.ProxyID, message.SessionKey, messageOperator(message), message.Reason)
+	case CONTROLLER_MESSAGE_LIST_PENDING_SESSIONS:
+		var keys []string
+		err, keys = controller.ListPendingSessions(message.ProxyID)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(keys)
+			if err == nil {
+				reply["Sessions"] = data
+			}
+		}
+	case CONTROLLER_MESSAGE_SET_VIEWER_OPERATOR:
+		err = controller.SetViewerOperator(message.ProxyID, message.ViewerSecret, message.Operator)
+	case CONTROLLER_MESSAGE_KILL_SESSION:
+		terminatedBy := message.TerminatedBy
+		if terminatedBy == "" {
+			terminatedBy = CONTROLLER_OPERATOR
+		}
+		err = controller.TerminateSession(message.ProxyID, message.SessionKey, terminatedBy, message.Reason, message.Notice)
+	case CONTROLLER_MESSAGE_CREATE_CONTROLLER_KEY:
+		var key *ControllerKey
+		err, key = controller.CreateControllerKey(message.ControllerKey)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(key)
+			if err == nil {
+				reply["ControllerKey"] = data
+			}
+		}
+	case CONTROLLER_MESSAGE_ROTATE_CONTROLLER_KEY:
+		var key *ControllerKey
+		err, key = controller.RotateControllerKey(message.KeyName)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(key)
+			if err == nil {
+				reply["ControllerKey"] = data
+			}
+		}
+	case CONTROLLER_MESSAGE_REVOKE_CONTROLLER_KEY:
+		err = controller.RevokeControllerKey(message.KeyName)
+	case CONTROLLER_MESSAGE_LIST_CONTROLLER_KEYS:
+		var data []byte
+		data, err = json.Marshal(controller.ListControllerKeys())
+		if err == nil {
+			reply["ControllerKeys"] = data
+		}
+	case CONTROLLER_MESSAGE_QUERY_AUDIT_LOG:
+		var entries []*AuditEntry
+		err, entries = controller.QueryAuditLog(message.Audit)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(entries)
+			if err == nil {
+				reply["Entries"] = data
+			}
+		}
+	case CONTROLLER_MESSAGE_RELOAD_CONFIG:
+		var diff *ConfigDiff
+		err, diff = controller.ReloadConfig("", message.DryRun)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(diff)
+			if err == nil {
+				reply["Diff"] = data
+			}
+		}
 	default:
-		err = errors.New("unsupported message type")
-	}
-
-	if err != nil {
-		reply["Error"] = fmt.Sprintf("%s", err)
+		err = newKindError(ErrUnsupported, "unsupported message type")
 	}
-	
-	replyData, err := json.Marshal(reply)
-	if (err == nil)	{
-		return replyData
-	} else {
-		return []byte("")
-	}
-	
+	return reply, err
 }
\ No newline at end of file
@@ -8,11 +8,13 @@ import (
 	"bytes"
 	"time"
 	"net/http"
+	"net"
+	"sync"
 )
 
 func TestMessageWrapperVerifyValid(t *testing.T) {
 	key := []byte("key")
-	messageJson := []byte(`{"Message":"eyJNZXNzYWdlVHlwZSI6Imxpc3QtcHJveGllcyJ9","HMAC":"ax2pX7hEbL29TIquZL7JQ+wtSTMTI9xEKIAtoKORKYQ="}`)
+	messageJson := []byte(`{"Version":1,"Timestamp":1660000000000000000,"Nonce":"nonce","Message":"eyJNZXNzYWdlVHlwZSI6Imxpc3QtcHJveGllcyJ9","HMAC":"T8PeQB/gz0Y4IR3J+8V0bgOMt7boGMxCLLZqoDrnPFs="}`)
 	wrapper := &ControllerHMAC{}
 	json.Unmarshal(messageJson,wrapper)
 
@@ -28,9 +30,11 @@ func TestMessageWrapperVerifyValid(t *testing.T) {
 
 func TestMessageWrapperVerifyInvalid(t *testing.T) {
 	key := []byte("key")
-	messageJson := []byte(`{"Message":"eyJNZXNzYWdlVHlwZSI6Imxpc3QtcHJveGllcyJ9","HMAC":"ax2pX7hEbL2fTIquZL7JQ+wtSTMTI9fEKIAtoKORKYQ="}`)
+	messageJson := []byte(`{"Version":1,"Timestamp":1660000000000000000,"Nonce":"nonce","Message":"eyJNZXNzYWdlVHlwZSI6Imxpc3QtcHJveGllcyJ9","HMAC":"T8PeQB/gz0Y4IR3J+8V0bgOMt7boGMxCLLZqoDrnPFs="}`)
 	wrapper := &ControllerHMAC{}
 	json.Unmarshal(messageJson,wrapper)
+	// the HMAC covers the nonce
+	wrapper.Nonce = "other"
 
 	err, _ := wrapper.Verify(key)
 
@@ -41,7 +45,7 @@ func TestMessageWrapperVerifyInvalid(t *testing.T) {
 
 func TestMessageWrapperVerifyInvalidBlank(t *testing.T) {
 	key := []byte("key")
-	messageJson := []byte(`{"Message":"eyJNZXNzYWdlVHlwZSI6Imxpc3QtcHJveGllcyJ9","HMAC":""}`)
+	messageJson := []byte(`{"Version":1,"Timestamp":1660000000000000000,"Nonce":"nonce","Message":"eyJNZXNzYWdlVHlwZSI6Imxpc3QtcHJveGllcyJ9","HMAC":""}`)
 	wrapper := &ControllerHMAC{}
 	json.Unmarshal(messageJson,wrapper)
 
@@ -152,7 +156,7 @@ func TestMessageStartProxy(t *testing.T) {
 	simulateMessage(message, controller, t)
 
 
-	for proxy.running == false {
+	for !proxy.isRunning() {
 		time.Sleep(100)
 	}
 	controller.StopProxy(proxyID)
@@ -194,7 +198,7 @@ func TestMessageStopProxy(t *testing.T) {
 	}
 
 	err = controller.StartProxy(proxyID)
-	for proxy.running == false {
+	for !proxy.isRunning() {
 		time.Sleep(100)
 	}
 	if (err != nil) {
@@ -207,7 +211,7 @@ func TestMessageStopProxy(t *testing.T) {
 		}	
 	simulateMessage(message, controller, t)
 
-	if proxy.running  {
+	if proxy.isRunning()  {
 		t.Errorf("*ControllerMessage handleMessage() did not correctly stop the proxy.")
 		controller.StopProxy(proxyID)
 	}
@@ -1151,7 +1155,7 @@ func TestMessageRemoveChannelFilter(t *testing.T) {
 		t.Fatalf("*ControllerMessage handleMessage() threw an unexpected error: %v", ErrorString)
 	}
 
-	if _, ok := controller.channelFilters[key]; ok {
+	if _, ok := controller.ChannelFilters[key]; ok {
 		t.Fatalf("*ControllerMessage handleMessage() failed to remove filter from user: %s", key)
 	}
 
@@ -1180,13 +1184,21 @@ func TestMessageRemoveChannelFilterErrorCondition(t *testing.T) {
 
 type callbackHandler struct {
 	triggered bool
+	mutex sync.Mutex
 }
 func (me *callbackHandler) catchCallback(writer http.ResponseWriter, reader *http.Request) {
+	me.mutex.Lock()
 	me.triggered = true
+	me.mutex.Unlock()
+}
+func (me *callbackHandler) wasTriggered() bool {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.triggered
 }
 func TestMessageAddUserCallback(t *testing.T) {
 
-	callback  := &callbackHandler{false}
+	callback  := &callbackHandler{}
 	callbackHost := "127.0.0.1:11989"
 
 	serverMux := http.NewServeMux()
@@ -1196,7 +1208,12 @@ func TestMessageAddUserCallback(t *testing.T) {
 		Handler: serverMux,
 		Addr:	callbackHost,
 	}
-	go callbackServer.ListenAndServe()
+	// listen before the callback fires
+	callbackListener, err := net.Listen("tcp", callbackHost)
+	if err != nil {
+		t.Fatalf("Failed to start callback server: %s", err)
+	}
+	go callbackServer.Serve(callbackListener)
 
 	defer callbackServer.Close()
 	controller := makeNewController()
@@ -1248,7 +1265,7 @@ func TestMessageAddUserCallback(t *testing.T) {
 	
 
 	// check if web server got reply
-	if callback.triggered != true {
+	if callback.wasTriggered() != true {
 		t.Errorf("*ControllerMessage handleMessage() callback function failed to callback as expected")
 	}
 
@@ -1314,3 +1331,24 @@ func TestMessageRemoveUserCallbackErrorCondition(t *testing.T) {
 		t.Fatalf("*ControllerMessage handleMessage() did not throw an error when it should have: %v", replyObj)
 	}
 }
+
+func TestMessageSignPreservesFields(t *testing.T) {
+	message := &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_REMOVE_PROXY_USER,
+		ProxyID: 7,
+		Username: "testuser",
+		Password: "testpass",
+	}
+	key := []byte("key")
+	err, wrapper := message.Sign(key)
+	if err != nil {
+		t.Fatalf("*ControllerMessage Sign() threw an unexpected error: %s", err)
+	}
+	err, verified := wrapper.Verify(key)
+	if err != nil {
+		t.Fatalf("*ControllerHMAC Verify() threw an unexpected error: %s", err)
+	}
+	if verified.ProxyID != message.ProxyID || verified.Username != message.Username || verified.Password != message.Password {
+		t.Fatalf("*ControllerMessage Sign() did not preserve message fields: got %+v, expected %+v", verified, message)
+	}
+}
@@ -0,0 +1,470 @@
+package sshproxyplus
+
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"syscall"
+)
+
+/*
+ A ProxyConfigDiff lists what a reload changed
+ on a proxy that was kept. Users are named by
+ Username. MovedListener is "old -> new" when
+ the listen address changed.
+*/
+type ProxyConfigDiff struct {
+	AddedUsers		[]string `json:",omitempty"`
+	RemovedUsers	[]string `json:",omitempty"`
+	UpdatedUsers	[]string `json:",omitempty"`
+	UpdatedSettings	[]string `json:",omitempty"`
+	MovedListener	string `json:",omitempty"`
+}
+
+/*
+ A ConfigDiff is what a reload did, or would do
+ on a dry run. Errors are changes that could not
+ be applied, like a listen address in use.
+*/
+type ConfigDiff struct {
+	AddedProxies	[]uint64 `json:",omitempty"`
+	RemovedProxies	[]uint64 `json:",omitempty"`
+	UpdatedProxies	map[uint64]*ProxyConfigDiff `json:",omitempty"`
+	Errors			[]string `json:",omitempty"`
+}
+
+// proxy fields a reload doesn't copy as settings
+var reloadIgnoredFields = map[string]bool{
+	"Log": true,
+	"Users": true,
+	"Viewers": true,
+	"ListenIP": true,
+	"ListenPort": true,
+}
+
+/*
+ ReloadConfig reads path, or ConfigFile when path
+ is empty, and makes the running proxies match
+ it. Proxies are matched by ID: new ones are
+ added, activated and started, missing ones are
+ destroyed. Kept proxies get their users added,
+ removed or replaced and their settings updated,
+ and their listener moved if the address
+ changed. Live sessions of kept proxies carry on
+ with the user they logged in as. Controller
+ settings are not reloaded.
+*/
+func (controller *ProxyController) ReloadConfig(path string, dryRun bool) (error, *ConfigDiff) {
+	if path == "" {
+		controller.mutex.Lock()
+		path = controller.ConfigFile
+		controller.mutex.Unlock()
+	}
+	if path == "" {
+		return errors.New("no config file to reload"), nil
+	}
+	err, loaded := LoadControllerConfigFromFile(path, controller.DefaultSigner)
+	if err != nil {
+		return err, nil
+	}
+	controller.reloadMutex.Lock()
+	defer controller.reloadMutex.Unlock()
+
+	controller.mutex.Lock()
+	running := make(map[uint64]*ProxyContext, len(controller.Proxies))
+	for id, proxy := range controller.Proxies {
+		running[id] = proxy
+	}
+	controller.mutex.Unlock()
+	ids := make([]uint64, 0, len(running)+len(loaded.Proxies))
+	for id := range running {
+		ids = append(ids, id)
+	}
+	for id := range loaded.Proxies {
+		if _, ok := running[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	diff := &ConfigDiff{}
+	for _, id := range ids {
+		proxy, kept := running[id]
+		next, wanted := loaded.Proxies[id]
+		switch {
+		case !kept:
+			diff.AddedProxies = append(diff.AddedProxies, id)
+			if !dryRun {
+				if err := controller.addReloadedProxy(id, next); err != nil {
+					diff.Errors = append(diff.Errors, fmt.Sprintf("proxy %v: %v", id, err))
+				}
+			}
+		case !wanted:
+			diff.RemovedProxies = append(diff.RemovedProxies, id)
+			if !dryRun {
+				controller.unregisterProxySpecKeys(proxy)
+				controller.DestroyProxy(id)
+			}
+		default:
+			proxyDiff, err := controller.reloadProxy(id, proxy, next, dryRun)
+			if err != nil {
+				diff.Errors = append(diff.Errors, fmt.Sprintf("proxy %v: %v", id, err))
+			}
+			if proxyDiff != nil {
+				if diff.UpdatedProxies == nil {
+					diff.UpdatedProxies = make(map[uint64]*ProxyConfigDiff)
+				}
+				diff.UpdatedProxies[id] = proxyDiff
+			}
+		}
+	}
+	if !dryRun {
+		controller.mutex.Lock()
+		controller.ConfigFile = path
+		controller.mutex.Unlock()
+		if data, err := json.Marshal(diff); err == nil {
+			controller.Log.Printf("Reloaded config from %v: %s\n", path, data)
+		}
+	}
+	return nil, diff
+}
+
+func (controller *ProxyController) addReloadedProxy(id uint64, proxy *ProxyContext) error {
+	proxy.Log = controller.Log
+	proxy.setIdentityLoader(controller.loadRecordingIdentity)
+	// read before the proxy is shared
+	ip, port := proxy.ListenIP, proxy.ListenPort
+	controller.mutex.Lock()
+	controller.Proxies[id] = proxy
+	if controller.ProxyCounter <= id {
+		controller.ProxyCounter = id + 1
+	}
+	for _, user := range proxy.ListProxyUsers() {
+		controller.registerUserSpecKeys(id, user)
+	}
+	controller.mutex.Unlock()
+	proxy.Activate()
+	listener, err := net.Listen("tcp", ip +":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	proxy.Log.Printf("Starting proxy on socket %v:%v\n", ip, port)
+	go proxy.serve(listener)
+	return nil
+}
+
+// reloadProxy returns nil when nothing changed
+func (controller *ProxyController) reloadProxy(id uint64, proxy *ProxyContext, next *ProxyContext, dryRun bool) (*ProxyConfigDiff, error) {
+	proxyDiff := &ProxyConfigDiff{}
+	for _, pair := range pairReloadedUsers(proxy.ListProxyUsers(), next.ListProxyUsers()) {
+		old, user := pair.old, pair.user
+		switch {
+		case old == nil:
+			proxyDiff.AddedUsers = append(proxyDiff.AddedUsers, user.Username)
+		case user == nil:
+			proxyDiff.RemovedUsers = append(proxyDiff.RemovedUsers, old.Username)
+		case pair.old_key != pair.key || !sameProxyUser(old, user):
+			proxyDiff.UpdatedUsers = append(proxyDiff.UpdatedUsers, user.Username)
+		default:
+			continue
+		}
+		if !dryRun {
+			controller.mutex.Lock()
+			if old != nil {
+				controller.unregisterUserSpecKeys(old)
+			}
+			if user != nil {
+				controller.registerUserSpecKeys(id, user)
+			}
+			controller.mutex.Unlock()
+			proxy.setProxyUser(pair.old_key, pair.key, old, user)
+		}
+	}
+
+	// a copy taken under the proxy's locks, since
+	// sessions and updates use the proxy meanwhile
+	data, err := json.Marshal(proxy)
+	if err != nil {
+		return nil, err
+	}
+	current := &ProxyContext{}
+	json.Unmarshal(data, current)
+	proxyDiff.UpdatedSettings = changedProxySettings(current, next)
+	if !dryRun {
+		err = proxy.applySettings(next, proxyDiff.UpdatedSettings)
+	}
+	if current.ListenIP != next.ListenIP || current.ListenPort != next.ListenPort {
+		proxyDiff.MovedListener = fmt.Sprintf("%v:%v -> %v:%v", current.ListenIP, current.ListenPort, next.ListenIP, next.ListenPort)
+		if !dryRun && err == nil {
+			err = proxy.reloadListener(next.ListenIP, next.ListenPort)
+		}
+	}
+	if len(proxyDiff.AddedUsers) == 0 && len(proxyDiff.RemovedUsers) == 0 && len(proxyDiff.UpdatedUsers) == 0 &&
+		len(proxyDiff.UpdatedSettings) == 0 && proxyDiff.MovedListener == "" {
+		return nil, err
+	}
+	return proxyDiff, err
+}
+
+func sameProxyUser(a, b *ProxyUser) bool {
+	a_data, a_err := json.Marshal(a.clone())
+	b_data, b_err := json.Marshal(b.clone())
+	return a_err == nil && b_err == nil && string(a_data) == string(b_data)
+}
+
+// reloadedUser pairs a user of the running
+// proxy with the user that replaces it
+type reloadedUser struct {
+	old_key	string
+	old		*ProxyUser
+	key		string
+	user	*ProxyUser
+}
+
+/*
+ pairReloadedUsers matches the users of the
+ running proxy to those of the reloaded config
+ by Username, so a changed password updates the
+ user rather than removing it and adding a new
+ one. Usernames listed more than once on either
+ side are matched by key.
+*/
+func pairReloadedUsers(current map[string]*ProxyUser, wanted map[string]*ProxyUser) []reloadedUser {
+	current_names, wanted_names := usersByName(current), usersByName(wanted)
+	pairs := make([]reloadedUser, 0)
+	for name, old_keys := range current_names {
+		keys := wanted_names[name]
+		if len(old_keys) == 1 && len(keys) == 1 {
+			pairs = append(pairs, reloadedUser{old_key: old_keys[0], old: current[old_keys[0]], key: keys[0], user: wanted[keys[0]]})
+			continue
+		}
+		for _, key := range old_keys {
+			pair := reloadedUser{old_key: key, old: current[key], key: key}
+			pair.user = wanted[key]
+			pairs = append(pairs, pair)
+		}
+	}
+	for name, keys := range wanted_names {
+		old_keys := current_names[name]
+		if len(old_keys) == 1 && len(keys) == 1 {
+			continue
+		}
+		for _, key := range keys {
+			if _, ok := current[key]; !ok {
+				pairs = append(pairs, reloadedUser{key: key, user: wanted[key]})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key == pairs[j].key {
+			return pairs[i].old_key < pairs[j].old_key
+		}
+		return pairs[i].key < pairs[j].key
+	})
+	return pairs
+}
+
+func usersByName(users map[string]*ProxyUser) map[string][]string {
+	names := make(map[string][]string)
+	for key, user := range users {
+		names[user.Username] = append(names[user.Username], key)
+	}
+	return names
+}
+
+/*
+ setProxyUser puts user under key in place of
+ old, which was under old_key, or removes old
+ when user is nil. Viewers of old, which may
+ hold a copy of it, are moved to the new user.
+*/
+func (proxy *ProxyContext) setProxyUser(old_key string, key string, old *ProxyUser, user *ProxyUser) {
+	proxy.users_mutex.Lock()
+	defer proxy.users_mutex.Unlock()
+	if old != nil && proxy.Users[old_key] == old {
+		delete(proxy.Users, old_key)
+	}
+	if user == nil {
+		return
+	}
+	proxy.Users[key] = user
+	if old == nil {
+		return
+	}
+	for _, viewer := range proxy.Viewers {
+		if viewer.User == nil {
+			continue
+		}
+		if viewer.User == old || (viewer.User.Username == old.Username && viewer.User.Password == old.Password) {
+			viewer.User = user
+		}
+	}
+}
+
+// changedProxySettings names the settings of next
+// that differ from proxy; neither may be shared,
+// so compare a copy of a running proxy
+func changedProxySettings(proxy *ProxyContext, next *ProxyContext) []string {
+	return changedFields(proxy, next, reloadIgnoredFields)
+}
+
+// changedFields names the exported fields that
+// differ between two structs of the same type
+func changedFields(a interface{}, b interface{}, ignored map[string]bool) []string {
+	var changed []string
+	current, wanted := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for index := 0; index < current.NumField(); index++ {
+		field := current.Type().Field(index)
+		if field.PkgPath != "" || field.Tag.Get("json") == "-" || ignored[field.Name] {
+			continue
+		}
+		// compared as they are saved, leaving out
+		// what was compiled or cached from them
+		current_data, _ := json.Marshal(current.Field(index).Interface())
+		wanted_data, _ := json.Marshal(wanted.Field(index).Interface())
+		if string(current_data) != string(wanted_data) {
+			changed = append(changed, field.Name)
+		}
+	}
+	return changed
+}
+
+func (proxy *ProxyContext) applySettings(next *ProxyContext, fields []string) error {
+	var errs []string
+	current, wanted := reflect.ValueOf(proxy).Elem(), reflect.ValueOf(next).Elem()
+	for _, name := range fields {
+		switch name {
+		case "Redaction":
+			if err := proxy.SetRedaction(next.Redaction); err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			}
+		case "Retention":
+			if err := proxy.SetRetention(next.Retention); err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			}
+		default:
+			proxy.mutex.Lock()
+			current.FieldByName(name).Set(wanted.FieldByName(name))
+			switch name {
+			case "SessionFolder", "RecordingStorage":
+				proxy.recordingStore = nil
+			case "RecordingRecipientFile":
+				proxy.recordingRecipient = nil
+			}
+			proxy.mutex.Unlock()
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(fmt.Sprint(errs))
+	}
+	return nil
+}
+
+// reloadListener moves a running proxy to a new
+// address; a stopped one just takes the address
+func (proxy *ProxyContext) reloadListener(ip string, port int) error {
+	if proxy.isRunning() {
+		return proxy.moveListener(ip, port)
+	}
+	proxy.mutex.Lock()
+	proxy.ListenIP, proxy.ListenPort = ip, port
+	proxy.mutex.Unlock()
+	return nil
+}
+
+/*
+ registerUserSpecKeys puts the filters and
+ callbacks a user was loaded with under their
+ keys, so they can be removed by key. Specs
+ written without a key are given one. The
+ caller holds controller.mutex or owns the
+ controller.
+*/
+func (controller *ProxyController) registerUserSpecKeys(proxyID uint64, user *ProxyUser) {
+	for index, filter := range user.getChannelFilters() {
+		if filter.spec == nil {
+			continue
+		}
+		if filter.spec.Key == "" {
+			filter.spec.Key = fmt.Sprintf("filter-proxy%v-%s-%s-%v",proxyID,user.Username,user.Password,index)
+		}
+		for existing, ok := controller.ChannelFilters[filter.spec.Key]; ok && existing != filter; existing, ok = controller.ChannelFilters[filter.spec.Key] {
+			filter.spec.Key = filter.spec.Key + "."
+		}
+		controller.ChannelFilters[filter.spec.Key] = filter
+	}
+	for index, callback := range user.getEventCallbacks() {
+		if callback.spec == nil {
+			continue
+		}
+		if callback.spec.Key == "" {
+			callback.spec.Key = fmt.Sprintf("callback-proxy%v-%s-%s-%v",proxyID,user.Username,user.Password,index)
+		}
+		for existing, ok := controller.EventCallbacks[callback.spec.Key]; ok && existing != callback; existing, ok = controller.EventCallbacks[callback.spec.Key] {
+			callback.spec.Key = callback.spec.Key + "."
+		}
+		controller.EventCallbacks[callback.spec.Key] = callback
+	}
+}
+
+// unregisterUserSpecKeys drops the keys of a
+// user's filters and callbacks
+func (controller *ProxyController) unregisterUserSpecKeys(user *ProxyUser) {
+	for _, filter := range user.getChannelFilters() {
+		if filter.spec != nil && controller.ChannelFilters[filter.spec.Key] == filter {
+			delete(controller.ChannelFilters, filter.spec.Key)
+		}
+	}
+	for _, callback := range user.getEventCallbacks() {
+		if callback.spec != nil && controller.EventCallbacks[callback.spec.Key] == callback {
+			delete(controller.EventCallbacks, callback.spec.Key)
+		}
+	}
+}
+
+func (controller *ProxyController) unregisterProxySpecKeys(proxy *ProxyContext) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	for _, user := range proxy.ListProxyUsers() {
+		controller.unregisterUserSpecKeys(user)
+	}
+}
+
+/*
+ ReloadOnSignal reloads ConfigFile with a
+ reload-config message whenever the process
+ gets SIGHUP, until the controller is stopped.
+*/
+func (controller *ProxyController) ReloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	controller.mutex.Lock()
+	controller.reloadSignals = signals
+	controller.mutex.Unlock()
+	go func() {
+		for range signals {
+			message := &ControllerMessage{MessageType: CONTROLLER_MESSAGE_RELOAD_CONFIG}
+			if _, err := controller.dispatch(message, nil, AUDIT_IDENTITY_SIGNAL, "SIGHUP"); err != nil {
+				controller.Log.Println("unable to reload config:", err)
+			}
+		}
+	}()
+}
+
+func (controller *ProxyController) stopReloadOnSignal() {
+	controller.mutex.Lock()
+	signals := controller.reloadSignals
+	controller.reloadSignals = nil
+	controller.mutex.Unlock()
+	if signals != nil {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
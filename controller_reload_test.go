@@ -0,0 +1,190 @@
+package sshproxyplus
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+
+// writeReloadConfig writes a controller config
+// with one proxy per port; other adds a second
+// user to the first proxy
+func writeReloadConfig(t *testing.T, path string, remote string, folder string, ports []int, other bool, max_sessions int) {
+	proxies := ""
+	for id, port := range ports {
+		users := fmt.Sprintf(`"user:password": {"Username": "user", "Password": "password", "RemoteHost": %q, "RemoteUsername": "user", "RemotePassword": "password"}`, remote)
+		if other && id == 0 {
+			users += fmt.Sprintf(`, "other:password": {"Username": "other", "Password": "password", "RemoteHost": %q, "RemoteUsername": "user", "RemotePassword": "password"}`, remote)
+		}
+		if proxies != "" {
+			proxies += ", "
+		}
+		proxies += fmt.Sprintf(`"%v": {"ListenIP": "127.0.0.1", "ListenPort": %v, "SessionFolder": %q, "RequireValidPassword": true, "MaxSessions": %v, "Users": {%s}}`, id, port, folder, max_sessions, users)
+	}
+	config := fmt.Sprintf(`{"ProxyCounter": %v, "Proxies": {%s}}`, len(ports), proxies)
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("unable to write config: %v", err)
+	}
+}
+
+func TestControllerReloadConfig(t *testing.T) {
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+	remote := "127.0.0.1:"+dummyServer.port.Text(10)
+	folder := t.TempDir()
+	path := filepath.Join(t.TempDir(), "controller.json")
+	first, moved, added := int(newRandomPort().Int64()), int(newRandomPort().Int64()), int(newRandomPort().Int64())
+
+	writeReloadConfig(t, path, remote, folder, []int{first}, false, 0)
+	signer, _ := GenerateSigner()
+	err, controller := LoadControllerConfigFromFile(path, signer)
+	if err != nil {
+		t.Fatalf("LoadControllerConfigFromFile() = %v", err)
+	}
+	controller.Log = log.Default()
+	controller.ActivateProxy(0)
+	controller.StartProxy(0)
+	defer controller.Stop()
+	time.Sleep(500*time.Millisecond)
+
+	shell, err := openTestShell(t, "127.0.0.1:"+strconv.Itoa(first), "user", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer shell.close()
+
+	writeReloadConfig(t, path, remote, folder, []int{moved, added}, true, 10)
+	reply := simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_RELOAD_CONFIG, DryRun: true}, controller, t)
+	diff := &ConfigDiff{}
+	replyField(reply, "Diff", diff)
+	if len(diff.AddedProxies) != 1 || diff.UpdatedProxies[0] == nil {
+		t.Fatalf("reload-config dry run = %+v, expected an added and an updated proxy", diff)
+	}
+	if len(controller.Proxies) != 1 || len(controller.Proxies[0].ListProxyUsers()) != 1 {
+		t.Errorf("reload-config dry run changed the controller")
+	}
+
+	reply = simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_RELOAD_CONFIG}, controller, t)
+	diff = &ConfigDiff{}
+	replyField(reply, "Diff", diff)
+	updated := diff.UpdatedProxies[0]
+	if len(diff.AddedProxies) != 1 || diff.AddedProxies[0] != 1 || len(diff.Errors) != 0 || updated == nil {
+		t.Fatalf("reload-config = %+v, expected proxy 1 added and proxy 0 updated", diff)
+	}
+	if len(updated.AddedUsers) != 1 || updated.AddedUsers[0] != "other" || updated.MovedListener == "" ||
+		len(updated.UpdatedSettings) != 1 || updated.UpdatedSettings[0] != "MaxSessions" {
+		t.Errorf("reload-config proxy diff = %+v, expected other added, the listener moved and MaxSessions", updated)
+	}
+	time.Sleep(500*time.Millisecond)
+
+	io.WriteString(shell.stdin, "after-reload")
+	if !waitForOutput(shell.output, "after-reload") {
+		t.Errorf("live session did not survive the reload; got %q", shell.output.String())
+	}
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(first), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("proxy still listens on its old port after the reload")
+	}
+	other, err := openTestShell(t, "127.0.0.1:"+strconv.Itoa(moved), "other", "password")
+	if err != nil {
+		t.Fatalf("added user could not log in on the moved listener: %v", err)
+	}
+	other.close()
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(added), time.Second); err != nil {
+		t.Errorf("added proxy is not listening: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	controller.ReloadOnSignal()
+	writeReloadConfig(t, path, remote, folder, []int{moved}, false, 10)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	proxy, _ := controller.GetProxy(0)
+	for tries := 0; tries < 30 && len(proxy.ListProxyUsers()) != 1; tries++ {
+		time.Sleep(100*time.Millisecond)
+	}
+	if len(proxy.ListProxyUsers()) != 1 {
+		t.Errorf("SIGHUP did not reload the config")
+	}
+	if _, err := controller.GetProxy(1); err == nil {
+		t.Errorf("reload did not destroy a proxy that left the config")
+	}
+	io.WriteString(shell.stdin, "after-signal")
+	if !waitForOutput(shell.output, "after-signal") {
+		t.Errorf("live session did not survive the second reload")
+	}
+}
+
+func TestControllerReloadUserPassword(t *testing.T) {
+	controller := makeNewController()
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxyID := controller.AddExistingProxy(proxy)
+	proxy.AddProxyUser(&ProxyUser{Username: "user", Password: "old", RemoteHost: "127.0.0.1:22"})
+	err, viewer := controller.CreateUserSessionViewer(proxyID, "user", "old")
+	if err != nil {
+		t.Fatalf("CreateUserSessionViewer() = %v", err)
+	}
+
+	next := MakeNewProxy(controller.DefaultSigner)
+	next.AddProxyUser(&ProxyUser{Username: "user", Password: "new", RemoteHost: "127.0.0.1:22"})
+	diff, err := controller.reloadProxy(proxyID, proxy, next, false)
+	if err != nil || diff == nil {
+		t.Fatalf("reloadProxy() = %+v, %v, expected a diff", diff, err)
+	}
+	if len(diff.AddedUsers) != 0 || len(diff.RemovedUsers) != 0 || len(diff.UpdatedUsers) != 1 || diff.UpdatedUsers[0] != "user" {
+		t.Errorf("reloadProxy() = %+v, expected user updated", diff)
+	}
+	users := proxy.ListProxyUsers()
+	user, ok := users[buildProxyUserKey("user", "new")]
+	if len(users) != 1 || !ok {
+		t.Fatalf("reloadProxy() left users %v, expected only user:new", users)
+	}
+	if viewer.User != user {
+		t.Errorf("reloadProxy() did not move the viewer to the user with the new password")
+	}
+}
+
+func TestControllerReloadConcurrent(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(t.TempDir(), "controller.json")
+	port := int(newRandomPort().Int64())
+	writeReloadConfig(t, path, "127.0.0.1:22", folder, []int{port}, false, 0)
+	signer, _ := GenerateSigner()
+	err, controller := LoadControllerConfigFromFile(path, signer)
+	if err != nil {
+		t.Fatalf("LoadControllerConfigFromFile() = %v", err)
+	}
+	controller.Log = log.New(io.Discard, "", 0)
+	proxy, _ := controller.GetProxy(0)
+	writeReloadConfig(t, path, "127.0.0.1:22", folder, []int{port + 1}, true, 2)
+
+	done := make(chan bool)
+	go func() {
+		for count := 0; count < 20; count++ {
+			proxy.SetRetention(&RetentionPolicy{MaxAgeSeconds: int64(count)})
+			proxy.reloadListener("127.0.0.1", port)
+			controller.ReloadConfig("", true)
+		}
+		done <- true
+	}()
+	for count := 0; count < 20; count++ {
+		if err, _ := controller.ReloadConfig(path, false); err != nil {
+			t.Errorf("ReloadConfig() = %v", err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,85 @@
+package sshproxyplus
+
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// version of the signed envelope that Sign
+// writes and Verify accepts
+const CONTROLLER_HMAC_VERSION int = 1
+
+// how far a message timestamp may be from the
+// controller's clock when MessageClockSkewSeconds
+// is not set
+const CONTROLLER_DEFAULT_CLOCK_SKEW int = 300
+
+/*
+ replayGuard remembers the nonces of accepted
+ messages. A nonce only has to be kept while its
+ timestamp is inside the skew window; after that
+ the timestamp alone gets the message rejected.
+*/
+type replayGuard struct {
+	mutex	sync.Mutex
+	seen	map[string]time.Time
+}
+
+func (guard *replayGuard) check(messageWrapper *ControllerHMAC, window time.Duration, now time.Time) error {
+	sent := time.Unix(0, messageWrapper.Timestamp)
+	if sent.Before(now.Add(-window)) || sent.After(now.Add(window)) {
+		return fmt.Errorf("message timestamp %v is outside the allowed clock skew of %v", sent.UTC().Format(time.RFC3339), window)
+	}
+	if messageWrapper.Nonce == "" {
+		return errors.New("message has no nonce")
+	}
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	if guard.seen == nil {
+		guard.seen = make(map[string]time.Time)
+	}
+	for nonce, expires := range guard.seen {
+		if now.After(expires) {
+			delete(guard.seen, nonce)
+		}
+	}
+	if _, ok := guard.seen[messageWrapper.Nonce]; ok {
+		return errors.New("message nonce has already been used")
+	}
+	guard.seen[messageWrapper.Nonce] = sent.Add(window)
+	return nil
+}
+
+func (controller *ProxyController) clockSkew() time.Duration {
+	seconds := controller.MessageClockSkewSeconds
+	if seconds <= 0 {
+		seconds = CONTROLLER_DEFAULT_CLOCK_SKEW
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/*
+ verifyMessage checks the HMAC of a signed
+ message and that it is neither stale nor a
+ replay of one the controller already took. It
+ returns the key that signed it, nil for
+ PresharedKey; dispatch checks what the key may
+ send.
+*/
+func (controller *ProxyController) verifyMessage(messageWrapper *ControllerHMAC) (error, ControllerMessage, *ControllerKey) {
+	err, secret, key := controller.signingKey(messageWrapper.KeyName)
+	if err != nil {
+		return err, ControllerMessage{}, nil
+	}
+	err, message := messageWrapper.Verify(secret)
+	if err != nil {
+		return err, message, nil
+	}
+	if err := controller.replay.check(messageWrapper, controller.clockSkew(), time.Now()); err != nil {
+		return err, ControllerMessage{}, nil
+	}
+	return nil, message, key
+}
@@ -0,0 +1,59 @@
+package sshproxyplus
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func TestMessageWrapperVerifyLegacy(t *testing.T) {
+	key := []byte("key")
+	// signed before envelopes had a version
+	messageJson := []byte(`{"Message":"eyJNZXNzYWdlVHlwZSI6Imxpc3QtcHJveGllcyJ9","HMAC":"ax2pX7hEbL29TIquZL7JQ+wtSTMTI9xEKIAtoKORKYQ="}`)
+	wrapper := &ControllerHMAC{}
+	json.Unmarshal(messageJson,wrapper)
+
+	err, _ := wrapper.Verify(key)
+	if err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("*ControllerHMAC Verify() of an unversioned message = %v, expected a version error", err)
+	}
+}
+
+func TestControllerVerifyMessageReplay(t *testing.T) {
+	controller := makeNewController()
+	controller.MessageClockSkewSeconds = 60
+	message := &ControllerMessage{MessageType: CONTROLLER_MESSAGE_DESTROY_PROXY, ProxyID: 3}
+
+	_, wrapper := message.Sign([]byte(controller.PresharedKey))
+	if err, verified, _ := controller.verifyMessage(&wrapper); err != nil || verified.ProxyID != 3 {
+		t.Fatalf("verifyMessage() of a fresh message = %v, %+v", err, verified)
+	}
+	if err, _, _ := controller.verifyMessage(&wrapper); err == nil {
+		t.Errorf("verifyMessage() accepted a replayed message")
+	}
+
+	_, other := message.Sign([]byte(controller.PresharedKey))
+	if other.Nonce == wrapper.Nonce {
+		t.Errorf("Sign() reused a nonce")
+	}
+	if err, _, _ := controller.verifyMessage(&other); err != nil {
+		t.Errorf("verifyMessage() rejected a second message with its own nonce: %v", err)
+	}
+
+	for _, offset := range []time.Duration{-2*time.Minute, 2*time.Minute} {
+		_, skewed := message.Sign([]byte(controller.PresharedKey))
+		skewed.Timestamp = time.Now().Add(offset).UnixNano()
+		skewed.HMAC = skewed.mac([]byte(controller.PresharedKey))
+		if err, _, _ := controller.verifyMessage(&skewed); err == nil || !strings.Contains(err.Error(), "clock skew") {
+			t.Errorf("verifyMessage() of a message %v off = %v, expected a clock skew error", offset, err)
+		}
+	}
+
+	_, unsigned := message.Sign([]byte(controller.PresharedKey))
+	unsigned.Timestamp = time.Now().Add(time.Second).UnixNano()
+	if err, _, _ := controller.verifyMessage(&unsigned); err == nil {
+		t.Errorf("verifyMessage() accepted a message whose timestamp was changed after signing")
+	}
+}
@@ -70,8 +70,9 @@ func (client *ProxyControllerSocketTCPClient) 	ReadLine() ([]byte, error) {
 
 func (socket *ProxyControllerSocketTCP) ListenAndServe(host string, handler ProxyControllerSocketHandler) error {
 	var err error
+	var listener net.Listener
 	if(socket.plaintext) {
-		socket.listener, err = net.Listen("tcp", host)
+		listener, err = net.Listen("tcp", host)
 	} else {
 		var keyPair tls.Certificate 
 		keyPair, err = tls.LoadX509KeyPair(socket.TLSCert, socket.TLSKey)
@@ -81,7 +82,7 @@ func (socket *ProxyControllerSocketTCP) ListenAndServe(host string, handler Prox
 		}
 		TLSConfig := &tls.Config{Certificates: []tls.Certificate{keyPair}}
 
-		socket.listener, err = tls.Listen("tcp", host, TLSConfig)
+		listener, err = tls.Listen("tcp", host, TLSConfig)
 	}
 	
 	
@@ -89,11 +90,14 @@ func (socket *ProxyControllerSocketTCP) ListenAndServe(host string, handler Prox
 		fmt.Println("Error creating TLS socket:",err.Error())
 		return err
 	}
+	socket.clientMutex.Lock()
+	socket.listener = listener
 	socket.active = true
+	socket.clientMutex.Unlock()
 	defer socket.Stop()
 
-	for socket.active {
-		client, err := socket.listener.Accept()
+	for socket.isActive() {
+		client, err := listener.Accept()
 		if err != nil {
 				fmt.Println("Error accepting: ", err.Error())
 				break;
@@ -127,17 +131,21 @@ func (socket *ProxyControllerSocketTCP) clientClose(client net.Conn) {
 	socket.clientMutex.Unlock()
 }
 
-func (socket *ProxyControllerSocketTCP) Stop() {
-
+func (socket *ProxyControllerSocketTCP) isActive() bool {
+	socket.clientMutex.Lock()
+	defer socket.clientMutex.Unlock()
+	return socket.active
+}
 
+func (socket *ProxyControllerSocketTCP) Stop() {
+	socket.clientMutex.Lock()
+	defer socket.clientMutex.Unlock()
 	if(socket.active) {
 		socket.active = false
-		socket.clientMutex.Lock()
-			for _, client := range socket.clients {
-				client.Close();
-			}
-			socket.clients = make([]net.Conn,0)
-		socket.clientMutex.Unlock()
+		for _, client := range socket.clients {
+			client.Close();
+		}
+		socket.clients = make([]net.Conn,0)
 	}
 }
 
@@ -151,8 +159,9 @@ type ProxyControllerSocketWeb struct {
 	TLSKey			string
 	plaintext		bool
 	handler 		ProxyControllerSocketHandler
-	server			http.Server
+	server			*http.Server
 	active			bool
+	mutex			sync.Mutex
 }
 
 type ProxyControllerSocketWebClient struct {
@@ -200,24 +209,28 @@ func (socket *ProxyControllerSocketWeb) ListenAndServe(host string, handler Prox
 	serverMux := http.NewServeMux()
 	serverMux.HandleFunc("/", socket.handleWebRequest)
 	
-	socket.server = http.Server{
+	server := &http.Server{
 		Handler: serverMux,
 		Addr:	host,
 	}
 
-
+	socket.mutex.Lock()
+	socket.server = server
 	socket.active = true
+	socket.mutex.Unlock()
 
 	if(socket.plaintext) {
-		err = socket.server.ListenAndServe()
+		err = server.ListenAndServe()
 	} else {
-		err = socket.server.ListenAndServeTLS(socket.TLSCert, socket.TLSKey)
+		err = server.ListenAndServeTLS(socket.TLSCert, socket.TLSKey)
 	}
 	
 	
 	if (err != nil)	{
 		fmt.Println("Error creating web server:",err.Error())
+		socket.mutex.Lock()
 		socket.active = false
+		socket.mutex.Unlock()
 		return err
 	}
 
@@ -226,6 +239,8 @@ func (socket *ProxyControllerSocketWeb) ListenAndServe(host string, handler Prox
 }
 
 func (socket *ProxyControllerSocketWeb) Stop() {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
 	if(socket.active) {
 		socket.active = false
 		socket.server.Close()
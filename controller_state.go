@@ -0,0 +1,67 @@
+package sshproxyplus
+
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// messages that change nothing, so the state
+// file is not rewritten after them
+var controllerStatelessMessages = append([]string{
+	CONTROLLER_MESSAGE_LIST_CONTROLLER_KEYS,
+	CONTROLLER_MESSAGE_QUERY_AUDIT_LOG,
+}, controllerReadOnlyMessages...)
+
+/*
+ writeFileAtomic writes data to a temporary
+ file next to path and renames it over path, so
+ a crash never leaves a half written file.
+*/
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err = temp.Write(data); err == nil {
+		err = temp.Sync()
+	}
+	if close_err := temp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	return err
+}
+
+/*
+ persistState rewrites StateFile with the
+ controller as it is now. Nothing is written
+ while it is unset. The file can be loaded
+ with LoadControllerConfigFromFile.
+*/
+func (controller *ProxyController) persistState() error {
+	if controller.StateFile == "" {
+		return nil
+	}
+	controller.stateMutex.Lock()
+	defer controller.stateMutex.Unlock()
+	controller.mutex.Lock()
+	data, err := controller.ExportControllerAsJSON()
+	controller.mutex.Unlock()
+	if err == nil {
+		data, err = encodeConfig(controller.StateFile, data)
+	}
+	if err == nil {
+		err = writeFileAtomic(controller.StateFile, data)
+	}
+	if err != nil {
+		controller.Log.Println("unable to write state file:", err)
+	}
+	return err
+}
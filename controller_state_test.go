@@ -0,0 +1,126 @@
+package sshproxyplus
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+func TestControllerStateFile(t *testing.T) {
+	controller := makeNewController()
+	controller.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(fmt.Sprintf(`{"ListenPort": 2222, "SessionFolder": %q, "Users": {"user:pass": {"Username": "user", "Password": "pass"}}}`, t.TempDir())),
+	}, controller, t)
+	proxyID := uint64(reply["ProxyID"].(float64))
+	if _, err := os.Stat(controller.StateFile); err != nil {
+		t.Fatalf("persistState() did not write the state file after create-proxy: %v", err)
+	}
+	controller.AddChannelFilterToUser(proxyID, "user", "pass", &ChannelFilterFunc{fn: func(data []byte, wrapper *channelWrapper) []byte { return data }})
+	simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_PROXY_USER,
+		ProxyID: proxyID,
+		ProxyUser: &ProxyUser{Username: "other", Password: "other", RemoteHost: "127.0.0.1:22"},
+	}, controller, t)
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_NEW_PROXY_VIEWER,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "pass",
+	}, controller, t)
+	viewer := &proxySessionViewer{}
+	replyField(reply, "Viewer", viewer)
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "pass",
+		FindString: []byte("secret"),
+		ReplaceString: []byte("hidden"),
+	}, controller, t)
+	filterKey := reply["FilterKey"].(string)
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_USER_CALLBACK,
+		ProxyID: proxyID,
+		Username: "other",
+		Password: "other",
+		FindString: []byte("whoami"),
+		CallbackURL: "http://127.0.0.1:1/callback",
+	}, controller, t)
+	callbackKey := reply["CallbackKey"].(string)
+
+	before, _ := os.ReadFile(controller.StateFile)
+	simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_LIST_PROXIES}, controller, t)
+	simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_DESTROY_PROXY, ProxyID: 99}, controller, t)
+	after, _ := os.ReadFile(controller.StateFile)
+	if string(before) != string(after) {
+		t.Errorf("persistState() rewrote the state file after a read or a failed message")
+	}
+
+	err, loaded := LoadControllerConfigFromFile(controller.StateFile, nil)
+	if err != nil {
+		t.Fatalf("LoadControllerConfigFromFile() = %v", err)
+	}
+	proxy, ok := loaded.Proxies[proxyID]
+	if !ok {
+		t.Fatalf("LoadControllerConfigFromFile() lost proxy %v", proxyID)
+	}
+	err, user, _ := proxy.GetProxyUser("other", "other", false)
+	if err != nil {
+		t.Fatalf("LoadControllerConfigFromFile() lost an added user: %v", err)
+	}
+	if len(user.getEventCallbacks()) != 1 || loaded.EventCallbacks[callbackKey] == nil {
+		t.Errorf("LoadControllerConfigFromFile() did not restore the user's callback")
+	}
+	if _, ok := proxy.Viewers[viewer.Secret]; viewer.Secret == "" || !ok {
+		t.Errorf("LoadControllerConfigFromFile() lost viewer %q", viewer.Secret)
+	}
+	err, user, _ = proxy.GetProxyUser("user", "pass", false)
+	if err != nil {
+		t.Fatalf("LoadControllerConfigFromFile() lost a user: %v", err)
+	}
+	if len(user.getChannelFilters()) != 1 || len(loaded.ChannelFilters) != 1 {
+		t.Fatalf("LoadControllerConfigFromFile() restored %v filters, expected only the one built from a message", len(user.getChannelFilters()))
+	}
+	if filtered := user.getChannelFilters()[0].fn([]byte("a secret"), nil); string(filtered) != "a hidden" {
+		t.Errorf("restored filter returned %q, expected %q", filtered, "a hidden")
+	}
+	if loaded.ChannelFilters[filterKey] == nil {
+		t.Errorf("LoadControllerConfigFromFile() lost filter %v", filterKey)
+	}
+}
+
+func TestControllerStateWhileUsersChange(t *testing.T) {
+	controller := makeNewController()
+	controller.StateFile = filepath.Join(t.TempDir(), "state.json")
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(fmt.Sprintf(`{"ListenPort": 2222, "SessionFolder": %q}`, t.TempDir())),
+	}, controller, t)
+	proxyID := uint64(reply["ProxyID"].(float64))
+	proxy, _ := controller.GetProxy(proxyID)
+
+	done := make(chan bool)
+	go func() {
+		for index := 0; index < 50; index++ {
+			user := &ProxyUser{Username: fmt.Sprintf("user%v", index), Password: "pass", RemoteHost: "127.0.0.1:22"}
+			proxy.AddProxyUser(user)
+			proxy.AddSessionViewer(createNewSessionViewer(SESSION_VIEWER_TYPE_LIST, proxy, user))
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			if err := controller.persistState(); err != nil {
+				t.Fatalf("persistState() = %v", err)
+			}
+		}
+	}
+}
@@ -258,7 +258,7 @@ func TestControllerStartAndStopProxy(t *testing.T) {
 	}
 
 	err = controller.StartProxy(proxyID)
-	for proxy.running == false {
+	for !proxy.isRunning() {
 		time.Sleep(100)
 	}
 	controller.StopProxy(proxyID)
@@ -1046,8 +1046,8 @@ func TestControllerFullIntegration(t *testing.T) {
 	}
 	time.Sleep(time.Millisecond*100)
 
-	curUserSessions, userSessionEntryFound := proxy.userSessions[testUser1.getKey()]
-	if len(proxy.allSessions) != 1  {
+	curUserSessions, userSessionEntryFound := proxy.sessions.userSnapshot(testUser1.getKey())
+	if proxy.sessions.len() != 1  {
 		t.Errorf("Proxy did not store session in allSessions.")
 	} else if ! userSessionEntryFound  {
 		t.Errorf("Proxy did not create entry in userSessions for user.")
@@ -1079,8 +1079,7 @@ func TestControllerFullIntegration(t *testing.T) {
 		}
 
 
-		for testSessionKey, _ := range proxy.allSessions {
-			testSession := proxy.allSessions[testSessionKey]
+		for _, testSession := range proxy.sessions.snapshot() {
 			if (strings.Compare(testSession.client_username, testUser) != 0) {
 				t.Errorf("Proxy session does not have expected username. Expected %s, got %s", testUser, testSession.client_username)
 			}
@@ -1093,8 +1092,7 @@ func TestControllerFullIntegration(t *testing.T) {
 
 	proxy.Stop()
 
-	for testSessionKey, _ := range proxy.allSessions {
-		testSession := proxy.allSessions[testSessionKey]
+	for _, testSession := range proxy.sessions.snapshot() {
 		err := os.Remove(testSession.filename)
 		if err != nil {
 			log.Printf("Failed to remove file during cleanup: %s\n", err)
@@ -0,0 +1,272 @@
+package sshproxyplus
+
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+ A SettingsUpdate lists the fields that an
+ update-proxy or update-proxy-user changed. Live
+ names the ones that also reach sessions that
+ are already running; the rest only apply to
+ sessions that start after the update.
+*/
+type SettingsUpdate struct {
+	Updated		[]string `json:",omitempty"`
+	Live		[]string `json:",omitempty"`
+}
+
+/*
+ proxyLiveSettings are read again while sessions
+ run, or by viewers and the janitor, so changing
+ them affects running sessions. Every other
+ proxy setting is read when a session starts. A
+ session holds its own copy of its ProxyUser, so
+ no user field is live.
+*/
+var proxyLiveSettings = []string{
+	"Redaction",
+	"IdleWarningMessage",
+	"MaxSessionWarningMessage",
+	"SessionEvictionSeconds",
+	"PublicAccess",
+	"BaseURI",
+	"Retention",
+}
+
+// fields an update can't change, and what to
+// use instead
+var proxyUpdateFixedFields = map[string]string{
+	"Users": "add-proxy-user, remove-proxy-user and update-proxy-user",
+	"Viewers": "new-proxy-viewer",
+}
+
+var userUpdateFixedFields = map[string]string{
+	"Username": "remove-proxy-user and add-proxy-user",
+	"Password": "remove-proxy-user and add-proxy-user",
+	"FilterSpecs": "add-channel-filter and remove-channel-filter",
+	"CallbackSpecs": "add-user-callback and remove-user-callback",
+}
+
+/*
+ parseUpdate checks a partial update, a JSON
+ object holding only the fields of t to change,
+ and returns their Go names. Every unknown or
+ fixed field is reported.
+*/
+func parseUpdate(update []byte, t reflect.Type, fixed map[string]string) (error, []string) {
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(update, &values); err != nil {
+		return fmt.Errorf("the update must be a JSON object: %v", err), nil
+	}
+	if len(values) == 0 {
+		return errors.New("the update changes no fields"), nil
+	}
+	names := make(map[string]string)
+	for index := 0; index < t.NumField(); index++ {
+		field := t.Field(index)
+		tag := field.Tag.Get("json")
+		if field.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name := field.Name
+		if tag_name := strings.Split(tag, ",")[0]; tag_name != "" {
+			name = tag_name
+		}
+		names[strings.ToLower(name)] = field.Name
+	}
+	var fields, problems []string
+	for key := range values {
+		name, ok := names[strings.ToLower(key)]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v: unknown field", key))
+		} else if instead, ok := fixed[name]; ok {
+			problems = append(problems, fmt.Sprintf("%v: can't be updated; use %v", key, instead))
+		} else {
+			fields = append(fields, name)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; ")), nil
+	}
+	sort.Strings(fields)
+	return nil, fields
+}
+
+// applyUpdate replaces the named fields of
+// target with the ones in update; objects such
+// as Redaction are replaced as a whole
+func applyUpdate(update []byte, target interface{}, fields []string) error {
+	value := reflect.ValueOf(target).Elem()
+	for _, name := range fields {
+		field := value.FieldByName(name)
+		field.Set(reflect.Zero(field.Type()))
+	}
+	if err := json.Unmarshal(update, target); err != nil {
+		return fmt.Errorf("invalid update: %v", err)
+	}
+	return nil
+}
+
+// addedProblems returns the problems of after
+// that before did not already have, so an update
+// is only refused for what it breaks
+func addedProblems(before []string, after []string) []string {
+	var added []string
+	for _, problem := range after {
+		if !containsString(before, problem) {
+			added = append(added, problem)
+		}
+	}
+	return added
+}
+
+func (update *SettingsUpdate) markLive(live []string) {
+	for _, name := range update.Updated {
+		if containsString(live, name) {
+			update.Live = append(update.Live, name)
+		}
+	}
+}
+
+/*
+ UpdateProxy changes the settings in update, a
+ JSON object of ProxyContext fields, and keeps
+ the others. The new settings are validated
+ first; a new ListenIP or ListenPort moves a
+ running proxy's listener without dropping its
+ sessions. With dryRun nothing is changed.
+*/
+func (controller *ProxyController) UpdateProxy(proxyID uint64, update []byte, dryRun bool) (error, *SettingsUpdate) {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy == nil {
+		return err, nil
+	}
+	err, fields := parseUpdate(update, reflect.TypeOf(ProxyContext{}), proxyUpdateFixedFields)
+	if err != nil {
+		return err, nil
+	}
+	controller.reloadMutex.Lock()
+	defer controller.reloadMutex.Unlock()
+
+	data, err := json.Marshal(proxy)
+	if err != nil {
+		return err, nil
+	}
+	current, next := &ProxyContext{}, &ProxyContext{}
+	json.Unmarshal(data, current)
+	json.Unmarshal(data, next)
+	if err = applyUpdate(update, next, fields); err != nil {
+		return err, nil
+	}
+
+	problems := addedProblems(current.validateSettings(""), next.validateSettings(""))
+	moved := current.ListenIP != next.ListenIP || current.ListenPort != next.ListenPort
+	if moved {
+		if other, used := controller.listenerInUse(proxyID, next.ListenIP, next.ListenPort); used {
+			problems = append(problems, fmt.Sprintf("ListenPort: %v is also used by proxy %v", next.ListenPort, other))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; ")), nil
+	}
+
+	settings := changedProxySettings(current, next)
+	result := &SettingsUpdate{Updated: append([]string(nil), settings...)}
+	if current.ListenIP != next.ListenIP {
+		result.Updated = append(result.Updated, "ListenIP")
+	}
+	if current.ListenPort != next.ListenPort {
+		result.Updated = append(result.Updated, "ListenPort")
+	}
+	sort.Strings(result.Updated)
+	result.markLive(proxyLiveSettings)
+	if dryRun {
+		return nil, result
+	}
+	err = proxy.applySettings(next, settings)
+	if err == nil && moved {
+		err = proxy.reloadListener(next.ListenIP, next.ListenPort)
+	}
+	if err == nil && len(result.Updated) > 0 {
+		controller.Log.Printf("proxy %v updated: %v\n", proxyID, strings.Join(result.Updated, ", "))
+	}
+	return err, result
+}
+
+/*
+ UpdateProxyUser changes the fields in update, a
+ JSON object of ProxyUser fields, and keeps the
+ others. Sessions the user already has keep the
+ settings they started with; new sessions and
+ the user's viewers get the new ones.
+*/
+func (controller *ProxyController) UpdateProxyUser(proxyID uint64, username, password string, update []byte, dryRun bool) (error, *SettingsUpdate) {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy == nil {
+		return err, nil
+	}
+	err, fields := parseUpdate(update, reflect.TypeOf(ProxyUser{}), userUpdateFixedFields)
+	if err != nil {
+		return err, nil
+	}
+	controller.reloadMutex.Lock()
+	defer controller.reloadMutex.Unlock()
+
+	err, user, _ := proxy.GetProxyUser(username, password, false)
+	if err != nil {
+		return err, nil
+	}
+	current := user.clone()
+	next := user.clone()
+	if err = applyUpdate(update, next, fields); err != nil {
+		return err, nil
+	}
+	if problems := addedProblems(current.validateConfig(""), next.validateConfig("")); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; ")), nil
+	}
+
+	result := &SettingsUpdate{Updated: changedFields(current, next, nil)}
+	if dryRun || len(result.Updated) == 0 {
+		return nil, result
+	}
+	// set in place so the filters, callbacks and
+	// viewers of the user stay with it
+	user.mutex.Lock()
+	stored, wanted := reflect.ValueOf(user).Elem(), reflect.ValueOf(next).Elem()
+	for _, name := range result.Updated {
+		stored.FieldByName(name).Set(wanted.FieldByName(name))
+	}
+	user.mutex.Unlock()
+	controller.Log.Printf("user %v of proxy %v updated: %v\n", username, proxyID, strings.Join(result.Updated, ", "))
+	return nil, result
+}
+
+// listenerInUse finds another proxy that
+// listens where ip and port would
+func (controller *ProxyController) listenerInUse(proxyID uint64, ip string, port int) (uint64, bool) {
+	if port == 0 {
+		return 0, false
+	}
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	for id, proxy := range controller.Proxies {
+		if id == proxyID {
+			continue
+		}
+		proxy.mutex.Lock()
+		other_ip, other_port := proxy.ListenIP, proxy.ListenPort
+		proxy.mutex.Unlock()
+		if other_port == port && sameListenIP(other_ip, ip) {
+			return id, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,187 @@
+package sshproxyplus
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func TestControllerUpdateProxy(t *testing.T) {
+	controller := makeNewController()
+	folder := t.TempDir()
+	first, moved := int(newRandomPort().Int64()), int(newRandomPort().Int64())
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(fmt.Sprintf(`{"ListenIP": "127.0.0.1", "ListenPort": %v, "SessionFolder": %q, "RequireValidPassword": true, "PublicAccess": true}`, first, folder)),
+	}, controller, t)
+	proxyID := uint64(reply["ProxyID"].(float64))
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(fmt.Sprintf(`{"ListenIP": "0.0.0.0", "ListenPort": 2299, "SessionFolder": %q}`, folder)),
+	}, controller, t)
+	proxy, _ := controller.GetProxy(proxyID)
+
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY,
+		ProxyID: proxyID,
+		ProxyData: []byte(`{"OverrideUser": "ben", "PublicAccess": false}`),
+	}, controller, t)
+	update := &SettingsUpdate{}
+	replyField(reply, "Update", update)
+	if reply["Error"] != nil || strings.Join(update.Updated, ",") != "OverrideUser,PublicAccess" || strings.Join(update.Live, ",") != "PublicAccess" {
+		t.Fatalf("update-proxy = %v %+v, expected OverrideUser and a live PublicAccess", reply["Error"], update)
+	}
+	if proxy.OverrideUser != "ben" || proxy.PublicAccess || !proxy.RequireValidPassword || proxy.ListenPort != first {
+		t.Errorf("update-proxy did not change only the fields it was given: %+v", proxy)
+	}
+
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY,
+		ProxyID: proxyID,
+		ProxyData: []byte(`{"RequireValidPassword": false}`),
+		DryRun: true,
+	}, controller, t)
+	if reply["Error"] != nil || !proxy.RequireValidPassword {
+		t.Errorf("update-proxy dry run = %v, expected it to change nothing", reply["Error"])
+	}
+
+	for update, expected := range map[string]string{
+		`{"Users": {}}`: "use add-proxy-user",
+		`{"ListenPrt": 2223}`: "ListenPrt: unknown field",
+		`{"SessionFolder": "/nonexistent/sessions"}`: "SessionFolder:",
+		`{"ListenPort": 2299}`: "is also used by proxy",
+		`{"ListenPort": "2223"}`: "invalid update",
+		`{}`: "changes no fields",
+	} {
+		reply = simulateMessage(&ControllerMessage{MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY, ProxyID: proxyID, ProxyData: []byte(update)}, controller, t)
+		if err, _ := reply["Error"].(string); !strings.Contains(err, expected) {
+			t.Errorf("update-proxy %v = %q, expected an error with %q", update, err, expected)
+		}
+	}
+	if proxy.SessionFolder != folder || proxy.ListenPort != first {
+		t.Errorf("a refused update-proxy changed the proxy")
+	}
+
+	controller.StartProxy(proxyID)
+	defer controller.StopProxy(proxyID)
+	time.Sleep(500*time.Millisecond)
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY,
+		ProxyID: proxyID,
+		ProxyData: []byte(fmt.Sprintf(`{"ListenPort": %v}`, moved)),
+	}, controller, t)
+	if reply["Error"] != nil {
+		t.Fatalf("update-proxy of ListenPort = %v", reply["Error"])
+	}
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(moved), time.Second); err != nil {
+		t.Errorf("update-proxy did not move the listener: %v", err)
+	} else {
+		conn.Close()
+	}
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(first), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("proxy still listens on its old port after update-proxy")
+	}
+}
+
+func TestControllerUpdateProxyUser(t *testing.T) {
+	controller := makeNewController()
+	controller.APIToken = "token"
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(fmt.Sprintf(`{"ListenPort": 2222, "SessionFolder": %q}`, t.TempDir())),
+	}, controller, t)
+	proxyID := uint64(reply["ProxyID"].(float64))
+	simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_PROXY_USER,
+		ProxyID: proxyID,
+		ProxyUser: &ProxyUser{
+			Username: "user",
+			Password: "pass",
+			RemoteHost: "127.0.0.1:22",
+			RemoteUsername: "remote",
+			FilterSpecs: []*ChannelFilterSpec{{Type: CHANNEL_FILTER_REPLACE, Parameters: map[string]string{"find": "a", "replace": "b"}}},
+		},
+	}, controller, t)
+	proxy, _ := controller.GetProxy(proxyID)
+	// what a session that is already running holds
+	_, session_user, _ := proxy.GetProxyUser("user", "pass", true)
+
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY_USER,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "pass",
+		UserData: []byte(`{"RemoteHost": "10.0.0.5:2222", "RequireApproval": true, "RemoteUsername": "remote"}`),
+	}, controller, t)
+	update := &SettingsUpdate{}
+	replyField(reply, "Update", update)
+	if reply["Error"] != nil || strings.Join(update.Updated, ",") != "RemoteHost,RequireApproval" || len(update.Live) != 0 {
+		t.Fatalf("update-proxy-user = %v %+v, expected RemoteHost and RequireApproval", reply["Error"], update)
+	}
+	_, user, _ := proxy.GetProxyUser("user", "pass", false)
+	if user.RemoteHost != "10.0.0.5:2222" || !user.RequireApproval || user.RemoteUsername != "remote" || len(user.getChannelFilters()) != 1 {
+		t.Errorf("update-proxy-user left %+v", user)
+	}
+	if session_user.RemoteHost != "127.0.0.1:22" {
+		t.Errorf("update-proxy-user changed the user of a running session")
+	}
+
+	for update, expected := range map[string]string{
+		`{"Password": "other"}`: "use remove-proxy-user and add-proxy-user",
+		`{"RemoteHost": "10.0.0.5"}`: "RemoteHost:",
+	} {
+		reply = simulateMessage(&ControllerMessage{
+			MessageType: CONTROLLER_MESSAGE_UPDATE_PROXY_USER,
+			ProxyID: proxyID,
+			Username: "user",
+			Password: "pass",
+			UserData: []byte(update),
+		}, controller, t)
+		if err, _ := reply["Error"].(string); !strings.Contains(err, expected) {
+			t.Errorf("update-proxy-user %v = %q, expected an error with %q", update, err, expected)
+		}
+	}
+
+	response := apiCallWithPassword(controller, http.MethodPatch, fmt.Sprintf("/proxies/%v/users/user", proxyID), "token", "pass", `{"MaxSessions": 2}`)
+	if response.Code != http.StatusOK || user.MaxSessions != 2 {
+		t.Errorf("PATCH /proxies/{id}/users/{username} = %v %v, expected 200", response.Code, response.Body.String())
+	}
+	response = apiCall(controller, http.MethodPatch, fmt.Sprintf("/proxies/%v/users/nobody", proxyID), "token", `{"MaxSessions": 2}`)
+	if response.Code == http.StatusOK {
+		t.Errorf("PATCH of a missing user = %v, expected an error", response.Code)
+	}
+}
+
+func TestControllerUpdateProxyWhileAuthenticating(t *testing.T) {
+	controller := makeNewController()
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(fmt.Sprintf(`{"ListenPort": 2222, "SessionFolder": %q}`, t.TempDir())),
+	}, controller, t)
+	proxyID := uint64(reply["ProxyID"].(float64))
+	proxy, _ := controller.GetProxy(proxyID)
+
+	done := make(chan bool)
+	go func() {
+		for index := 0; index < 50; index++ {
+			update := fmt.Sprintf(`{"OverrideUser": "user%v", "RequireValidPassword": %v, "PublicAccess": %v}`, index, index%2 == 0, index%2 == 1)
+			controller.UpdateProxy(proxyID, []byte(update), false)
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			proxy.AuthenticateUser("user", "pass")
+			proxy.isPublic()
+		}
+	}
+}
@@ -0,0 +1,1437 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: controller.proto
+
+package controllerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ProxyControllerServiceClient is the client API for ProxyControllerService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProxyControllerServiceClient interface {
+	CreateProxy(ctx context.Context, in *CreateProxyRequest, opts ...grpc.CallOption) (*ProxyID, error)
+	StartProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	StopProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	DestroyProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ActivateProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	DeactivateProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListProxies(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ProxyList, error)
+	GetProxyInfo(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*ProxyInfo, error)
+	UpdateProxy(ctx context.Context, in *UpdateProxyRequest, opts ...grpc.CallOption) (*SettingsUpdate, error)
+	AddProxyUser(ctx context.Context, in *AddProxyUserRequest, opts ...grpc.CallOption) (*Key, error)
+	RemoveProxyUser(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	UpdateProxyUser(ctx context.Context, in *UpdateProxyUserRequest, opts ...grpc.CallOption) (*SettingsUpdate, error)
+	AddChannelFilter(ctx context.Context, in *AddChannelFilterRequest, opts ...grpc.CallOption) (*Key, error)
+	RemoveChannelFilter(ctx context.Context, in *RemoveKeyRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	AddUserCallback(ctx context.Context, in *AddUserCallbackRequest, opts ...grpc.CallOption) (*Key, error)
+	RemoveUserCallback(ctx context.Context, in *RemoveKeyRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListChannelFilters(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*ChannelFilterList, error)
+	ListUserCallbacks(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*EventCallbackList, error)
+	GetProxyViewer(ctx context.Context, in *GetProxyViewerRequest, opts ...grpc.CallOption) (*Viewer, error)
+	GetProxyViewers(ctx context.Context, in *GetProxyViewersRequest, opts ...grpc.CallOption) (*ViewerList, error)
+	NewProxyViewer(ctx context.Context, in *NewProxyViewerRequest, opts ...grpc.CallOption) (*Viewer, error)
+	SetViewerOperator(ctx context.Context, in *SetViewerOperatorRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	SetProxyRedaction(ctx context.Context, in *SetProxyConfigRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	SetProxyRetention(ctx context.Context, in *SetProxyConfigRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ApplyProxyRetention(ctx context.Context, in *ApplyProxyRetentionRequest, opts ...grpc.CallOption) (*RetentionReport, error)
+	SearchSessions(ctx context.Context, in *SearchSessionsRequest, opts ...grpc.CallOption) (*SearchSessionsReply, error)
+	KillSession(ctx context.Context, in *KillSessionRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ApproveSession(ctx context.Context, in *SessionDecisionRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	DenySession(ctx context.Context, in *SessionDecisionRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListPendingSessions(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*SessionKeys, error)
+	CreateControllerKey(ctx context.Context, in *ControllerKey, opts ...grpc.CallOption) (*ControllerKey, error)
+	RotateControllerKey(ctx context.Context, in *KeyName, opts ...grpc.CallOption) (*ControllerKey, error)
+	RevokeControllerKey(ctx context.Context, in *KeyName, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListControllerKeys(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ControllerKeyList, error)
+	QueryAuditLog(ctx context.Context, in *AuditQuery, opts ...grpc.CallOption) (*AuditEntries, error)
+	ReloadConfig(ctx context.Context, in *ReloadConfigRequest, opts ...grpc.CallOption) (*ConfigDiff, error)
+	// streams the events of a session, from
+	// from_event on; with follow set it keeps
+	// streaming until the session ends
+	WatchSession(ctx context.Context, in *WatchSessionRequest, opts ...grpc.CallOption) (ProxyControllerService_WatchSessionClient, error)
+}
+
+type proxyControllerServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProxyControllerServiceClient(cc grpc.ClientConnInterface) ProxyControllerServiceClient {
+	return &proxyControllerServiceClient{cc}
+}
+
+func (c *proxyControllerServiceClient) CreateProxy(ctx context.Context, in *CreateProxyRequest, opts ...grpc.CallOption) (*ProxyID, error) {
+	out := new(ProxyID)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/CreateProxy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) StartProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/StartProxy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) StopProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/StopProxy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) DestroyProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/DestroyProxy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ActivateProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ActivateProxy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) DeactivateProxy(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/DeactivateProxy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ListProxies(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ProxyList, error) {
+	out := new(ProxyList)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ListProxies", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) GetProxyInfo(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*ProxyInfo, error) {
+	out := new(ProxyInfo)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/GetProxyInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) UpdateProxy(ctx context.Context, in *UpdateProxyRequest, opts ...grpc.CallOption) (*SettingsUpdate, error) {
+	out := new(SettingsUpdate)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/UpdateProxy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) AddProxyUser(ctx context.Context, in *AddProxyUserRequest, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/AddProxyUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) RemoveProxyUser(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/RemoveProxyUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) UpdateProxyUser(ctx context.Context, in *UpdateProxyUserRequest, opts ...grpc.CallOption) (*SettingsUpdate, error) {
+	out := new(SettingsUpdate)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/UpdateProxyUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) AddChannelFilter(ctx context.Context, in *AddChannelFilterRequest, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/AddChannelFilter", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) RemoveChannelFilter(ctx context.Context, in *RemoveKeyRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/RemoveChannelFilter", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) AddUserCallback(ctx context.Context, in *AddUserCallbackRequest, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/AddUserCallback", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) RemoveUserCallback(ctx context.Context, in *RemoveKeyRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/RemoveUserCallback", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ListChannelFilters(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*ChannelFilterList, error) {
+	out := new(ChannelFilterList)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ListChannelFilters", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ListUserCallbacks(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*EventCallbackList, error) {
+	out := new(EventCallbackList)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ListUserCallbacks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) GetProxyViewer(ctx context.Context, in *GetProxyViewerRequest, opts ...grpc.CallOption) (*Viewer, error) {
+	out := new(Viewer)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/GetProxyViewer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) GetProxyViewers(ctx context.Context, in *GetProxyViewersRequest, opts ...grpc.CallOption) (*ViewerList, error) {
+	out := new(ViewerList)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/GetProxyViewers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) NewProxyViewer(ctx context.Context, in *NewProxyViewerRequest, opts ...grpc.CallOption) (*Viewer, error) {
+	out := new(Viewer)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/NewProxyViewer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) SetViewerOperator(ctx context.Context, in *SetViewerOperatorRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/SetViewerOperator", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) SetProxyRedaction(ctx context.Context, in *SetProxyConfigRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/SetProxyRedaction", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) SetProxyRetention(ctx context.Context, in *SetProxyConfigRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/SetProxyRetention", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ApplyProxyRetention(ctx context.Context, in *ApplyProxyRetentionRequest, opts ...grpc.CallOption) (*RetentionReport, error) {
+	out := new(RetentionReport)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ApplyProxyRetention", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) SearchSessions(ctx context.Context, in *SearchSessionsRequest, opts ...grpc.CallOption) (*SearchSessionsReply, error) {
+	out := new(SearchSessionsReply)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/SearchSessions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) KillSession(ctx context.Context, in *KillSessionRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/KillSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ApproveSession(ctx context.Context, in *SessionDecisionRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ApproveSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) DenySession(ctx context.Context, in *SessionDecisionRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/DenySession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ListPendingSessions(ctx context.Context, in *ProxyID, opts ...grpc.CallOption) (*SessionKeys, error) {
+	out := new(SessionKeys)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ListPendingSessions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) CreateControllerKey(ctx context.Context, in *ControllerKey, opts ...grpc.CallOption) (*ControllerKey, error) {
+	out := new(ControllerKey)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/CreateControllerKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) RotateControllerKey(ctx context.Context, in *KeyName, opts ...grpc.CallOption) (*ControllerKey, error) {
+	out := new(ControllerKey)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/RotateControllerKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) RevokeControllerKey(ctx context.Context, in *KeyName, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/RevokeControllerKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ListControllerKeys(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ControllerKeyList, error) {
+	out := new(ControllerKeyList)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ListControllerKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) QueryAuditLog(ctx context.Context, in *AuditQuery, opts ...grpc.CallOption) (*AuditEntries, error) {
+	out := new(AuditEntries)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/QueryAuditLog", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) ReloadConfig(ctx context.Context, in *ReloadConfigRequest, opts ...grpc.CallOption) (*ConfigDiff, error) {
+	out := new(ConfigDiff)
+	err := c.cc.Invoke(ctx, "/sshproxyplus.v1.ProxyControllerService/ReloadConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyControllerServiceClient) WatchSession(ctx context.Context, in *WatchSessionRequest, opts ...grpc.CallOption) (ProxyControllerService_WatchSessionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ProxyControllerService_ServiceDesc.Streams[0], "/sshproxyplus.v1.ProxyControllerService/WatchSession", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &proxyControllerServiceWatchSessionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ProxyControllerService_WatchSessionClient interface {
+	Recv() (*SessionEvent, error)
+	grpc.ClientStream
+}
+
+type proxyControllerServiceWatchSessionClient struct {
+	grpc.ClientStream
+}
+
+func (x *proxyControllerServiceWatchSessionClient) Recv() (*SessionEvent, error) {
+	m := new(SessionEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ProxyControllerServiceServer is the server API for ProxyControllerService service.
+// All implementations must embed UnimplementedProxyControllerServiceServer
+// for forward compatibility
+type ProxyControllerServiceServer interface {
+	CreateProxy(context.Context, *CreateProxyRequest) (*ProxyID, error)
+	StartProxy(context.Context, *ProxyID) (*emptypb.Empty, error)
+	StopProxy(context.Context, *ProxyID) (*emptypb.Empty, error)
+	DestroyProxy(context.Context, *ProxyID) (*emptypb.Empty, error)
+	ActivateProxy(context.Context, *ProxyID) (*emptypb.Empty, error)
+	DeactivateProxy(context.Context, *ProxyID) (*emptypb.Empty, error)
+	ListProxies(context.Context, *emptypb.Empty) (*ProxyList, error)
+	GetProxyInfo(context.Context, *ProxyID) (*ProxyInfo, error)
+	UpdateProxy(context.Context, *UpdateProxyRequest) (*SettingsUpdate, error)
+	AddProxyUser(context.Context, *AddProxyUserRequest) (*Key, error)
+	RemoveProxyUser(context.Context, *UserRequest) (*emptypb.Empty, error)
+	UpdateProxyUser(context.Context, *UpdateProxyUserRequest) (*SettingsUpdate, error)
+	AddChannelFilter(context.Context, *AddChannelFilterRequest) (*Key, error)
+	RemoveChannelFilter(context.Context, *RemoveKeyRequest) (*emptypb.Empty, error)
+	AddUserCallback(context.Context, *AddUserCallbackRequest) (*Key, error)
+	RemoveUserCallback(context.Context, *RemoveKeyRequest) (*emptypb.Empty, error)
+	ListChannelFilters(context.Context, *UserRequest) (*ChannelFilterList, error)
+	ListUserCallbacks(context.Context, *UserRequest) (*EventCallbackList, error)
+	GetProxyViewer(context.Context, *GetProxyViewerRequest) (*Viewer, error)
+	GetProxyViewers(context.Context, *GetProxyViewersRequest) (*ViewerList, error)
+	NewProxyViewer(context.Context, *NewProxyViewerRequest) (*Viewer, error)
+	SetViewerOperator(context.Context, *SetViewerOperatorRequest) (*emptypb.Empty, error)
+	SetProxyRedaction(context.Context, *SetProxyConfigRequest) (*emptypb.Empty, error)
+	SetProxyRetention(context.Context, *SetProxyConfigRequest) (*emptypb.Empty, error)
+	ApplyProxyRetention(context.Context, *ApplyProxyRetentionRequest) (*RetentionReport, error)
+	SearchSessions(context.Context, *SearchSessionsRequest) (*SearchSessionsReply, error)
+	KillSession(context.Context, *KillSessionRequest) (*emptypb.Empty, error)
+	ApproveSession(context.Context, *SessionDecisionRequest) (*emptypb.Empty, error)
+	DenySession(context.Context, *SessionDecisionRequest) (*emptypb.Empty, error)
+	ListPendingSessions(context.Context, *ProxyID) (*SessionKeys, error)
+	CreateControllerKey(context.Context, *ControllerKey) (*ControllerKey, error)
+	RotateControllerKey(context.Context, *KeyName) (*ControllerKey, error)
+	RevokeControllerKey(context.Context, *KeyName) (*emptypb.Empty, error)
+	ListControllerKeys(context.Context, *emptypb.Empty) (*ControllerKeyList, error)
+	QueryAuditLog(context.Context, *AuditQuery) (*AuditEntries, error)
+	ReloadConfig(context.Context, *ReloadConfigRequest) (*ConfigDiff, error)
+	// streams the events of a session, from
+	// from_event on; with follow set it keeps
+	// streaming until the session ends
+	WatchSession(*WatchSessionRequest, ProxyControllerService_WatchSessionServer) error
+	mustEmbedUnimplementedProxyControllerServiceServer()
+}
+
+// UnimplementedProxyControllerServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedProxyControllerServiceServer struct {
+}
+
+func (UnimplementedProxyControllerServiceServer) CreateProxy(context.Context, *CreateProxyRequest) (*ProxyID, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateProxy not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) StartProxy(context.Context, *ProxyID) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartProxy not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) StopProxy(context.Context, *ProxyID) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StopProxy not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) DestroyProxy(context.Context, *ProxyID) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DestroyProxy not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ActivateProxy(context.Context, *ProxyID) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ActivateProxy not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) DeactivateProxy(context.Context, *ProxyID) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeactivateProxy not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ListProxies(context.Context, *emptypb.Empty) (*ProxyList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListProxies not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) GetProxyInfo(context.Context, *ProxyID) (*ProxyInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetProxyInfo not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) UpdateProxy(context.Context, *UpdateProxyRequest) (*SettingsUpdate, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateProxy not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) AddProxyUser(context.Context, *AddProxyUserRequest) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddProxyUser not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) RemoveProxyUser(context.Context, *UserRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveProxyUser not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) UpdateProxyUser(context.Context, *UpdateProxyUserRequest) (*SettingsUpdate, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateProxyUser not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) AddChannelFilter(context.Context, *AddChannelFilterRequest) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddChannelFilter not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) RemoveChannelFilter(context.Context, *RemoveKeyRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveChannelFilter not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) AddUserCallback(context.Context, *AddUserCallbackRequest) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddUserCallback not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) RemoveUserCallback(context.Context, *RemoveKeyRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveUserCallback not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ListChannelFilters(context.Context, *UserRequest) (*ChannelFilterList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListChannelFilters not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ListUserCallbacks(context.Context, *UserRequest) (*EventCallbackList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUserCallbacks not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) GetProxyViewer(context.Context, *GetProxyViewerRequest) (*Viewer, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetProxyViewer not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) GetProxyViewers(context.Context, *GetProxyViewersRequest) (*ViewerList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetProxyViewers not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) NewProxyViewer(context.Context, *NewProxyViewerRequest) (*Viewer, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method NewProxyViewer not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) SetViewerOperator(context.Context, *SetViewerOperatorRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetViewerOperator not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) SetProxyRedaction(context.Context, *SetProxyConfigRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetProxyRedaction not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) SetProxyRetention(context.Context, *SetProxyConfigRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetProxyRetention not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ApplyProxyRetention(context.Context, *ApplyProxyRetentionRequest) (*RetentionReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApplyProxyRetention not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) SearchSessions(context.Context, *SearchSessionsRequest) (*SearchSessionsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchSessions not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) KillSession(context.Context, *KillSessionRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KillSession not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ApproveSession(context.Context, *SessionDecisionRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApproveSession not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) DenySession(context.Context, *SessionDecisionRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DenySession not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ListPendingSessions(context.Context, *ProxyID) (*SessionKeys, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPendingSessions not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) CreateControllerKey(context.Context, *ControllerKey) (*ControllerKey, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateControllerKey not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) RotateControllerKey(context.Context, *KeyName) (*ControllerKey, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateControllerKey not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) RevokeControllerKey(context.Context, *KeyName) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeControllerKey not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ListControllerKeys(context.Context, *emptypb.Empty) (*ControllerKeyList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListControllerKeys not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) QueryAuditLog(context.Context, *AuditQuery) (*AuditEntries, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAuditLog not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) ReloadConfig(context.Context, *ReloadConfigRequest) (*ConfigDiff, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReloadConfig not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) WatchSession(*WatchSessionRequest, ProxyControllerService_WatchSessionServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchSession not implemented")
+}
+func (UnimplementedProxyControllerServiceServer) mustEmbedUnimplementedProxyControllerServiceServer() {
+}
+
+// UnsafeProxyControllerServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProxyControllerServiceServer will
+// result in compilation errors.
+type UnsafeProxyControllerServiceServer interface {
+	mustEmbedUnimplementedProxyControllerServiceServer()
+}
+
+func RegisterProxyControllerServiceServer(s grpc.ServiceRegistrar, srv ProxyControllerServiceServer) {
+	s.RegisterService(&ProxyControllerService_ServiceDesc, srv)
+}
+
+func _ProxyControllerService_CreateProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateProxyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).CreateProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/CreateProxy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).CreateProxy(ctx, req.(*CreateProxyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_StartProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProxyID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).StartProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/StartProxy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).StartProxy(ctx, req.(*ProxyID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_StopProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProxyID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).StopProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/StopProxy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).StopProxy(ctx, req.(*ProxyID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_DestroyProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProxyID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).DestroyProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/DestroyProxy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).DestroyProxy(ctx, req.(*ProxyID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ActivateProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProxyID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ActivateProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ActivateProxy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ActivateProxy(ctx, req.(*ProxyID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_DeactivateProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProxyID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).DeactivateProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/DeactivateProxy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).DeactivateProxy(ctx, req.(*ProxyID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ListProxies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ListProxies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ListProxies",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ListProxies(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_GetProxyInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProxyID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).GetProxyInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/GetProxyInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).GetProxyInfo(ctx, req.(*ProxyID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_UpdateProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateProxyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).UpdateProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/UpdateProxy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).UpdateProxy(ctx, req.(*UpdateProxyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_AddProxyUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddProxyUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).AddProxyUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/AddProxyUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).AddProxyUser(ctx, req.(*AddProxyUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_RemoveProxyUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).RemoveProxyUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/RemoveProxyUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).RemoveProxyUser(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_UpdateProxyUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateProxyUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).UpdateProxyUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/UpdateProxyUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).UpdateProxyUser(ctx, req.(*UpdateProxyUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_AddChannelFilter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddChannelFilterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).AddChannelFilter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/AddChannelFilter",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).AddChannelFilter(ctx, req.(*AddChannelFilterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_RemoveChannelFilter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).RemoveChannelFilter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/RemoveChannelFilter",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).RemoveChannelFilter(ctx, req.(*RemoveKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_AddUserCallback_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddUserCallbackRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).AddUserCallback(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/AddUserCallback",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).AddUserCallback(ctx, req.(*AddUserCallbackRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_RemoveUserCallback_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).RemoveUserCallback(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/RemoveUserCallback",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).RemoveUserCallback(ctx, req.(*RemoveKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ListChannelFilters_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ListChannelFilters(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ListChannelFilters",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ListChannelFilters(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ListUserCallbacks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ListUserCallbacks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ListUserCallbacks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ListUserCallbacks(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_GetProxyViewer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetProxyViewerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).GetProxyViewer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/GetProxyViewer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).GetProxyViewer(ctx, req.(*GetProxyViewerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_GetProxyViewers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetProxyViewersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).GetProxyViewers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/GetProxyViewers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).GetProxyViewers(ctx, req.(*GetProxyViewersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_NewProxyViewer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NewProxyViewerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).NewProxyViewer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/NewProxyViewer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).NewProxyViewer(ctx, req.(*NewProxyViewerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_SetViewerOperator_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetViewerOperatorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).SetViewerOperator(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/SetViewerOperator",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).SetViewerOperator(ctx, req.(*SetViewerOperatorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_SetProxyRedaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetProxyConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).SetProxyRedaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/SetProxyRedaction",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).SetProxyRedaction(ctx, req.(*SetProxyConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_SetProxyRetention_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetProxyConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).SetProxyRetention(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/SetProxyRetention",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).SetProxyRetention(ctx, req.(*SetProxyConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ApplyProxyRetention_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ApplyProxyRetentionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ApplyProxyRetention(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ApplyProxyRetention",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ApplyProxyRetention(ctx, req.(*ApplyProxyRetentionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_SearchSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchSessionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).SearchSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/SearchSessions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).SearchSessions(ctx, req.(*SearchSessionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_KillSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KillSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).KillSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/KillSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).KillSession(ctx, req.(*KillSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ApproveSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionDecisionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ApproveSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ApproveSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ApproveSession(ctx, req.(*SessionDecisionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_DenySession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionDecisionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).DenySession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/DenySession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).DenySession(ctx, req.(*SessionDecisionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ListPendingSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProxyID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ListPendingSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ListPendingSessions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ListPendingSessions(ctx, req.(*ProxyID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_CreateControllerKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ControllerKey)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).CreateControllerKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/CreateControllerKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).CreateControllerKey(ctx, req.(*ControllerKey))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_RotateControllerKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyName)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).RotateControllerKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/RotateControllerKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).RotateControllerKey(ctx, req.(*KeyName))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_RevokeControllerKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyName)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).RevokeControllerKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/RevokeControllerKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).RevokeControllerKey(ctx, req.(*KeyName))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ListControllerKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ListControllerKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ListControllerKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ListControllerKeys(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_QueryAuditLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuditQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).QueryAuditLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/QueryAuditLog",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).QueryAuditLog(ctx, req.(*AuditQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_ReloadConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyControllerServiceServer).ReloadConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshproxyplus.v1.ProxyControllerService/ReloadConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyControllerServiceServer).ReloadConfig(ctx, req.(*ReloadConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyControllerService_WatchSession_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchSessionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProxyControllerServiceServer).WatchSession(m, &proxyControllerServiceWatchSessionServer{stream})
+}
+
+type ProxyControllerService_WatchSessionServer interface {
+	Send(*SessionEvent) error
+	grpc.ServerStream
+}
+
+type proxyControllerServiceWatchSessionServer struct {
+	grpc.ServerStream
+}
+
+func (x *proxyControllerServiceWatchSessionServer) Send(m *SessionEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// ProxyControllerService_ServiceDesc is the grpc.ServiceDesc for ProxyControllerService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ProxyControllerService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sshproxyplus.v1.ProxyControllerService",
+	HandlerType: (*ProxyControllerServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateProxy",
+			Handler:    _ProxyControllerService_CreateProxy_Handler,
+		},
+		{
+			MethodName: "StartProxy",
+			Handler:    _ProxyControllerService_StartProxy_Handler,
+		},
+		{
+			MethodName: "StopProxy",
+			Handler:    _ProxyControllerService_StopProxy_Handler,
+		},
+		{
+			MethodName: "DestroyProxy",
+			Handler:    _ProxyControllerService_DestroyProxy_Handler,
+		},
+		{
+			MethodName: "ActivateProxy",
+			Handler:    _ProxyControllerService_ActivateProxy_Handler,
+		},
+		{
+			MethodName: "DeactivateProxy",
+			Handler:    _ProxyControllerService_DeactivateProxy_Handler,
+		},
+		{
+			MethodName: "ListProxies",
+			Handler:    _ProxyControllerService_ListProxies_Handler,
+		},
+		{
+			MethodName: "GetProxyInfo",
+			Handler:    _ProxyControllerService_GetProxyInfo_Handler,
+		},
+		{
+			MethodName: "UpdateProxy",
+			Handler:    _ProxyControllerService_UpdateProxy_Handler,
+		},
+		{
+			MethodName: "AddProxyUser",
+			Handler:    _ProxyControllerService_AddProxyUser_Handler,
+		},
+		{
+			MethodName: "RemoveProxyUser",
+			Handler:    _ProxyControllerService_RemoveProxyUser_Handler,
+		},
+		{
+			MethodName: "UpdateProxyUser",
+			Handler:    _ProxyControllerService_UpdateProxyUser_Handler,
+		},
+		{
+			MethodName: "AddChannelFilter",
+			Handler:    _ProxyControllerService_AddChannelFilter_Handler,
+		},
+		{
+			MethodName: "RemoveChannelFilter",
+			Handler:    _ProxyControllerService_RemoveChannelFilter_Handler,
+		},
+		{
+			MethodName: "AddUserCallback",
+			Handler:    _ProxyControllerService_AddUserCallback_Handler,
+		},
+		{
+			MethodName: "RemoveUserCallback",
+			Handler:    _ProxyControllerService_RemoveUserCallback_Handler,
+		},
+		{
+			MethodName: "ListChannelFilters",
+			Handler:    _ProxyControllerService_ListChannelFilters_Handler,
+		},
+		{
+			MethodName: "ListUserCallbacks",
+			Handler:    _ProxyControllerService_ListUserCallbacks_Handler,
+		},
+		{
+			MethodName: "GetProxyViewer",
+			Handler:    _ProxyControllerService_GetProxyViewer_Handler,
+		},
+		{
+			MethodName: "GetProxyViewers",
+			Handler:    _ProxyControllerService_GetProxyViewers_Handler,
+		},
+		{
+			MethodName: "NewProxyViewer",
+			Handler:    _ProxyControllerService_NewProxyViewer_Handler,
+		},
+		{
+			MethodName: "SetViewerOperator",
+			Handler:    _ProxyControllerService_SetViewerOperator_Handler,
+		},
+		{
+			MethodName: "SetProxyRedaction",
+			Handler:    _ProxyControllerService_SetProxyRedaction_Handler,
+		},
+		{
+			MethodName: "SetProxyRetention",
+			Handler:    _ProxyControllerService_SetProxyRetention_Handler,
+		},
+		{
+			MethodName: "ApplyProxyRetention",
+			Handler:    _ProxyControllerService_ApplyProxyRetention_Handler,
+		},
+		{
+			MethodName: "SearchSessions",
+			Handler:    _ProxyControllerService_SearchSessions_Handler,
+		},
+		{
+			MethodName: "KillSession",
+			Handler:    _ProxyControllerService_KillSession_Handler,
+		},
+		{
+			MethodName: "ApproveSession",
+			Handler:    _ProxyControllerService_ApproveSession_Handler,
+		},
+		{
+			MethodName: "DenySession",
+			Handler:    _ProxyControllerService_DenySession_Handler,
+		},
+		{
+			MethodName: "ListPendingSessions",
+			Handler:    _ProxyControllerService_ListPendingSessions_Handler,
+		},
+		{
+			MethodName: "CreateControllerKey",
+			Handler:    _ProxyControllerService_CreateControllerKey_Handler,
+		},
+		{
+			MethodName: "RotateControllerKey",
+			Handler:    _ProxyControllerService_RotateControllerKey_Handler,
+		},
+		{
+			MethodName: "RevokeControllerKey",
+			Handler:    _ProxyControllerService_RevokeControllerKey_Handler,
+		},
+		{
+			MethodName: "ListControllerKeys",
+			Handler:    _ProxyControllerService_ListControllerKeys_Handler,
+		},
+		{
+			MethodName: "QueryAuditLog",
+			Handler:    _ProxyControllerService_QueryAuditLog_Handler,
+		},
+		{
+			MethodName: "ReloadConfig",
+			Handler:    _ProxyControllerService_ReloadConfig_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchSession",
+			Handler:       _ProxyControllerService_WatchSession_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "controller.proto",
+}
@@ -0,0 +1,8 @@
+/*
+ Package controllerpb holds the protobuf service
+ definition of the controller's gRPC control
+ plane and the code generated from it.
+*/
+package controllerpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative controller.proto
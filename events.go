@@ -11,6 +11,37 @@ const EVENT_NEW_REQUEST 	string = "new-request"
 const EVENT_NEW_CHANNEL 	string = "new-channel"
 const EVENT_WINDOW_RESIZE 	string = "window-resize"
 const EVENT_MESSAGE	 		string = "new-message"
+const EVENT_SESSION_TERMINATED	string = "session-terminated"
+const EVENT_TAKEOVER_START		string = "takeover-start"
+const EVENT_TAKEOVER_STOP		string = "takeover-stop"
+const EVENT_OPERATOR_INPUT		string = "operator-input"
+const EVENT_OBSERVER_JOIN		string = "observer-join"
+const EVENT_OBSERVER_LEAVE		string = "observer-leave"
+const EVENT_APPROVAL_PENDING	string = "approval-pending"
+const EVENT_SESSION_APPROVED	string = "session-approved"
+const EVENT_SESSION_DENIED		string = "session-denied"
+const EVENT_SESSION_TIMEOUT		string = "session-timeout"
+const EVENT_LIMIT_EXCEEDED		string = "limit-exceeded"
+
+var sessionEventTypes = []string{
+	EVENT_SESSION_START,
+	EVENT_SESSION_STOP,
+	EVENT_NEW_REQUEST,
+	EVENT_NEW_CHANNEL,
+	EVENT_WINDOW_RESIZE,
+	EVENT_MESSAGE,
+	EVENT_SESSION_TERMINATED,
+	EVENT_TAKEOVER_START,
+	EVENT_TAKEOVER_STOP,
+	EVENT_OPERATOR_INPUT,
+	EVENT_OBSERVER_JOIN,
+	EVENT_OBSERVER_LEAVE,
+	EVENT_APPROVAL_PENDING,
+	EVENT_SESSION_APPROVED,
+	EVENT_SESSION_DENIED,
+	EVENT_SESSION_TIMEOUT,
+	EVENT_LIMIT_EXCEEDED,
+}
 
 
 /*
@@ -42,6 +73,13 @@ type SessionEvent struct {
 	RequestPayload	[]byte		`json:"request_payload,omitempty"`
 	ChannelID		int			`json:"channel_id,omitempty"`
 	RequestID		int			`json:"request_id,omitempty"`
+	TerminatedBy	string		`json:"terminated_by,omitempty"`
+	Reason			string		`json:"reason,omitempty"`
+	Operator		string		`json:"operator,omitempty"`
+	Exclusive		bool		`json:"exclusive,omitempty"`
+	Timeout			int64		`json:"timeout,omitempty"`
+	Limit			int			`json:"limit,omitempty"`
+	Sessions		[]string	`json:"sessions,omitempty"`
 }
 
 func (event *SessionEvent) ToJSON() string {
@@ -64,6 +102,9 @@ func (session * SessionContext) AddEvent(event *SessionEvent) *SessionEvent{
 	event.TimeOffset = session.GetTimeOffset()
 	session.event_mutex.Lock()
 	session.events = append(session.events, event)
+	// index under the lock so lines are built
+	// in the order the events are stored
+	session.proxy.getSearchIndex().AddEvent(session, event, session.events_dropped + len(session.events) - 1)
 	session.event_mutex.Unlock()
 	return event
 }
@@ -86,32 +127,46 @@ func (session * SessionContext) LogEvent(event *SessionEvent) {
 }
 
 func (session * SessionContext) HandleEvent(event *SessionEvent) {
-	go func(session * SessionContext, event *SessionEvent) {
-		if(session.user.EventCallbacks != nil)	{
-			for _, callback := range session.user.EventCallbacks  {
+	session.proxy.getRedaction().redactEvent(event)
+	// callbacks get a copy since the event is
+	// updated as it is stored
+	go func(session * SessionContext, event SessionEvent) {
+		if callbacks := session.user.getEventCallbacks(); callbacks != nil {
+			for _, callback := range callbacks  {
 				if callback.events != nil {
 					if triggerEvent, ok :=  callback.events[event.Type]; ok {
 						if triggerEvent {
-							go callback.handler(*event)
+							go callback.handler(event)
 						}
 					}
 				}
 			}
 		}
-	}(session,event)
+	}(session,*event)
+	session.record_mutex.Lock()
 	updated_event := session.AddEvent(event)
 	session.LogEvent(updated_event)
+	session.record_mutex.Unlock()
+	session.trimEvents()
 	session.signalNewMessage()
 }
 
 type EventCallbackFunc func(SessionEvent)
 
+/*
+ EventCallback and ChannelFilterFunc wrap Go
+ functions. The ones built from a spec keep it,
+ so they can be listed and saved with their
+ user; others can't be saved.
+*/
 type EventCallback struct {
 	events map[string]bool
 	handler EventCallbackFunc
+	spec	*EventCallbackSpec
 }
 
 type ChannelFilterFunc	struct {
 	fn func([]byte, *channelWrapper) []byte
+	spec	*ChannelFilterSpec
 }
 // has to be hooked in the reader
@@ -0,0 +1,264 @@
+package sshproxyplus
+
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// replaces Parameters["find"] with
+// Parameters["replace"]
+const CHANNEL_FILTER_REPLACE		string = "replace"
+// replaces matches of Parameters["pattern"] with
+// Parameters["replacement"], which may use $1
+const CHANNEL_FILTER_REGEX_REPLACE	string = "regex-replace"
+
+// posts events as JSON to Parameters["url"];
+// with Parameters["find"] set only events whose
+// data contains it are posted
+const EVENT_CALLBACK_HTTP_POST		string = "http-post"
+
+const CHANNEL_DIRECTION_INCOMING	string = "incoming"
+const CHANNEL_DIRECTION_OUTGOING	string = "outgoing"
+
+/*
+ A ChannelFilterSpec describes a channel filter
+ as data so it can be stored with its ProxyUser,
+ saved in a config and listed. Type picks what
+ the filter does and Parameters configure it.
+ Directions limits it to incoming or outgoing
+ data; empty means both. Key is set by the
+ controller when the filter is added.
+*/
+type ChannelFilterSpec struct {
+	Key			string `json:",omitempty"`
+	Type		string
+	Parameters	map[string]string `json:",omitempty"`
+	Directions	[]string `json:",omitempty"`
+}
+
+/*
+ An EventCallbackSpec describes an event
+ callback as data. Events limits which event
+ types it is called for; empty means every
+ event.
+*/
+type EventCallbackSpec struct {
+	Key			string `json:",omitempty"`
+	Type		string
+	Parameters	map[string]string `json:",omitempty"`
+	Events		[]string `json:",omitempty"`
+}
+
+func (spec *ChannelFilterSpec) clone() *ChannelFilterSpec {
+	copied := *spec
+	copied.Parameters = make(map[string]string, len(spec.Parameters))
+	for name, value := range spec.Parameters {
+		copied.Parameters[name] = value
+	}
+	copied.Directions = append([]string(nil), spec.Directions...)
+	return &copied
+}
+
+func (spec *EventCallbackSpec) clone() *EventCallbackSpec {
+	copied := *spec
+	copied.Parameters = make(map[string]string, len(spec.Parameters))
+	for name, value := range spec.Parameters {
+		copied.Parameters[name] = value
+	}
+	copied.Events = append([]string(nil), spec.Events...)
+	return &copied
+}
+
+// build makes the filter the spec describes
+func (spec *ChannelFilterSpec) build() (error, *ChannelFilterFunc) {
+	var filter func([]byte) []byte
+	switch spec.Type {
+	case CHANNEL_FILTER_REPLACE:
+		find, replace := []byte(spec.Parameters["find"]), []byte(spec.Parameters["replace"])
+		if len(find) == 0 {
+			return errors.New("replace filter has no find parameter"), nil
+		}
+		filter = func(data []byte) []byte {
+			return bytes.Replace(data, find, replace, -1)
+		}
+	case CHANNEL_FILTER_REGEX_REPLACE:
+		if spec.Parameters["pattern"] == "" {
+			return errors.New("regex-replace filter has no pattern parameter"), nil
+		}
+		pattern, err := regexp.Compile(spec.Parameters["pattern"])
+		if err != nil {
+			return fmt.Errorf("regex-replace filter pattern: %v", err), nil
+		}
+		replacement := []byte(spec.Parameters["replacement"])
+		filter = func(data []byte) []byte {
+			return pattern.ReplaceAll(data, replacement)
+		}
+	default:
+		return fmt.Errorf("unknown channel filter type %q", spec.Type), nil
+	}
+	directions := make(map[string]bool)
+	for _, direction := range spec.Directions {
+		if direction != CHANNEL_DIRECTION_INCOMING && direction != CHANNEL_DIRECTION_OUTGOING {
+			return fmt.Errorf("unknown channel direction %q", direction), nil
+		}
+		directions[direction] = true
+	}
+	return nil, &ChannelFilterFunc{
+		spec: spec,
+		fn: func(data []byte, wrapper *channelWrapper) []byte {
+			if len(directions) > 0 && (wrapper == nil || !directions[wrapper.direction]) {
+				return data
+			}
+			return filter(data)
+		},
+	}
+}
+
+// build makes the callback the spec describes
+func (spec *EventCallbackSpec) build() (error, *EventCallback) {
+	var handler EventCallbackFunc
+	switch spec.Type {
+	case EVENT_CALLBACK_HTTP_POST:
+		url, find := spec.Parameters["url"], []byte(spec.Parameters["find"])
+		if url == "" {
+			return errors.New("http-post callback has no url parameter"), nil
+		}
+		handler = func(event SessionEvent) {
+			if bytes.Index(event.Data, find) != -1 {
+				data, err := json.Marshal(&event)
+				if err == nil {
+					responseBody := bytes.NewBuffer(data)
+					resp, err := http.Post(url, "application/json",responseBody)
+					if err == nil {
+						defer resp.Body.Close()
+					}
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown event callback type %q", spec.Type), nil
+	}
+	events := make(map[string]bool)
+	if len(spec.Events) == 0 {
+		for _, event := range sessionEventTypes {
+			events[event] = true
+		}
+	}
+	for _, event := range spec.Events {
+		if !containsString(sessionEventTypes, event) {
+			return fmt.Errorf("unknown event type %q", event), nil
+		}
+		events[event] = true
+	}
+	return nil, &EventCallback{spec: spec, events: events, handler: handler}
+}
+
+/*
+ initializeSpecs builds the filters and
+ callbacks of specs that were loaded with the
+ user. Specs that can't be built are dropped
+ and returned as errors.
+*/
+func (user *ProxyUser) initializeSpecs() []error {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	var errs []error
+	built := make(map[*ChannelFilterSpec]bool)
+	for _, filter := range user.channelFilters {
+		built[filter.spec] = true
+	}
+	filterSpecs := make([]*ChannelFilterSpec, 0, len(user.FilterSpecs))
+	filters := append([]*ChannelFilterFunc(nil), user.channelFilters...)
+	for _, spec := range user.FilterSpecs {
+		if !built[spec] {
+			err, filter := spec.build()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("user %v filter %v: %v", user.Username, spec.Key, err))
+				continue
+			}
+			filters = append(filters, filter)
+		}
+		filterSpecs = append(filterSpecs, spec)
+	}
+	user.FilterSpecs, user.channelFilters = filterSpecs, filters
+
+	builtCallbacks := make(map[*EventCallbackSpec]bool)
+	for _, callback := range user.EventCallbacks {
+		builtCallbacks[callback.spec] = true
+	}
+	callbackSpecs := make([]*EventCallbackSpec, 0, len(user.CallbackSpecs))
+	callbacks := append([]*EventCallback(nil), user.EventCallbacks...)
+	for _, spec := range user.CallbackSpecs {
+		if !builtCallbacks[spec] {
+			err, callback := spec.build()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("user %v callback %v: %v", user.Username, spec.Key, err))
+				continue
+			}
+			callbacks = append(callbacks, callback)
+		}
+		callbackSpecs = append(callbackSpecs, spec)
+	}
+	user.CallbackSpecs, user.EventCallbacks = callbackSpecs, callbacks
+	return errs
+}
+
+// ListChannelFilters returns copies of the specs
+// of a user's filters; filters added from Go
+// without a spec are not listed
+func (controller *ProxyController) ListChannelFilters(proxyID uint64, username, password string) (error, []*ChannelFilterSpec) {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy == nil {
+		return err, nil
+	}
+	err, user, _ := proxy.GetProxyUser(username, password, false)
+	if err != nil {
+		return err, nil
+	}
+	specs := make([]*ChannelFilterSpec, 0)
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	for _, filter := range user.getChannelFilters() {
+		if filter.spec != nil {
+			specs = append(specs, filter.spec.clone())
+		}
+	}
+	return nil, specs
+}
+
+// ListEventCallbacks returns copies of the specs
+// of a user's callbacks
+func (controller *ProxyController) ListEventCallbacks(proxyID uint64, username, password string) (error, []*EventCallbackSpec) {
+	proxy, err := controller.GetProxy(proxyID)
+	if proxy == nil {
+		return err, nil
+	}
+	err, user, _ := proxy.GetProxyUser(username, password, false)
+	if err != nil {
+		return err, nil
+	}
+	specs := make([]*EventCallbackSpec, 0)
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	for _, callback := range user.getEventCallbacks() {
+		if callback.spec != nil {
+			specs = append(specs, callback.spec.clone())
+		}
+	}
+	return nil, specs
+}
+
+// registerSpecKeys registers the spec keys of
+// every user the controller was loaded with
+func (controller *ProxyController) registerSpecKeys() {
+	for proxy_id, proxy := range controller.Proxies {
+		for _, user := range proxy.Users {
+			controller.registerUserSpecKeys(proxy_id, user)
+		}
+	}
+}
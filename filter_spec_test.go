@@ -0,0 +1,137 @@
+package sshproxyplus
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+
+func TestChannelFilterSpecBuild(t *testing.T) {
+	spec := &ChannelFilterSpec{
+		Type: CHANNEL_FILTER_REGEX_REPLACE,
+		Parameters: map[string]string{"pattern": `token=(\w+)`, "replacement": "token=<$1>"},
+		Directions: []string{CHANNEL_DIRECTION_INCOMING},
+	}
+	err, filter := spec.build()
+	if err != nil {
+		t.Fatalf("build() = %v", err)
+	}
+	if out := filter.fn([]byte("token=abc"), &channelWrapper{direction: CHANNEL_DIRECTION_INCOMING}); string(out) != "token=<abc>" {
+		t.Errorf("build() filter returned %q for incoming data", out)
+	}
+	if out := filter.fn([]byte("token=abc"), &channelWrapper{direction: CHANNEL_DIRECTION_OUTGOING}); string(out) != "token=abc" {
+		t.Errorf("build() filter changed outgoing data to %q", out)
+	}
+
+	for _, invalid := range []*ChannelFilterSpec{
+		{Type: "rot13"},
+		{Type: CHANNEL_FILTER_REPLACE},
+		{Type: CHANNEL_FILTER_REGEX_REPLACE, Parameters: map[string]string{"pattern": "("}},
+		{Type: CHANNEL_FILTER_REPLACE, Parameters: map[string]string{"find": "a"}, Directions: []string{"sideways"}},
+	} {
+		if err, _ := invalid.build(); err == nil {
+			t.Errorf("build() accepted an invalid filter spec %+v", invalid)
+		}
+	}
+	for _, invalid := range []*EventCallbackSpec{
+		{Type: "email"},
+		{Type: EVENT_CALLBACK_HTTP_POST},
+		{Type: EVENT_CALLBACK_HTTP_POST, Parameters: map[string]string{"url": "http://127.0.0.1:1/"}, Events: []string{"reboot"}},
+	} {
+		if err, _ := invalid.build(); err == nil {
+			t.Errorf("build() accepted an invalid callback spec %+v", invalid)
+		}
+	}
+}
+
+func TestChannelFilterSpecsSurviveExport(t *testing.T) {
+	controller := makeNewController()
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_CREATE_PROXY,
+		ProxyData: []byte(fmt.Sprintf(`{"ListenPort": 2222, "SessionFolder": %q}`, t.TempDir())),
+	}, controller, t)
+	proxyID := uint64(reply["ProxyID"].(float64))
+	simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_PROXY_USER,
+		ProxyID: proxyID,
+		ProxyUser: &ProxyUser{
+			Username: "user",
+			Password: "pass",
+			FilterSpecs: []*ChannelFilterSpec{{Type: CHANNEL_FILTER_REPLACE, Parameters: map[string]string{"find": "a", "replace": "b"}}},
+		},
+	}, controller, t)
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "pass",
+		FindString: []byte("secret"),
+		ReplaceString: []byte("hidden"),
+	}, controller, t)
+	filterKey := reply["FilterKey"].(string)
+	simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_USER_CALLBACK,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "pass",
+		EventCallback: &EventCallbackSpec{
+			Type: EVENT_CALLBACK_HTTP_POST,
+			Parameters: map[string]string{"url": "http://127.0.0.1:1/"},
+			Events: []string{EVENT_SESSION_START},
+		},
+	}, controller, t)
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_ADD_CHANNEL_FILTER,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "pass",
+		ChannelFilter: &ChannelFilterSpec{Type: "rot13"},
+	}, controller, t)
+	if reply["Error"] == nil {
+		t.Errorf("add-channel-filter accepted an unknown filter type: %v", reply)
+	}
+
+	path := filepath.Join(t.TempDir(), "controller.json")
+	if err := controller.WriteControllerConfigToFile(path); err != nil {
+		t.Fatalf("WriteControllerConfigToFile() = %v", err)
+	}
+	err, loaded := LoadControllerConfigFromFile(path, nil)
+	if err != nil {
+		t.Fatalf("LoadControllerConfigFromFile() = %v", err)
+	}
+
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_LIST_CHANNEL_FILTERS,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "pass",
+	}, loaded, t)
+	filters := make([]*ChannelFilterSpec, 0)
+	replyField(reply, "ChannelFilters", &filters)
+	if len(filters) != 2 || filters[0].Key == "" || filters[1].Key != filterKey || filters[1].Parameters["find"] != "secret" {
+		t.Fatalf("list-channel-filters after loading = %+v, expected both filters with their keys", filters)
+	}
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_LIST_USER_CALLBACKS,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "pass",
+	}, loaded, t)
+	callbacks := make([]*EventCallbackSpec, 0)
+	replyField(reply, "EventCallbacks", &callbacks)
+	if len(callbacks) != 1 || callbacks[0].Type != EVENT_CALLBACK_HTTP_POST || len(callbacks[0].Events) != 1 {
+		t.Errorf("list-user-callbacks after loading = %+v, expected the http-post callback", callbacks)
+	}
+
+	if err := loaded.RemoveChannelFilterFromUserByKey(proxyID, "user", "pass", filterKey); err != nil {
+		t.Fatalf("RemoveChannelFilterFromUserByKey() after loading = %v", err)
+	}
+	err, user, _ := loaded.Proxies[proxyID].GetProxyUser("user", "pass", false)
+	if err != nil {
+		t.Fatalf("GetProxyUser() = %v", err)
+	}
+	if len(user.getChannelFilters()) != 1 || len(user.FilterSpecs) != 1 || user.FilterSpecs[0].Key == filterKey {
+		t.Errorf("RemoveChannelFilterFromUserByKey() left %+v", user.FilterSpecs)
+	}
+}
@@ -234,6 +234,134 @@ function get_session_from_socket(session,clickTarget)
     } else {
         get_public_session_from_socket(session)
     }
+    update_operator_controls(session)
+}
+
+function set_operator_status(text)
+{
+    jQuery("#operator_controls .operator_status").text(text)
+}
+
+/*
+ update_operator_controls shows the operator controls under
+ the terminal when the selected session is live and the
+ viewer has an operator: approve and deny while the session
+ waits for approval, takeover once it runs.
+*/
+function update_operator_controls(session)
+{
+    stop_session_takeover()
+    let controls = jQuery("#operator_controls")
+    set_operator_status("")
+    if(session.secret == undefined || !session.operator || !session.active)
+    {
+        controls.hide()
+        return
+    }
+    controls.find(".approval_controls").toggle(session.pending == true)
+    controls.find(".takeover_controls").toggle(session.pending != true)
+    controls.find(".approve_button").off("click").click(function() {
+        decide_session_approval(session, true)
+    })
+    controls.find(".deny_button").off("click").click(function() {
+        decide_session_approval(session, false)
+    })
+    controls.find(".takeover_button").off("click").click(function() {
+        if(takeover_socket == undefined) {
+            start_session_takeover(session, controls.find(".takeover_exclusive").prop("checked"))
+        } else {
+            stop_session_takeover()
+            set_operator_status("")
+        }
+    })
+    controls.show()
+}
+
+var takeover_socket = undefined
+var takeover_input = undefined
+
+/*
+ start_session_takeover asks for write access to a live
+ session as the operator of the viewer. Keys typed into the
+ terminal are sent to the session until stop_session_takeover
+ is called. With exclusive set the user's own input is
+ blocked meanwhile.
+*/
+function start_session_takeover(session, exclusive=false)
+{
+    stop_session_takeover()
+    let socket = new WebSocket(build_proxy_socket_url())
+    socket.onopen = function() {
+        socket.send('viewer-takeover');
+        socket.send(session.secret);
+        socket.send(session.key);
+        socket.send(exclusive ? 'exclusive' : 'shared');
+    }
+    socket.onmessage = (event) => {
+        if (event.data == "takeover-started") {
+            takeover_input = terminal_reader.on_terminal_data((data) => {
+                socket.send(data)
+            })
+            jQuery("#operator_controls .takeover_button").text("Release")
+            set_operator_status("typing into the session")
+        } else {
+            console.log("takeover:", event.data)
+            set_operator_status(event.data)
+            stop_session_takeover()
+        }
+    }
+    socket.onclose = (event) => {
+        if (takeover_socket == socket) {
+            stop_session_takeover()
+        }
+    }
+    takeover_socket = socket
+}
+
+function stop_session_takeover()
+{
+    jQuery("#operator_controls .takeover_button").text("Take over")
+    if (takeover_input != undefined) {
+        takeover_input.dispose()
+        takeover_input = undefined
+    }
+    if (takeover_socket != undefined) {
+        let socket = takeover_socket
+        takeover_socket = undefined
+        if (socket.readyState == WebSocket.OPEN) {
+            socket.send('takeover-release')
+        }
+        socket.close()
+    }
+}
+
+/*
+ decide_session_approval approves or denies a session that
+ is waiting for an operator, and updates the operator
+ controls with the outcome.
+*/
+function decide_session_approval(session, approve)
+{
+    let socket = new WebSocket(build_proxy_socket_url())
+    socket.onopen = function() {
+        socket.send('viewer-approval');
+        socket.send(session.secret);
+        socket.send(session.key);
+        socket.send(approve ? 'approve' : 'deny');
+    }
+    socket.onmessage = (event) => {
+        console.log("approval:", event.data)
+        socket.close()
+        if (event.data == "approved") {
+            session.pending = false
+            update_operator_controls(session)
+        } else if (event.data == "denied") {
+            session.pending = false
+            session.active = false
+            update_operator_controls(session)
+        }
+        set_operator_status(event.data)
+    }
 }
 
 function list_viewer_session_and_add_to_list(viewer_key)
@@ -482,6 +610,9 @@ function add_viewer_session_to_list(sessions)
             fn = function() {
                 var cur_session = session;
                 cur_session.display_text = cur_session.key + " (" + seconds_to_str(cur_session.length) +")";
+                if (cur_session.pending) {
+                    cur_session.display_text += " [awaiting approval]";
+                }
                 add_link_to_list(
                     session, 
                     "#signed-viewer&"+session.secret+"/"+session.key, 
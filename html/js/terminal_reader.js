@@ -347,6 +347,13 @@ class TerminalReader {
         this.fit_terminal()
     }
 
+    // calls handler with what is typed into the terminal;
+    // returns a disposable that stops it
+    on_terminal_data(handler)
+    {
+        return this.#terminal.onData(handler)
+    }
+
     get events()
     {
         return this.#events
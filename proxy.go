@@ -6,14 +6,14 @@ import (
 	"time"
 	"net"
 	"strconv"
-	"os"
 	"errors"
 	"log"
 	"encoding/json"
+	"sync"
+	"sync/atomic"
 )
 
 const SESSION_LIST_FN	string = ".session_list"
-const ACTIVE_POLLING_DELAY time.Duration = 500* time.Millisecond
 
 
 // a proxy runs on a single port
@@ -43,16 +43,99 @@ type ProxyContext struct {
 	WebListenPort		int
 	ServerVersion		string
 	Users 				map[string]*ProxyUser
-	userSessions		map[string]map[string]*SessionContext
-	allSessions			map[string]*SessionContext 
+	sessions			*sessionRegistry
 	RequireValidPassword	bool
 	active				bool
+	// closed while the proxy is active; new
+	// sessions wait on it
+	activated			chan struct{}
 	PublicAccess		bool
 	Viewers				map[string]*proxySessionViewer
 	BaseURI				string
+	// path to a PEM public key; when set, session
+	// logs are encrypted for this recipient
+	RecordingRecipientFile	string
+	recordingRecipient	*RecordingRecipient
+	// scrubs passwords and other secrets from
+	// events before they are stored or sent
+	Redaction			*RedactionConfig
+	// the compiled copy of Redaction that sessions
+	// use, a *RedactionConfig swapped as a whole
+	redaction			atomic.Value
+	// where session logs are kept; defaults
+	// to files in SessionFolder
+	RecordingStorage	*RecordingStoreConfig
+	recordingStore		RecordingStore
+	// how long recordings are kept; nil keeps
+	// them forever
+	Retention			*RetentionPolicy
+	janitor				retentionJanitor
+	// recent events kept in memory for each session;
+	// older ones are read back from the recording
+	EventBufferSize		int
+	// seconds an ended session is kept in memory
+	// before it is replaced by its archived summary
+	SessionEvictionSeconds	int64
+	// lets watch+<session> logins observe any
+	// session; viewer secrets work too
+	ObserverKey			string
+	// seconds a session of a user with
+	// RequireApproval waits before it is denied
+	ApprovalTimeoutSeconds	int64
+	// seconds without server output before a
+	// session is closed; 0 never closes it
+	IdleTimeoutSeconds	int64
+	// seconds a session may last at most;
+	// 0 has no limit
+	MaxSessionSeconds	int64
+	// how long before a timeout the client is
+	// warned, and what they are told
+	TimeoutWarningSeconds	int64
+	IdleWarningMessage	string
+	MaxSessionWarningMessage	string
+	// most live sessions per proxy, per ProxyUser
+	// and per client IP; 0 has no limit
+	MaxSessions			int
+	MaxSessionsPerUser	int
+	MaxSessionsPerClientIP	int
+	// reject (the default) turns a new session
+	// away; terminate-oldest closes older ones
+	SessionLimitPolicy	string
+	searchOnce			sync.Once
+	searchIndex			*SessionSearchIndex
+	// guards running, listener, active and id,
+	// and the settings a config reload or
+	// update-proxy can change
+	mutex				sync.Mutex
+	// the key of the proxy in its controller;
+	// it prefixes session IDs
+	id					uint64
+	// loads the RecordingIdentity of the
+	// controller, if the proxy has one
+	identityLoader		func() (*RecordingIdentity, error)
+	// guards Users and Viewers
+	users_mutex			sync.RWMutex
 	// when there are new sessions, block forwarding until this is true
 }
 
+// proxyContextJSON marshals the fields of a
+// ProxyContext without its MarshalJSON
+type proxyContextJSON ProxyContext
+
+/*
+ MarshalJSON holds the proxy's mutexes while the
+ proxy is marshalled, since its settings, users
+ and viewers change while it runs. The caller
+ must not hold either of them.
+*/
+func (proxy *ProxyContext) MarshalJSON() ([]byte, error) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	proxy.users_mutex.RLock()
+	defer proxy.users_mutex.RUnlock()
+	return json.Marshal((*proxyContextJSON)(proxy))
+}
+
 type LoggerInterface interface {
 	Printf(format string, v ...any)
 	Println(v ...any)
@@ -68,8 +151,7 @@ func MakeNewProxy(signer ssh.Signer) *ProxyContext {
 	return &ProxyContext{
 		Log: log.Default(), 
 		Users: map[string]*ProxyUser{},
-		userSessions: map[string]map[string]*SessionContext{},
-		allSessions: map[string]*SessionContext{},
+		sessions: newSessionRegistry(),
 		Viewers: map[string]*proxySessionViewer{},
 		DefaultRemotePort: 22,
 		DefaultRemoteIP: "127.0.0.1",
@@ -86,6 +168,16 @@ func MakeNewProxy(signer ssh.Signer) *ProxyContext {
 func (proxy *ProxyContext) StartProxy() {
 
 	proxy.Log.Printf("Starting proxy on socket %v:%v\n", proxy.ListenIP, proxy.ListenPort)
+	listener, err := net.Listen("tcp",  proxy.ListenIP +":"+strconv.Itoa(proxy.ListenPort))
+	if err != nil {
+		panic(err)
+	}
+	proxy.serve(listener)
+}
+
+// serve accepts sessions on listener until the
+// proxy stops or moves to another listener
+func (proxy *ProxyContext) serve(listener net.Listener) {
 	config := &ssh.ServerConfig{
 	NoClientAuth: false,
 	MaxAuthTries: 3,
@@ -96,10 +188,18 @@ func (proxy *ProxyContext) StartProxy() {
 		proxy.Log.Printf("Got client (%s) using creds (%s:%s)\n",
 		conn.RemoteAddr(),
 		conn.User(),
-		password)
+		proxy.redactPassword(string(password)))
 
 		//TODO: make session_key unique with a counter
 
+		if isObserverLogin(conn.User()) {
+			permissions, err := proxy.authenticateObserver(conn.User(), string(password))
+			if err != nil {
+				proxy.Log.Printf("observer authentication failed: %v\n",err)
+			}
+			return permissions, err
+		}
+
 		err, user := proxy.AuthenticateUser(conn.User(),string(password))
 
 		if(err != nil) {
@@ -107,110 +207,233 @@ func (proxy *ProxyContext) StartProxy() {
 			return nil, err
 		}
 
-		sess_key := conn.LocalAddr().String()+":"+conn.RemoteAddr().String() // +string(getNextSessionIdCounter())
-		curSession := proxy.allSessions[sess_key]
-		
-		curSession.user = user
-		curSession.client_password = string(password)
-		curSession.client_username = conn.User()
-		curSession.proxy = proxy
-		curSession.channels = make([]*channel_data, 0)
-		curSession.channel_count = 1
-		curSession.active = true
-		curSession.requests = make([]*request_data, 0)
-		curSession.request_count = 1
-		curSession.thread_count = 0
-		curSession.start_time = time.Now()
-		curSession.msg_signal = make([]chan int,0)
-		curSession.filename = sess_key + ".log.json"
-		curSession.sessionID = sess_key
-		
-		curSession.mutex.Unlock()
-		return nil, nil
+		session_id, err := proxy.newSessionID()
+		if err != nil {
+			proxy.Log.Printf("unable to create session id: %v\n",err)
+			return nil, err
+		}
+		curSession := &SessionContext{
+			user: user,
+			client_host: conn.RemoteAddr().String(),
+			client_password: string(password),
+			client_username: conn.User(),
+			proxy: proxy,
+			channels: make([]*channel_data, 0),
+			active: true,
+			requests: make([]*request_data, 0),
+			thread_count: 0,
+			start_time: time.Now(),
+			msg_signal: make([]chan int,0),
+			filename: session_id + SESSION_LOG_SUFFIX,
+			sessionID: session_id,
+			address: conn.LocalAddr().String()+":"+conn.RemoteAddr().String(),
+		}
+		curSession.channel_count.Store(1)
+		curSession.request_count.Store(1)
+		// the session is only listed once the
+		// handshake is done; the accept loop finds it
+		// by the ID in the permissions
+		proxy.sessions.addPending(session_id, curSession)
+		return &ssh.Permissions{
+			Extensions: map[string]string{SESSION_ID_EXTENSION: session_id},
+		}, nil
 	},
-	ServerVersion: proxy.ServerVersion,
+	ServerVersion: proxy.getServerVersion(),
 	BannerCallback: func(conn ssh.ConnMetadata) string {
 		return "bannerCallback"
 	},
 	}
 	config.AddHostKey(proxy.private_key)
 	
-	listener, err := net.Listen("tcp",  proxy.ListenIP +":"+strconv.Itoa(proxy.ListenPort))
-	if err != nil {
-		panic(err)
-	}
+	proxy.mutex.Lock()
 	proxy.listener = listener
 	proxy.running = true
-	for proxy.running {
+	proxy.mutex.Unlock()
+	if err := proxy.LoadArchivedSessions(); err != nil {
+		proxy.Log.Println("error loading archived sessions:", err)
+	}
+	proxy.startRetentionJanitor()
+	for proxy.isServing(listener) {
 		conn, err := listener.Accept()
 		if err != nil {
 			continue
 		}
-		sess_key := conn.LocalAddr().String()+":"+conn.RemoteAddr().String()
-		// if a client reuses socket ports, let's preserve the old session
-		// they shouldn't be able to do this concurrently because of how TCP works.
-		if  val, ok := proxy.allSessions[sess_key]; ok {
-			proxy.allSessions[sess_key+"_old"] = val
-			delete(proxy.allSessions, sess_key)
-		}
-		proxy.allSessions[sess_key] = new(SessionContext)
-		proxy.allSessions[sess_key].client_host = conn.RemoteAddr().String()
-		proxy.allSessions[sess_key].mutex.Lock()
-		
+		address := conn.LocalAddr().String()+":"+conn.RemoteAddr().String()
 
 		ssh_conn, channels, reqs, err:= ssh.NewServerConn(conn, config)
 		if err != nil {
+			proxy.sessions.removePendingAddress(address)
+			continue
+		}
+		if _, ok := ssh_conn.Permissions.Extensions[OBSERVER_SESSION_EXTENSION]; ok {
+			go proxy.handleObserverConn(ssh_conn, channels, reqs)
 			continue
 		}
 		
+		curSession := proxy.sessions.activate(ssh_conn.Permissions.Extensions[SESSION_ID_EXTENSION])
+		if curSession == nil {
+			proxy.Log.Printf("no session found for connection from %v\n", address)
+			ssh_conn.Close()
+			continue
+		}
 		//go ssh.DiscardRequests(reqs)
 		// maybe we *can* discard requests?
-		go proxy.HandleClientConn(ssh_conn, channels, reqs, proxy.allSessions[sess_key])
+		go proxy.HandleClientConn(ssh_conn, channels, reqs, curSession)
+	}
+}
+
+func (proxy *ProxyContext) isRunning() bool {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.running
+}
+
+func (proxy *ProxyContext) isServing(listener net.Listener) bool {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.running && proxy.listener == listener
+}
+
+/*
+ moveListener starts listening on a new address
+ and closes the old listener. Live sessions are
+ left alone. The old address is kept if the new
+ one can't be listened on.
+*/
+func (proxy *ProxyContext) moveListener(ip string, port int) error {
+	listener, err := net.Listen("tcp", ip +":"+strconv.Itoa(port))
+	if err != nil {
+		return err
 	}
+	proxy.mutex.Lock()
+	old := proxy.listener
+	proxy.listener = listener
+	proxy.ListenIP, proxy.ListenPort = ip, port
+	proxy.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	proxy.Log.Printf("Moved proxy to socket %v:%v\n", ip, port)
+	go proxy.serve(listener)
+	return nil
 }
 
 func (proxy *ProxyContext) Stop() {
+	proxy.mutex.Lock()
 	proxy.running = false
-	proxy.listener.Close()
-	for _, session := range proxy.allSessions { 
+	listener := proxy.listener
+	proxy.mutex.Unlock()
+	proxy.stopRetentionJanitor()
+	if listener != nil {
+		listener.Close()
+	}
+	for _, session := range proxy.sessions.snapshot() { 
 		session.End()
 	}
 }
 
 func (proxy *ProxyContext) AddSessionToUserList(session *SessionContext) {
-	user := session.user.GetKey()
-	if  _, ok := proxy.userSessions[user]; !ok {
-		proxy.userSessions[user] = make(map[string]*SessionContext)
-	}
-	session_id := session.GetID()
-	proxy.userSessions[user][session_id] = session
+	proxy.sessions.addToUser(session.user.GetKey(), session)
 }
 
 func (proxy *ProxyContext) Activate() {
+	proxy.mutex.Lock()
+	activated := proxy.activatedLocked()
+	if !proxy.active {
+		close(activated)
+	}
 	proxy.active = true
+	proxy.mutex.Unlock()
 }
 
 func (proxy *ProxyContext) Deactivate() {
+	proxy.mutex.Lock()
+	proxy.activatedLocked()
+	if proxy.active {
+		proxy.activated = make(chan struct{})
+	}
 	proxy.active = false
+	proxy.mutex.Unlock()
+}
+
+// activatedLocked returns the channel that is
+// closed while the proxy is active
+func (proxy *ProxyContext) activatedLocked() chan struct{} {
+	if proxy.activated == nil {
+		proxy.activated = make(chan struct{})
+		if proxy.active {
+			close(proxy.activated)
+		}
+	}
+	return proxy.activated
+}
+
+/*
+ awaitActive holds a new session until the
+ proxy is active. It returns false if the
+ client goes away first.
+*/
+func (proxy *ProxyContext) awaitActive(client_closed <-chan struct{}) bool {
+	proxy.mutex.Lock()
+	activated := proxy.activatedLocked()
+	proxy.mutex.Unlock()
+	select {
+	case <-activated:
+		return true
+	case <-client_closed:
+		return false
+	}
 }
 
 func (proxy *ProxyContext) IsActive() bool {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
 	return proxy.active 
 }
 
+// isPublic reports PublicAccess; like the other
+// settings it can change while the proxy runs
+func (proxy *ProxyContext) isPublic() bool {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.PublicAccess
+}
+
+func (proxy *ProxyContext) getServerVersion() string {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.ServerVersion
+}
+
 func (proxy *ProxyContext) AddSessionToSessionList(session * SessionContext) {
-	filename := SESSION_LIST_FN
-	fd, err := os.OpenFile(proxy.SessionFolder + "/" + filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	store, err := proxy.GetRecordingStore()
 	if err != nil {
-		proxy.Log.Println("error opening session list file:", err)
+		proxy.Log.Println("error opening recording store:", err)
+		return
 	}
-	if _, err := fd.WriteString(session.InfoAsJSON() + "\n"); err != nil {
-		proxy.Log.Println("error writing to session list file:", err)
+	if err := store.AddToSessionList([]byte(session.InfoAsJSON() + "\n")); err != nil {
+		proxy.Log.Println("error writing to session list:", err)
 	}
-	if err := fd.Close(); err != nil {
-		proxy.Log.Println("error closing session list file:", err)
+}
+
+/*
+ GetRecordingStore returns the store that
+ session logs are written to, creating it
+ from RecordingStorage the first time. A
+ reload or update that changes the storage
+ resets it under the mutex.
+*/
+func (proxy *ProxyContext) GetRecordingStore() (RecordingStore, error) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if proxy.recordingStore == nil {
+		store, err := NewRecordingStore(proxy.RecordingStorage, proxy.SessionFolder)
+		if err != nil {
+			return nil, err
+		}
+		proxy.recordingStore = store
 	}
-	
+	return proxy.recordingStore, nil
 }
 
 
@@ -218,17 +441,17 @@ func (proxy *ProxyContext) AddSessionToSessionList(session * SessionContext) {
 func (proxy *ProxyContext) GetProxyUser(username, password string, cloneUser bool) (error, *ProxyUser,bool) {
 	err := errors.New("not a valid user")
 	key := buildProxyUserKey(username,password)
+	proxy.users_mutex.RLock()
+	defer proxy.users_mutex.RUnlock()
 	if  val, ok := proxy.Users[key]; ok {
 		if(cloneUser) {
-			return_val := *val
-			return nil, &return_val, false
+			return nil, val.clone(), false
 		}
 		return nil, val, false
 	} else if  val, ok := proxy.Users[buildProxyUserKey(username,"")]; ok {
 		if val.Password == "" {
 			if (cloneUser) {
-				return_val := *val
-				return nil, &return_val, true
+				return nil, val.clone(), true
 			}
 			return nil, val, true
 		} else {
@@ -241,21 +464,36 @@ func (proxy *ProxyContext) GetProxyUser(username, password string, cloneUser boo
 
 func (proxy *ProxyContext) AddProxyUser(user *ProxyUser) string {
 	key := buildProxyUserKey(user.Username,user.Password)
+	proxy.users_mutex.Lock()
 	proxy.Users[key] = user
+	proxy.users_mutex.Unlock()
 	return key
 }
 
 func (proxy *ProxyContext) RemoveProxyUser(username string, password string) error {
 	key := buildProxyUserKey(username,password)
 	var err error
+	proxy.users_mutex.Lock()
 	if _, ok := proxy.Users[key]; ok {
 		delete(proxy.Users, key)
 	} else {
-		err = errors.New("That ProxyUser does not exist")
+		err = newKindError(ErrNotFound, "That ProxyUser does not exist")
 	}
+	proxy.users_mutex.Unlock()
 	return err
 }
 
+// ListProxyUsers returns a copy of the users
+func (proxy *ProxyContext) ListProxyUsers() map[string]*ProxyUser {
+	proxy.users_mutex.RLock()
+	defer proxy.users_mutex.RUnlock()
+	users := make(map[string]*ProxyUser, len(proxy.Users))
+	for key, user := range proxy.Users {
+		users[key] = user
+	}
+	return users
+}
+
 // TODO: create test case for when the password is blank in the ProxyUser
 
 func (proxy *ProxyContext) AuthenticateUser(username,password string) (error, *ProxyUser) {
@@ -270,19 +508,26 @@ func (proxy *ProxyContext) AuthenticateUser(username,password string) (error, *P
 		channelFilters: make([]*ChannelFilterFunc,0),
 	}
 
+	// settings a reload or update-proxy can
+	// change are read under the mutex
+	proxy.mutex.Lock()
+	override_password, override_user := proxy.OverridePassword, proxy.OverrideUser
+	require_valid_password := proxy.RequireValidPassword
+	proxy.mutex.Unlock()
+
 	// override password if it is provided
-	if proxy.OverridePassword != "" {
-		default_user.RemotePassword = proxy.OverridePassword
+	if override_password != "" {
+		default_user.RemotePassword = override_password
 	}
 	// override user if it is provided
-	if proxy.OverrideUser != "" {
-		default_user.RemoteUsername = proxy.OverrideUser
+	if override_user != "" {
+		default_user.RemoteUsername = override_user
 	}
 
-	if(len(proxy.Users)>0) {
+	if(len(proxy.ListProxyUsers())>0) {
 		err, user,password_blank := proxy.GetProxyUser(username, password,true)
 		if (err != nil) {
-			if ! proxy.RequireValidPassword {
+			if ! require_valid_password {
 				return nil, default_user
 			} else {
 				return err, nil
@@ -299,7 +544,61 @@ func (proxy *ProxyContext) AuthenticateUser(username,password string) (error, *P
 	}
 }
 
+/*
+ getRecordingRecipient loads the recipient public
+ key the first time it is needed. A nil recipient
+ with a nil error means recordings are not encrypted.
+*/
+func (proxy *ProxyContext) getRecordingRecipient() (*RecordingRecipient, error) {
+	proxy.mutex.Lock()
+	path, recipient := proxy.RecordingRecipientFile, proxy.recordingRecipient
+	proxy.mutex.Unlock()
+	if path == "" || recipient != nil {
+		return recipient, nil
+	}
+	// the file is read without the mutex; the key
+	// is only kept if the file wasn't changed
+	// meanwhile
+	recipient, err := LoadRecordingRecipient(path)
+	if err != nil {
+		return nil, err
+	}
+	proxy.mutex.Lock()
+	if proxy.RecordingRecipientFile == path {
+		proxy.recordingRecipient = recipient
+	}
+	proxy.mutex.Unlock()
+	return recipient, nil
+}
+
+/*
+ SetRedaction replaces the redaction config
+ for new events. A copy of config is compiled
+ and only swapped in if it compiles, so
+ sessions never see a config half compiled.
+*/
+func (proxy *ProxyContext) SetRedaction(config *RedactionConfig) error {
+	compiled := config.clone()
+	if err := compiled.Compile(); err != nil {
+		return err
+	}
+	proxy.mutex.Lock()
+	proxy.Redaction = compiled
+	proxy.mutex.Unlock()
+	proxy.redaction.Store(compiled)
+	return nil
+}
+
+// getRedaction returns the compiled redaction
+// config, or nil when nothing is redacted
+func (proxy *ProxyContext) getRedaction() *RedactionConfig {
+	config, _ := proxy.redaction.Load().(*RedactionConfig)
+	return config
+}
+
 func (proxy *ProxyContext) GetDefaultRemoteHost() string {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
 	return proxy.DefaultRemoteIP +":"+strconv.Itoa(proxy.DefaultRemotePort)
 }
 
@@ -322,12 +621,8 @@ func (proxy *ProxyContext) Initialize(defaultSigner ssh.Signer) {
 	if proxy.Users == nil {
 		proxy.Users = map[string]*ProxyUser{}
 	}
-	if proxy.userSessions == nil {
-		proxy.userSessions = map[string]map[string]*SessionContext{}
-	}
-
-	if proxy.allSessions == nil {
-		proxy.allSessions = map[string]*SessionContext{}
+	if proxy.sessions == nil {
+		proxy.sessions = newSessionRegistry()
 	}
 
 	if proxy.Viewers == nil {
@@ -338,7 +633,26 @@ func (proxy *ProxyContext) Initialize(defaultSigner ssh.Signer) {
 		proxy.private_key = defaultSigner
 	}
 
-	for _, viewer := range proxy.Viewers {
+	if err := proxy.SetRedaction(proxy.Redaction); err != nil {
+		proxy.Log.Println("error compiling redaction config:", err)
+	}
+
+	if _, err := proxy.GetRecordingStore(); err != nil {
+		proxy.Log.Println("error configuring recording store:", err)
+	}
+
+	if err := proxy.Retention.Validate(); err != nil {
+		proxy.Log.Println("error in retention policy; recordings will not be cleaned up:", err)
+		proxy.Retention = nil
+	}
+
+	for _, user := range proxy.Users {
+		for _, err := range user.initializeSpecs() {
+			proxy.Log.Println("dropping filter or callback that can't be built:", err)
+		}
+	}
+
+	for _, viewer := range proxy.ListSessionViewers() {
 		viewer.proxy = proxy
 		if(viewer.User != nil) {
 			err, user, _ := proxy.GetProxyUser(viewer.User.Username, viewer.User.Password,false)
@@ -357,10 +671,12 @@ func (proxy *ProxyContext) HandleClientConn(client_conn *ssh.ServerConn, client_
 	//sess_key := client_conn.LocalAddr().String()+":"+client_conn.RemoteAddr().String()
 	//curSession := proxy.allSessions[sess_key]
 	//sess_key := curSession.sessionID
+	curSession.mutex.Lock()
+	curSession.client_conn = client_conn
+	curSession.mutex.Unlock()
 	curSession.markThreadStarted()
 	curSession.initializeLog()
 	defer curSession.markThreadStopped()
-	proxy.Log.Printf("i can see password: %s\n",curSession.client_password)
 	
 	// connect to client.
 
@@ -372,9 +688,53 @@ func (proxy *ProxyContext) HandleClientConn(client_conn *ssh.ServerConn, client_
 		},
 
 	}
+	start_event := SessionEvent{
+		Type: EVENT_SESSION_START,
+		Key: curSession.sessionID,
+		ServHost: curSession.user.RemoteHost,
+		ClientHost: client_conn.RemoteAddr().String(),
+		Username: curSession.client_username ,
+		Password: curSession.client_password,
+		StartTime: curSession.getStartTimeAsUnix(),
+		TimeOffset: 0,
+	}
+	limit_exceeded := curSession.enforceLimits()
+	if limit_exceeded != nil && limit_exceeded.rejected {
+		curSession.HandleEvent(&start_event)
+		curSession.HandleEvent(limit_exceeded.event())
+		client_conn.Close()
+		return
+	}
+
+	proxy.AddSessionToUserList(curSession)
+
+	curSession.HandleEvent(&start_event)
+	if limit_exceeded != nil {
+		curSession.HandleEvent(limit_exceeded.event())
+	}
+		
+	proxy.Log.Printf("New session starting: %v\n",start_event.ToJSON())
+
+	// nothing is sent upstream until the session
+	// may go ahead
+	client_closed := make(chan struct{})
+	go func() {
+		client_conn.Wait()
+		close(client_closed)
+	}()
+	if !proxy.awaitActive(client_closed) {
+		return
+	}
+	client_channels, approved := curSession.awaitApproval(client_channels)
+	if !approved {
+		client_conn.Close()
+		return
+	}
+
 	remote_sock, err := net.DialTimeout("tcp", curSession.user.RemoteHost, time.Second*3)
 	if err != nil {
 		proxy.Log.Printf("Error: cannot connect to remote server %s\n",curSession.user.RemoteHost)
+		client_conn.Close()
 		return
 	}
 
@@ -384,6 +744,7 @@ func (proxy *ProxyContext) HandleClientConn(client_conn *ssh.ServerConn, client_
 
 	if err != nil {
 		proxy.Log.Printf("Error creating new ssh client conn %v\n", err)
+		client_conn.Close()
 		return 
 	}
 
@@ -396,35 +757,12 @@ func (proxy *ProxyContext) HandleClientConn(client_conn *ssh.ServerConn, client_
 		shutdown_err <- remote_conn.Wait()
 	}()
 
-	proxy.AddSessionToUserList(curSession)
-
-	start_event := SessionEvent{
-		Type: EVENT_SESSION_START,
-		Key: curSession.sessionID,
-		ServHost: curSession.user.RemoteHost,
-		ClientHost: client_conn.RemoteAddr().String(),
-		Username: curSession.client_username ,
-		Password: curSession.client_password,
-		StartTime: curSession.getStartTimeAsUnix(),
-		TimeOffset: 0,
-	}
-	curSession.HandleEvent(&start_event)
-		
-	proxy.Log.Printf("New session starting: %v\n",start_event.ToJSON())
-	for {
-		if (proxy.active) {
-			break;
-		}
-		time.Sleep(ACTIVE_POLLING_DELAY)
-	}
-	
-	
-
 	//curSession.log_session_data()
 	go curSession.HandleChannels(remote_conn, client_channels)
 	go curSession.HandleChannels(client_conn, remote_channels)
 	go curSession.handleRequests(client_conn, remote_requests, 0)
 	go curSession.handleRequests(remote_conn, client_requests, 0)
+	go curSession.enforceTimeouts()
 	
 	proxy.Log.Println("New session started")
 
@@ -489,17 +827,48 @@ func (proxy *ProxyContext) MakeSessionViewerForSession(user_key string, password
 
 func (proxy *ProxyContext) AddSessionViewer(viewer *proxySessionViewer) {
 	key := viewer.Secret
+	proxy.users_mutex.Lock()
 	proxy.Viewers[key] = viewer
+	proxy.users_mutex.Unlock()
+}
+
+/*
+ SetSessionViewerOperator lets the viewer take
+ over sessions as operator. An empty operator
+ takes that right away again.
+*/
+func (proxy *ProxyContext) SetSessionViewerOperator(key string, operator string) error {
+	proxy.users_mutex.Lock()
+	defer proxy.users_mutex.Unlock()
+	viewer, ok := proxy.Viewers[key]
+	if !ok {
+		return newKindError(ErrNotFound, "Could not find viewer with that key.")
+	}
+	viewer.Operator = operator
+	return nil
 }
 
 func (proxy *ProxyContext) RemoveSessionViewer(key string) {
+	proxy.users_mutex.Lock()
 	if _, ok := proxy.Viewers[key]; ok {
 		delete(proxy.Viewers, key)
 	}
+	proxy.users_mutex.Unlock()
+}
+
+// ListSessionViewers returns a copy of the viewers
+func (proxy *ProxyContext) ListSessionViewers() map[string]*proxySessionViewer {
+	proxy.users_mutex.RLock()
+	defer proxy.users_mutex.RUnlock()
+	viewers := make(map[string]*proxySessionViewer, len(proxy.Viewers))
+	for key, viewer := range proxy.Viewers {
+		viewers[key] = viewer
+	}
+	return viewers
 }
 
 func (proxy *ProxyContext) RemoveExpiredSessions() {
-	for key, val:= range proxy.Viewers {
+	for key, val:= range proxy.ListSessionViewers() {
 		if val.isExpired() {
 			proxy.RemoveSessionViewer(key)
 		} 
@@ -507,7 +876,10 @@ func (proxy *ProxyContext) RemoveExpiredSessions() {
 }
 
 func (proxy *ProxyContext) GetSessionViewer(key string) *proxySessionViewer {
-	if  val, ok := proxy.Viewers[key]; ok {
+	proxy.users_mutex.RLock()
+	val, ok := proxy.Viewers[key]
+	proxy.users_mutex.RUnlock()
+	if ok {
 		if val.isExpired() {
 			proxy.RemoveSessionViewer(key)
 		} else {
@@ -521,7 +893,7 @@ func makeListOfSessionKeys(sessions map[string]*SessionContext, include_inactive
 	session_keys := make([]string, 0)
 	
 	for cur_key := range sessions {
-		if sessions[cur_key].active == true || include_inactive {
+		if sessions[cur_key].isActive() || include_inactive {
 			session_keys = append(session_keys, cur_key)
 		}
 	}
@@ -530,22 +902,24 @@ func makeListOfSessionKeys(sessions map[string]*SessionContext, include_inactive
 }
 
 func (proxy *ProxyContext) ListAllUserSessions(user string) []string {
-	return makeListOfSessionKeys(proxy.userSessions[user],true)
+	sessions, _ := proxy.sessions.userSnapshot(user)
+	return makeListOfSessionKeys(sessions,true)
 }
 
 func (proxy *ProxyContext) ListAllActiveUserSessions(user string) []string {
-	return makeListOfSessionKeys(proxy.userSessions[user],false)
+	sessions, _ := proxy.sessions.userSnapshot(user)
+	return makeListOfSessionKeys(sessions,false)
 }
 
 
 
 func (proxy *ProxyContext) ListAllSessions() []string {
-	return makeListOfSessionKeys(proxy.allSessions,true)
+	return makeListOfSessionKeys(proxy.sessions.snapshot(),true)
 }
 
 
 func (proxy *ProxyContext) ListAllActiveSessions() []string {
-	return makeListOfSessionKeys(proxy.allSessions,false)
+	return makeListOfSessionKeys(proxy.sessions.snapshot(),false)
 }
 
 
@@ -602,11 +976,35 @@ type ProxyUser struct {
 	RemoteHost	string
 	RemoteUsername string
 	RemotePassword string
+	// sessions wait for an operator to approve
+	// them before they are forwarded
+	RequireApproval	bool `json:",omitempty"`
+	// override the proxy's timeouts when set;
+	// negative turns the timeout off
+	IdleTimeoutSeconds	int64 `json:",omitempty"`
+	MaxSessionSeconds	int64 `json:",omitempty"`
+	// overrides the proxy's MaxSessionsPerUser
+	MaxSessions		int `json:",omitempty"`
 	EventCallbacks []*EventCallback `json:"-"`
 	channelFilters []*ChannelFilterFunc
+	// the filters and callbacks that were built
+	// from specs, kept so they can be saved
+	FilterSpecs		[]*ChannelFilterSpec `json:",omitempty"`
+	CallbackSpecs	[]*EventCallbackSpec `json:",omitempty"`
+	mutex		sync.RWMutex
 }
 
 
+type proxyUserJSON ProxyUser
+
+// MarshalJSON holds the user's mutex, since
+// update-proxy-user changes fields in place
+func (user *ProxyUser) MarshalJSON() ([]byte, error) {
+	user.mutex.RLock()
+	defer user.mutex.RUnlock()
+	return json.Marshal((*proxyUserJSON)(user))
+}
+
 func buildProxyUserKey(user,pass string) string {
 	return user + ":" + pass
 }
@@ -616,41 +1014,101 @@ func (user *ProxyUser) GetKey() string {
 }
 
 func (user *ProxyUser) AddEventCallback(callback *EventCallback) int {
-	if user.EventCallbacks == nil {
-		user.EventCallbacks = make([]*EventCallback,0)
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	// callbacks are read while sessions run, so
+	// the list is replaced rather than changed
+	callbacks := make([]*EventCallback, len(user.EventCallbacks), len(user.EventCallbacks)+1)
+	copy(callbacks, user.EventCallbacks)
+	user.EventCallbacks = append(callbacks, callback)
+	if callback.spec != nil {
+		user.CallbackSpecs = append(append([]*EventCallbackSpec(nil), user.CallbackSpecs...), callback.spec)
 	}
-	user.EventCallbacks = append(user.EventCallbacks, callback)
 	return len(user.EventCallbacks) - 1
 }
 
 func (user *ProxyUser) RemoveEventCallback(callback *EventCallback) {
-	if user.EventCallbacks != nil {
-		for index, value := range user.EventCallbacks {
-			if value == callback {
-				user.EventCallbacks[index] = user.EventCallbacks[len(user.EventCallbacks)-1]
-				user.EventCallbacks = user.EventCallbacks[:len(user.EventCallbacks)-1]
-			}
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	callbacks := make([]*EventCallback, 0, len(user.EventCallbacks))
+	for _, value := range user.EventCallbacks {
+		if value != callback {
+			callbacks = append(callbacks, value)
+		}
+	}
+	user.EventCallbacks = callbacks
+	specs := make([]*EventCallbackSpec, 0, len(user.CallbackSpecs))
+	for _, spec := range user.CallbackSpecs {
+		if spec != callback.spec {
+			specs = append(specs, spec)
 		}
 	}
+	user.CallbackSpecs = specs
+}
+
+func (user *ProxyUser) getEventCallbacks() []*EventCallback {
+	user.mutex.RLock()
+	defer user.mutex.RUnlock()
+	return user.EventCallbacks
 }
 
 func (user *ProxyUser) AddChannelFilter(function *ChannelFilterFunc) int {
-	if user.channelFilters == nil {
-		user.channelFilters = make([]*ChannelFilterFunc,0)
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	filters := make([]*ChannelFilterFunc, len(user.channelFilters), len(user.channelFilters)+1)
+	copy(filters, user.channelFilters)
+	user.channelFilters = append(filters, function)
+	if function.spec != nil {
+		user.FilterSpecs = append(append([]*ChannelFilterSpec(nil), user.FilterSpecs...), function.spec)
 	}
-	user.channelFilters = append(user.channelFilters, function)
 	return len(user.channelFilters) -1
 }
 
 func (user *ProxyUser) RemoveChannelFilter(function *ChannelFilterFunc) {
-	if user.channelFilters != nil {
-		for index, value := range user.channelFilters {
-			if value == function {
-				user.channelFilters[index] = user.channelFilters[len(user.channelFilters)-1]
-				user.channelFilters = user.channelFilters[:len(user.channelFilters)-1]
-			}
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	filters := make([]*ChannelFilterFunc, 0, len(user.channelFilters))
+	for _, value := range user.channelFilters {
+		if value != function {
+			filters = append(filters, value)
+		}
+	}
+	user.channelFilters = filters
+	specs := make([]*ChannelFilterSpec, 0, len(user.FilterSpecs))
+	for _, spec := range user.FilterSpecs {
+		if spec != function.spec {
+			specs = append(specs, spec)
 		}
 	}
+	user.FilterSpecs = specs
+}
+
+func (user *ProxyUser) getChannelFilters() []*ChannelFilterFunc {
+	user.mutex.RLock()
+	defer user.mutex.RUnlock()
+	return user.channelFilters
+}
+
+// clone copies the user; the copy starts with
+// the callbacks and filters the user has now
+func (user *ProxyUser) clone() *ProxyUser {
+	user.mutex.RLock()
+	defer user.mutex.RUnlock()
+	return &ProxyUser{
+		Username: user.Username,
+		Password: user.Password,
+		RemoteHost: user.RemoteHost,
+		RemoteUsername: user.RemoteUsername,
+		RemotePassword: user.RemotePassword,
+		RequireApproval: user.RequireApproval,
+		IdleTimeoutSeconds: user.IdleTimeoutSeconds,
+		MaxSessionSeconds: user.MaxSessionSeconds,
+		MaxSessions: user.MaxSessions,
+		EventCallbacks: user.EventCallbacks,
+		channelFilters: user.channelFilters,
+		FilterSpecs: user.FilterSpecs,
+		CallbackSpecs: user.CallbackSpecs,
+	}
 }
 
 
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"os"
+	"sync"
 
 )
 
@@ -35,8 +36,7 @@ func makeNewTestProxy() *ProxyContext {
 	return &ProxyContext{
 		Log: log.Default(), 
 		Users: map[string]*ProxyUser{},
-		userSessions: map[string]map[string]*SessionContext{},
-		allSessions: map[string]*SessionContext{},
+		sessions: newSessionRegistry(),
 		Viewers: map[string]*proxySessionViewer{},
 		DefaultRemotePort: 22,
 		DefaultRemoteIP: "127.0.0.1",
@@ -258,16 +258,44 @@ type testSSHServer struct {
 	listener net.Listener
 	active bool
 	messages [][]byte
+	mutex sync.Mutex
 }
 
 
 func (self *testSSHServer) stop() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	self.active = false
 	if self.listener != nil {
 		self.listener.Close()
 	}
 }
 
+func (self *testSSHServer) isActive() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.active
+}
+
+// lockedBuffer lets the test read output
+// while the ssh session is still writing it
+type lockedBuffer struct {
+	buffer bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (self *lockedBuffer) Write(data []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.buffer.Write(data)
+}
+
+func (self *lockedBuffer) String() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.buffer.String()
+}
+
 func (self *testSSHServer) listen() {
 		var err error
 		if self.messages == nil {
@@ -299,9 +327,11 @@ func (self *testSSHServer) listen() {
 		if err != nil {
 			self.t.Fatalf("Cannot start server listener: %s", err)
 		}
+		self.mutex.Lock()
 		self.listener = listener
+		self.mutex.Unlock()
 		log.Printf("Starting dummy SSH server on :%s\n",self.port)
-		for self.active {
+		for self.isActive() {
 			// Once a ServerConfig has been configured, connections can be accepted.
 			serverConnection, err := listener.Accept()
 			
@@ -311,7 +341,9 @@ func (self *testSSHServer) listen() {
 			}
 			// Before use, a handshake must be performed on the incoming net.Conn.
 			SSHConn, SSHChannels, SSHRequests, err := ssh.NewServerConn(serverConnection, config)
+			self.mutex.Lock()
 			self.SSHConn = SSHConn
+			self.mutex.Unlock()
 			if err != nil {
 				self.t.Errorf("Failed to start ssh connection: %s", err)
 				continue
@@ -362,7 +394,9 @@ func (self *testSSHServer) listen() {
 						data := make([]byte,1024)
 						numBytes,err := channel.Read(data)
 						if (err == nil) {
+							self.mutex.Lock()
 							self.messages = append(self.messages,data[:numBytes])
+							self.mutex.Unlock()
 							_,err = channel.Write(data[:numBytes])
 						}
 						log.Printf("data: %s\n",data)
@@ -396,7 +430,7 @@ func sendCommandToTestServer(host, user, password, command string) (error, strin
 		err = newErr
 		if err == nil {
 			defer session.Close()
-			var reply bytes.Buffer
+			var reply lockedBuffer
 			var input bytes.Buffer
 			session.Stdout = &reply
 			session.Stdin = &input
@@ -483,11 +517,10 @@ func TestProxy(t *testing.T) {
 		t.Errorf("Failed to get test string back from dummy echo server. Expected `%s`, got `%s`", testString, testReply)
 	}
 
-	if len(proxy.allSessions) != 1 {
+	if proxy.sessions.len() != 1 {
 		t.Errorf("Proxy did not store session.")
 	} else {
-		for testSessionKey, _ := range proxy.allSessions {
-			testSession := proxy.allSessions[testSessionKey]
+		for _, testSession := range proxy.sessions.snapshot() {
 			if (strings.Compare(testSession.client_username, testUser) != 0) {
 				t.Errorf("Proxy session does not have expected username. Expected %s, got %s", testUser, testSession.client_username)
 			}
@@ -500,8 +533,7 @@ func TestProxy(t *testing.T) {
 
 	proxy.Stop()
 
-	for testSessionKey, _ := range proxy.allSessions {
-		testSession := proxy.allSessions[testSessionKey]
+	for _, testSession := range proxy.sessions.snapshot() {
 		err := os.Remove(testSession.filename)
 		if err != nil {
 			log.Printf("Failed to remove file during cleanup: %s\n", err)
@@ -510,6 +542,75 @@ func TestProxy(t *testing.T) {
 
 }
 
+func TestProxyConcurrentSessions(t *testing.T) {
+	testCount := 20
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	signer, _ := GenerateSigner()
+	proxy := MakeNewProxy(signer)
+	proxy.DefaultRemotePort = int(dummyServer.port.Int64())
+	proxy.ListenPort =  int(newRandomPort().Int64())
+	proxy.SessionFolder = t.TempDir()
+	proxy.SessionEvictionSeconds = -1
+	proxy.Activate()
+	go proxy.StartProxy()
+	time.Sleep(500*time.Millisecond)
+	defer proxy.Stop()
+
+	// read and change the proxy while
+	// the sessions run
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			user := makeNewTestProxyUser()
+			proxy.AddProxyUser(user)
+			proxy.MakeSessionViewerForUser(user.Username, user.Password)
+			for _, viewer := range proxy.ListSessionViewers() {
+				viewer.getSessions()
+			}
+			proxy.ListAllActiveSessions()
+			proxy.SearchSessions(&SessionSearchQuery{Text: "concurrent"}, nil)
+			proxy.RemoveProxyUser(user.Username, user.Password)
+		}
+	}()
+
+	var wait sync.WaitGroup
+	for index := 0; index < testCount; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			testString := fmt.Sprintf("echo concurrent %v", index)
+			err, testReply := sendCommandToTestServer("127.0.0.1:"+strconv.Itoa(proxy.ListenPort), "user", "password", testString)
+			if err != nil {
+				t.Errorf("Error when sending command to proxy: %s", err)
+			} else if testReply != testString {
+				t.Errorf("Failed to get test string back from dummy echo server. Expected `%s`, got `%s`", testString, testReply)
+			}
+		}(index)
+	}
+	wait.Wait()
+	close(done)
+
+	if proxy.sessions.len() != testCount {
+		t.Errorf("Proxy stored %v sessions, expected %v", proxy.sessions.len(), testCount)
+	}
+	if userSessions := proxy.ListAllUserSessions("user:"); len(userSessions) != testCount {
+		t.Errorf("Proxy listed %v sessions for the user, expected %v", len(userSessions), testCount)
+	}
+}
+
 func requestWindowChangeToTestServer(host, user, password string, height, width int) (error) {
 	config := &ssh.ClientConfig{
 		User: user,
@@ -614,25 +715,26 @@ func TestProxyRequestPty(t *testing.T) {
 	
 	
 
-	if len(proxy.allSessions) != 1 {
+	if proxy.sessions.len() != 1 {
 		t.Errorf("Proxy did not store session.")
 	} else {
-		for testSessionKey, _ := range proxy.allSessions {
-			testSession := proxy.allSessions[testSessionKey]
-			if testSession.term_rows != testHeight {
-				t.Errorf("Proxy session does not have expected term_rows. Expected %v, got %v", testHeight, testSession.term_rows )
+		for _, testSession := range proxy.sessions.snapshot() {
+			testSession.mutex.Lock()
+			termRows, termCols := testSession.term_rows, testSession.term_cols
+			testSession.mutex.Unlock()
+			if termRows != testHeight {
+				t.Errorf("Proxy session does not have expected term_rows. Expected %v, got %v", testHeight, termRows )
 			}
 
-			if testSession.term_cols != testWidth {
-				t.Errorf("Proxy session does not have expected term_cols. Expected %v, got %v", testWidth, testSession.term_cols )
+			if termCols != testWidth {
+				t.Errorf("Proxy session does not have expected term_cols. Expected %v, got %v", testWidth, termCols )
 			}
 		}
 	}
 
 	proxy.Stop()
 
-	for testSessionKey, _ := range proxy.allSessions {
-		testSession := proxy.allSessions[testSessionKey]
+	for _, testSession := range proxy.sessions.snapshot() {
 		err := os.Remove(testSession.filename)
 		if err != nil {
 			log.Printf("Failed to remove file during cleanup: %s\n", err)
@@ -679,25 +781,26 @@ func TestProxyWindowChange(t *testing.T) {
 	
 	
 
-	if len(proxy.allSessions) != 1 {
+	if proxy.sessions.len() != 1 {
 		t.Errorf("Proxy did not store session.")
 	} else {
-		for testSessionKey, _ := range proxy.allSessions {
-			testSession := proxy.allSessions[testSessionKey]
-			if testSession.term_rows != testHeight {
-				t.Errorf("Proxy session does not have expected term_rows. Expected %v, got %v", testHeight, testSession.term_rows )
+		for _, testSession := range proxy.sessions.snapshot() {
+			testSession.mutex.Lock()
+			termRows, termCols := testSession.term_rows, testSession.term_cols
+			testSession.mutex.Unlock()
+			if termRows != testHeight {
+				t.Errorf("Proxy session does not have expected term_rows. Expected %v, got %v", testHeight, termRows )
 			}
 
-			if testSession.term_cols != testWidth {
-				t.Errorf("Proxy session does not have expected term_cols. Expected %v, got %v", testWidth, testSession.term_cols )
+			if termCols != testWidth {
+				t.Errorf("Proxy session does not have expected term_cols. Expected %v, got %v", testWidth, termCols )
 			}
 		}
 	}
 
 	proxy.Stop()
 
-	for testSessionKey, _ := range proxy.allSessions {
-		testSession := proxy.allSessions[testSessionKey]
+	for _, testSession := range proxy.sessions.snapshot() {
 		err := os.Remove(testSession.filename)
 		if err != nil {
 			log.Printf("Failed to remove file during cleanup: %s\n", err)
@@ -749,8 +852,8 @@ func TestListSessionsSingle(t *testing.T) {
 		user: testUser2,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
-	proxy.allSessions[proxySessionInactiveKey] = inactiveSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
+	proxy.sessions.add(proxySessionInactiveKey, inactiveSession)
 
 	proxy.AddSessionToUserList(activeSession)
 	proxy.AddSessionToUserList(inactiveSession)
@@ -777,4 +880,60 @@ func TestListSessionsSingle(t *testing.T) {
 // test get Users
 
 
-// expired sessions
\ No newline at end of file
+// expired sessions
+func TestRecordingStoreWhileSettingsChange(t *testing.T) {
+	_, public, err := GenerateRecordingKeyPair(RECORDING_KEY_TYPE_X25519)
+	if err != nil {
+		t.Fatalf("GenerateRecordingKeyPair() = %v", err)
+	}
+	recipientFile := t.TempDir() + "/recipient.pem"
+	os.WriteFile(recipientFile, public, 0600)
+	proxy := makeNewTestProxy()
+	folders := []string{t.TempDir(), t.TempDir()}
+
+	done := make(chan bool)
+	go func() {
+		for index := 0; index < 100; index++ {
+			next := &ProxyContext{SessionFolder: folders[index%2], RecordingRecipientFile: recipientFile}
+			proxy.applySettings(next, []string{"SessionFolder", "RecordingRecipientFile"})
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			if _, err := proxy.GetRecordingStore(); err != nil {
+				t.Fatalf("GetRecordingStore() = %v", err)
+			}
+			proxy.getRecordingRecipient()
+		}
+	}
+	if recipient, err := proxy.getRecordingRecipient(); recipient == nil || err != nil {
+		t.Errorf("getRecordingRecipient() = %v, %v after the settings changed", recipient, err)
+	}
+}
+
+func TestSessionSignalsDoNotBlock(t *testing.T) {
+	proxy := makeNewTestProxy()
+	session := &SessionContext{proxy: proxy, active: true}
+	signal := session.MakeNewSignal()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for count := 0; count < 100; count++ {
+			session.signalNewMessage()
+		}
+		session.signalSessionEnd()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("sendSignalToClients() blocked on a client that wasn't reading")
+	}
+	if value := <-signal; value != SIGNAL_SESSION_END {
+		t.Errorf("signal gave %v after the session ended, expected %v", value, SIGNAL_SESSION_END)
+	}
+}
@@ -0,0 +1,484 @@
+package sshproxyplus
+
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// every encrypted recording starts with this line
+const RECORDING_ENCRYPTED_MAGIC		string = "SSHPROXYPLUS-ENC-1\n"
+// appended to the log filename when a recording is encrypted
+const RECORDING_ENCRYPTED_SUFFIX	string = ".enc"
+
+const RECORDING_KEY_TYPE_X25519		string = "x25519"
+const RECORDING_KEY_TYPE_RSA		string = "rsa-oaep"
+
+const RECORDING_X25519_PUBLIC_PEM	string = "X25519 PUBLIC KEY"
+const RECORDING_X25519_PRIVATE_PEM	string = "X25519 PRIVATE KEY"
+
+const recordingDataKeyLen		int = 32
+const recordingMaxRecordLen		uint32 = 16 * 1024 * 1024
+const recordingRSABits			int = 3072
+
+var recordingKeyLabel = []byte("sshproxyplus recording key")
+// the additional data of the record that ends a recording
+var recordingFinalLabel = []byte("sshproxyplus final record")
+
+/*
+ Recordings are protected with envelope
+ encryption. Every session gets a fresh
+ random data key that is used to seal the
+ log with AES-256-GCM. The data key itself
+ is wrapped for a recipient public key
+ (X25519 or RSA) and stored in the header
+ of the file, so only the holder of the
+ matching private key can read the
+ recording back; the proxy host only
+ ever sees the public half.
+
+ File layout:
+
+	SSHPROXYPLUS-ENC-1\n
+	{recordingHeader as JSON}\n
+	[4 byte big-endian length][sealed record]...
+	[4 byte big-endian length][sealed final record]
+
+ Every call to Write produces one sealed
+ record. Records use a counter nonce so
+ they cannot be reordered or dropped from
+ the middle of a file without detection.
+ Close seals an empty final record with
+ recordingFinalLabel as its additional data,
+ so records dropped from the end are caught
+ too: a recording without it is truncated.
+*/
+type recordingHeader struct {
+	Version		int		`json:"version"`
+	KeyType		string	`json:"key_type"`
+	Ephemeral	[]byte	`json:"ephemeral,omitempty"`
+	WrappedKey	[]byte	`json:"wrapped_key"`
+}
+
+// A RecordingRecipient is the public half
+// of a recording key pair.
+type RecordingRecipient struct {
+	KeyType		string
+	x25519		[]byte
+	rsa			*rsa.PublicKey
+}
+
+// A RecordingIdentity is the private half
+// of a recording key pair and is used to
+// decrypt recordings.
+type RecordingIdentity struct {
+	KeyType		string
+	x25519		[]byte
+	rsa			*rsa.PrivateKey
+}
+
+type RecordingWriter struct {
+	writer		io.Writer
+	aead		cipher.AEAD
+	counter		uint64
+	closed		bool
+}
+
+type recordingReader struct {
+	reader		*bufio.Reader
+	aead		cipher.AEAD
+	counter		uint64
+	buffer		[]byte
+	// set once the final record has been read
+	finished	bool
+	// the recording is still being written, so
+	// it has no final record yet
+	live		bool
+}
+
+
+func recordingNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+func newRecordingAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func deriveX25519WrappingKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	kdf := hkdf.New(sha256.New, shared, salt, recordingKeyLabel)
+	key := make([]byte, recordingDataKeyLen)
+	_, err := io.ReadFull(kdf, key)
+	return key, err
+}
+
+func (recipient *RecordingRecipient) wrapKey(dataKey []byte) (*recordingHeader, error) {
+	header := &recordingHeader{Version: 1, KeyType: recipient.KeyType}
+	switch recipient.KeyType {
+	case RECORDING_KEY_TYPE_X25519:
+		ephemeralPrivate := make([]byte, curve25519.ScalarSize)
+		if _, err := io.ReadFull(rand.Reader, ephemeralPrivate); err != nil {
+			return nil, err
+		}
+		ephemeralPublic, err := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := curve25519.X25519(ephemeralPrivate, recipient.x25519)
+		if err != nil {
+			return nil, err
+		}
+		wrappingKey, err := deriveX25519WrappingKey(shared, ephemeralPublic, recipient.x25519)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newRecordingAEAD(wrappingKey)
+		if err != nil {
+			return nil, err
+		}
+		header.Ephemeral = ephemeralPublic
+		header.WrappedKey = aead.Seal(nil, recordingNonce(aead, 0), dataKey, recordingKeyLabel)
+	case RECORDING_KEY_TYPE_RSA:
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient.rsa, dataKey, recordingKeyLabel)
+		if err != nil {
+			return nil, err
+		}
+		header.WrappedKey = wrapped
+	default:
+		return nil, fmt.Errorf("unsupported recording key type: %v", recipient.KeyType)
+	}
+	return header, nil
+}
+
+func (identity *RecordingIdentity) unwrapKey(header *recordingHeader) ([]byte, error) {
+	if header.KeyType != identity.KeyType {
+		return nil, fmt.Errorf("recording was encrypted for a %v key, not %v", header.KeyType, identity.KeyType)
+	}
+	switch identity.KeyType {
+	case RECORDING_KEY_TYPE_X25519:
+		public, err := curve25519.X25519(identity.x25519, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := curve25519.X25519(identity.x25519, header.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		wrappingKey, err := deriveX25519WrappingKey(shared, header.Ephemeral, public)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newRecordingAEAD(wrappingKey)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, recordingNonce(aead, 0), header.WrappedKey, recordingKeyLabel)
+	case RECORDING_KEY_TYPE_RSA:
+		return rsa.DecryptOAEP(sha256.New(), nil, identity.rsa, header.WrappedKey, recordingKeyLabel)
+	default:
+		return nil, fmt.Errorf("unsupported recording key type: %v", identity.KeyType)
+	}
+}
+
+/*
+ NewRecordingWriter writes the recording header
+ for a fresh data key to writer and returns
+ a RecordingWriter that seals everything
+ written to it afterwards.
+*/
+func NewRecordingWriter(writer io.Writer, recipient *RecordingRecipient) (*RecordingWriter, error) {
+	dataKey := make([]byte, recordingDataKeyLen)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	header, err := recipient.wrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newRecordingAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write([]byte(RECORDING_ENCRYPTED_MAGIC + string(headerData) + "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingWriter{writer: writer, aead: aead}, nil
+}
+
+func (recording *RecordingWriter) writeRecord(data []byte, additional []byte) error {
+	sealed := recording.aead.Seal(nil, recordingNonce(recording.aead, recording.counter), data, additional)
+	recording.counter += 1
+	record := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(record, uint32(len(sealed)))
+	record = append(record, sealed...)
+	_, err := recording.writer.Write(record)
+	return err
+}
+
+func (recording *RecordingWriter) Write(data []byte) (int, error) {
+	if recording.closed {
+		return 0, errors.New("recording is closed")
+	}
+	if err := recording.writeRecord(data, nil); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Close writes the final record. A recording
+// that is never closed reads as truncated.
+func (recording *RecordingWriter) Close() error {
+	if recording.closed {
+		return nil
+	}
+	recording.closed = true
+	return recording.writeRecord(nil, recordingFinalLabel)
+}
+
+func (recording *recordingReader) Read(buff []byte) (int, error) {
+	for len(recording.buffer) == 0 {
+		if recording.finished {
+			return 0, io.EOF
+		}
+		lengthBytes := make([]byte, 4)
+		if _, err := io.ReadFull(recording.reader, lengthBytes); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, errors.New("truncated recording record")
+			}
+			if errors.Is(err, io.EOF) && !recording.live {
+				return 0, errors.New("truncated recording: the final record is missing")
+			}
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(lengthBytes)
+		if length > recordingMaxRecordLen {
+			return 0, errors.New("recording record is too large")
+		}
+		sealed := make([]byte, length)
+		if _, err := io.ReadFull(recording.reader, sealed); err != nil {
+			return 0, errors.New("truncated recording record")
+		}
+		nonce := recordingNonce(recording.aead, recording.counter)
+		plain, err := recording.aead.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			if _, final_err := recording.aead.Open(nil, nonce, sealed, recordingFinalLabel); final_err != nil {
+				return 0, fmt.Errorf("unable to decrypt recording record %v: %w", recording.counter, err)
+			}
+			if _, err := recording.reader.Peek(1); !errors.Is(err, io.EOF) {
+				return 0, errors.New("recording has data after its final record")
+			}
+			recording.finished = true
+		}
+		recording.counter += 1
+		recording.buffer = plain
+	}
+	count := copy(buff, recording.buffer)
+	recording.buffer = recording.buffer[count:]
+	return count, nil
+}
+
+/*
+ NewRecordingReader returns a reader that yields
+ the plaintext of a recording. Recordings that
+ were not encrypted are passed through untouched,
+ so callers do not need to know ahead of time
+ how a log was written. identity may be nil
+ if only plaintext recordings are expected.
+ Reading an encrypted recording that is
+ missing its final record fails.
+*/
+func NewRecordingReader(reader io.Reader, identity *RecordingIdentity) (io.Reader, error) {
+	return newRecordingReader(reader, identity, false)
+}
+
+// live recordings end at the last record
+// written so far instead of a final record
+func newRecordingReader(reader io.Reader, identity *RecordingIdentity, live bool) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+	magic, err := buffered.Peek(len(RECORDING_ENCRYPTED_MAGIC))
+	if err != nil || string(magic) != RECORDING_ENCRYPTED_MAGIC {
+		return buffered, nil
+	}
+	if identity == nil {
+		return nil, errors.New("recording is encrypted and no identity was provided")
+	}
+	buffered.Discard(len(RECORDING_ENCRYPTED_MAGIC))
+	headerLine, err := buffered.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("unable to read recording header: %w", err)
+	}
+	header := &recordingHeader{}
+	if err := json.Unmarshal(headerLine, header); err != nil {
+		return nil, fmt.Errorf("unable to parse recording header: %w", err)
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported recording version: %v", header.Version)
+	}
+	dataKey, err := identity.unwrapKey(header)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap recording key: %w", err)
+	}
+	aead, err := newRecordingAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingReader{reader: buffered, aead: aead, live: live}, nil
+}
+
+// IsEncryptedRecording reports whether data begins
+// with the encrypted recording header.
+func IsEncryptedRecording(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(RECORDING_ENCRYPTED_MAGIC))
+}
+
+// DecryptRecording decrypts an entire recording held in memory.
+func DecryptRecording(data []byte, identity *RecordingIdentity) ([]byte, error) {
+	reader, err := NewRecordingReader(bytes.NewReader(data), identity)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func ParseRecordingRecipient(data []byte) (*RecordingRecipient, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found in recording recipient")
+	}
+	switch block.Type {
+	case RECORDING_X25519_PUBLIC_PEM:
+		if len(block.Bytes) != curve25519.PointSize {
+			return nil, errors.New("invalid X25519 public key length")
+		}
+		return &RecordingRecipient{KeyType: RECORDING_KEY_TYPE_X25519, x25519: block.Bytes}, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &RecordingRecipient{KeyType: RECORDING_KEY_TYPE_RSA, rsa: key}, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return &RecordingRecipient{KeyType: RECORDING_KEY_TYPE_RSA, rsa: rsaKey}, nil
+		}
+		return nil, errors.New("unsupported public key type in recording recipient")
+	default:
+		return nil, fmt.Errorf("unsupported PEM block in recording recipient: %v", block.Type)
+	}
+}
+
+func ParseRecordingIdentity(data []byte) (*RecordingIdentity, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found in recording identity")
+	}
+	switch block.Type {
+	case RECORDING_X25519_PRIVATE_PEM:
+		if len(block.Bytes) != curve25519.ScalarSize {
+			return nil, errors.New("invalid X25519 private key length")
+		}
+		return &RecordingIdentity{KeyType: RECORDING_KEY_TYPE_X25519, x25519: block.Bytes}, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &RecordingIdentity{KeyType: RECORDING_KEY_TYPE_RSA, rsa: key}, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return &RecordingIdentity{KeyType: RECORDING_KEY_TYPE_RSA, rsa: rsaKey}, nil
+		}
+		return nil, errors.New("unsupported private key type in recording identity")
+	default:
+		return nil, fmt.Errorf("unsupported PEM block in recording identity: %v", block.Type)
+	}
+}
+
+func LoadRecordingRecipient(filepath string) (*RecordingRecipient, error) {
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRecordingRecipient(data)
+}
+
+func LoadRecordingIdentity(filepath string) (*RecordingIdentity, error) {
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRecordingIdentity(data)
+}
+
+/*
+ GenerateRecordingKeyPair creates a new recording
+ key pair of the given type and returns the
+ PEM-encoded private and public keys.
+*/
+func GenerateRecordingKeyPair(keyType string) (privatePEM []byte, publicPEM []byte, err error) {
+	switch keyType {
+	case RECORDING_KEY_TYPE_X25519:
+		private := make([]byte, curve25519.ScalarSize)
+		if _, err = io.ReadFull(rand.Reader, private); err != nil {
+			return nil, nil, err
+		}
+		var public []byte
+		public, err = curve25519.X25519(private, curve25519.Basepoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		privatePEM = pem.EncodeToMemory(&pem.Block{Type: RECORDING_X25519_PRIVATE_PEM, Bytes: private})
+		publicPEM = pem.EncodeToMemory(&pem.Block{Type: RECORDING_X25519_PUBLIC_PEM, Bytes: public})
+	case RECORDING_KEY_TYPE_RSA:
+		var key *rsa.PrivateKey
+		key, err = rsa.GenerateKey(rand.Reader, recordingRSABits)
+		if err != nil {
+			return nil, nil, err
+		}
+		var public []byte
+		public, err = x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		privatePEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		publicPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+	default:
+		err = fmt.Errorf("unsupported recording key type: %v", keyType)
+	}
+	return privatePEM, publicPEM, err
+}
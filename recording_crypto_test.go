@@ -0,0 +1,327 @@
+package sshproxyplus
+
+import (
+	"testing"
+	"bytes"
+	"os"
+	"io"
+	"time"
+	"net/http"
+	"encoding/json"
+)
+
+
+func testRecordingRoundTrip(t *testing.T, keyType string) {
+	privatePEM, publicPEM, err := GenerateRecordingKeyPair(keyType)
+	if err != nil {
+		t.Fatalf("GenerateRecordingKeyPair(%v) returned an error: %s", keyType, err)
+	}
+	recipient, err := ParseRecordingRecipient(publicPEM)
+	if err != nil {
+		t.Fatalf("ParseRecordingRecipient() returned an error: %s", err)
+	}
+	identity, err := ParseRecordingIdentity(privatePEM)
+	if err != nil {
+		t.Fatalf("ParseRecordingIdentity() returned an error: %s", err)
+	}
+
+	var sealed bytes.Buffer
+	writer, err := NewRecordingWriter(&sealed, recipient)
+	if err != nil {
+		t.Fatalf("NewRecordingWriter() returned an error: %s", err)
+	}
+	chunks := []string{"[\n", `{"type":"session-start","password":"hunter2"}`, ",\n{\"type\":\"session-stop\"}", "\n]"}
+	for _, chunk := range chunks {
+		writer.Write([]byte(chunk))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("RecordingWriter.Close() returned an error: %s", err)
+	}
+
+	if bytes.Contains(sealed.Bytes(), []byte("hunter2")) {
+		t.Fatalf("RecordingWriter.Write() left plaintext in the recording")
+	}
+	if !IsEncryptedRecording(sealed.Bytes()) {
+		t.Fatalf("IsEncryptedRecording() did not detect an encrypted recording")
+	}
+
+	plain, err := DecryptRecording(sealed.Bytes(), identity)
+	if err != nil {
+		t.Fatalf("DecryptRecording() returned an error: %s", err)
+	}
+	expected := ""
+	for _, chunk := range chunks {
+		expected += chunk
+	}
+	if string(plain) != expected {
+		t.Fatalf("DecryptRecording() = %s, expected %s", plain, expected)
+	}
+
+	otherPrivatePEM, _, _ := GenerateRecordingKeyPair(keyType)
+	otherIdentity, _ := ParseRecordingIdentity(otherPrivatePEM)
+	_, err = DecryptRecording(sealed.Bytes(), otherIdentity)
+	if err == nil {
+		t.Fatalf("DecryptRecording() succeeded with the wrong identity")
+	}
+}
+
+func TestRecordingRoundTripX25519(t *testing.T) {
+	testRecordingRoundTrip(t, RECORDING_KEY_TYPE_X25519)
+}
+
+func TestRecordingRoundTripRSA(t *testing.T) {
+	testRecordingRoundTrip(t, RECORDING_KEY_TYPE_RSA)
+}
+
+func TestRecordingReaderPlaintextPassthrough(t *testing.T) {
+	plain := []byte("[\n{\"type\":\"session-start\"}\n]")
+	out, err := DecryptRecording(plain, nil)
+	if err != nil {
+		t.Fatalf("DecryptRecording() returned an error for a plaintext recording: %s", err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Fatalf("DecryptRecording() = %s, expected %s", out, plain)
+	}
+}
+
+func TestRecordingReaderTamperedRecord(t *testing.T) {
+	privatePEM, publicPEM, _ := GenerateRecordingKeyPair(RECORDING_KEY_TYPE_X25519)
+	recipient, _ := ParseRecordingRecipient(publicPEM)
+	identity, _ := ParseRecordingIdentity(privatePEM)
+
+	var sealed bytes.Buffer
+	writer, _ := NewRecordingWriter(&sealed, recipient)
+	writer.Write([]byte("some data"))
+	data := sealed.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	_, err := DecryptRecording(data, identity)
+	if err == nil {
+		t.Fatalf("DecryptRecording() did not detect a modified record")
+	}
+}
+
+func TestRecordingReaderTruncated(t *testing.T) {
+	privatePEM, publicPEM, _ := GenerateRecordingKeyPair(RECORDING_KEY_TYPE_X25519)
+	recipient, _ := ParseRecordingRecipient(publicPEM)
+	identity, _ := ParseRecordingIdentity(privatePEM)
+
+	var sealed bytes.Buffer
+	writer, _ := NewRecordingWriter(&sealed, recipient)
+	writer.Write([]byte("[\n"))
+	writer.Write([]byte(`{"type":"session-start"}`))
+	complete := sealed.Len()
+	writer.Write([]byte(",\n{\"type\":\"session-stop\"}"))
+	writer.Write([]byte("\n]"))
+	writer.Close()
+	data := sealed.Bytes()
+
+	if _, err := DecryptRecording(data, identity); err != nil {
+		t.Fatalf("DecryptRecording() returned an error for a complete recording: %s", err)
+	}
+	// the final record is an empty plaintext plus the GCM tag
+	finalLen := 4 + 16
+	if _, err := DecryptRecording(data[:len(data)-finalLen], identity); err == nil {
+		t.Errorf("DecryptRecording() accepted a recording without its final record")
+	}
+	if _, err := DecryptRecording(data[:complete], identity); err == nil {
+		t.Errorf("DecryptRecording() accepted a recording cut at a record boundary")
+	}
+	extra := append(append([]byte{}, data...), data[len(data)-finalLen:]...)
+	if _, err := DecryptRecording(extra, identity); err == nil {
+		t.Errorf("DecryptRecording() accepted data after the final record")
+	}
+
+	reader, _ := NewRecordingReader(bytes.NewReader(data[:complete]), identity)
+	if err, _ := indexRecording(&SessionContext{}, reader); err == nil {
+		t.Errorf("indexRecording() indexed a truncated recording")
+	}
+	reader, _ = newRecordingReader(bytes.NewReader(data[:complete]), identity, true)
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Errorf("a live recording without a final record could not be read: %s", err)
+	}
+}
+
+func writeTestRecordingKeys(t *testing.T) (string, string) {
+	privatePEM, publicPEM, err := GenerateRecordingKeyPair(RECORDING_KEY_TYPE_X25519)
+	if err != nil {
+		t.Fatalf("GenerateRecordingKeyPair() returned an error: %s", err)
+	}
+	folder := t.TempDir()
+	privateFile := folder + "/recording.key"
+	publicFile := folder + "/recording.pub"
+	os.WriteFile(privateFile, privatePEM, 0600)
+	os.WriteFile(publicFile, publicPEM, 0644)
+	return privateFile, publicFile
+}
+
+func TestSessionEncryptedLog(t *testing.T) {
+	privateFile, publicFile := writeTestRecordingKeys(t)
+
+	proxy := makeNewTestProxy()
+	proxy.SessionFolder = t.TempDir()
+	proxy.RecordingRecipientFile = publicFile
+
+	session := &SessionContext{
+		proxy: proxy,
+		active: true,
+		start_time: time.Now(),
+		filename: "encrypted-session.log.json",
+		user: makeNewTestProxyUser(),
+		client_password: "secret-password",
+	}
+	session.initializeLog()
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START, Password: session.client_password})
+	session.finalizeLog()
+
+	if !bytes.HasSuffix([]byte(session.filename), []byte(RECORDING_ENCRYPTED_SUFFIX + ".scan")) {
+		t.Fatalf("initializeLog() did not mark the log file as encrypted: %v", session.filename)
+	}
+
+	data, err := os.ReadFile(proxy.SessionFolder + "/" + session.filename)
+	if err != nil {
+		t.Fatalf("Failed to read session log: %s", err)
+	}
+	if bytes.Contains(data, []byte(session.client_password)) {
+		t.Fatalf("initializeLog() wrote the password to disk in cleartext")
+	}
+
+	identity, _ := LoadRecordingIdentity(privateFile)
+	plain, err := DecryptRecording(data, identity)
+	if err != nil {
+		t.Fatalf("DecryptRecording() returned an error: %s", err)
+	}
+	events := make([]SessionEvent, 0)
+	err = json.Unmarshal(plain, &events)
+	if err != nil {
+		t.Fatalf("Decrypted session log is not valid json: %s: %s", err, plain)
+	}
+	if len(events) != 1 || events[0].Password != session.client_password {
+		t.Fatalf("Decrypted session log did not contain the expected event: %s", plain)
+	}
+
+	var info session_info_extended
+	json.Unmarshal([]byte(session.InfoAsJSON()), &info)
+	if info.Password != "" {
+		t.Fatalf("InfoAsJSON() leaked the password for an encrypted session")
+	}
+}
+
+func TestSessionEncryptedLogBadRecipient(t *testing.T) {
+	proxy := makeNewTestProxy()
+	proxy.SessionFolder = t.TempDir()
+	proxy.RecordingRecipientFile = proxy.SessionFolder + "/missing.pub"
+
+	session := &SessionContext{
+		proxy: proxy,
+		filename: "session.log.json",
+		user: makeNewTestProxyUser(),
+	}
+	session.initializeLog()
+	session.appendToLog([]byte("data"))
+
+	entries, _ := os.ReadDir(proxy.SessionFolder)
+	if len(entries) != 0 {
+		t.Fatalf("initializeLog() wrote a cleartext log when the recipient could not be loaded")
+	}
+}
+
+func TestWebServerRecordingDecrypt(t *testing.T) {
+	privateFile, publicFile := writeTestRecordingKeys(t)
+
+	controller := makeNewController()
+	controller.InitializeSocket()
+	controller.RecordingIdentityFile = privateFile
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.SessionFolder = t.TempDir()
+	proxy.RecordingRecipientFile = publicFile
+	proxyID := controller.AddExistingProxy(proxy)
+
+	user := makeNewTestProxyUser()
+	proxy.AddProxyUser(user)
+
+	sessionKey := "recorded-session"
+	session := &SessionContext{
+		proxy: proxy,
+		active: true,
+		start_time: time.Now(),
+		filename: sessionKey + ".log.json",
+		sessionID: sessionKey,
+		user: user,
+	}
+	proxy.sessions.add(sessionKey, session)
+	proxy.AddSessionToUserList(session)
+	session.initializeLog()
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START, Key: sessionKey})
+
+	err, viewer := controller.CreateUserSessionViewer(proxyID, user.Username, user.Password)
+	if err != nil {
+		t.Fatalf("Failed to create session viewer during setup: %s", err)
+	}
+
+	go controller.StartWebServer()
+	defer controller.StopWebServer()
+	time.Sleep(100* time.Millisecond)
+
+	baseURL := "http://" + controller.WebHost + "/recording/?id=0&session=" + sessionKey
+	resp, err := http.Get(baseURL + "&viewer=wrong")
+	if err != nil {
+		t.Fatalf("Failed to query recording endpoint: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("handleRecordingRequest() gave status %v for a bad viewer secret, expected %v", resp.StatusCode, http.StatusForbidden)
+	}
+
+	resp, err = http.Get(baseURL + "&viewer=" + viewer.Secret)
+	if err != nil {
+		t.Fatalf("Failed to query recording endpoint: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("handleRecordingRequest() gave status %v for a live session, expected %v", resp.StatusCode, http.StatusConflict)
+	}
+
+	session.mutex.Lock()
+	session.active = false
+	session.mutex.Unlock()
+	resp, err = http.Get(baseURL + "&viewer=" + viewer.Secret)
+	if err != nil {
+		t.Fatalf("Failed to query recording endpoint: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("handleRecordingRequest() gave status %v for a session whose recording is still open, expected %v", resp.StatusCode, http.StatusConflict)
+	}
+
+	session.finalizeLog()
+	resp, err = http.Get(baseURL + "&viewer=" + viewer.Secret)
+	if err != nil {
+		t.Fatalf("Failed to query recording endpoint: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	events := make([]SessionEvent, 0)
+	err = json.Unmarshal(body, &events)
+	if err != nil {
+		t.Fatalf("handleRecordingRequest() did not return the decrypted recording: %s: %s", err, body)
+	}
+	if len(events) != 1 || events[0].Key != sessionKey {
+		t.Fatalf("handleRecordingRequest() returned unexpected events: %s", body)
+	}
+
+	path := proxy.SessionFolder + "/" + session.getFilename()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read session log: %s", err)
+	}
+	os.WriteFile(path, data[:len(data)-(4+16)], 0600)
+	resp, err = http.Get(baseURL + "&viewer=" + viewer.Secret)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("handleRecordingRequest() sent a recording without its final record as complete")
+	}
+}
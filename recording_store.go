@@ -0,0 +1,279 @@
+package sshproxyplus
+
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RECORDING_STORE_FILESYSTEM	string = "filesystem"
+const RECORDING_STORE_S3			string = "s3"
+
+/*
+ A RecordingStore persists session logs and the
+ list of finished sessions.
+
+ A recording is created once, appended to as
+ events occur, and finalized when the session
+ ends. Finalize may give the recording a new
+ name (e.g. the ".scan" suffix for short
+ sessions). Recordings can be opened for reading
+ once they are finalized; some stores may also
+ allow reading a recording that is still being
+ written.
+
+ The session list holds one JSON summary line
+ per finished session. PruneSessionList drops
+ every entry that keep returns false for and
+ reports how many were dropped.
+*/
+type RecordingStore interface {
+	Create(name string) error
+	Append(name string, data []byte) error
+	Finalize(name string, finalName string) error
+	List() ([]RecordingInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Delete(name string) error
+	AddToSessionList(entry []byte) error
+	OpenSessionList() (io.ReadCloser, error)
+	PruneSessionList(keep func(entry []byte) bool) (int, error)
+}
+
+type RecordingInfo struct {
+	Name	string
+	Size	int64
+	ModTime	time.Time
+}
+
+/*
+ RecordingStoreConfig selects and configures the
+ RecordingStore for a proxy. The filesystem store
+ is used when the config is missing or the Type
+ is empty, and writes to the proxy's
+ SessionFolder just as it always has.
+
+ The s3 store talks to any S3-compatible object
+ store using path-style requests, e.g.
+ Endpoint "http://127.0.0.1:9000" and Bucket
+ "recordings". Objects are written under Prefix.
+*/
+type RecordingStoreConfig struct {
+	Type		string
+	Endpoint	string	`json:",omitempty"`
+	Region		string	`json:",omitempty"`
+	Bucket		string	`json:",omitempty"`
+	Prefix		string	`json:",omitempty"`
+	AccessKey	string	`json:",omitempty"`
+	SecretKey	string	`json:",omitempty"`
+}
+
+func NewRecordingStore(config *RecordingStoreConfig, sessionFolder string) (RecordingStore, error) {
+	if config == nil || config.Type == "" || config.Type == RECORDING_STORE_FILESYSTEM {
+		return NewFilesystemRecordingStore(sessionFolder), nil
+	}
+	switch config.Type {
+	case RECORDING_STORE_S3:
+		return NewS3RecordingStore(config)
+	default:
+		return nil, fmt.Errorf("unsupported recording store type: %v", config.Type)
+	}
+}
+
+// recordingAppender adapts a store recording to an io.Writer
+// so it can sit underneath a RecordingWriter
+type recordingAppender struct {
+	store	RecordingStore
+	name	string
+}
+
+func (appender *recordingAppender) Write(data []byte) (int, error) {
+	if err := appender.store.Append(appender.name, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+
+/*
+ FilesystemRecordingStore keeps every recording
+ as a file in Folder, with the session list in
+ Folder/.session_list
+*/
+type FilesystemRecordingStore struct {
+	Folder		string
+	mutex		sync.Mutex
+	open		map[string]*os.File
+	list_mutex	sync.Mutex
+}
+
+func NewFilesystemRecordingStore(folder string) *FilesystemRecordingStore {
+	return &FilesystemRecordingStore{Folder: folder, open: make(map[string]*os.File)}
+}
+
+func (store *FilesystemRecordingStore) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) {
+		return "", fmt.Errorf("invalid recording name: %v", name)
+	}
+	return store.Folder + "/" + name, nil
+}
+
+func (store *FilesystemRecordingStore) Create(name string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	if old, ok := store.open[name]; ok {
+		old.Close()
+	}
+	store.open[name] = fd
+	store.mutex.Unlock()
+	return nil
+}
+
+func (store *FilesystemRecordingStore) Append(name string, data []byte) error {
+	store.mutex.Lock()
+	fd, ok := store.open[name]
+	store.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("recording is not open: %v", name)
+	}
+	_, err := fd.Write(data)
+	return err
+}
+
+func (store *FilesystemRecordingStore) Finalize(name string, finalName string) error {
+	store.mutex.Lock()
+	fd, ok := store.open[name]
+	delete(store.open, name)
+	store.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("recording is not open: %v", name)
+	}
+	err := fd.Close()
+	if err == nil && finalName != "" && finalName != name {
+		var oldPath, newPath string
+		oldPath, err = store.path(name)
+		if err == nil {
+			newPath, err = store.path(finalName)
+		}
+		if err == nil {
+			err = os.Rename(oldPath, newPath)
+		}
+	}
+	return err
+}
+
+func (store *FilesystemRecordingStore) List() ([]RecordingInfo, error) {
+	entries, err := os.ReadDir(store.Folder)
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]RecordingInfo, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, RecordingInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return recordings, nil
+}
+
+func (store *FilesystemRecordingStore) Open(name string) (io.ReadCloser, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (store *FilesystemRecordingStore) Delete(name string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	_, live := store.open[name]
+	store.mutex.Unlock()
+	if live {
+		return fmt.Errorf("recording is still open: %v", name)
+	}
+	return os.Remove(path)
+}
+
+func (store *FilesystemRecordingStore) AddToSessionList(entry []byte) error {
+	store.list_mutex.Lock()
+	defer store.list_mutex.Unlock()
+	fd, err := os.OpenFile(store.Folder + "/" + SESSION_LIST_FN, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(entry)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (store *FilesystemRecordingStore) OpenSessionList() (io.ReadCloser, error) {
+	fd, err := os.Open(store.Folder + "/" + SESSION_LIST_FN)
+	if errors.Is(err, os.ErrNotExist) {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return fd, err
+}
+
+/*
+ PruneSessionList rewrites the session list
+ to a temporary file and renames it into place
+ so a crash can't leave a half-written list.
+*/
+func (store *FilesystemRecordingStore) PruneSessionList(keep func(entry []byte) bool) (int, error) {
+	store.list_mutex.Lock()
+	defer store.list_mutex.Unlock()
+	path := store.Folder + "/" + SESSION_LIST_FN
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var kept bytes.Buffer
+	pruned := 0
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if keep(line) {
+			kept.Write(line)
+		} else {
+			pruned += 1
+		}
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+	err = os.WriteFile(path + ".tmp", kept.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(path + ".tmp", path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
@@ -0,0 +1,426 @@
+package sshproxyplus
+
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const s3SessionListFolder		string = SESSION_LIST_FN + ".d/"
+const s3DefaultRegion			string = "us-east-1"
+const s3TimeFormat				string = "20060102T150405Z"
+const s3DateFormat				string = "20060102"
+
+/*
+ S3RecordingStore writes recordings to an
+ S3-compatible object store. Requests are
+ signed with AWS Signature Version 4.
+
+ Objects can't be appended to, so a recording
+ is spooled to a temporary file while the
+ session is live and uploaded when it is
+ finalized.
+ Session list entries are stored as one object
+ each under Prefix + ".session_list.d/".
+*/
+type S3RecordingStore struct {
+	config		RecordingStoreConfig
+	client		*http.Client
+	mutex		sync.Mutex
+	spools		map[string]*os.File
+	counter		uint64
+}
+
+type s3ListBucketResult struct {
+	Contents				[]s3ListObject	`xml:"Contents"`
+	IsTruncated				bool			`xml:"IsTruncated"`
+	NextContinuationToken	string			`xml:"NextContinuationToken"`
+}
+
+type s3ListObject struct {
+	Key				string		`xml:"Key"`
+	Size			int64		`xml:"Size"`
+	LastModified	time.Time	`xml:"LastModified"`
+}
+
+func NewS3RecordingStore(config *RecordingStoreConfig) (*S3RecordingStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("s3 recording store requires an Endpoint and a Bucket")
+	}
+	if _, err := url.Parse(config.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	store := &S3RecordingStore{
+		config: *config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		spools: make(map[string]*os.File),
+	}
+	if store.config.Region == "" {
+		store.config.Region = s3DefaultRegion
+	}
+	return store, nil
+}
+
+func (store *S3RecordingStore) Create(name string) error {
+	spool, err := os.CreateTemp("", "sshproxyplus-*.spool")
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	previous, ok := store.spools[name]
+	store.spools[name] = spool
+	store.mutex.Unlock()
+	if ok {
+		closeSpool(previous)
+	}
+	return nil
+}
+
+func (store *S3RecordingStore) Append(name string, data []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	spool, ok := store.spools[name]
+	if !ok {
+		return fmt.Errorf("recording is not open: %v", name)
+	}
+	_, err := spool.Write(data)
+	return err
+}
+
+func (store *S3RecordingStore) Finalize(name string, finalName string) error {
+	store.mutex.Lock()
+	spool, ok := store.spools[name]
+	delete(store.spools, name)
+	store.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("recording is not open: %v", name)
+	}
+	defer closeSpool(spool)
+	if finalName == "" {
+		finalName = name
+	}
+	return store.putFile(store.config.Prefix + finalName, spool)
+}
+
+func closeSpool(spool *os.File) {
+	spool.Close()
+	os.Remove(spool.Name())
+}
+
+func (store *S3RecordingStore) List() ([]RecordingInfo, error) {
+	objects, err := store.listObjects(store.config.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]RecordingInfo, 0)
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, store.config.Prefix)
+		if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		recordings = append(recordings, RecordingInfo{Name: name, Size: object.Size, ModTime: object.LastModified})
+	}
+	return recordings, nil
+}
+
+/*
+ Open reads a finalized recording from the
+ object store. A recording that is still live
+ is read from its spool file.
+*/
+func (store *S3RecordingStore) Open(name string) (io.ReadCloser, error) {
+	store.mutex.Lock()
+	if spool, ok := store.spools[name]; ok {
+		// the store holds the spool open, so it can't
+		// be removed before this one is opened
+		reader, err := os.Open(spool.Name())
+		store.mutex.Unlock()
+		return reader, err
+	}
+	store.mutex.Unlock()
+	return store.getObject(store.config.Prefix + name)
+}
+
+func (store *S3RecordingStore) Delete(name string) error {
+	store.mutex.Lock()
+	_, live := store.spools[name]
+	store.mutex.Unlock()
+	if live {
+		return fmt.Errorf("recording is still open: %v", name)
+	}
+	return store.deleteObject(store.config.Prefix + name)
+}
+
+func (store *S3RecordingStore) AddToSessionList(entry []byte) error {
+	store.mutex.Lock()
+	store.counter += 1
+	counter := store.counter
+	store.mutex.Unlock()
+	suffix, err := generateRandomString(8)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%v%v%020d-%v-%v.json", store.config.Prefix, s3SessionListFolder, time.Now().UnixNano(), counter, suffix)
+	return store.putObject(key, entry)
+}
+
+func (store *S3RecordingStore) OpenSessionList() (io.ReadCloser, error) {
+	objects, err := store.listObjects(store.config.Prefix + s3SessionListFolder)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	var list bytes.Buffer
+	for _, object := range objects {
+		reader, err := store.getObject(object.Key)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(&list, reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return io.NopCloser(&list), nil
+}
+
+// PruneSessionList deletes the objects of the
+// entries that aren't kept
+func (store *S3RecordingStore) PruneSessionList(keep func(entry []byte) bool) (int, error) {
+	objects, err := store.listObjects(store.config.Prefix + s3SessionListFolder)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, object := range objects {
+		reader, err := store.getObject(object.Key)
+		if err != nil {
+			return pruned, err
+		}
+		entry, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return pruned, err
+		}
+		if keep(entry) {
+			continue
+		}
+		if err = store.deleteObject(object.Key); err != nil {
+			return pruned, err
+		}
+		pruned += 1
+	}
+	return pruned, nil
+}
+
+func (store *S3RecordingStore) objectURL(key string) string {
+	return strings.TrimSuffix(store.config.Endpoint, "/") + "/" + s3URIEncode(store.config.Bucket, false) + "/" + s3URIEncode(key, false)
+}
+
+func (store *S3RecordingStore) putObject(key string, data []byte) error {
+	request, err := http.NewRequest(http.MethodPut, store.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	response, err := store.do(request, data)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// putFile uploads a file without reading it
+// into memory
+func (store *S3RecordingStore) putFile(key string, file *os.File) error {
+	hash := sha256.New()
+	size, err := io.Copy(hash, io.NewSectionReader(file, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPut, store.objectURL(key), io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	response, err := store.send(request, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (store *S3RecordingStore) getObject(key string) (io.ReadCloser, error) {
+	request, err := http.NewRequest(http.MethodGet, store.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := store.do(request, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (store *S3RecordingStore) deleteObject(key string) error {
+	request, err := http.NewRequest(http.MethodDelete, store.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	response, err := store.do(request, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (store *S3RecordingStore) listObjects(prefix string) ([]s3ListObject, error) {
+	objects := make([]s3ListObject, 0)
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		listURL := strings.TrimSuffix(store.config.Endpoint, "/") + "/" + s3URIEncode(store.config.Bucket, false) + "?" + s3CanonicalQuery(query)
+		request, err := http.NewRequest(http.MethodGet, listURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		response, err := store.do(request, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := s3ListBucketResult{}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse s3 object list: %w", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return objects, nil
+}
+
+func (store *S3RecordingStore) do(request *http.Request, body []byte) (*http.Response, error) {
+	payloadHash := sha256.Sum256(body)
+	return store.send(request, hex.EncodeToString(payloadHash[:]))
+}
+
+// send signs the request with the hex sha256
+// of its body and sends it
+func (store *S3RecordingStore) send(request *http.Request, payloadHex string) (*http.Response, error) {
+	store.signPayload(request, payloadHex, time.Now().UTC())
+	response, err := store.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("s3 %v %v failed: %v: %s", request.Method, request.URL.Path, response.Status, message)
+	}
+	return response, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (store *S3RecordingStore) sign(request *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	store.signPayload(request, hex.EncodeToString(payloadHash[:]), now)
+}
+
+func (store *S3RecordingStore) signPayload(request *http.Request, payloadHex string, now time.Time) {
+	amzDate := now.Format(s3TimeFormat)
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", payloadHex)
+	if store.config.AccessKey == "" {
+		return
+	}
+
+	canonicalHeaders := "host:" + request.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHex + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHex,
+	}, "\n")
+
+	scope := now.Format(s3DateFormat) + "/" + store.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := s3HMAC([]byte("AWS4" + store.config.SecretKey), now.Format(s3DateFormat))
+	key = s3HMAC(key, store.config.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		store.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode follows the AWS rules: only unreserved
+// characters are left as-is
+func s3URIEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			encoded.WriteByte(b)
+		} else {
+			encoded.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return encoded.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3URIEncode(key, true) + "=" + s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
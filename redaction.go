@@ -0,0 +1,218 @@
+package sshproxyplus
+
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+)
+
+// passwords are stored and logged as-is
+const REDACTION_PASSWORD_KEEP	string = "keep"
+// passwords are replaced with a salted sha256 hash
+const REDACTION_PASSWORD_HASH	string = "hash"
+// passwords are replaced with REDACTION_MASK
+const REDACTION_PASSWORD_MASK	string = "mask"
+// passwords are removed entirely
+const REDACTION_PASSWORD_DROP	string = "drop"
+
+const REDACTION_MASK			string = "[REDACTED]"
+
+// matches the end of an output chunk that asks
+// for a secret, e.g. "[sudo] password for ben: "
+const REDACTION_DEFAULT_PROMPT	string = `(?i)(password|passphrase|passcode|pin)[^\n]{0,64}:\s*$`
+
+/*
+ A RedactionPattern replaces every match of
+ Pattern in event data with Replacement, which
+ may reference capture groups ($1) like
+ regexp.ReplaceAll. If Replacement is empty,
+ REDACTION_MASK is used.
+
+ Patterns are applied to each chunk of data
+ as it is read, so a secret that is split
+ across two reads will not be matched.
+*/
+type RedactionPattern struct {
+	Name		string
+	Pattern		string
+	Replacement	string
+	compiled	*regexp.Regexp
+}
+
+/*
+ RedactionConfig controls which secrets are
+ scrubbed from events before they are stored,
+ written to the session log, logged, or sent to
+ callbacks and viewers.
+
+ PasswordMode decides what happens to the
+ password a client authenticated with: keep,
+ hash, mask or drop. An empty mode keeps the
+ password.
+
+ When RedactPromptInput is set, client input
+ that follows a password prompt from the server
+ is dropped up to the next newline, since it
+ is typed with echo turned off. PromptPattern
+ overrides REDACTION_DEFAULT_PROMPT.
+*/
+type RedactionConfig struct {
+	PasswordMode		string
+	HashSalt			string
+	Patterns			[]*RedactionPattern
+	RedactPromptInput	bool
+	PromptPattern		string
+	promptCompiled		*regexp.Regexp
+}
+
+// common patterns that can be added to a RedactionConfig
+func DefaultRedactionPatterns() []*RedactionPattern {
+	return []*RedactionPattern{
+		&RedactionPattern{Name: "aws-access-key", Pattern: `\b(AKIA|ASIA)[0-9A-Z]{16}\b`},
+		&RedactionPattern{Name: "aws-secret-key", Pattern: `(?i)(aws_secret_access_key\s*[=:]\s*)[A-Za-z0-9/+=]{40}`, Replacement: "${1}" + REDACTION_MASK},
+		&RedactionPattern{Name: "private-key", Pattern: `-----BEGIN [A-Z ]*PRIVATE KEY-----`},
+	}
+}
+
+// clone copies the config and its patterns so
+// the copy can be compiled on its own
+func (config *RedactionConfig) clone() *RedactionConfig {
+	if config == nil {
+		return nil
+	}
+	copied := *config
+	copied.Patterns = make([]*RedactionPattern, 0, len(config.Patterns))
+	for _, pattern := range config.Patterns {
+		copied_pattern := *pattern
+		copied.Patterns = append(copied.Patterns, &copied_pattern)
+	}
+	return &copied
+}
+
+/*
+ Compile checks the password mode and compiles
+ every pattern. It must be called before the
+ config is used; the proxy does this when it
+ is initialized or when the config is replaced
+ via the controller.
+*/
+func (config *RedactionConfig) Compile() error {
+	if config == nil {
+		return nil
+	}
+	switch config.PasswordMode {
+	case "", REDACTION_PASSWORD_KEEP, REDACTION_PASSWORD_HASH, REDACTION_PASSWORD_MASK, REDACTION_PASSWORD_DROP:
+	default:
+		return fmt.Errorf("unsupported password redaction mode: %v", config.PasswordMode)
+	}
+	for _, pattern := range config.Patterns {
+		compiled, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid redaction pattern %v: %w", pattern.Name, err)
+		}
+		pattern.compiled = compiled
+	}
+	if config.RedactPromptInput {
+		prompt := config.PromptPattern
+		if prompt == "" {
+			prompt = REDACTION_DEFAULT_PROMPT
+		}
+		compiled, err := regexp.Compile(prompt)
+		if err != nil {
+			return fmt.Errorf("invalid redaction prompt pattern: %w", err)
+		}
+		config.promptCompiled = compiled
+	}
+	return nil
+}
+
+func (config *RedactionConfig) RedactPassword(password string) string {
+	if config == nil || password == "" {
+		return password
+	}
+	switch config.PasswordMode {
+	case REDACTION_PASSWORD_HASH:
+		sum := sha256.Sum256([]byte(config.HashSalt + password))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	case REDACTION_PASSWORD_MASK:
+		return REDACTION_MASK
+	case REDACTION_PASSWORD_DROP:
+		return ""
+	default:
+		return password
+	}
+}
+
+func (config *RedactionConfig) RedactData(data []byte) []byte {
+	if config == nil || len(data) == 0 {
+		return data
+	}
+	for _, pattern := range config.Patterns {
+		if pattern.compiled == nil {
+			continue
+		}
+		replacement := pattern.Replacement
+		if replacement == "" {
+			replacement = REDACTION_MASK
+		}
+		data = pattern.compiled.ReplaceAll(data, []byte(replacement))
+	}
+	return data
+}
+
+func (config *RedactionConfig) isPrompt(data []byte) bool {
+	return config != nil && config.promptCompiled != nil && config.promptCompiled.Match(data)
+}
+
+/*
+ redactEvent scrubs an event in place before
+ it is handed to callbacks, stored or logged.
+*/
+func (config *RedactionConfig) redactEvent(event *SessionEvent) {
+	if config == nil {
+		return
+	}
+	event.Password = config.RedactPassword(event.Password)
+	event.Data = config.RedactData(event.Data)
+	event.RequestPayload = config.RedactData(event.RequestPayload)
+}
+
+/*
+ redactChannelData tracks password prompts on
+ each channel. Output from the server
+ ("incoming") that ends with a prompt marks
+ the channel, and the next client input
+ ("outgoing") is dropped up to and not
+ including the first newline.
+*/
+func (session *SessionContext) redactChannelData(data []byte, direction string, channel_id int) []byte {
+	config := session.proxy.getRedaction()
+	if config == nil || !config.RedactPromptInput {
+		return data
+	}
+	session.prompt_mutex.Lock()
+	defer session.prompt_mutex.Unlock()
+	if session.prompt_channels == nil {
+		session.prompt_channels = make(map[int]bool)
+	}
+	if direction == "incoming" {
+		session.prompt_channels[channel_id] = config.isPrompt(data)
+		return data
+	}
+	if !session.prompt_channels[channel_id] {
+		return data
+	}
+	end := bytes.IndexAny(data, "\r\n")
+	if end == -1 {
+		return []byte{}
+	}
+	session.prompt_channels[channel_id] = false
+	return data[end:]
+}
+
+func (proxy *ProxyContext) redactPassword(password string) string {
+	return proxy.getRedaction().RedactPassword(password)
+}
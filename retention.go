@@ -0,0 +1,396 @@
+package sshproxyplus
+
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RETENTION_DEFAULT_INTERVAL		int64 = 3600
+const RETENTION_SCAN_SUFFIX				string = ".scan"
+
+const RETENTION_REASON_MAX_AGE			string = "max-age"
+const RETENTION_REASON_SCAN_MAX_AGE		string = "scan-max-age"
+const RETENTION_REASON_KEEP_PER_USER	string = "keep-per-user"
+const RETENTION_REASON_MAX_TOTAL_BYTES	string = "max-total-bytes"
+
+/*
+ RetentionPolicy decides which recordings a
+ proxy keeps. A zero value for a rule turns
+ that rule off.
+
+ Rules are applied in order:
+  - ScanMaxAgeSeconds removes short ".scan"
+    recordings; MaxAgeSeconds is used for them
+    when it isn't set
+  - MaxAgeSeconds removes other old recordings
+  - KeepPerUser keeps only the newest N
+    recordings of each user (".scan" recordings
+    don't count)
+  - MaxTotalBytes removes the oldest recordings
+    until the rest fit
+
+ Recordings of live sessions are never removed.
+ Session list entries whose recording is gone
+ are dropped as well.
+
+ Each deletion is written as a JSON line to
+ AuditLogFile when it is set.
+*/
+type RetentionPolicy struct {
+	MaxAgeSeconds		int64	`json:",omitempty"`
+	ScanMaxAgeSeconds	int64	`json:",omitempty"`
+	MaxTotalBytes		int64	`json:",omitempty"`
+	KeepPerUser			int		`json:",omitempty"`
+	IntervalSeconds		int64	`json:",omitempty"`
+	AuditLogFile		string	`json:",omitempty"`
+}
+
+type RetentionDeletion struct {
+	Name		string
+	Username	string	`json:",omitempty"`
+	Size		int64
+	ModTime		time.Time
+	Reason		string
+}
+
+type RetentionReport struct {
+	DryRun				bool
+	Deleted				[]RetentionDeletion
+	DeletedBytes		int64
+	KeptCount			int
+	KeptBytes			int64
+	PrunedSessionList	int
+	Errors				[]string	`json:",omitempty"`
+}
+
+type retentionAuditEntry struct {
+	Time		int64	`json:"time"`
+	Event		string	`json:"event"`
+	Name		string	`json:"name"`
+	Username	string	`json:"username,omitempty"`
+	Size		int64	`json:"size"`
+	Reason		string	`json:"reason"`
+}
+
+type retentionJanitor struct {
+	mutex		sync.Mutex
+	stop		chan bool
+}
+
+func (policy *RetentionPolicy) Validate() error {
+	if policy == nil {
+		return nil
+	}
+	if policy.MaxAgeSeconds < 0 || policy.ScanMaxAgeSeconds < 0 || policy.MaxTotalBytes < 0 ||
+		policy.KeepPerUser < 0 || policy.IntervalSeconds < 0 {
+		return fmt.Errorf("retention rules can't be negative")
+	}
+	return nil
+}
+
+func (policy *RetentionPolicy) interval() time.Duration {
+	if policy == nil || policy.IntervalSeconds == 0 {
+		return time.Duration(RETENTION_DEFAULT_INTERVAL) * time.Second
+	}
+	return time.Duration(policy.IntervalSeconds) * time.Second
+}
+
+/*
+ plan works out which recordings to delete.
+ users maps a recording name to the user
+ that made it, and live holds the names of
+ recordings that are still being written.
+*/
+func (policy *RetentionPolicy) plan(recordings []RecordingInfo, users map[string]string, live map[string]bool, now time.Time) ([]RetentionDeletion, []RecordingInfo) {
+	deleted := make([]RetentionDeletion, 0)
+	kept := make([]RecordingInfo, 0)
+
+	// newest first
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].ModTime.After(recordings[j].ModTime)
+	})
+
+	scanMaxAge := policy.ScanMaxAgeSeconds
+	if scanMaxAge == 0 {
+		scanMaxAge = policy.MaxAgeSeconds
+	}
+	userCounts := make(map[string]int)
+	for _, recording := range recordings {
+		if live[recording.Name] {
+			kept = append(kept, recording)
+			continue
+		}
+		age := int64(now.Sub(recording.ModTime).Seconds())
+		username := users[recording.Name]
+		reason := ""
+		if strings.HasSuffix(recording.Name, RETENTION_SCAN_SUFFIX) {
+			if scanMaxAge > 0 && age > scanMaxAge {
+				reason = RETENTION_REASON_SCAN_MAX_AGE
+			}
+		} else if policy.MaxAgeSeconds > 0 && age > policy.MaxAgeSeconds {
+			reason = RETENTION_REASON_MAX_AGE
+		} else if username != "" {
+			userCounts[username] += 1
+			if policy.KeepPerUser > 0 && userCounts[username] > policy.KeepPerUser {
+				reason = RETENTION_REASON_KEEP_PER_USER
+			}
+		}
+		if reason != "" {
+			deleted = append(deleted, RetentionDeletion{Name: recording.Name, Username: username, Size: recording.Size, ModTime: recording.ModTime, Reason: reason})
+		} else {
+			kept = append(kept, recording)
+		}
+	}
+
+	if policy.MaxTotalBytes > 0 {
+		var total int64
+		for _, recording := range kept {
+			total += recording.Size
+		}
+		remaining := make([]RecordingInfo, 0)
+		// walk oldest first
+		for index := len(kept) - 1; index >= 0; index-- {
+			recording := kept[index]
+			if total > policy.MaxTotalBytes && !live[recording.Name] {
+				total -= recording.Size
+				deleted = append(deleted, RetentionDeletion{Name: recording.Name, Username: users[recording.Name], Size: recording.Size, ModTime: recording.ModTime, Reason: RETENTION_REASON_MAX_TOTAL_BYTES})
+			} else {
+				remaining = append([]RecordingInfo{recording}, remaining...)
+			}
+		}
+		kept = remaining
+	}
+	return deleted, kept
+}
+
+/*
+ SetRetention replaces the retention policy of
+ the proxy. The janitor picks up the new policy
+ on its next run. A nil policy stops cleanup.
+*/
+func (proxy *ProxyContext) SetRetention(policy *RetentionPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	// under both locks, since the proxy is saved
+	// under its mutex
+	proxy.mutex.Lock()
+	proxy.janitor.mutex.Lock()
+	proxy.Retention = policy
+	proxy.janitor.mutex.Unlock()
+	proxy.mutex.Unlock()
+	return nil
+}
+
+func (proxy *ProxyContext) getRetention() *RetentionPolicy {
+	proxy.janitor.mutex.Lock()
+	defer proxy.janitor.mutex.Unlock()
+	return proxy.Retention
+}
+
+func (proxy *ProxyContext) liveRecordings() map[string]bool {
+	live := make(map[string]bool)
+	for _, session := range proxy.sessions.snapshot() {
+		if filename := session.getFilename(); session.isActive() && filename != "" {
+			live[filename] = true
+		}
+	}
+	return live
+}
+
+func (proxy *ProxyContext) sessionListUsers(store RecordingStore) (map[string]string, error) {
+	users := make(map[string]string)
+	reader, err := store.OpenSessionList()
+	if err != nil {
+		return users, err
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	for {
+		var info session_info_extended
+		err := decoder.Decode(&info)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return users, err
+		}
+		users[info.Filename] = info.Username
+	}
+	return users, nil
+}
+
+/*
+ ApplyRetention enforces the retention policy
+ once. With dryRun set nothing is deleted and
+ the report lists what would have been.
+*/
+func (proxy *ProxyContext) ApplyRetention(dryRun bool) (error, *RetentionReport) {
+	policy := proxy.getRetention()
+	if policy == nil {
+		return fmt.Errorf("proxy has no retention policy"), nil
+	}
+	store, err := proxy.GetRecordingStore()
+	if err != nil {
+		return err, nil
+	}
+	// the session list is read first: an entry is
+	// only added once its recording is finalized, so
+	// a listed session whose recording is missing
+	// below lost it before this run
+	users, err := proxy.sessionListUsers(store)
+	if err != nil {
+		return err, nil
+	}
+	recordings, err := store.List()
+	if err != nil {
+		return err, nil
+	}
+
+	report := &RetentionReport{DryRun: dryRun, Deleted: make([]RetentionDeletion, 0)}
+	deleted, kept := policy.plan(recordings, users, proxy.liveRecordings(), time.Now())
+	for _, recording := range kept {
+		report.KeptCount += 1
+		report.KeptBytes += recording.Size
+	}
+
+	// only entries of recordings deleted here, or
+	// already missing, are pruned; sessions that
+	// finish during the run keep their entries
+	prune := make(map[string]bool)
+	listed := make(map[string]bool)
+	for _, recording := range recordings {
+		listed[recording.Name] = true
+	}
+	for filename := range users {
+		if !listed[filename] {
+			prune[filename] = true
+		}
+	}
+	for _, deletion := range deleted {
+		if !dryRun {
+			if err := store.Delete(deletion.Name); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%v: %v", deletion.Name, err))
+				continue
+			}
+			proxy.auditRetentionDeletion(policy, deletion)
+			proxy.forgetArchivedSession(deletion.Name)
+		}
+		prune[deletion.Name] = true
+		report.Deleted = append(report.Deleted, deletion)
+		report.DeletedBytes += deletion.Size
+	}
+
+	keep := func(entry []byte) bool {
+		var info session_info_extended
+		if json.Unmarshal(entry, &info) != nil {
+			return true
+		}
+		return !prune[info.Filename]
+	}
+	if dryRun {
+		for filename := range users {
+			if prune[filename] {
+				report.PrunedSessionList += 1
+			}
+		}
+	} else {
+		report.PrunedSessionList, err = store.PruneSessionList(keep)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%v: %v", SESSION_LIST_FN, err))
+		}
+	}
+	return nil, report
+}
+
+// forgetArchivedSession drops an archived session
+// once its recording is gone
+func (proxy *ProxyContext) forgetArchivedSession(filename string) {
+	for _, session := range proxy.sessions.snapshot() {
+		if !session.archived || session.filename != filename {
+			continue
+		}
+		proxy.sessions.remove(session)
+		proxy.getSearchIndex().removeSession(session)
+	}
+}
+
+func (proxy *ProxyContext) auditRetentionDeletion(policy *RetentionPolicy, deletion RetentionDeletion) {
+	proxy.Log.Printf("retention: deleted recording %v (%v bytes): %v\n", deletion.Name, deletion.Size, deletion.Reason)
+	if policy.AuditLogFile == "" {
+		return
+	}
+	data, err := json.Marshal(retentionAuditEntry{
+		Time: time.Now().Unix(),
+		Event: "recording-deleted",
+		Name: deletion.Name,
+		Username: deletion.Username,
+		Size: deletion.Size,
+		Reason: deletion.Reason,
+	})
+	if err != nil {
+		proxy.Log.Println("Error during marshaling json: ", err)
+		return
+	}
+	fd, err := os.OpenFile(policy.AuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		proxy.Log.Println("error opening retention audit log:", err)
+		return
+	}
+	defer fd.Close()
+	if _, err := fd.Write(append(data, '\n')); err != nil {
+		proxy.Log.Println("error writing retention audit log:", err)
+	}
+}
+
+/*
+ startRetentionJanitor runs ApplyRetention in
+ the background until stopRetentionJanitor is
+ called. It does nothing while the proxy has
+ no retention policy.
+*/
+func (proxy *ProxyContext) startRetentionJanitor() {
+	proxy.janitor.mutex.Lock()
+	if proxy.janitor.stop != nil {
+		proxy.janitor.mutex.Unlock()
+		return
+	}
+	stop := make(chan bool)
+	proxy.janitor.stop = stop
+	proxy.janitor.mutex.Unlock()
+
+	go func() {
+		for {
+			if proxy.getRetention() != nil {
+				err, report := proxy.ApplyRetention(false)
+				if err != nil {
+					proxy.Log.Println("retention: error during cleanup:", err)
+				} else {
+					for _, message := range report.Errors {
+						proxy.Log.Println("retention: error during cleanup:", message)
+					}
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(proxy.getRetention().interval()):
+			}
+		}
+	}()
+}
+
+func (proxy *ProxyContext) stopRetentionJanitor() {
+	proxy.janitor.mutex.Lock()
+	if proxy.janitor.stop != nil {
+		close(proxy.janitor.stop)
+		proxy.janitor.stop = nil
+	}
+	proxy.janitor.mutex.Unlock()
+}
@@ -0,0 +1,247 @@
+package sshproxyplus
+
+import (
+	"testing"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+
+func writeTestRecording(t *testing.T, proxy *ProxyContext, name, username string, size int, age time.Duration) {
+	path := proxy.SessionFolder + "/" + name
+	err := os.WriteFile(path, make([]byte, size), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test recording: %s", err)
+	}
+	modTime := time.Now().Add(-age)
+	os.Chtimes(path, modTime, modTime)
+	if username != "" {
+		entry := fmt.Sprintf("{\"username\":%q,\"filename\":%q}\n", username, name)
+		store, _ := proxy.GetRecordingStore()
+		store.AddToSessionList([]byte(entry))
+	}
+}
+
+func makeRetentionTestProxy(t *testing.T) *ProxyContext {
+	proxy := makeNewTestProxy()
+	proxy.SessionFolder = t.TempDir()
+	writeTestRecording(t, proxy, "old.log.json", "alice", 100, 48*time.Hour)
+	writeTestRecording(t, proxy, "scan.log.json.scan", "bob", 10, 2*time.Hour)
+	writeTestRecording(t, proxy, "alice1.log.json", "alice", 100, 3*time.Hour)
+	writeTestRecording(t, proxy, "alice2.log.json", "alice", 100, 2*time.Hour)
+	writeTestRecording(t, proxy, "alice3.log.json", "alice", 100, 1*time.Hour)
+	writeTestRecording(t, proxy, "live.log.json", "", 500, 72*time.Hour)
+	proxy.sessions.add("live", &SessionContext{proxy: proxy, active: true, filename: "live.log.json"})
+	return proxy
+}
+
+func retentionDeletedNames(report *RetentionReport) map[string]string {
+	names := make(map[string]string)
+	for _, deletion := range report.Deleted {
+		names[deletion.Name] = deletion.Reason
+	}
+	return names
+}
+
+func TestApplyRetentionDryRun(t *testing.T) {
+	proxy := makeRetentionTestProxy(t)
+	proxy.SetRetention(&RetentionPolicy{
+		MaxAgeSeconds: 24*3600,
+		ScanMaxAgeSeconds: 3600,
+		KeepPerUser: 2,
+	})
+
+	err, report := proxy.ApplyRetention(true)
+	if err != nil {
+		t.Fatalf("ApplyRetention() returned an error: %s", err)
+	}
+	expected := map[string]string{
+		"old.log.json": RETENTION_REASON_MAX_AGE,
+		"scan.log.json.scan": RETENTION_REASON_SCAN_MAX_AGE,
+		"alice1.log.json": RETENTION_REASON_KEEP_PER_USER,
+	}
+	deleted := retentionDeletedNames(report)
+	if len(deleted) != len(expected) {
+		t.Fatalf("ApplyRetention() planned to delete %v, expected %v", deleted, expected)
+	}
+	for name, reason := range expected {
+		if deleted[name] != reason {
+			t.Errorf("ApplyRetention() gave %v the reason %q, expected %q", name, deleted[name], reason)
+		}
+	}
+	if report.PrunedSessionList != 3 {
+		t.Errorf("ApplyRetention() reported %v session list entries to prune, expected 3", report.PrunedSessionList)
+	}
+
+	entries, _ := os.ReadDir(proxy.SessionFolder)
+	if len(entries) != 7 {
+		t.Errorf("ApplyRetention() deleted files during a dry run")
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	proxy := makeRetentionTestProxy(t)
+	auditFile := t.TempDir() + "/audit.log"
+	proxy.SetRetention(&RetentionPolicy{
+		MaxTotalBytes: 750,
+		AuditLogFile: auditFile,
+	})
+
+	err, report := proxy.ApplyRetention(false)
+	if err != nil {
+		t.Fatalf("ApplyRetention() returned an error: %s", err)
+	}
+	deleted := retentionDeletedNames(report)
+	// live.log.json is the oldest and biggest, but is still being written
+	if len(deleted) != 2 || deleted["old.log.json"] == "" || deleted["alice1.log.json"] == "" {
+		t.Fatalf("ApplyRetention() deleted %v, expected old.log.json and alice1.log.json", deleted)
+	}
+	if report.KeptBytes > 750 {
+		t.Errorf("ApplyRetention() kept %v bytes, expected at most 750", report.KeptBytes)
+	}
+	for name := range deleted {
+		if _, err := os.Stat(proxy.SessionFolder + "/" + name); err == nil {
+			t.Errorf("ApplyRetention() did not delete %v", name)
+		}
+	}
+	if _, err := os.Stat(proxy.SessionFolder + "/live.log.json"); err != nil {
+		t.Errorf("ApplyRetention() deleted the recording of a live session")
+	}
+
+	store, _ := proxy.GetRecordingStore()
+	reader, _ := store.OpenSessionList()
+	list, _ := io.ReadAll(reader)
+	reader.Close()
+	if strings.Contains(string(list), "old.log.json") || !strings.Contains(string(list), "alice3.log.json") {
+		t.Errorf("ApplyRetention() did not prune the session list: %s", list)
+	}
+
+	audit, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatalf("ApplyRetention() did not write an audit log: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(audit)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("ApplyRetention() wrote %v audit entries, expected 2", len(lines))
+	}
+	var entry retentionAuditEntry
+	json.Unmarshal([]byte(lines[0]), &entry)
+	if entry.Event != "recording-deleted" || entry.Reason != RETENTION_REASON_MAX_TOTAL_BYTES {
+		t.Errorf("ApplyRetention() wrote an unexpected audit entry: %v", lines[0])
+	}
+}
+
+// finishingStore finishes a session while
+// retention deletes recordings
+type finishingStore struct {
+	*FilesystemRecordingStore
+}
+
+func (store finishingStore) Delete(name string) error {
+	os.WriteFile(store.Folder + "/finished.log.json", []byte("[]"), 0644)
+	store.AddToSessionList([]byte("{\"username\":\"carol\",\"filename\":\"finished.log.json\"}\n"))
+	return store.FilesystemRecordingStore.Delete(name)
+}
+
+func TestApplyRetentionKeepsFinishedSessions(t *testing.T) {
+	proxy := makeRetentionTestProxy(t)
+	proxy.recordingStore = finishingStore{NewFilesystemRecordingStore(proxy.SessionFolder)}
+	// a session list entry whose recording is already gone
+	proxy.recordingStore.AddToSessionList([]byte("{\"username\":\"dave\",\"filename\":\"missing.log.json\"}\n"))
+	proxy.SetRetention(&RetentionPolicy{MaxAgeSeconds: 24*3600})
+
+	err, report := proxy.ApplyRetention(false)
+	if err != nil {
+		t.Fatalf("ApplyRetention() returned an error: %s", err)
+	}
+	if report.PrunedSessionList != 2 {
+		t.Errorf("ApplyRetention() pruned %v session list entries, expected 2", report.PrunedSessionList)
+	}
+	reader, _ := proxy.recordingStore.OpenSessionList()
+	list, _ := io.ReadAll(reader)
+	reader.Close()
+	if !strings.Contains(string(list), "finished.log.json") {
+		t.Errorf("ApplyRetention() pruned a session that finished during the run: %s", list)
+	}
+	if strings.Contains(string(list), "old.log.json") || strings.Contains(string(list), "missing.log.json") {
+		t.Errorf("ApplyRetention() did not prune the session list: %s", list)
+	}
+}
+
+func TestRetentionJanitor(t *testing.T) {
+	proxy := makeRetentionTestProxy(t)
+	proxy.SetRetention(&RetentionPolicy{MaxAgeSeconds: 24*3600, IntervalSeconds: 1})
+	proxy.startRetentionJanitor()
+	defer proxy.stopRetentionJanitor()
+
+	for index := 0; index < 20; index++ {
+		if _, err := os.Stat(proxy.SessionFolder + "/old.log.json"); err != nil {
+			return
+		}
+		time.Sleep(50*time.Millisecond)
+	}
+	t.Fatalf("startRetentionJanitor() did not clean up old recordings")
+}
+
+func TestMessageApplyProxyRetention(t *testing.T) {
+	controller := makeNewController()
+	proxy := makeRetentionTestProxy(t)
+	proxyID := controller.AddExistingProxy(proxy)
+
+	message := &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_APPLY_PROXY_RETENTION,
+		ProxyID: proxyID,
+		DryRun: true,
+	}
+	replyObj := simulateMessage(message, controller, t)
+	if _, errorFound := replyObj["Error"]; !errorFound {
+		t.Fatalf("*ControllerMessage handleMessage() did not throw an error for a proxy without a retention policy")
+	}
+
+	replyObj = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_SET_PROXY_RETENTION,
+		ProxyID: proxyID,
+		Retention: &RetentionPolicy{KeepPerUser: -1},
+	}, controller, t)
+	if _, errorFound := replyObj["Error"]; !errorFound {
+		t.Fatalf("*ControllerMessage handleMessage() accepted an invalid retention policy")
+	}
+
+	replyObj = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_SET_PROXY_RETENTION,
+		ProxyID: proxyID,
+		Retention: &RetentionPolicy{MaxAgeSeconds: 24*3600},
+	}, controller, t)
+	if errorString, errorFound := replyObj["Error"]; errorFound {
+		t.Fatalf("*ControllerMessage handleMessage() threw an unexpected error: %v", errorString)
+	}
+
+	replyObj = simulateMessage(message, controller, t)
+	if errorString, errorFound := replyObj["Error"]; errorFound {
+		t.Fatalf("*ControllerMessage handleMessage() threw an unexpected error: %v", errorString)
+	}
+	reportString, reportFound := replyObj["Report"]
+	if !reportFound {
+		t.Fatalf("*ControllerMessage handleMessage() did not return a Report")
+	}
+	reportObj, err := base64.StdEncoding.DecodeString(reportString.(string))
+	if err != nil {
+		t.Fatalf("*ControllerMessage handleMessage() returned a Report that could not be decoded: %s", err)
+	}
+	report := &RetentionReport{}
+	err = json.Unmarshal(reportObj, report)
+	if err != nil {
+		t.Fatalf("*ControllerMessage handleMessage() returned an invalid report: %s", err)
+	}
+	if !report.DryRun || len(report.Deleted) != 1 || report.Deleted[0].Name != "old.log.json" {
+		t.Fatalf("*ControllerMessage handleMessage() returned an unexpected report: %v", report)
+	}
+	if _, err := os.Stat(proxy.SessionFolder + "/old.log.json"); err != nil {
+		t.Fatalf("*ControllerMessage handleMessage() deleted a recording during a dry run")
+	}
+}
@@ -0,0 +1,565 @@
+package sshproxyplus
+
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SEARCH_SOURCE_OUTPUT	string = "output"
+const SEARCH_SOURCE_INPUT	string = "input"
+const SEARCH_SOURCE_EXEC	string = "exec"
+
+const SEARCH_DEFAULT_LIMIT			int = 100
+const SEARCH_MAX_HITS_PER_SESSION	int = 100
+const SEARCH_MAX_LINE_LENGTH		int = 4096
+const SEARCH_MAX_LINES_PER_SESSION	int = 100000
+const SEARCH_ARCHIVE_CACHE_SIZE		int = 64
+
+/*
+ A SessionSearchQuery selects sessions. Every
+ field that is set must match:
+  - Text is matched, case-insensitively, against
+    each line of decoded terminal output, each
+    line of reconstructed input, and each exec
+    command
+  - Username and Host match part of the username
+    or of the client or server host
+  - Since and Until (unix seconds) keep the
+    sessions that overlap that time range
+ At most Limit sessions are returned, newest
+ first.
+*/
+type SessionSearchQuery struct {
+	Text		string	`json:",omitempty"`
+	Username	string	`json:",omitempty"`
+	Host		string	`json:",omitempty"`
+	Since		int64	`json:",omitempty"`
+	Until		int64	`json:",omitempty"`
+	Limit		int		`json:",omitempty"`
+}
+
+/*
+ A SessionSearchHit points at the event a
+ matching line came from. EventIndex is the
+ position of the event in the session and
+ Offset is its time offset in milliseconds,
+ so a viewer can jump straight to it.
+*/
+type SessionSearchHit struct {
+	EventIndex	int
+	Offset		int64
+	Source		string
+	ChannelID	int		`json:",omitempty"`
+	Text		string
+}
+
+type SessionSearchResult struct {
+	SessionKey	string
+	Username	string
+	ClientHost	string
+	ServerHost	string
+	Start		int64
+	Stop		int64
+	Active		bool
+	Hits		[]SessionSearchHit	`json:",omitempty"`
+}
+
+/*
+ SessionSearchIndex keeps the searchable lines
+ of the sessions of a proxy. Each document has
+ the trigrams of its lines, used to skip the
+ documents that can't contain a piece of text
+ without scanning them.
+
+ Live sessions are indexed as their events come
+ in and dropped when they are evicted. Archived
+ sessions are indexed from their recordings when
+ searched, and only the SEARCH_ARCHIVE_CACHE_SIZE
+ most recently searched are kept.
+*/
+type SessionSearchIndex struct {
+	mutex		sync.Mutex
+	documents	map[*SessionContext]*searchDocument
+	// archived documents, most recently
+	// searched first
+	archived	*list.List
+}
+
+type searchDocument struct {
+	session		*SessionContext
+	lines		[]SessionSearchHit
+	trigrams	map[string]bool
+	partial		map[searchPartialKey]*searchPartialLine
+	// its place in archived, for documents
+	// built from a recording
+	element		*list.Element
+}
+
+// lines are built separately for each
+// direction of each channel
+type searchPartialKey struct {
+	source		string
+	channelID	int
+}
+
+type searchPartialLine struct {
+	text		[]byte
+	eventIndex	int
+	offset		int64
+}
+
+func NewSessionSearchIndex() *SessionSearchIndex {
+	return &SessionSearchIndex{
+		documents: make(map[*SessionContext]*searchDocument),
+		archived: list.New(),
+	}
+}
+
+func newSearchDocument(session *SessionContext) *searchDocument {
+	return &searchDocument{
+		session: session,
+		trigrams: make(map[string]bool),
+		partial: make(map[searchPartialKey]*searchPartialLine),
+	}
+}
+
+func (index *SessionSearchIndex) hasSession(session *SessionContext) bool {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	_, ok := index.documents[session]
+	return ok
+}
+
+func (index *SessionSearchIndex) removeSession(session *SessionContext) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.removeSessionLocked(session)
+}
+
+func (index *SessionSearchIndex) removeSessionLocked(session *SessionContext) {
+	document, ok := index.documents[session]
+	if !ok {
+		return
+	}
+	delete(index.documents, session)
+	if document.element != nil {
+		index.archived.Remove(document.element)
+		document.element = nil
+	}
+}
+
+/*
+ addArchived keeps the document of an archived
+ session, dropping the least recently searched
+ ones past SEARCH_ARCHIVE_CACHE_SIZE.
+*/
+func (index *SessionSearchIndex) addArchived(document *searchDocument) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if _, ok := index.documents[document.session]; ok {
+		return
+	}
+	index.documents[document.session] = document
+	document.element = index.archived.PushFront(document)
+	for index.archived.Len() > SEARCH_ARCHIVE_CACHE_SIZE {
+		oldest := index.archived.Back().Value.(*searchDocument)
+		index.removeSessionLocked(oldest.session)
+	}
+}
+
+/*
+ AddEvent indexes one event of a session.
+ eventIndex is the position of the event in
+ the session.
+*/
+func (index *SessionSearchIndex) AddEvent(session *SessionContext, event *SessionEvent, eventIndex int) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	document, ok := index.documents[session]
+	if !ok {
+		document = newSearchDocument(session)
+		index.documents[session] = document
+	}
+	document.addEvent(event, eventIndex)
+}
+
+func (document *searchDocument) addEvent(event *SessionEvent, eventIndex int) {
+	switch event.Type {
+	case EVENT_MESSAGE, EVENT_OPERATOR_INPUT:
+		source := SEARCH_SOURCE_OUTPUT
+		if event.Direction == "outgoing" {
+			source = SEARCH_SOURCE_INPUT
+		}
+		document.addData(source, event, eventIndex)
+	case EVENT_NEW_REQUEST:
+		if event.RequestType == "exec" {
+			document.addLine(SessionSearchHit{
+				EventIndex: eventIndex,
+				Offset: event.TimeOffset,
+				Source: SEARCH_SOURCE_EXEC,
+				ChannelID: event.ChannelID,
+				Text: parseExecCommand(event.RequestPayload),
+			})
+		}
+	case EVENT_SESSION_STOP:
+		for key := range document.partial {
+			document.flushPartial(key)
+		}
+	}
+}
+
+func (document *searchDocument) addData(source string, event *SessionEvent, eventIndex int) {
+	key := searchPartialKey{source: source, channelID: event.ChannelID}
+	data := stripTerminalEscapes(event.Data)
+	for _, char := range data {
+		partial, ok := document.partial[key]
+		if !ok {
+			partial = &searchPartialLine{eventIndex: eventIndex, offset: event.TimeOffset}
+			document.partial[key] = partial
+		}
+		switch {
+		case char == '\r' || char == '\n':
+			document.flushPartial(key)
+		case source == SEARCH_SOURCE_INPUT && (char == 0x7f || char == 0x08):
+			// reconstruct what was typed after backspaces
+			if len(partial.text) > 0 {
+				partial.text = partial.text[:len(partial.text)-1]
+			}
+		case source == SEARCH_SOURCE_INPUT && char == 0x15:
+			partial.text = partial.text[:0]
+		case char == '\t' || char >= 0x20:
+			if len(partial.text) < SEARCH_MAX_LINE_LENGTH {
+				partial.text = append(partial.text, char)
+			}
+		}
+	}
+}
+
+func (document *searchDocument) flushPartial(key searchPartialKey) {
+	partial, ok := document.partial[key]
+	if !ok {
+		return
+	}
+	delete(document.partial, key)
+	text := strings.TrimSpace(string(partial.text))
+	if text == "" {
+		return
+	}
+	document.addLine(SessionSearchHit{
+		EventIndex: partial.eventIndex,
+		Offset: partial.offset,
+		Source: key.source,
+		ChannelID: key.channelID,
+		Text: text,
+	})
+}
+
+/*
+ addLine keeps a line, dropping the oldest once
+ a session has SEARCH_MAX_LINES_PER_SESSION. The
+ trigrams of dropped lines stay; they only cost
+ a scan of the document.
+*/
+func (document *searchDocument) addLine(line SessionSearchHit) {
+	if line.Text == "" {
+		return
+	}
+	if len(document.lines) >= SEARCH_MAX_LINES_PER_SESSION {
+		document.lines = append(document.lines[:0], document.lines[len(document.lines)-SEARCH_MAX_LINES_PER_SESSION+1:]...)
+	}
+	document.lines = append(document.lines, line)
+	for _, trigram := range searchTrigrams(line.Text) {
+		document.trigrams[trigram] = true
+	}
+}
+
+// mayContain reports whether the document has
+// every trigram of the searched text
+func (document *searchDocument) mayContain(trigrams []string) bool {
+	for _, trigram := range trigrams {
+		if !document.trigrams[trigram] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ Search returns the sessions in sessions that
+ match the query. loaded has the documents of
+ archived sessions read for this search, which
+ may already have left the cache. Other sessions
+ that aren't indexed only match queries without
+ Text.
+*/
+func (index *SessionSearchIndex) Search(query *SessionSearchQuery, sessions map[string]*SessionContext, loaded map[*SessionContext]*searchDocument) []SessionSearchResult {
+	if query == nil {
+		query = &SessionSearchQuery{}
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	text := strings.ToLower(query.Text)
+	trigrams := searchTrigrams(text)
+	now := time.Now().Unix()
+	results := make([]SessionSearchResult, 0)
+	for key, session := range sessions {
+		result := session.searchResult(key, now)
+		if !query.matchesSession(&result) {
+			continue
+		}
+		if text != "" {
+			document, ok := index.documents[session]
+			if ok && document.element != nil {
+				index.archived.MoveToFront(document.element)
+			} else if !ok {
+				document, ok = loaded[session]
+			}
+			if !ok || !document.mayContain(trigrams) {
+				continue
+			}
+			for _, line := range document.lines {
+				if strings.Contains(strings.ToLower(line.Text), text) {
+					result.Hits = append(result.Hits, line)
+					if len(result.Hits) >= SEARCH_MAX_HITS_PER_SESSION {
+						break
+					}
+				}
+			}
+			if len(result.Hits) == 0 {
+				continue
+			}
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Start == results[j].Start {
+			return results[i].SessionKey < results[j].SessionKey
+		}
+		return results[i].Start > results[j].Start
+	})
+	limit := query.Limit
+	if limit <= 0 {
+		limit = SEARCH_DEFAULT_LIMIT
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// searchResult describes a session, without hits
+func (session *SessionContext) searchResult(key string, now int64) SessionSearchResult {
+	result := SessionSearchResult{
+		SessionKey: key,
+		Username: session.client_username,
+		ClientHost: session.client_host,
+		ServerHost: session.serverHost(),
+		Start: session.start_time.Unix(),
+		Stop: session.getStopTime().Unix(),
+		Active: session.isActive(),
+	}
+	if result.Active {
+		result.Stop = now
+	}
+	return result
+}
+
+func (query *SessionSearchQuery) matchesSession(result *SessionSearchResult) bool {
+	if query.Username != "" && !strings.Contains(strings.ToLower(result.Username), strings.ToLower(query.Username)) {
+		return false
+	}
+	if query.Host != "" && !strings.Contains(result.ClientHost, query.Host) && !strings.Contains(result.ServerHost, query.Host) {
+		return false
+	}
+	if query.Since != 0 && result.Stop < query.Since {
+		return false
+	}
+	if query.Until != 0 && result.Start > query.Until {
+		return false
+	}
+	return true
+}
+
+func searchTrigrams(text string) []string {
+	lower := strings.ToLower(text)
+	seen := make(map[string]bool)
+	trigrams := make([]string, 0)
+	for start := 0; start + 3 <= len(lower); start++ {
+		trigram := lower[start:start+3]
+		if !seen[trigram] {
+			seen[trigram] = true
+			trigrams = append(trigrams, trigram)
+		}
+	}
+	return trigrams
+}
+
+// stripTerminalEscapes removes ANSI escape sequences
+// (CSI, OSC and two byte escapes) from terminal data
+func stripTerminalEscapes(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for index := 0; index < len(data); index++ {
+		if data[index] != 0x1b {
+			out = append(out, data[index])
+			continue
+		}
+		index++
+		if index >= len(data) {
+			break
+		}
+		switch data[index] {
+		case '[':
+			for index+1 < len(data) && (data[index+1] < 0x40 || data[index+1] > 0x7e) {
+				index++
+			}
+			index++
+		case ']':
+			for index+1 < len(data) && data[index+1] != 0x07 && data[index+1] != 0x1b {
+				index++
+			}
+			index++
+			if index < len(data) && data[index] == 0x1b {
+				index++
+			}
+		}
+	}
+	return out
+}
+
+// parseExecCommand reads the command out of the
+// ssh string in an exec request payload
+func parseExecCommand(payload []byte) string {
+	if len(payload) < 4 {
+		return string(payload)
+	}
+	length := binary.BigEndian.Uint32(payload[:4])
+	if int(length) > len(payload) - 4 {
+		return string(payload[4:])
+	}
+	return string(payload[4:4+length])
+}
+
+func (session *SessionContext) serverHost() string {
+	if session.user != nil && session.user.RemoteHost != "" {
+		return session.user.RemoteHost
+	}
+	return session.proxy.GetDefaultRemoteHost()
+}
+
+/*
+ indexRecording builds the document of a
+ recorded session.
+*/
+func indexRecording(session *SessionContext, reader io.Reader) (error, *searchDocument) {
+	decoder := json.NewDecoder(reader)
+	token, err := decoder.Token()
+	if err != nil {
+		return err, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return errors.New("session recording is not a list of events"), nil
+	}
+	document := newSearchDocument(session)
+	for eventIndex := 0; decoder.More(); eventIndex++ {
+		event := &SessionEvent{}
+		if err := decoder.Decode(event); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err, nil
+		}
+		document.addEvent(event, eventIndex)
+	}
+	if err := checkRecordingEnd(decoder); err != nil {
+		return err, nil
+	}
+	document.addEvent(&SessionEvent{Type: EVENT_SESSION_STOP}, -1)
+	return nil, document
+}
+
+func (proxy *ProxyContext) getSearchIndex() *SessionSearchIndex {
+	proxy.searchOnce.Do(func() {
+		proxy.searchIndex = NewSessionSearchIndex()
+	})
+	return proxy.searchIndex
+}
+
+/*
+ indexArchivedSessions reads the recordings of
+ the archived sessions the query could match
+ that aren't indexed yet, so recordings are
+ only read when someone searches their text.
+*/
+func (proxy *ProxyContext) indexArchivedSessions(query *SessionSearchQuery, sessions map[string]*SessionContext, identity *RecordingIdentity) map[*SessionContext]*searchDocument {
+	loaded := make(map[*SessionContext]*searchDocument)
+	if query == nil || query.Text == "" {
+		return loaded
+	}
+	index := proxy.getSearchIndex()
+	now := time.Now().Unix()
+	for key, session := range sessions {
+		if !session.archived || index.hasSession(session) {
+			continue
+		}
+		result := session.searchResult(key, now)
+		if !query.matchesSession(&result) {
+			continue
+		}
+		reader, err := session.openRecording(identity)
+		var document *searchDocument
+		if err == nil {
+			err, document = indexRecording(session, reader)
+			reader.Close()
+		}
+		if err != nil {
+			proxy.Log.Printf("error indexing session %v: %v\n", session.sessionID, err)
+			continue
+		}
+		loaded[session] = document
+		index.addArchived(document)
+	}
+	return loaded
+}
+
+/*
+ SearchSessions searches the live and archived
+ sessions of the proxy. identity decrypts
+ archived recordings and may be nil when they
+ aren't encrypted.
+*/
+func (proxy *ProxyContext) SearchSessions(query *SessionSearchQuery, identity *RecordingIdentity) []SessionSearchResult {
+	return proxy.searchSessions(query, identity, nil)
+}
+
+/*
+ searchSessions only searches the sessions in
+ allowed when it isn't nil. They are matched by
+ session rather than by key, and before the
+ limit is applied.
+*/
+func (proxy *ProxyContext) searchSessions(query *SessionSearchQuery, identity *RecordingIdentity, allowed map[string]*SessionContext) []SessionSearchResult {
+	sessions := proxy.sessions.snapshot()
+	if allowed != nil {
+		permitted := make(map[*SessionContext]bool)
+		for _, session := range allowed {
+			permitted[session] = true
+		}
+		for key, session := range sessions {
+			if !permitted[session] {
+				delete(sessions, key)
+			}
+		}
+	}
+	loaded := proxy.indexArchivedSessions(query, sessions, identity)
+	return proxy.getSearchIndex().Search(query, sessions, loaded)
+}
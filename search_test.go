@@ -0,0 +1,268 @@
+package sshproxyplus
+
+import (
+	"testing"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+
+func makeSearchTestSession(proxy *ProxyContext, key, username string) *SessionContext {
+	user := &ProxyUser{Username: username, Password: "pass"}
+	proxy.AddProxyUser(user)
+	session := &SessionContext{
+		proxy: proxy,
+		active: true,
+		start_time: time.Now(),
+		client_host: "10.0.0.1:5555",
+		client_username: username,
+		sessionID: key,
+		user: user,
+	}
+	proxy.sessions.add(key, session)
+	proxy.AddSessionToUserList(session)
+	return session
+}
+
+func TestSearchSessionsInput(t *testing.T) {
+	proxy := makeNewTestProxy()
+	session := makeSearchTestSession(proxy, "prod-session", "alice")
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START})
+	session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Direction: "outgoing", ChannelID: 1, Data: []byte("rm -rx")})
+	session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Direction: "outgoing", ChannelID: 1, Data: []byte("\x7ff /var\r")})
+	session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Direction: "incoming", ChannelID: 1, Data: []byte("\x1b[01;32mdone\x1b[0m\r\n")})
+
+	results := proxy.SearchSessions(&SessionSearchQuery{Text: "RM -RF /var"}, nil)
+	if len(results) != 1 || results[0].SessionKey != "prod-session" {
+		t.Fatalf("SearchSessions() = %v, expected prod-session", results)
+	}
+	hits := results[0].Hits
+	if len(hits) != 1 || hits[0].Source != SEARCH_SOURCE_INPUT || hits[0].Text != "rm -rf /var" || hits[0].EventIndex != 1 {
+		t.Fatalf("SearchSessions() returned unexpected hits: %v", hits)
+	}
+	if hits[0].Offset != session.events[1].TimeOffset {
+		t.Errorf("SearchSessions() gave offset %v, expected %v", hits[0].Offset, session.events[1].TimeOffset)
+	}
+
+	results = proxy.SearchSessions(&SessionSearchQuery{Text: "done"}, nil)
+	if len(results) != 1 || results[0].Hits[0].Source != SEARCH_SOURCE_OUTPUT || results[0].Hits[0].Text != "done" {
+		t.Errorf("SearchSessions() did not find decoded output: %v", results)
+	}
+
+	results = proxy.SearchSessions(&SessionSearchQuery{Text: "rm -rx"}, nil)
+	if len(results) != 0 {
+		t.Errorf("SearchSessions() matched input that was erased: %v", results)
+	}
+}
+
+func TestSearchSessionsExecAndFilters(t *testing.T) {
+	proxy := makeNewTestProxy()
+	alice := makeSearchTestSession(proxy, "alice-session", "alice")
+	bob := makeSearchTestSession(proxy, "bob-session", "bob")
+	bob.client_host = "192.168.1.7:4444"
+	bob.start_time = time.Now().Add(-48*time.Hour)
+	bob.stop_time = time.Now().Add(-47*time.Hour)
+	bob.active = false
+
+	payload := []byte{0, 0, 0, 14}
+	payload = append(payload, []byte("rm -rf /backup")...)
+	alice.HandleEvent(&SessionEvent{Type: EVENT_NEW_REQUEST, RequestType: "exec", RequestPayload: payload, ChannelID: 1})
+	bob.HandleEvent(&SessionEvent{Type: EVENT_NEW_REQUEST, RequestType: "exec", RequestPayload: payload, ChannelID: 1})
+
+	results := proxy.SearchSessions(&SessionSearchQuery{Text: "rm -rf"}, nil)
+	if len(results) != 2 || results[0].SessionKey != "alice-session" {
+		t.Fatalf("SearchSessions() = %v, expected both sessions, newest first", results)
+	}
+	if results[0].Hits[0].Source != SEARCH_SOURCE_EXEC || results[0].Hits[0].Text != "rm -rf /backup" {
+		t.Errorf("SearchSessions() did not index the exec command: %v", results[0].Hits)
+	}
+
+	queries := map[string]*SessionSearchQuery{
+		"alice-session": &SessionSearchQuery{Text: "rm -rf", Username: "ALI"},
+		"bob-session": &SessionSearchQuery{Host: "192.168.1."},
+	}
+	for expected, query := range queries {
+		results = proxy.SearchSessions(query, nil)
+		if len(results) != 1 || results[0].SessionKey != expected {
+			t.Errorf("SearchSessions(%+v) = %v, expected %v", query, results, expected)
+		}
+	}
+
+	results = proxy.SearchSessions(&SessionSearchQuery{Since: time.Now().Add(-24*time.Hour).Unix()}, nil)
+	if len(results) != 1 || results[0].SessionKey != "alice-session" {
+		t.Errorf("SearchSessions() did not filter by time: %v", results)
+	}
+	results = proxy.SearchSessions(&SessionSearchQuery{Until: time.Now().Add(-24*time.Hour).Unix()}, nil)
+	if len(results) != 1 || results[0].SessionKey != "bob-session" {
+		t.Errorf("SearchSessions() did not filter by time: %v", results)
+	}
+	results = proxy.SearchSessions(&SessionSearchQuery{Limit: 1}, nil)
+	if len(results) != 1 {
+		t.Errorf("SearchSessions() did not apply the limit: %v", results)
+	}
+}
+
+func TestStripTerminalEscapes(t *testing.T) {
+	data := []byte("\x1b]0;user@host: ~\x07\x1b[?2004huser@host:~$ \x1b[1mls\x1b[0m")
+	if out := string(stripTerminalEscapes(data)); out != "user@host:~$ ls" {
+		t.Errorf("stripTerminalEscapes() = %q, expected %q", out, "user@host:~$ ls")
+	}
+}
+
+func TestMessageSearchSessionsArchived(t *testing.T) {
+	privateFile, publicFile := writeTestRecordingKeys(t)
+	folder := t.TempDir()
+	user := makeNewTestProxyUser()
+
+	before := makeNewTestProxy()
+	before.SessionFolder = folder
+	before.RecordingRecipientFile = publicFile
+	session := &SessionContext{
+		proxy: before,
+		active: true,
+		start_time: time.Now(),
+		filename: "archived" + SESSION_LOG_SUFFIX,
+		sessionID: "archived",
+		client_username: user.Username,
+		user: user,
+	}
+	session.initializeLog()
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START})
+	session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Direction: "outgoing", ChannelID: 1, Data: []byte("shutdown -h now\r")})
+	session.End()
+
+	controller := makeNewController()
+	controller.RecordingIdentityFile = privateFile
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.SessionFolder = folder
+	proxyID := controller.AddExistingProxy(proxy)
+	proxy.LoadArchivedSessions()
+
+	replyObj := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_SEARCH_SESSIONS,
+		ProxyID: proxyID,
+		Search: &SessionSearchQuery{Text: "shutdown"},
+	}, controller, t)
+	if errorString, errorFound := replyObj["Error"]; errorFound {
+		t.Fatalf("*ControllerMessage handleMessage() threw an unexpected error: %v", errorString)
+	}
+	resultsString, resultsFound := replyObj["Results"]
+	if !resultsFound {
+		t.Fatalf("*ControllerMessage handleMessage() did not return Results")
+	}
+	resultsObj, err := base64.StdEncoding.DecodeString(resultsString.(string))
+	if err != nil {
+		t.Fatalf("*ControllerMessage handleMessage() returned Results that could not be decoded: %s", err)
+	}
+	results := make([]SessionSearchResult, 0)
+	json.Unmarshal(resultsObj, &results)
+	if len(results) != 1 || results[0].SessionKey != "archived" || len(results[0].Hits) != 1 {
+		t.Fatalf("*ControllerMessage handleMessage() returned unexpected results: %s", resultsObj)
+	}
+	if results[0].Hits[0].EventIndex != 1 || results[0].Hits[0].Text != "shutdown -h now" {
+		t.Errorf("*ControllerMessage handleMessage() returned an unexpected hit: %v", results[0].Hits[0])
+	}
+}
+
+func TestWebServerSearch(t *testing.T) {
+	controller := makeNewController()
+	controller.InitializeSocket()
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.PublicAccess = false
+	controller.AddExistingProxy(proxy)
+
+	alice := makeSearchTestSession(proxy, "alice-session", "alice")
+	bob := makeSearchTestSession(proxy, "bob-session", "bob")
+	for _, session := range []*SessionContext{alice, bob} {
+		session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Direction: "outgoing", ChannelID: 1, Data: []byte("cat /etc/shadow\r")})
+	}
+	err, viewer := controller.CreateUserSessionViewer(0, "alice", "pass")
+	if err != nil {
+		t.Fatalf("Failed to create session viewer during setup: %s", err)
+	}
+
+	go controller.StartWebServer()
+	defer controller.StopWebServer()
+	time.Sleep(100* time.Millisecond)
+
+	baseURL := "http://" + controller.WebHost + "/search/?id=0&q=shadow"
+	resp, err := http.Get(baseURL)
+	if err != nil {
+		t.Fatalf("Failed to query search endpoint: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("handleSearchRequest() gave status %v without a viewer, expected %v", resp.StatusCode, http.StatusForbidden)
+	}
+
+	resp, err = http.Get(baseURL + "&viewer=" + viewer.Secret)
+	if err != nil {
+		t.Fatalf("Failed to query search endpoint: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	results := make([]SessionSearchResult, 0)
+	if err = json.Unmarshal(body, &results); err != nil {
+		t.Fatalf("handleSearchRequest() did not return json: %s: %s", err, body)
+	}
+	if len(results) != 1 || results[0].SessionKey != "alice-session" {
+		t.Fatalf("handleSearchRequest() returned sessions outside of the viewer: %s", body)
+	}
+
+	// bob's newer session must not use up the limit
+	bob.start_time = time.Now().Add(time.Hour)
+	resp, err = http.Get(baseURL + "&limit=1&viewer=" + viewer.Secret)
+	if err != nil {
+		t.Fatalf("Failed to query search endpoint: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ = io.ReadAll(resp.Body)
+	results = make([]SessionSearchResult, 0)
+	if err = json.Unmarshal(body, &results); err != nil || len(results) != 1 || results[0].SessionKey != "alice-session" {
+		t.Errorf("handleSearchRequest() applied the limit before the viewer: %s", body)
+	}
+}
+
+func TestSearchSessionsAllowedByAlias(t *testing.T) {
+	proxy := makeNewTestProxy()
+	alice := makeSearchTestSession(proxy, "alice-session", "alice")
+	makeSearchTestSession(proxy, "bob-session", "bob")
+
+	allowed := map[string]*SessionContext{"127.0.0.1:2222:127.0.0.1:40000": alice}
+	results := proxy.searchSessions(&SessionSearchQuery{}, nil, allowed)
+	if len(results) != 1 || results[0].SessionKey != "alice-session" {
+		t.Errorf("searchSessions() = %v, expected the session allowed by its alias", results)
+	}
+}
+
+func TestSearchIndexArchiveCache(t *testing.T) {
+	proxy := makeNewTestProxy()
+	index := NewSessionSearchIndex()
+	sessions := make([]*SessionContext, 0)
+	for count := 0; count <= SEARCH_ARCHIVE_CACHE_SIZE; count++ {
+		session := &SessionContext{proxy: proxy, archived: true}
+		document := newSearchDocument(session)
+		document.addLine(SessionSearchHit{Text: "archived line"})
+		sessions = append(sessions, session)
+		index.addArchived(document)
+		if count == 0 {
+			continue
+		}
+		// keep the first session in use
+		index.Search(&SessionSearchQuery{Text: "archived"}, map[string]*SessionContext{"first": sessions[0]}, nil)
+	}
+	if index.archived.Len() != SEARCH_ARCHIVE_CACHE_SIZE || len(index.documents) != SEARCH_ARCHIVE_CACHE_SIZE {
+		t.Fatalf("index kept %v archived documents, expected %v", len(index.documents), SEARCH_ARCHIVE_CACHE_SIZE)
+	}
+	if !index.hasSession(sessions[0]) || index.hasSession(sessions[1]) {
+		t.Errorf("index did not evict the least recently searched document")
+	}
+
+	index.removeSession(sessions[0])
+	if index.hasSession(sessions[0]) || index.archived.Len() != SEARCH_ARCHIVE_CACHE_SIZE-1 {
+		t.Errorf("removeSession() did not drop the archived document")
+	}
+}
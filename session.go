@@ -3,13 +3,12 @@ package sshproxyplus
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 	"golang.org/x/crypto/ssh"
 	"io"
-	"os"
 	"errors"
 	"fmt"
-	"strconv"
 	"encoding/binary"
 	"encoding/json"
 )
@@ -55,26 +54,62 @@ type SessionContext struct {
 	mutex				sync.Mutex
 	log_mutex			sync.Mutex
 	event_mutex			sync.Mutex
-	log_fd				*os.File
+	prompt_mutex		sync.Mutex
+	log_store			RecordingStore
+	log_writer			io.Writer
+	log_encrypted		bool
 	client_host			string
 	client_username		string
 	client_password		string	
 	remote_conn			*ssh.Conn
+	client_conn			ssh.Conn
+	// the session channels opened by the client,
+	// by channel ID
+	client_channels		map[int]*clientChannel
 	channels			[]*channel_data
-	channel_count		int
+	channel_count		atomic.Int64
 	requests			[]*request_data
-	request_count		int
+	request_count		atomic.Int64
+	// mutex guards active, stop_time, the terminal
+	// size, the connections and the channel and
+	// request lists
 	active				bool
 	thread_count		int
 	start_time   		time.Time
 	stop_time 	 		time.Time
 	msg_signal			[]chan int
+	signal_mutex		sync.Mutex
 	term_rows			uint32
 	term_cols			uint32
 	filename			string
+	// set while the recording is still being written
+	log_open			bool
+	// the most recent events; older ones are
+	// only in the recording
 	events				[]*SessionEvent
+	events_dropped		int
+	// keeps events in the same order in memory
+	// and in the recording
+	record_mutex		sync.Mutex
 	user				*ProxyUser
 	sessionID			string
+	// LocalAddr:RemoteAddr, which used to be
+	// the session key
+	address				string
+	// channels waiting on echo-less input after a password prompt
+	prompt_channels		map[int]bool
+	// set while a session of a user with
+	// RequireApproval waits for an operator
+	approval			*sessionApproval
+	// unix nanoseconds of the last client or
+	// operator input, for the idle timeout
+	last_activity		atomic.Int64
+	// counts towards the session limits; guarded
+	// by the registry lock
+	admitted			bool
+	// loaded from the store after a restart; the
+	// events are read from the recording on demand
+	archived			bool
 
 }
 // TODO: create a routine to remove a signal
@@ -112,9 +147,7 @@ func getNextSessionIdCounter() uint64 {
 func (session * SessionContext) forwardChannel(dest_conn ssh.Conn, cur_channel ssh.NewChannel) {
 	session.markThreadStarted()
 	defer session.markThreadStopped()
-	channel_id := session.channel_count
-
-	session.channel_count += 1
+	channel_id := int(session.channel_count.Add(1) - 1)
 	session.HandleEvent(
 		&SessionEvent{
 			Type: EVENT_NEW_CHANNEL,
@@ -147,6 +180,8 @@ func (session * SessionContext) forwardChannel(dest_conn ssh.Conn, cur_channel s
 		return
 	}
 	defer incoming_channel.Close()
+	session.trackClientChannel(dest_conn, cur_channel.ChannelType(), channel_id, incoming_channel, outgoing_channel)
+	defer session.untrackClientChannel(channel_id)
 
 	dest_requests_completed := make(chan struct{})
 	// https://github.com/cmoog/sshproxy/blob/47ea68e82eaa4d43250d2a93c18fb26806cd67eb/reverseproxy.go#L127
@@ -215,8 +250,7 @@ func (session * SessionContext) forwardRequest(outgoing_channel requestDest, req
 	session.markThreadStarted()
 	defer session.markThreadStopped()
 	
-	request_id := session.request_count
-	session.request_count += 1
+	request_id := int(session.request_count.Add(1) - 1)
 	
 	request_entry := &request_data{Req_type: request.Type, Req_payload: request.Payload, Msg_type: "request-data", Offset: session.GetTimeOffset() }
 	session.HandleEvent(
@@ -228,26 +262,28 @@ func (session * SessionContext) forwardRequest(outgoing_channel requestDest, req
 			ChannelID: channel_id,
 		})
 	
+	session.mutex.Lock()
 	session.requests = append(session.requests, request_entry)
+	session.mutex.Unlock()
 	if request.Type == "env" || request.Type == "shell" || request.Type == "exec" {
-		session.proxy.Log.Printf("req.Type:%v, req.Payload:%v\n",request.Type,string(request.Payload))
+		session.proxy.Log.Printf("req.Type:%v, req.Payload:%v\n",request.Type,string(session.proxy.getRedaction().RedactData(request.Payload)))
 	} else {
 		session.proxy.Log.Printf("req.Type:%v, req.Payload:%v\n",request.Type,request.Payload)
 	}
 	
 	if request.Type == "pty-req" {
+		session.markClientChannelTTY(channel_id)
 		//https://github.com/Scalingo/go-ssh-examples/blob/ae24797273aa9fcd3a8fa6c624af1b068a81d58b/server_complex.go#L206
 		if(len(request.Payload)>4) {
 			termLen := uint(request.Payload[3])
 			if len(request.Payload) >= (4 + int(termLen)+ 8) {
 				width, height := parseDims(request.Payload[termLen+4:])
-				session.term_rows = height
-				session.term_cols = width
+				session.setTermSize(height, width)
 				go session.HandleEvent(
 					&SessionEvent{
 						Type: EVENT_WINDOW_RESIZE,
-						TermRows: session.term_rows,
-						TermCols: session.term_cols,
+						TermRows: height,
+						TermCols: width,
 						RequestID: request_id,
 					})
 				session.proxy.Log.Printf("Window row:%v, col:%v\n", height,width)
@@ -255,13 +291,12 @@ func (session * SessionContext) forwardRequest(outgoing_channel requestDest, req
 		}					
 	} else if request.Type == "window-change" && len(request.Payload) >= 8 {
 		width, height := parseDims(request.Payload)
-		session.term_rows = height
-		session.term_cols = width
+		session.setTermSize(height, width)
 		go session.HandleEvent(
 			&SessionEvent{
 				Type: EVENT_WINDOW_RESIZE,
-				TermRows: session.term_rows,
-				TermCols: session.term_cols,
+				TermRows: height,
+				TermCols: width,
 				RequestID: request_id,
 			})
 		session.proxy.Log.Printf("New window row:%v, col:%v\n", height,width)
@@ -290,9 +325,34 @@ func (session * SessionContext) forwardRequest(outgoing_channel requestDest, req
 	return nil
 }
 
+/*
+ sendSignalToClients never blocks. Signals have
+ room for one value: a new message is dropped
+ when one is already waiting, since the client
+ reads every new event either way, and the end
+ of the session replaces a waiting value.
+*/
 func (session * SessionContext) sendSignalToClients(signal int) {
-	for _, cur_signal := range session.msg_signal {
-		cur_signal <- signal
+	session.signal_mutex.Lock()
+	signals := make([]chan int, len(session.msg_signal))
+	copy(signals, session.msg_signal)
+	session.signal_mutex.Unlock()
+	for _, cur_signal := range signals {
+		for {
+			select {
+			case cur_signal <- signal:
+			default:
+				if signal == SIGNAL_SESSION_END {
+					// make room and try again
+					select {
+					case <-cur_signal:
+					default:
+					}
+					continue
+				}
+			}
+			break
+		}
 	}
 }
 
@@ -315,9 +375,14 @@ func (session * SessionContext) markThreadStarted() {
 
 
 func (session * SessionContext) End() {
-	if (session.active) {
+	session.mutex.Lock()
+	ending := session.active
+	if ending {
 		session.active = false
 		session.stop_time = time.Now()
+	}
+	session.mutex.Unlock()
+	if (ending) {
 		session.HandleEvent(
 			&SessionEvent{
 				Type: EVENT_SESSION_STOP,
@@ -326,36 +391,85 @@ func (session * SessionContext) End() {
 		session.signalSessionEnd()
 		session.finalizeLog()
 		session.proxy.AddSessionToSessionList(session)
-		if session.remote_conn != nil {
-			conn := *session.remote_conn
+		session.proxy.scheduleEviction(session)
+		session.mutex.Lock()
+		remote_conn := session.remote_conn
+		session.mutex.Unlock()
+		if remote_conn != nil {
+			conn := *remote_conn
 			conn.Close()
 		}
 	}
 }
 
+func (session * SessionContext) isActive() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.active
+}
+
+func (session * SessionContext) getStopTime() time.Time {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.stop_time
+}
+
+func (session * SessionContext) isRecording() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.active || session.log_open
+}
+
+func (session * SessionContext) getFilename() string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.filename
+}
+
+func (session * SessionContext) setTermSize(rows uint32, cols uint32) {
+	session.mutex.Lock()
+	session.term_rows = rows
+	session.term_cols = cols
+	session.mutex.Unlock()
+}
+
 
 func (session * SessionContext) markThreadStopped() {
 	session.mutex.Lock()
 	session.thread_count -= 1
-	if session.thread_count < 1 {
+	stopped := session.thread_count < 1
+	session.mutex.Unlock()
+	// End takes the lock itself
+	if stopped {
 		session.End()
 	}
-	session.mutex.Unlock()
 }
 
 
 func (session * SessionContext) InfoAsJSON() string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
 	session_info := session_info_extended{
 		Start_time: 	session.start_time.Unix(),
 		Stop_time: 		session.stop_time.Unix(),
 		Length:			int64(session.stop_time.Sub(session.start_time).Seconds()),
 		Client_host:	session.client_host,
-		Serv_host:		session.proxy.DefaultRemoteIP +":"+strconv.Itoa(session.proxy.DefaultRemotePort),
+		Serv_host:		session.proxy.GetDefaultRemoteHost(),
 		Username:		session.client_username,
-		Password: 		session.client_password,
+		Password: 		session.proxy.redactPassword(session.client_password),
 		Term_rows:		session.term_rows,
 		Term_cols:		session.term_cols,
-		Filename:		session.filename}
+		Filename:		session.filename,
+		Key:			session.sessionID,
+		Address:		session.address}
+	if session.user != nil {
+		session_info.User = session.user.GetKey()
+	}
+	// the session list is not encrypted, so keep
+	// secrets in the recording only
+	if session.log_encrypted {
+		session_info.Password = ""
+	}
 	for _, request := range session.requests {
 		session_info.Requests = append(session_info.Requests, request.Req_type)
 	}
@@ -376,52 +490,101 @@ func (session * SessionContext) GetTimeOffset() int64 {
 
 
 func (session * SessionContext) initializeLog()  {
-	f, err := os.OpenFile(session.proxy.SessionFolder + "/" + session.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// if encryption is configured but the key can't be
+	// used, don't fall back to writing a cleartext log
+	recipient, err := session.proxy.getRecordingRecipient()
 	if err != nil {
+		session.proxy.Log.Println("error loading recording recipient; session will not be logged:", err)
+		return
+	}
+	store, err := session.proxy.GetRecordingStore()
+	if err != nil {
+		session.proxy.Log.Println("error opening recording store:", err)
+		return
+	}
+	filename := session.getFilename()
+	if recipient != nil {
+		filename = filename + RECORDING_ENCRYPTED_SUFFIX
+	}
+	if err := store.Create(filename); err != nil {
 		session.proxy.Log.Println("error opening session log file:", err)
+		return
+	}
+	var writer io.Writer = &recordingAppender{store: store, name: filename}
+	if recipient != nil {
+		writer, err = NewRecordingWriter(writer, recipient)
+		if err != nil {
+			store.Finalize(filename, "")
+			session.proxy.Log.Println("error starting encrypted session log:", err)
+			return
+		}
 	}
 	session.mutex.Lock()
-		session.log_fd = f
+		session.filename = filename
+		session.log_store = store
+		session.log_encrypted = recipient != nil
+		session.log_open = true
 	session.mutex.Unlock()
+	session.log_mutex.Lock()
+		session.log_writer = writer
+	session.log_mutex.Unlock()
 	session.appendToLog([]byte("[\n")); 
 }
 
 func (session * SessionContext) appendToLog(data []byte) {
 	session.log_mutex.Lock()
-	if _, err := session.log_fd.Write(data); err != nil {
-		session.log_fd.Close() // ignore error; Write error takes precedence
-		session.proxy.Log.Println("error writing to log file:", err)
+	if session.log_writer != nil {
+		if _, err := session.log_writer.Write(data); err != nil {
+			session.log_writer = nil
+			session.proxy.Log.Println("error writing to log file:", err)
+		}
 	}
 	session.log_mutex.Unlock()
 }
 
 func (session * SessionContext) finalizeLog()  {
 	session.appendToLog([]byte("\n]"))
-	if err := session.log_fd.Close(); err != nil {
-		session.proxy.Log.Println("error closing log file:", err)
+	session.mutex.Lock()
+	store := session.log_store
+	filename := session.filename
+	session.mutex.Unlock()
+	if store == nil {
+		return
 	}
-	if(len(session.events)<10) {
-		old_file := session.proxy.SessionFolder + "/" + session.filename
-		new_file := old_file + ".scan"
-		err := os.Rename(old_file,new_file)
-		if err != nil {
-			session.proxy.Log.Printf("Error moving log file from %v to %v: %v",old_file, new_file, err)
+	final_name := filename
+	if(session.EventCount()<10) {
+		final_name = filename + ".scan"
+	}
+	session.log_mutex.Lock()
+	// encrypted recordings end with a final record
+	if closer, ok := session.log_writer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			session.proxy.Log.Println("error closing log file:", err)
 		}
-		session.filename = new_file
 	}
+	session.log_writer = nil
+	session.log_mutex.Unlock()
+	if err := store.Finalize(filename, final_name); err != nil {
+		session.proxy.Log.Printf("Error finalizing log file %v: %v", filename, err)
+		final_name = filename
+	}
+	session.mutex.Lock()
+	session.filename = final_name
+	session.log_open = false
+	session.mutex.Unlock()
 }
 
 
 func (session * SessionContext) MakeNewSignal() chan int {
-	new_msg_signal := make(chan int)
-	session.mutex.Lock()
+	new_msg_signal := make(chan int, 1)
+	session.signal_mutex.Lock()
 	session.msg_signal = append(session.msg_signal,new_msg_signal)
-	session.mutex.Unlock()
+	session.signal_mutex.Unlock()
 	return new_msg_signal
 }
 
 func (session * SessionContext) RemoveSignal(signal chan int) {
-	session.mutex.Lock()
+	session.signal_mutex.Lock()
 	for index, val := range session.msg_signal {
 		if val == signal {
 			session.msg_signal[index] = session.msg_signal[len(session.msg_signal)-1]
@@ -429,7 +592,7 @@ func (session * SessionContext) RemoveSignal(signal chan int) {
 			break
 		}
 	}
-	session.mutex.Unlock()
+	session.signal_mutex.Unlock()
 }
 
 
@@ -447,24 +610,45 @@ type channelWrapper struct {
 func (channel * channelWrapper) Read(buff []byte) (bytes_read int, err error) {
 	bytes_read, err = channel.ReadWriter.Read(buff)
 
+	// only the client's keystrokes count against the
+	// idle timeout, so a server that keeps printing
+	// doesn't hold an unattended session open
+	if err == nil && bytes_read > 0 && channel.direction == "outgoing" {
+		channel.session.markActivity()
+	}
+
+	// an operator has the keyboard
+	if err == nil && channel.direction == "outgoing" && channel.session.clientInputLocked(channel.channel_id) {
+		return 0, nil
+	}
+
 	if err == nil {
 		
 		data_copy := make([]byte, bytes_read)
 	
 		copy(data_copy, buff)
 
-		if(channel.session.user.channelFilters != nil)	{
-			for _, filterFunc := range channel.session.user.channelFilters  {
+		if filters := channel.session.user.getChannelFilters(); filters != nil {
+			for _, filterFunc := range filters  {
 				data_copy = filterFunc.fn(data_copy,channel)
 			}
 		}
 
+		// prompt tracking depends on the order of reads,
+		// so it can't wait for the HandleEvent goroutine
+		size := bytes_read
+		redacted := channel.session.redactChannelData(data_copy, channel.direction, channel.channel_id)
+		if len(redacted) != len(data_copy) {
+			size = len(redacted)
+		}
+		data_copy = redacted
+
 		go channel.session.HandleEvent(
 			&SessionEvent{
 				Type: EVENT_MESSAGE,
 				Direction: channel.direction,
 				ChannelType: channel.data_type,
-				Size:	bytes_read,
+				Size:	size,
 				Data:	data_copy,
 				ChannelID: channel.channel_id,
 			})
@@ -502,7 +686,9 @@ func newChannelWrapper(
 	channel_id int,
 	) io.ReadWriter {
 	
+	context.mutex.Lock()
 	context.channels = append(context.channels, &channel_data{chunks: make([]block_chunk, 0), channel_type: channel_type})
+	context.mutex.Unlock()
 	
 	return &channelWrapper{ReadWriter: in_channel, session: context, direction: direction, data_type: data_type, start_time: start_time, channel_id: channel_id}
 }
@@ -546,6 +732,9 @@ type session_info_extended struct {
 	Term_cols	uint32 `json:"term_cols"`
 	Filename	string  `json:"filename"`
 	Requests	[]string `json:"requests"`
+	Key			string `json:"key,omitempty"`
+	User		string `json:"user,omitempty"`
+	Address		string `json:"address,omitempty"`
 }
 
 // taken from 192-208: https://github.com/cmoog/sshproxy/blob/47ea68e82eaa4d43250d2a93c18fb26806cd67eb/reverseproxy.go#L192
@@ -0,0 +1,323 @@
+package sshproxyplus
+
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+const SESSION_APPROVAL_APPROVE	string = "approve"
+const SESSION_APPROVAL_DENY		string = "deny"
+
+const SESSION_APPROVAL_TIMEOUT_DEFAULT	int64 = 300
+
+const SESSION_APPROVAL_NOTICE	string = "This session is waiting for an operator to approve it."
+
+/*
+ A sessionApproval holds a new session of a
+ user with RequireApproval until an operator
+ approves or denies it, or it times out.
+*/
+type sessionApproval struct {
+	decided		chan struct{}
+	approved	bool
+	approver	string
+	reason		string
+}
+
+/*
+ approvalTimeout is how long a session waits
+ for approval before it is denied. A negative
+ ApprovalTimeoutSeconds waits forever.
+*/
+func (proxy *ProxyContext) approvalTimeout() time.Duration {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if proxy.ApprovalTimeoutSeconds == 0 {
+		return time.Duration(SESSION_APPROVAL_TIMEOUT_DEFAULT) * time.Second
+	}
+	return time.Duration(proxy.ApprovalTimeoutSeconds) * time.Second
+}
+
+// isPendingApproval reports whether the session
+// is waiting for an operator
+func (session *SessionContext) isPendingApproval() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.approval == nil {
+		return false
+	}
+	select {
+	case <-session.approval.decided:
+		return false
+	default:
+		return true
+	}
+}
+
+// Approve lets a pending session through
+func (session *SessionContext) Approve(approver string, reason string) error {
+	return session.decideApproval(true, approver, reason)
+}
+
+// Deny closes a pending session
+func (session *SessionContext) Deny(approver string, reason string) error {
+	return session.decideApproval(false, approver, reason)
+}
+
+func (session *SessionContext) decideApproval(approved bool, approver string, reason string) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	approval := session.approval
+	if approval == nil {
+		return newKindError(ErrConflict, "session is not waiting for approval")
+	}
+	select {
+	case <-approval.decided:
+		return newKindError(ErrConflict, "session is not waiting for approval")
+	default:
+	}
+	approval.approved = approved
+	approval.approver = approver
+	approval.reason = reason
+	close(approval.decided)
+	return nil
+}
+
+/*
+ heldChannel is a client channel that was
+ accepted while its session waited for
+ approval. Forwarding it later "accepts" it
+ again and gets the channel and its queued
+ requests.
+*/
+type heldChannel struct {
+	ssh.NewChannel
+	channel		ssh.Channel
+	requests	chan *ssh.Request
+}
+
+/*
+ holdRequests queues the client's requests
+ (pty-req, shell and so on) while the session
+ waits. They are answered by the server once
+ the session is approved, and refused when it
+ is denied.
+*/
+func (held *heldChannel) holdRequests(requests <-chan *ssh.Request, approval *sessionApproval) {
+	defer close(held.requests)
+	queued := make([]*ssh.Request, 0)
+	for waiting := true; waiting; {
+		select {
+		case request, ok := <-requests:
+			if !ok {
+				return
+			}
+			queued = append(queued, request)
+		case <-approval.decided:
+			waiting = false
+		}
+	}
+	// the decision is written before decided is closed
+	if !approval.approved {
+		for _, request := range queued {
+			if request.WantReply {
+				request.Reply(false, nil)
+			}
+		}
+		ssh.DiscardRequests(requests)
+		return
+	}
+	for _, request := range queued {
+		held.requests <- request
+	}
+	for request := range requests {
+		held.requests <- request
+	}
+}
+
+func (held *heldChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	return held.channel, held.requests, nil
+}
+
+func (held *heldChannel) Reject(reason ssh.RejectionReason, message string) error {
+	return held.channel.Close()
+}
+
+/*
+ awaitApproval holds a session of a user with
+ RequireApproval before the server is dialed.
+ The first session channel
+ the client opens is accepted so the notice can
+ be shown; it and any other channels are
+ forwarded once the session is approved. When
+ the session is denied or times out, false is
+ returned and the caller closes it.
+*/
+func (session *SessionContext) awaitApproval(client_channels <-chan ssh.NewChannel) (<-chan ssh.NewChannel, bool) {
+	if !session.user.RequireApproval {
+		return client_channels, true
+	}
+	approval := &sessionApproval{decided: make(chan struct{})}
+	session.mutex.Lock()
+	session.approval = approval
+	session.mutex.Unlock()
+
+	timeout := session.proxy.approvalTimeout()
+	session.HandleEvent(
+		&SessionEvent{
+			Type: EVENT_APPROVAL_PENDING,
+			Timeout: int64(timeout.Seconds()),
+		})
+	session.proxy.Log.Printf("session %v is waiting for approval\n", session.GetID())
+	var timer <-chan time.Time
+	if timeout >= 0 {
+		timer = time.After(timeout)
+	}
+
+	var held *heldChannel
+	queued := make([]ssh.NewChannel, 0)
+	waiting := true
+	for waiting {
+		select {
+		case new_channel, ok := <-client_channels:
+			if !ok {
+				client_channels = nil
+				session.decideApproval(false, "", "client disconnected")
+				continue
+			}
+			if held != nil || new_channel.ChannelType() != "session" {
+				queued = append(queued, new_channel)
+				continue
+			}
+			channel, requests, err := new_channel.Accept()
+			if err != nil {
+				continue
+			}
+			held = &heldChannel{NewChannel: new_channel, channel: channel, requests: make(chan *ssh.Request)}
+			go held.holdRequests(requests, approval)
+			fmt.Fprintf(channel, "%v\r\n", SESSION_APPROVAL_NOTICE)
+		case <-timer:
+			session.decideApproval(false, "", "approval timed out")
+		case <-approval.decided:
+			waiting = false
+		}
+	}
+
+	session.mutex.Lock()
+	approved, approver, reason := approval.approved, approval.approver, approval.reason
+	session.mutex.Unlock()
+	event_type := EVENT_SESSION_DENIED
+	if approved {
+		event_type = EVENT_SESSION_APPROVED
+	}
+	session.HandleEvent(
+		&SessionEvent{
+			Type: event_type,
+			Operator: approver,
+			Reason: reason,
+		})
+	session.proxy.Log.Printf("session %v %v by %v: %v\n", session.GetID(), event_type, approver, reason)
+
+	if !approved {
+		if held != nil {
+			fmt.Fprintf(held.channel, "Session denied: %v\r\n", reason)
+			held.channel.Close()
+		}
+		for _, new_channel := range queued {
+			new_channel.Reject(ssh.Prohibited, "session denied")
+		}
+		return nil, false
+	}
+
+	forwarded := make(chan ssh.NewChannel)
+	go func() {
+		defer close(forwarded)
+		if held != nil {
+			forwarded <- held
+		}
+		for _, new_channel := range queued {
+			forwarded <- new_channel
+		}
+		if client_channels == nil {
+			return
+		}
+		for new_channel := range client_channels {
+			forwarded <- new_channel
+		}
+	}()
+	return forwarded, true
+}
+
+/*
+ DecideSession approves or denies a session
+ that is waiting for approval.
+*/
+func (proxy *ProxyContext) DecideSession(sessionKey string, approved bool, approver string, reason string) error {
+	session, ok := proxy.sessions.get(sessionKey)
+	if !ok {
+		return newKindError(ErrNotFound, "could not find session")
+	}
+	return session.decideApproval(approved, approver, reason)
+}
+
+// ListPendingSessions lists the keys of the
+// sessions waiting for approval
+func (proxy *ProxyContext) ListPendingSessions() []string {
+	keys := make([]string, 0)
+	for key, session := range proxy.sessions.snapshot() {
+		if session.isPendingApproval() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+/*
+ sessionViewerSocketApproval handles the
+ viewer-approval command: the viewer secret,
+ the session key and approve or deny. Only
+ viewers with an Operator may decide.
+*/
+func (server *proxyWebServer) sessionViewerSocketApproval(conn *websocket.Conn) {
+	_, viewerKey, err := conn.ReadMessage()
+	if err != nil {
+		log.Println("Error during message reading:", err)
+		return
+	}
+	_, sessionKey, err := conn.ReadMessage()
+	if err != nil {
+		log.Println("Error during message reading:", err)
+		return
+	}
+	_, decision, err := conn.ReadMessage()
+	if err != nil {
+		log.Println("Error during message reading:", err)
+		return
+	}
+	viewer := server.proxy.GetSessionViewer(string(viewerKey))
+	if viewer == nil || viewer.getOperator() == "" {
+		conn.WriteMessage(websocket.TextMessage,[]byte("viewer may not approve sessions"))
+		return
+	}
+	session, ok := viewer.getSession(string(sessionKey))
+	if !ok {
+		conn.WriteMessage(websocket.TextMessage,[]byte("could not find session"))
+		return
+	}
+	approved := string(decision) == SESSION_APPROVAL_APPROVE
+	err = session.decideApproval(approved, viewer.getOperator(), "decided from the web viewer")
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage,[]byte(err.Error()))
+		return
+	}
+	if approved {
+		conn.WriteMessage(websocket.TextMessage,[]byte("approved"))
+	} else {
+		conn.WriteMessage(websocket.TextMessage,[]byte("denied"))
+	}
+}
@@ -0,0 +1,214 @@
+package sshproxyplus
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+
+func findSessionEvent(session *SessionContext, event_type string) *SessionEvent {
+	session.event_mutex.Lock()
+	defer session.event_mutex.Unlock()
+	for _, event := range session.events {
+		if event.Type == event_type {
+			return event
+		}
+	}
+	return nil
+}
+
+/*
+ openPendingShell opens a shell in the
+ background, since a held session only answers
+ the pty-req and shell requests once it is
+ decided. done is closed when the shell ends.
+*/
+func openPendingShell(t *testing.T, host string, user string, password string) (*testShell, chan struct{}) {
+	client, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout: time.Second * 3,
+	})
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		t.Fatalf("Error when opening a session: %s", err)
+	}
+	shell := &testShell{client: client, session: session, output: &lockedBuffer{}}
+	stdout, _ := session.StdoutPipe()
+	go io.Copy(shell.output, stdout)
+	shell.stdin, _ = session.StdinPipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}) != nil || session.Shell() != nil {
+			return
+		}
+		session.Wait()
+	}()
+	return shell, done
+}
+
+func waitClosed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(3 * time.Second):
+		return false
+	}
+}
+
+func TestMessageApproveSession(t *testing.T) {
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	controller := makeNewController()
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.ListenPort = int(newRandomPort().Int64())
+	proxy.SessionFolder = t.TempDir()
+	proxy.ApprovalTimeoutSeconds = 2
+	proxy.active = true
+	proxyID := controller.AddExistingProxy(proxy)
+	proxy.AddProxyUser(&ProxyUser{
+		Username: "user",
+		Password: "password",
+		RemoteHost: "127.0.0.1:"+dummyServer.port.Text(10),
+		RemoteUsername: "user",
+		RemotePassword: "password",
+		RequireApproval: true})
+	go proxy.StartProxy()
+	defer proxy.Stop()
+	time.Sleep(500*time.Millisecond)
+	host := "127.0.0.1:"+strconv.Itoa(proxy.ListenPort)
+
+	shell, _ := openPendingShell(t, host, "user", "password")
+	defer shell.close()
+	if !waitForOutput(shell.output, SESSION_APPROVAL_NOTICE) {
+		t.Fatalf("awaitApproval() did not show the notice; client got %q", shell.output.String())
+	}
+
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_LIST_PENDING_SESSIONS,
+		ProxyID: proxyID,
+	}, controller, t)
+	data, _ := base64.StdEncoding.DecodeString(reply["Sessions"].(string))
+	var pending []string
+	json.Unmarshal(data, &pending)
+	if len(pending) != 1 {
+		t.Fatalf("*ControllerMessage handleMessage() listed %v pending sessions, expected 1", pending)
+	}
+	session, _ := proxy.sessions.get(pending[0])
+	session.mutex.Lock()
+	dialed := session.remote_conn != nil
+	session.mutex.Unlock()
+	if dialed {
+		t.Errorf("HandleClientConn() connected to the server before the session was approved")
+	}
+	_, viewer := proxy.MakeSessionViewerForUser("user", "password")
+	proxy.SetSessionViewerOperator(viewer.Secret, "alice")
+	listed := (&proxyWebServer{proxy: proxy}).getUserSessionInfo(viewer)
+	if len(listed) != 1 || !listed[0].Active || !listed[0].Pending || !listed[0].Operator {
+		t.Errorf("getUserSessionInfo() = %+v, expected a pending session the operator can decide", listed)
+	}
+
+	go io.WriteString(shell.stdin, "held-input")
+	time.Sleep(300*time.Millisecond)
+	reply = simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_APPROVE_SESSION,
+		ProxyID: proxyID,
+		SessionKey: pending[0],
+		Operator: "alice",
+		Reason: "change window",
+	}, controller, t)
+	if reply["Error"] != nil && reply["Error"] != "" {
+		t.Fatalf("*ControllerMessage handleMessage() could not approve the session: %v", reply["Error"])
+	}
+	io.WriteString(shell.stdin, "approved-input")
+	if !waitForOutput(shell.output, "approved-input") {
+		t.Errorf("approved session was not forwarded; client got %q", shell.output.String())
+	}
+	if approved := findSessionEvent(session, EVENT_SESSION_APPROVED); approved == nil || approved.Operator != "alice" || approved.Reason != "change window" {
+		t.Errorf("awaitApproval() did not record the approver: %#v", approved)
+	}
+	if err := proxy.DecideSession(pending[0], false, "bob", ""); err == nil {
+		t.Errorf("DecideSession() decided an approved session again")
+	}
+
+	denied, deniedDone := openPendingShell(t, host, "user", "password")
+	defer denied.close()
+	if !waitForOutput(denied.output, SESSION_APPROVAL_NOTICE) {
+		t.Fatalf("awaitApproval() did not show the notice; client got %q", denied.output.String())
+	}
+	pending = proxy.ListPendingSessions()
+	if len(pending) != 1 {
+		t.Fatalf("ListPendingSessions() = %v, expected 1 session", pending)
+	}
+	deniedSession, _ := proxy.sessions.get(pending[0])
+	simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_DENY_SESSION,
+		ProxyID: proxyID,
+		SessionKey: pending[0],
+		Reason: "not scheduled",
+	}, controller, t)
+	if !waitClosed(deniedDone) {
+		t.Errorf("denied session was not closed")
+	}
+	if event := findSessionEvent(deniedSession, EVENT_SESSION_DENIED); event == nil || event.Operator != CONTROLLER_OPERATOR || event.Reason != "not scheduled" {
+		t.Errorf("awaitApproval() did not record the denial: %#v", event)
+	}
+
+	timedOut, timedOutDone := openPendingShell(t, host, "user", "password")
+	defer timedOut.close()
+	if !waitClosed(timedOutDone) {
+		t.Errorf("session was not closed when its approval timed out")
+	}
+	if !waitForOutput(timedOut.output, "approval timed out") {
+		t.Errorf("awaitApproval() did not tell the user the approval timed out; client got %q", timedOut.output.String())
+	}
+}
+
+func TestProxyAwaitActive(t *testing.T) {
+	proxy := makeNewTestProxy()
+	proxy.Deactivate()
+	result := make(chan bool, 1)
+	go func() {
+		result <- proxy.awaitActive(make(chan struct{}))
+	}()
+	select {
+	case <-result:
+		t.Fatalf("awaitActive() returned while the proxy was inactive")
+	case <-time.After(100*time.Millisecond):
+	}
+	proxy.Activate()
+	select {
+	case active := <-result:
+		if !active {
+			t.Errorf("awaitActive() = false, expected true once the proxy was activated")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("awaitActive() did not return when the proxy was activated")
+	}
+
+	proxy.Deactivate()
+	closed := make(chan struct{})
+	close(closed)
+	if proxy.awaitActive(closed) {
+		t.Errorf("awaitActive() = true for a client that went away")
+	}
+}
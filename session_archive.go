@@ -0,0 +1,236 @@
+package sshproxyplus
+
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const SESSION_LOG_SUFFIX	string = ".log.json"
+
+/*
+ LoadArchivedSessions indexes the recordings in
+ the proxy's RecordingStore so sessions from
+ before a restart show up in the web viewer
+ again. It is called when the proxy starts and
+ is safe to call more than once; recordings that
+ are already known are skipped.
+
+ Sessions are built from the session list. A
+ recording with no session list entry (e.g. the
+ proxy stopped before the session ended) is still
+ listed, but only for public queries since its
+ user is unknown.
+
+ Archived sessions only hold the summary; their
+ events stay in the store and are streamed from
+ it when a viewer plays one.
+*/
+func (proxy *ProxyContext) LoadArchivedSessions() error {
+	store, err := proxy.GetRecordingStore()
+	if err != nil {
+		return err
+	}
+	recordings, err := store.List()
+	if err != nil {
+		return err
+	}
+	available := make(map[string]RecordingInfo)
+	for _, recording := range recordings {
+		if strings.Contains(recording.Name, SESSION_LOG_SUFFIX) {
+			available[recording.Name] = recording
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, session := range proxy.sessions.snapshot() {
+		known[session.getFilename()] = true
+	}
+
+	reader, err := store.OpenSessionList()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	for {
+		var info session_info_extended
+		err := decoder.Decode(&info)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("unable to parse session list: %w", err)
+		}
+		if _, ok := available[info.Filename]; !ok || known[info.Filename] {
+			continue
+		}
+		proxy.addArchivedSession(&info)
+		known[info.Filename] = true
+	}
+
+	for name, recording := range available {
+		if known[name] {
+			continue
+		}
+		proxy.addArchivedSession(&session_info_extended{
+			Start_time: recording.ModTime.Unix(),
+			Stop_time: recording.ModTime.Unix(),
+			Filename: name,
+		})
+	}
+	return nil
+}
+
+func (proxy *ProxyContext) addArchivedSession(info *session_info_extended) {
+	key := info.Key
+	if key == "" {
+		key = archivedSessionKey(info.Filename)
+	}
+	session := &SessionContext{
+		proxy: proxy,
+		archived: true,
+		active: false,
+		start_time: time.Unix(info.Start_time, 0),
+		stop_time: time.Unix(info.Stop_time, 0),
+		client_host: info.Client_host,
+		client_username: info.Username,
+		term_rows: info.Term_rows,
+		term_cols: info.Term_cols,
+		filename: info.Filename,
+		sessionID: key,
+		address: info.Address,
+		log_encrypted: strings.Contains(info.Filename, RECORDING_ENCRYPTED_SUFFIX),
+	}
+	// the same address pair may have been reused
+	// across restarts; keep both sessions
+	if !proxy.sessions.addIfAbsent(key, session) {
+		key = fmt.Sprintf("%v_%v", key, info.Start_time)
+		session.sessionID = key
+		if !proxy.sessions.addIfAbsent(key, session) {
+			return
+		}
+	}
+	proxy.sessions.addAlias(info.Address, key)
+
+	userKey := info.User
+	if userKey == "" && info.Username != "" {
+		userKey = buildProxyUserKey(info.Username, "")
+	}
+	if userKey == "" {
+		return
+	}
+	for _, user := range proxy.ListProxyUsers() {
+		if user.GetKey() == userKey {
+			session.user = user
+		}
+	}
+	if session.user == nil {
+		session.user = &ProxyUser{Username: strings.TrimSuffix(userKey, ":")}
+	}
+	proxy.AddSessionToUserList(session)
+}
+
+// archivedSessionKey recovers the session key from
+// a recording name such as <key>.log.json.enc.scan
+func archivedSessionKey(filename string) string {
+	if index := strings.Index(filename, SESSION_LOG_SUFFIX); index >= 0 {
+		return filename[:index]
+	}
+	return filename
+}
+
+/*
+ openRecording opens the recording of a
+ session for reading, decrypting it with
+ identity when it is encrypted. The session
+ may still be live, in which case its
+ recording has no final record yet.
+*/
+func (session *SessionContext) openRecording(identity *RecordingIdentity) (io.ReadCloser, error) {
+	store, err := session.proxy.GetRecordingStore()
+	if err != nil {
+		return nil, err
+	}
+	live := session.isRecording()
+	fd, err := store.Open(session.getFilename())
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newRecordingReader(fd, identity, live)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, fd}, nil
+}
+
+/*
+ playArchivedSession streams the events of a
+ recording to the viewer one at a time, with
+ the same ack handshake as a live session,
+ without loading the recording into memory.
+ A plaintext recording that was cut off (e.g.
+ by a crash) plays up to its last complete
+ event; an encrypted one that is missing its
+ final record plays up to the cut and then
+ fails.
+*/
+func playArchivedSession(conn *websocket.Conn, session *SessionContext, identity *RecordingIdentity) error {
+	reader, err := session.openRecording(identity)
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage,[]byte("could not open session recording"))
+		return err
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return errors.New("session recording is not a list of events")
+	}
+	for decoder.More() {
+		var event json.RawMessage
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		if err := send_event_data(conn, event); err != nil {
+			return err
+		}
+	}
+	if err := checkRecordingEnd(decoder); err != nil {
+		conn.WriteMessage(websocket.TextMessage,[]byte("session recording is truncated"))
+		return err
+	}
+	return nil
+}
+
+/*
+ checkRecordingEnd reads the closing bracket
+ once decoder has no more events. Plaintext
+ recordings cut off by a crash just end, but
+ the reader of an encrypted recording returns
+ an error when the final record is missing,
+ which decoder.More() alone would hide.
+*/
+func checkRecordingEnd(decoder *json.Decoder) error {
+	_, err := decoder.Token()
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
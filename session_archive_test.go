@@ -0,0 +1,157 @@
+package sshproxyplus
+
+import (
+	"testing"
+	"encoding/json"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+
+func recordTestSession(proxy *ProxyContext, user *ProxyUser, key string, events int) *SessionContext {
+	session := &SessionContext{
+		proxy: proxy,
+		active: true,
+		start_time: time.Now(),
+		filename: key + SESSION_LOG_SUFFIX,
+		sessionID: key,
+		client_username: user.Username,
+		user: user,
+	}
+	session.initializeLog()
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START, Key: key})
+	for index := 1; index < events; index++ {
+		session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Data: []byte("ls\r")})
+	}
+	session.End()
+	return session
+}
+
+func TestLoadArchivedSessions(t *testing.T) {
+	folder := t.TempDir()
+	user := makeNewTestProxyUser()
+
+	before := makeNewTestProxy()
+	before.SessionFolder = folder
+	recordTestSession(before, user, "127.0.0.1:2222:10.0.0.1:5555", 12)
+	recordTestSession(before, user, "127.0.0.1:2222:10.0.0.1:5556", 1)
+	// a proxy that stopped before the session ended leaves no session list entry
+	os.WriteFile(folder + "/127.0.0.1:2222:10.0.0.1:5557" + SESSION_LOG_SUFFIX, []byte("[\n{\"type\":\"session-start\"}"), 0644)
+
+	after := makeNewTestProxy()
+	after.SessionFolder = folder
+	after.AddProxyUser(user)
+	if err := after.LoadArchivedSessions(); err != nil {
+		t.Fatalf("LoadArchivedSessions() returned an error: %s", err)
+	}
+
+	if after.sessions.len() != 3 {
+		t.Fatalf("LoadArchivedSessions() loaded %v sessions, expected 3", after.sessions.len())
+	}
+	session, ok := after.sessions.get("127.0.0.1:2222:10.0.0.1:5555")
+	if !ok {
+		t.Fatalf("LoadArchivedSessions() did not load the session under its key: %v", after.ListAllSessions())
+	}
+	if !session.archived || session.active || session.user != user || len(session.events) != 0 {
+		t.Errorf("LoadArchivedSessions() did not build an archived session: %#v", session)
+	}
+	if session.filename != "127.0.0.1:2222:10.0.0.1:5555" + SESSION_LOG_SUFFIX {
+		t.Errorf("LoadArchivedSessions() gave the session the wrong recording: %v", session.filename)
+	}
+	if len(after.ListAllUserSessions(user.GetKey())) != 2 {
+		t.Errorf("LoadArchivedSessions() did not add the sessions to the user list: %v", after.ListAllUserSessions(user.GetKey()))
+	}
+	if len(after.ListAllActiveSessions()) != 0 {
+		t.Errorf("LoadArchivedSessions() marked archived sessions as active")
+	}
+	orphan, ok := after.sessions.get("127.0.0.1:2222:10.0.0.1:5557")
+	if !ok || orphan.user != nil {
+		t.Errorf("LoadArchivedSessions() did not load the recording without a session list entry")
+	}
+
+	if err := after.LoadArchivedSessions(); err != nil || after.sessions.len() != 3 {
+		t.Errorf("LoadArchivedSessions() loaded sessions twice: %v", after.ListAllSessions())
+	}
+}
+
+func TestArchivedSessionKey(t *testing.T) {
+	names := map[string]string{
+		"127.0.0.1:2222:10.0.0.1:5555.log.json": "127.0.0.1:2222:10.0.0.1:5555",
+		"127.0.0.1:2222:10.0.0.1:5555.log.json.scan": "127.0.0.1:2222:10.0.0.1:5555",
+		"127.0.0.1:2222:10.0.0.1:5555.log.json.enc.scan": "127.0.0.1:2222:10.0.0.1:5555",
+	}
+	for name, expected := range names {
+		if key := archivedSessionKey(name); key != expected {
+			t.Errorf("archivedSessionKey(%v) = %v, expected %v", name, key, expected)
+		}
+	}
+}
+
+func TestWebServerRouteGetArchived(t *testing.T) {
+	privateFile, publicFile := writeTestRecordingKeys(t)
+	folder := t.TempDir()
+	user := makeNewTestProxyUser()
+	sessionKey := "127.0.0.1:2222:10.0.0.1:5555"
+
+	before := makeNewTestProxy()
+	before.SessionFolder = folder
+	before.RecordingRecipientFile = publicFile
+	recordTestSession(before, user, sessionKey, 12)
+
+	controller := makeNewController()
+	controller.InitializeSocket()
+	controller.RecordingIdentityFile = privateFile
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.SessionFolder = folder
+	proxy.AddProxyUser(user)
+	controller.AddExistingProxy(proxy)
+	if err := proxy.LoadArchivedSessions(); err != nil {
+		t.Fatalf("LoadArchivedSessions() returned an error: %s", err)
+	}
+
+	go controller.StartWebServer()
+	defer controller.StopWebServer()
+	time.Sleep(100* time.Millisecond)
+	connectURL := url.URL{Scheme: "ws", Host: controller.WebHost, Path: "/proxysocket/?id=0"}
+	conn, _, err := websocket.DefaultDialer.Dial(connectURL.String(), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to websocket: %s", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("list-all"))
+	_, reply, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read from websocket failed: %s", err)
+	}
+	sessions := make([]session_info, 0)
+	json.Unmarshal(reply, &sessions)
+	if len(sessions) != 1 || sessions[0].Key != sessionKey || sessions[0].Active {
+		t.Fatalf("list-all did not include the archived session: %s", reply)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("get"))
+	conn.WriteMessage(websocket.TextMessage, []byte(sessionKey))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// start, 11 messages, stop
+	for count := 0; count < 13; count++ {
+		_, reply, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Read from websocket failed after %v events: %s", count, err)
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("ack"))
+		event := &SessionEvent{}
+		if err = json.Unmarshal(reply, event); err != nil {
+			t.Fatalf("(server *proxyWebServer) playSession() did not stream valid json: %s: %s", err, reply)
+		}
+		if count == 0 && (event.Type != EVENT_SESSION_START || event.Key != sessionKey) {
+			t.Errorf("(server *proxyWebServer) playSession() streamed an unexpected first event: %s", reply)
+		}
+		if count == 12 && event.Type != EVENT_SESSION_STOP {
+			t.Errorf("(server *proxyWebServer) playSession() streamed an unexpected last event: %s", reply)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package sshproxyplus
+
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const SESSION_EVENT_BUFFER_DEFAULT		int = 1000
+const SESSION_EVICTION_DEFAULT			int64 = 600
+
+/*
+ eventBufferSize is how many recent events a
+ session keeps in memory. A negative
+ EventBufferSize keeps every event.
+*/
+func (proxy *ProxyContext) eventBufferSize() int {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if proxy.EventBufferSize == 0 {
+		return SESSION_EVENT_BUFFER_DEFAULT
+	}
+	return proxy.EventBufferSize
+}
+
+/*
+ sessionEvictionDelay is how long an ended
+ session stays in memory. A negative
+ SessionEvictionSeconds never evicts.
+*/
+func (proxy *ProxyContext) sessionEvictionDelay() time.Duration {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if proxy.SessionEvictionSeconds == 0 {
+		return time.Duration(SESSION_EVICTION_DEFAULT) * time.Second
+	}
+	return time.Duration(proxy.SessionEvictionSeconds) * time.Second
+}
+
+/*
+ trimEvents drops the oldest events once the
+ buffer is a quarter over its size. Events are
+ only dropped while the session is being logged
+ so they can be read back from the recording.
+*/
+func (session *SessionContext) trimEvents() {
+	limit := session.proxy.eventBufferSize()
+	if limit < 0 {
+		return
+	}
+	session.log_mutex.Lock()
+	logging := session.log_writer != nil
+	session.log_mutex.Unlock()
+	if !logging {
+		return
+	}
+	session.event_mutex.Lock()
+	if len(session.events) > limit + limit/4 {
+		excess := len(session.events) - limit
+		session.events = append([]*SessionEvent(nil), session.events[excess:]...)
+		session.events_dropped += excess
+	}
+	session.event_mutex.Unlock()
+}
+
+/*
+ eventsSince returns the events still in memory
+ from index next onwards, along with the index
+ of the first one returned. When older events
+ have been dropped, first is greater than next.
+*/
+func (session *SessionContext) eventsSince(next int) ([]*SessionEvent, int) {
+	session.event_mutex.Lock()
+	defer session.event_mutex.Unlock()
+	first := session.events_dropped
+	if next > first {
+		if next - first > len(session.events) {
+			return nil, next
+		}
+		first = next
+	}
+	events := make([]*SessionEvent, len(session.events) - (first - session.events_dropped))
+	copy(events, session.events[first - session.events_dropped:])
+	return events, first
+}
+
+// EventCount is the number of events in the
+// session, including those no longer in memory
+func (session *SessionContext) EventCount() int {
+	session.event_mutex.Lock()
+	defer session.event_mutex.Unlock()
+	return session.events_dropped + len(session.events)
+}
+
+/*
+ forEachLoggedEvent reads the events in
+ [from, until) from the session's recording
+ and hands each to handler. It returns the
+ index of the next event to read.
+*/
+func (session *SessionContext) forEachLoggedEvent(identity *RecordingIdentity, from int, until int, handler func(json.RawMessage) error) (int, error) {
+	reader, err := session.openRecording(identity)
+	if err != nil {
+		return from, err
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	if _, err := decoder.Token(); err != nil {
+		return from, err
+	}
+	for index := 0; index < until; index++ {
+		if !decoder.More() {
+			if err := checkRecordingEnd(decoder); err != nil {
+				return from, err
+			}
+			break
+		}
+		var event json.RawMessage
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return from, err
+		}
+		if index < from {
+			continue
+		}
+		if err := handler(event); err != nil {
+			return from, err
+		}
+		from = index + 1
+	}
+	return from, nil
+}
+
+/*
+ replayEventsFrom hands the events from index
+ next on to handler, reading those that have
+ left memory from the recording, decrypted with
+ identity. When the recording can't be read,
+ missed is told how many events were skipped.
+ It returns the index of the next event.
+*/
+func (session *SessionContext) replayEventsFrom(identity *RecordingIdentity, next int, handler func(int, *SessionEvent) error, missed func(int, error)) (int, error) {
+	events, first := session.eventsSince(next)
+	if next < first {
+		index := next
+		_, err := session.forEachLoggedEvent(identity, next, first, func(data json.RawMessage) error {
+			event := &SessionEvent{}
+			if err := json.Unmarshal(data, event); err != nil {
+				return err
+			}
+			index++
+			return handler(index - 1, event)
+		})
+		if err != nil {
+			missed(first - next, err)
+		}
+	}
+	for offset, event := range events {
+		if err := handler(first + offset, event); err != nil {
+			return first + offset, err
+		}
+	}
+	return first + len(events), nil
+}
+
+/*
+ sendLoggedEvents sends the events in
+ [from, until) from the session's recording.
+ It returns the index of the next event
+ to send.
+*/
+func (server *proxyWebServer) sendLoggedEvents(conn *websocket.Conn, session *SessionContext, from int, until int) (int, error) {
+	identity, err := server.loadRecordingIdentity()
+	if err != nil {
+		return from, err
+	}
+	return session.forEachLoggedEvent(identity, from, until, func(event json.RawMessage) error {
+		return send_event_data(conn, event)
+	})
+}
+
+/*
+ sendEventsFrom sends every event from index
+ next that is available, reading the ones that
+ have left memory from the recording. It
+ returns the index of the next event to send.
+*/
+func (server *proxyWebServer) sendEventsFrom(conn *websocket.Conn, session *SessionContext, next int) int {
+	events, first := session.eventsSince(next)
+	if next < first {
+		sent, err := server.sendLoggedEvents(conn, session, next, first)
+		if err != nil {
+			server.proxy.Log.Println("error reading session events from the recording:", err)
+		}
+		if sent < first {
+			// skip what couldn't be read rather than
+			// stalling the viewer
+			server.proxy.Log.Printf("skipped %v events of session %v\n", first - sent, session.sessionID)
+		}
+	}
+	send_latest_events(0, len(events), conn, events)
+	return first + len(events)
+}
+
+func (proxy *ProxyContext) setIdentityLoader(loader func() (*RecordingIdentity, error)) {
+	proxy.mutex.Lock()
+	proxy.identityLoader = loader
+	proxy.mutex.Unlock()
+}
+
+/*
+ loadRecordingIdentity loads the identity that
+ decrypts the proxy's recordings. It is nil
+ when the proxy isn't run by a controller or
+ the controller has none.
+*/
+func (proxy *ProxyContext) loadRecordingIdentity() (*RecordingIdentity, error) {
+	proxy.mutex.Lock()
+	loader := proxy.identityLoader
+	proxy.mutex.Unlock()
+	if loader == nil {
+		return nil, nil
+	}
+	return loader()
+}
+
+/*
+ scheduleEviction replaces an ended session with
+ its archived summary after the eviction delay,
+ releasing its events and channels. The session
+ stays listed and can still be played from its
+ recording.
+*/
+func (proxy *ProxyContext) scheduleEviction(session *SessionContext) {
+	delay := proxy.sessionEvictionDelay()
+	if delay < 0 {
+		return
+	}
+	time.AfterFunc(delay, func() {
+		proxy.evictSession(session)
+	})
+}
+
+func (proxy *ProxyContext) evictSession(session *SessionContext) {
+	if session.isActive() || session.archived {
+		return
+	}
+	proxy.sessions.remove(session)
+	proxy.getSearchIndex().removeSession(session)
+	if session.log_store == nil {
+		return
+	}
+	var info session_info_extended
+	if err := json.Unmarshal([]byte(session.InfoAsJSON()), &info); err != nil {
+		return
+	}
+	proxy.addArchivedSession(&info)
+}
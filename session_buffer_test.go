@@ -0,0 +1,183 @@
+package sshproxyplus
+
+import (
+	"testing"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+
+func makeBufferTestSession(proxy *ProxyContext, key string) *SessionContext {
+	user := makeNewTestProxyUser()
+	proxy.AddProxyUser(user)
+	session := &SessionContext{
+		proxy: proxy,
+		active: true,
+		start_time: time.Now(),
+		filename: key + SESSION_LOG_SUFFIX,
+		sessionID: key,
+		client_username: user.Username,
+		user: user,
+		msg_signal: make([]chan int,0),
+	}
+	proxy.sessions.add(key, session)
+	proxy.AddSessionToUserList(session)
+	return session
+}
+
+func TestSessionEventBuffer(t *testing.T) {
+	proxy := makeNewTestProxy()
+	proxy.SessionFolder = t.TempDir()
+	proxy.EventBufferSize = 10
+	session := makeBufferTestSession(proxy, "buffered")
+	session.initializeLog()
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START})
+	for index := 1; index < 100; index++ {
+		session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Data: []byte(fmt.Sprint(index))})
+	}
+
+	if len(session.events) > 12 {
+		t.Errorf("HandleEvent() kept %v events in memory, expected at most 12", len(session.events))
+	}
+	if session.EventCount() != 100 {
+		t.Errorf("EventCount() = %v, expected 100", session.EventCount())
+	}
+	events, first := session.eventsSince(0)
+	if first != 100 - len(events) || string(events[len(events)-1].Data) != "99" {
+		t.Errorf("eventsSince() returned events starting at %v, expected the tail", first)
+	}
+	events, first = session.eventsSince(98)
+	if first != 98 || len(events) != 2 {
+		t.Errorf("eventsSince(98) = %v events from %v, expected 2 from 98", len(events), first)
+	}
+	session.End()
+	if session.EventCount() != 101 {
+		t.Errorf("End() did not count the stop event: %v", session.EventCount())
+	}
+}
+
+func TestSessionEventBufferWithoutLog(t *testing.T) {
+	proxy := makeNewTestProxy()
+	proxy.EventBufferSize = 10
+	session := makeBufferTestSession(proxy, "unlogged")
+	for index := 0; index < 50; index++ {
+		session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE})
+	}
+	if len(session.events) != 50 {
+		t.Errorf("HandleEvent() dropped %v events that were never logged", 50 - len(session.events))
+	}
+}
+
+func TestReplayEncryptedEventsFrom(t *testing.T) {
+	privateFile, publicFile := writeTestRecordingKeys(t)
+	controller := makeNewController()
+	controller.RecordingIdentityFile = privateFile
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.SessionFolder = t.TempDir()
+	proxy.RecordingRecipientFile = publicFile
+	proxy.EventBufferSize = 4
+	controller.AddExistingProxy(proxy)
+
+	session := makeBufferTestSession(proxy, "encrypted")
+	session.initializeLog()
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START})
+	for index := 1; index < 20; index++ {
+		session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Data: []byte(fmt.Sprint(index))})
+	}
+
+	identity, err := proxy.loadRecordingIdentity()
+	if err != nil || identity == nil {
+		t.Fatalf("loadRecordingIdentity() = %v, %v, expected the controller's identity", identity, err)
+	}
+	replayed := 0
+	next, err := session.replayEventsFrom(identity, 0, func(index int, event *SessionEvent) error {
+		if index != replayed {
+			t.Errorf("replayEventsFrom() gave event %v, expected %v", index, replayed)
+		}
+		replayed++
+		return nil
+	}, func(count int, err error) {
+		t.Errorf("replayEventsFrom() could not read %v events from the recording: %s", count, err)
+	})
+	if err != nil || next != 20 || replayed != 20 {
+		t.Errorf("replayEventsFrom() replayed %v events up to %v, expected 20: %v", replayed, next, err)
+	}
+	session.End()
+}
+
+func TestWebServerRouteGetTrimmedSession(t *testing.T) {
+	controller := makeNewController()
+	controller.InitializeSocket()
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.SessionFolder = t.TempDir()
+	proxy.EventBufferSize = 4
+	controller.AddExistingProxy(proxy)
+
+	session := makeBufferTestSession(proxy, "trimmed")
+	session.initializeLog()
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START})
+	for index := 1; index < 20; index++ {
+		session.HandleEvent(&SessionEvent{Type: EVENT_MESSAGE, Data: []byte(fmt.Sprint(index))})
+	}
+
+	go controller.StartWebServer()
+	defer controller.StopWebServer()
+	time.Sleep(100* time.Millisecond)
+	connectURL := url.URL{Scheme: "ws", Host: controller.WebHost, Path: "/proxysocket/?id=0"}
+	conn, _, err := websocket.DefaultDialer.Dial(connectURL.String(), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to websocket: %s", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("get"))
+	conn.WriteMessage(websocket.TextMessage, []byte("trimmed"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for count := 0; count < 20; count++ {
+		_, reply, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Read from websocket failed after %v events: %s", count, err)
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("ack"))
+		event := &SessionEvent{}
+		json.Unmarshal(reply, event)
+		if count > 0 && string(event.Data) != fmt.Sprint(count) {
+			t.Fatalf("(server *proxyWebServer) playSession() sent event %s at position %v", event.Data, count)
+		}
+	}
+	session.active = false
+	session.signalSessionEnd()
+}
+
+func TestSessionEviction(t *testing.T) {
+	proxy := makeNewTestProxy()
+	proxy.SessionFolder = t.TempDir()
+	proxy.SessionEvictionSeconds = -1
+	session := makeBufferTestSession(proxy, "evicted")
+	session.initializeLog()
+	session.HandleEvent(&SessionEvent{Type: EVENT_SESSION_START})
+	session.End()
+
+	proxy.evictSession(session)
+	archived, ok := proxy.sessions.get("evicted")
+	if !ok || archived == session || !archived.archived {
+		t.Fatalf("evictSession() did not replace the session with its archived summary")
+	}
+	if len(archived.events) != 0 || archived.filename != session.filename {
+		t.Errorf("evictSession() built an unexpected archived session: %#v", archived)
+	}
+	if userSession, _ := proxy.sessions.getUserSession(session.user.GetKey(), "evicted"); userSession != archived {
+		t.Errorf("evictSession() did not update the user session list")
+	}
+
+	unlogged := makeBufferTestSession(proxy, "unlogged")
+	unlogged.End()
+	proxy.evictSession(unlogged)
+	if _, ok := proxy.sessions.get("unlogged"); ok {
+		t.Errorf("evictSession() kept a session with no recording")
+	}
+}
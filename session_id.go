@@ -0,0 +1,64 @@
+package sshproxyplus
+
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// the ssh.Permissions extension that carries the
+// session ID from the password callback to the
+// accept loop
+const SESSION_ID_EXTENSION	string = "sshproxyplus-session-id"
+
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+/*
+ newULID builds a ULID: a 48 bit millisecond
+ timestamp followed by 80 random bits, written
+ as 26 characters of Crockford base32. IDs
+ sort by the time they were made.
+*/
+func newULID(now time.Time) (string, error) {
+	var data [16]byte
+	ms := uint64(now.UnixMilli())
+	for index := 0; index < 6; index++ {
+		data[index] = byte(ms >> (8 * (5 - index)))
+	}
+	if _, err := rand.Read(data[6:]); err != nil {
+		return "", err
+	}
+	value := new(big.Int).SetBytes(data[:])
+	digit := new(big.Int)
+	mask := big.NewInt(31)
+	encoded := make([]byte, 26)
+	for index := len(encoded) - 1; index >= 0; index-- {
+		encoded[index] = ulidAlphabet[digit.And(value, mask).Int64()]
+		value.Rsh(value, 5)
+	}
+	return string(encoded), nil
+}
+
+/*
+ newSessionID gives a session an ID that is
+ unique across proxies and restarts: the ID
+ of the proxy in its controller and a ULID.
+*/
+func (proxy *ProxyContext) newSessionID() (string, error) {
+	ulid, err := newULID(time.Now())
+	if err != nil {
+		return "", err
+	}
+	proxy.mutex.Lock()
+	proxy_id := proxy.id
+	proxy.mutex.Unlock()
+	return fmt.Sprintf("p%v-%v", proxy_id, ulid), nil
+}
+
+func (proxy *ProxyContext) setID(id uint64) {
+	proxy.mutex.Lock()
+	proxy.id = id
+	proxy.mutex.Unlock()
+}
@@ -0,0 +1,83 @@
+package sshproxyplus
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func TestNewULID(t *testing.T) {
+	now := time.Now()
+	first, err := newULID(now)
+	if err != nil {
+		t.Fatalf("newULID() failed: %v", err)
+	}
+	if len(first) != 26 {
+		t.Errorf("newULID() = %v, expected 26 characters", first)
+	}
+	for _, char := range first {
+		if !strings.ContainsRune(ulidAlphabet, char) {
+			t.Errorf("newULID() = %v, which is not Crockford base32", first)
+		}
+	}
+	second, _ := newULID(now)
+	if first == second {
+		t.Errorf("newULID() returned %v twice", first)
+	}
+	if first[:10] != second[:10] {
+		t.Errorf("newULID() encoded the same time as %v and %v", first[:10], second[:10])
+	}
+	later, _ := newULID(now.Add(time.Second))
+	if later <= first {
+		t.Errorf("newULID() = %v, which does not sort after %v", later, first)
+	}
+}
+
+func TestProxyNewSessionID(t *testing.T) {
+	controller := makeNewController()
+	controller.AddExistingProxy(makeNewTestProxy())
+	proxy := makeNewTestProxy()
+	proxy_id := controller.AddExistingProxy(proxy)
+
+	seen := make(map[string]bool)
+	for count := 0; count < 1000; count++ {
+		id, err := proxy.newSessionID()
+		if err != nil {
+			t.Fatalf("newSessionID() failed: %v", err)
+		}
+		if !strings.HasPrefix(id, "p1-") || proxy_id != 1 {
+			t.Fatalf("newSessionID() = %v, expected the p1- prefix", id)
+		}
+		if seen[id] {
+			t.Fatalf("newSessionID() returned %v twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestSessionViewerAddressLookup(t *testing.T) {
+	proxy := makeNewTestProxy()
+	user := makeNewTestProxyUser()
+	proxy.AddProxyUser(user)
+	session := &SessionContext{
+		proxy: proxy,
+		sessionID: "p0-01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		address: "127.0.0.1:2222:127.0.0.1:40000",
+		user: user,
+	}
+	proxy.sessions.addPending(session.sessionID, session)
+	proxy.sessions.activate(session.sessionID)
+	proxy.AddSessionToUserList(session)
+
+	_, viewer := proxy.MakeSessionViewerForUser(user.Username, user.Password)
+	for _, key := range []string{session.sessionID, session.address} {
+		if found, ok := viewer.getSession(key); !ok || found != session {
+			t.Errorf("getSession(%v) did not find the session", key)
+		}
+	}
+	_, single := proxy.MakeSessionViewerForSession(user.Username, user.Password, session.address)
+	if sessions, keys := single.getSessions(); len(keys) != 1 || sessions[keys[0]] != session {
+		t.Errorf("getSessions() did not find the session of a viewer made with its address")
+	}
+}
@@ -0,0 +1,169 @@
+package sshproxyplus
+
+
+import (
+	"net"
+	"sort"
+)
+
+// what happens to a session over a limit
+const SESSION_LIMIT_REJECT				string = "reject"
+const SESSION_LIMIT_TERMINATE_OLDEST	string = "terminate-oldest"
+
+// the limits a session can run into
+const SESSION_LIMIT_USER		string = "user"
+const SESSION_LIMIT_CLIENT_IP	string = "client-ip"
+const SESSION_LIMIT_PROXY		string = "proxy"
+
+const SESSION_LIMIT_NOTICE		string = "This session was closed because too many sessions are open."
+
+/*
+ sessionLimit is one limit a new session is held
+ to: at most max admitted sessions that match.
+*/
+type sessionLimit struct {
+	scope	string
+	max		int
+	matches	func(*SessionContext) bool
+}
+
+// a limit exceeded by a new session, and the
+// sessions closed to make room for it
+type sessionLimitResult struct {
+	scope		string
+	max			int
+	rejected	bool
+	closed		[]*SessionContext
+}
+
+func clientIP(client_host string) string {
+	host, _, err := net.SplitHostPort(client_host)
+	if err != nil {
+		return client_host
+	}
+	return host
+}
+
+/*
+ sessionLimits lists the limits that apply to a
+ new session. The user's MaxSessions wins over
+ the proxy's MaxSessionsPerUser; zero or less
+ means no limit.
+*/
+func (session *SessionContext) sessionLimits() []sessionLimit {
+	proxy := session.proxy
+	proxy.mutex.Lock()
+	max_sessions, per_user, per_ip := proxy.MaxSessions, proxy.MaxSessionsPerUser, proxy.MaxSessionsPerClientIP
+	proxy.mutex.Unlock()
+	limits := make([]sessionLimit, 0, 3)
+	if session.user.MaxSessions != 0 {
+		per_user = session.user.MaxSessions
+	}
+	if per_user > 0 {
+		user_key := session.user.GetKey()
+		limits = append(limits, sessionLimit{SESSION_LIMIT_USER, per_user, func(other *SessionContext) bool {
+			return other.user.GetKey() == user_key
+		}})
+	}
+	if per_ip > 0 {
+		ip := clientIP(session.client_host)
+		limits = append(limits, sessionLimit{SESSION_LIMIT_CLIENT_IP, per_ip, func(other *SessionContext) bool {
+			return clientIP(other.client_host) == ip
+		}})
+	}
+	if max_sessions > 0 {
+		limits = append(limits, sessionLimit{SESSION_LIMIT_PROXY, max_sessions, func(other *SessionContext) bool {
+			return true
+		}})
+	}
+	return limits
+}
+
+/*
+ admit counts the live sessions that were
+ admitted before against the limits. Over a
+ limit, the session is either turned away or the
+ oldest sessions that count towards the limit
+ are picked to close. Checking and admitting
+ under one lock keeps two sessions from taking
+ the last place at the same time.
+*/
+func (registry *sessionRegistry) admit(session *SessionContext, limits []sessionLimit, terminate_oldest bool) *sessionLimitResult {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	var result *sessionLimitResult
+	closing := make(map[*SessionContext]bool)
+	for _, limit := range limits {
+		matching := make([]*SessionContext, 0)
+		for _, other := range registry.all {
+			if other != session && other.admitted && !closing[other] && other.isActive() && limit.matches(other) {
+				matching = append(matching, other)
+			}
+		}
+		if len(matching) < limit.max {
+			continue
+		}
+		if result == nil {
+			result = &sessionLimitResult{scope: limit.scope, max: limit.max}
+		}
+		if !terminate_oldest {
+			result.rejected = true
+			result.closed = nil
+			return result
+		}
+		sort.Slice(matching, func(i, j int) bool {
+			return matching[i].start_time.Before(matching[j].start_time)
+		})
+		for _, oldest := range matching[:len(matching) - limit.max + 1] {
+			closing[oldest] = true
+			result.closed = append(result.closed, oldest)
+		}
+	}
+	for other := range closing {
+		other.admitted = false
+	}
+	session.admitted = true
+	return result
+}
+
+/*
+ enforceLimits admits the session or, over a
+ limit, applies the proxy's SessionLimitPolicy.
+ It returns what was exceeded, or nil. Sessions
+ are admitted even without limits, so they count
+ once limits are set later.
+*/
+func (session *SessionContext) enforceLimits() *sessionLimitResult {
+	limits := session.sessionLimits()
+	session.proxy.mutex.Lock()
+	terminate_oldest := session.proxy.SessionLimitPolicy == SESSION_LIMIT_TERMINATE_OLDEST
+	session.proxy.mutex.Unlock()
+	result := session.proxy.sessions.admit(session, limits, terminate_oldest)
+	if result == nil {
+		return nil
+	}
+	if result.rejected {
+		session.proxy.Log.Printf("session %v rejected: %v limit of %v reached\n", session.GetID(), result.scope, result.max)
+		return result
+	}
+	for _, oldest := range result.closed {
+		session.proxy.Log.Printf("closing session %v to make room for %v\n", oldest.GetID(), session.GetID())
+		oldest.Terminate("session-limit", result.scope+" limit exceeded by "+session.GetID(), SESSION_LIMIT_NOTICE)
+	}
+	return result
+}
+
+func (result *sessionLimitResult) event() *SessionEvent {
+	event := &SessionEvent{
+		Type: EVENT_LIMIT_EXCEEDED,
+		Reason: result.scope,
+		Limit: result.max,
+	}
+	if result.rejected {
+		event.TerminatedBy = "session-limit"
+	}
+	for _, closed := range result.closed {
+		event.Sessions = append(event.Sessions, closed.GetID())
+	}
+	return event
+}
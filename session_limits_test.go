@@ -0,0 +1,139 @@
+package sshproxyplus
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+
+func startLimitedProxy(t *testing.T, serverPort string, policy string, user *ProxyUser) (*ProxyContext, string) {
+	signer, _ := GenerateSigner()
+	proxy := MakeNewProxy(signer)
+	proxy.ListenPort = int(newRandomPort().Int64())
+	proxy.SessionFolder = t.TempDir()
+	proxy.SessionLimitPolicy = policy
+	proxy.MaxSessions = 1
+	proxy.active = true
+	user.RemoteHost = "127.0.0.1:"+serverPort
+	user.RemoteUsername = "user"
+	user.RemotePassword = "password"
+	proxy.AddProxyUser(user)
+	go proxy.StartProxy()
+	time.Sleep(500*time.Millisecond)
+	return proxy, "127.0.0.1:"+strconv.Itoa(proxy.ListenPort)
+}
+
+func findLimitEvent(proxy *ProxyContext) *SessionEvent {
+	for _, session := range proxy.sessions.snapshot() {
+		if event := findSessionEvent(session, EVENT_LIMIT_EXCEEDED); event != nil {
+			return event
+		}
+	}
+	return nil
+}
+
+func TestSessionLimits(t *testing.T) {
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	proxy, host := startLimitedProxy(t, dummyServer.port.Text(10), SESSION_LIMIT_REJECT, &ProxyUser{
+		Username: "user",
+		Password: "password"})
+	defer proxy.Stop()
+	first, err := openTestShell(t, host, "user", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer first.close()
+	time.Sleep(300*time.Millisecond)
+	second, err := openTestShell(t, host, "user", "password")
+	if err == nil {
+		defer second.close()
+		if !second.waitClosed() {
+			t.Errorf("enforceLimits() did not reject a session over the proxy limit")
+		}
+	}
+	if event := findLimitEvent(proxy); event == nil || event.Reason != SESSION_LIMIT_PROXY || event.Limit != 1 || event.TerminatedBy == "" {
+		t.Errorf("enforceLimits() did not record the rejected session: %#v", event)
+	}
+	first.stdin.Write([]byte("still-open"))
+	if !waitForOutput(first.output, "still-open") {
+		t.Errorf("enforceLimits() closed the session that was already open")
+	}
+
+	oldest, host := startLimitedProxy(t, dummyServer.port.Text(10), SESSION_LIMIT_TERMINATE_OLDEST, &ProxyUser{
+		Username: "user",
+		Password: "password",
+		MaxSessions: 1})
+	defer oldest.Stop()
+	first, err = openTestShell(t, host, "user", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer first.close()
+	time.Sleep(300*time.Millisecond)
+	second, err = openTestShell(t, host, "user", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer second.close()
+	if !first.waitClosed() {
+		t.Errorf("enforceLimits() did not close the oldest session")
+	}
+	if !waitForOutput(first.output, SESSION_LIMIT_NOTICE) {
+		t.Errorf("enforceLimits() did not tell the user why their session closed; client got %q", first.output.String())
+	}
+	second.stdin.Write([]byte("newest-open"))
+	if !waitForOutput(second.output, "newest-open") {
+		t.Errorf("enforceLimits() did not forward the new session")
+	}
+	if event := findLimitEvent(oldest); event == nil || event.Reason != SESSION_LIMIT_USER || len(event.Sessions) != 1 {
+		t.Errorf("enforceLimits() did not record the session it closed: %#v", event)
+	}
+}
+
+func TestSessionLimitsSetAfterSessionsStarted(t *testing.T) {
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	proxy, host := startLimitedProxy(t, dummyServer.port.Text(10), SESSION_LIMIT_REJECT, &ProxyUser{
+		Username: "user",
+		Password: "password"})
+	defer proxy.Stop()
+	proxy.mutex.Lock()
+	proxy.MaxSessions = 0
+	proxy.mutex.Unlock()
+	first, err := openTestShell(t, host, "user", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer first.close()
+	time.Sleep(300*time.Millisecond)
+
+	proxy.mutex.Lock()
+	proxy.MaxSessions = 1
+	proxy.mutex.Unlock()
+	second, err := openTestShell(t, host, "user", "password")
+	if err == nil {
+		defer second.close()
+		if !second.waitClosed() {
+			t.Errorf("enforceLimits() did not count a session that started before the limit was set")
+		}
+	}
+	if event := findLimitEvent(proxy); event == nil || event.Reason != SESSION_LIMIT_PROXY {
+		t.Errorf("enforceLimits() did not record the rejected session: %#v", event)
+	}
+}
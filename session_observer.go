@@ -0,0 +1,267 @@
+package sshproxyplus
+
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// logging in as watch+<session key> with a viewer
+// secret or the ObserverKey as the password
+// watches that session; watch+<key>+rw also
+// types into it
+const SESSION_OBSERVER_PREFIX		string = "watch+"
+const SESSION_OBSERVER_WRITE_SUFFIX	string = "+rw"
+
+const OBSERVER_SESSION_EXTENSION	string = "sshproxyplus-observe"
+const OBSERVER_NAME_EXTENSION		string = "sshproxyplus-observer"
+const OBSERVER_WRITE_EXTENSION		string = "sshproxyplus-observer-write"
+
+// the observer name used with the ObserverKey
+const SESSION_OBSERVER_ADMIN		string = "admin"
+
+// keys that detach an observer: Ctrl-C, Ctrl-D
+// and q when read-only, Ctrl-] always
+const observerDetachKey				byte = 0x1d
+
+func isObserverLogin(username string) bool {
+	return strings.HasPrefix(username, SESSION_OBSERVER_PREFIX)
+}
+
+/*
+ authenticateObserver checks a watch+ login. The
+ password must be the secret of a viewer that
+ can see the session, or the ObserverKey of the
+ proxy. Writing needs a viewer with an Operator
+ or the ObserverKey.
+*/
+func (proxy *ProxyContext) authenticateObserver(username string, password string) (*ssh.Permissions, error) {
+	key := strings.TrimPrefix(username, SESSION_OBSERVER_PREFIX)
+	write := strings.HasSuffix(key, SESSION_OBSERVER_WRITE_SUFFIX)
+	key = strings.TrimSuffix(key, SESSION_OBSERVER_WRITE_SUFFIX)
+
+	var session *SessionContext
+	name := ""
+	proxy.mutex.Lock()
+	observer_key := proxy.ObserverKey
+	proxy.mutex.Unlock()
+	if observer_key != "" && subtle.ConstantTimeCompare([]byte(password), []byte(observer_key)) == 1 {
+		session, _ = proxy.sessions.get(key)
+		name = SESSION_OBSERVER_ADMIN
+	} else if viewer := proxy.GetSessionViewer(password); viewer != nil {
+		session, _ = viewer.getSession(key)
+		name = viewer.getOperator()
+		if name == "" {
+			if write {
+				return nil, errors.New("viewer may not take over sessions")
+			}
+			name = "viewer"
+		}
+	} else {
+		return nil, errors.New("not a valid viewer secret")
+	}
+	if session == nil {
+		return nil, errors.New("could not find session")
+	}
+	if !session.isActive() || session.archived {
+		return nil, errors.New("session is not active")
+	}
+	extensions := map[string]string{
+		OBSERVER_SESSION_EXTENSION: session.GetID(),
+		OBSERVER_NAME_EXTENSION: name,
+	}
+	if write {
+		extensions[OBSERVER_WRITE_EXTENSION] = "true"
+	}
+	return &ssh.Permissions{Extensions: extensions}, nil
+}
+
+/*
+ handleObserverConn serves an observer's
+ connection. Their first session channel shows
+ the watched session, history first; other
+ channels are rejected.
+*/
+func (proxy *ProxyContext) handleObserverConn(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+	defer conn.Close()
+	go ssh.DiscardRequests(requests)
+	extensions := conn.Permissions.Extensions
+	session, ok := proxy.sessions.get(extensions[OBSERVER_SESSION_EXTENSION])
+	if !ok {
+		return
+	}
+	for new_channel := range channels {
+		if new_channel.ChannelType() != "session" {
+			new_channel.Reject(ssh.UnknownChannelType, "observers only get a session channel")
+			continue
+		}
+		channel, channel_requests, err := new_channel.Accept()
+		if err != nil {
+			proxy.Log.Printf("error accept observer channel: %v\n", err)
+			return
+		}
+		go replyToObserverRequests(channel_requests)
+		observer := &sessionObserver{
+			session: session,
+			channel: channel,
+			name: extensions[OBSERVER_NAME_EXTENSION],
+			client_host: conn.RemoteAddr().String(),
+		}
+		observer.identity, err = proxy.loadRecordingIdentity()
+		if err != nil {
+			proxy.Log.Println("error loading the recording identity:", err)
+		}
+		err = observer.watch(extensions[OBSERVER_WRITE_EXTENSION] == "true")
+		if err != nil {
+			fmt.Fprintf(channel, "\r\n[%v]\r\n", err)
+		}
+		channel.Close()
+		return
+	}
+}
+
+// the observer's terminal is not used, but
+// clients expect pty and shell to succeed
+func replyToObserverRequests(requests <-chan *ssh.Request) {
+	for request := range requests {
+		switch request.Type {
+		case "pty-req", "shell", "window-change", "env":
+			request.Reply(true, nil)
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+type sessionObserver struct {
+	session		*SessionContext
+	channel		ssh.Channel
+	name		string
+	client_host	string
+	takeover	*sessionTakeover
+	// decrypts events read from the recording
+	identity	*RecordingIdentity
+}
+
+/*
+ watch replays the session so far and then
+ follows it until it ends or the observer
+ detaches.
+*/
+func (observer *sessionObserver) watch(write bool) error {
+	session := observer.session
+	if write {
+		takeover, err := session.StartTakeover(observer.name, false)
+		if err != nil {
+			return err
+		}
+		observer.takeover = takeover
+		defer takeover.Release()
+	}
+	session.HandleEvent(
+		&SessionEvent{
+			Type: EVENT_OBSERVER_JOIN,
+			Operator: observer.name,
+			ClientHost: observer.client_host,
+		})
+	defer func() {
+		if session.isActive() {
+			session.HandleEvent(
+				&SessionEvent{
+					Type: EVENT_OBSERVER_LEAVE,
+					Operator: observer.name,
+					ClientHost: observer.client_host,
+				})
+		}
+	}()
+	session.proxy.Log.Printf("observer %v from %v watching session %v\n", observer.name, observer.client_host, session.GetID())
+
+	signal := session.MakeNewSignal()
+	defer session.RemoveSignal(signal)
+	detached := make(chan struct{})
+	go observer.readInput(detached)
+
+	next, err := observer.sendEventsFrom(0)
+	if err != nil {
+		return err
+	}
+	if !session.isActive() {
+		return errors.New("session ended")
+	}
+	for {
+		select {
+		case <-detached:
+			return nil
+		case value := <-signal:
+			if next, err = observer.sendEventsFrom(next); err != nil {
+				return err
+			}
+			if value == SIGNAL_SESSION_END {
+				return errors.New("session ended")
+			}
+		}
+	}
+}
+
+/*
+ readInput reads the observer's keys. Read-only
+ observers can only detach; writers type into
+ the session and detach with Ctrl-].
+*/
+func (observer *sessionObserver) readInput(detached chan struct{}) {
+	defer close(detached)
+	buff := make([]byte, 256)
+	for {
+		bytes_read, err := observer.channel.Read(buff)
+		if err != nil {
+			return
+		}
+		data := buff[:bytes_read]
+		if observer.takeover == nil {
+			for _, key := range data {
+				if key == 0x03 || key == 0x04 || key == 'q' || key == observerDetachKey {
+					return
+				}
+			}
+			continue
+		}
+		if index := bytes.IndexByte(data, observerDetachKey); index >= 0 {
+			if index > 0 {
+				observer.takeover.Write(data[:index])
+			}
+			return
+		}
+		if _, err := observer.takeover.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+/*
+ sendEventsFrom writes the session's output
+ from event next onwards to the observer,
+ reading events that have left memory from the
+ recording. It returns the next event index.
+*/
+func (observer *sessionObserver) sendEventsFrom(next int) (int, error) {
+	session := observer.session
+	return session.replayEventsFrom(observer.identity, next, func(index int, event *SessionEvent) error {
+		return observer.sendEvent(event)
+	}, func(count int, err error) {
+		session.proxy.Log.Println("error reading session events from the recording:", err)
+		fmt.Fprintf(observer.channel, "\r\n[%v earlier events not shown]\r\n", count)
+	})
+}
+
+func (observer *sessionObserver) sendEvent(event *SessionEvent) error {
+	if event.Type != EVENT_MESSAGE || event.Direction != "incoming" {
+		return nil
+	}
+	_, err := observer.channel.Write(event.Data)
+	return err
+}
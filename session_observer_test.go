@@ -0,0 +1,170 @@
+package sshproxyplus
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+
+type testShell struct {
+	client	*ssh.Client
+	session	*ssh.Session
+	stdin	io.WriteCloser
+	output	*lockedBuffer
+}
+
+func openTestShell(t *testing.T, host string, user string, password string) (*testShell, error) {
+	client, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout: time.Second * 3,
+	})
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	shell := &testShell{client: client, session: session, output: &lockedBuffer{}}
+	session.Stdout = shell.output
+	shell.stdin, _ = session.StdinPipe()
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatalf("Error when requesting pty: %s", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Error when starting shell: %s", err)
+	}
+	return shell, nil
+}
+
+func (shell *testShell) close() {
+	shell.session.Close()
+	shell.client.Close()
+}
+
+func (shell *testShell) waitClosed() bool {
+	done := make(chan error, 1)
+	go func() {
+		done <- shell.session.Wait()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(3 * time.Second):
+		return false
+	}
+}
+
+func TestProxyObserver(t *testing.T) {
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	signer, _ := GenerateSigner()
+	proxy := MakeNewProxy(signer)
+	proxy.DefaultRemotePort = int(dummyServer.port.Int64())
+	proxy.ListenPort = int(newRandomPort().Int64())
+	proxy.SessionFolder = t.TempDir()
+	proxy.ObserverKey = "observer-key"
+	proxy.active = true
+	proxy.AddProxyUser(&ProxyUser{
+		Username: "user",
+		Password: "password",
+		RemoteHost: "127.0.0.1:"+dummyServer.port.Text(10),
+		RemoteUsername: "user",
+		RemotePassword: "password"})
+	go proxy.StartProxy()
+	defer proxy.Stop()
+	time.Sleep(500*time.Millisecond)
+	host := "127.0.0.1:"+strconv.Itoa(proxy.ListenPort)
+
+	user, err := openTestShell(t, host, "user", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer user.close()
+	io.WriteString(user.stdin, "before-join")
+	if !waitForOutput(user.output, "before-join") {
+		t.Fatalf("user did not get the echo from the server")
+	}
+	var session *SessionContext
+	for _, current := range proxy.sessions.snapshot() {
+		session = current
+	}
+	_, viewer := proxy.MakeSessionViewerForUser("user", "password")
+
+	if _, err := openTestShell(t, host, SESSION_OBSERVER_PREFIX+session.GetID(), "wrong"); err == nil {
+		t.Errorf("authenticateObserver() accepted a bad viewer secret")
+	}
+	if _, err := openTestShell(t, host, SESSION_OBSERVER_PREFIX+session.GetID()+SESSION_OBSERVER_WRITE_SUFFIX, viewer.Secret); err == nil {
+		t.Errorf("authenticateObserver() let a viewer without an operator write")
+	}
+
+	observer, err := openTestShell(t, host, SESSION_OBSERVER_PREFIX+session.GetID(), viewer.Secret)
+	if err != nil {
+		t.Fatalf("Error when joining as an observer: %s", err)
+	}
+	defer observer.close()
+	if !waitForOutput(observer.output, "before-join") {
+		t.Errorf("observer did not get the session history; got %q", observer.output.String())
+	}
+	io.WriteString(user.stdin, "after-join")
+	if !waitForOutput(observer.output, "after-join") {
+		t.Errorf("observer did not follow the session; got %q", observer.output.String())
+	}
+	io.WriteString(observer.stdin, "observer-typed")
+	time.Sleep(300*time.Millisecond)
+	if strings.Contains(user.output.String(), "observer-typed") {
+		t.Errorf("read-only observer input reached the session")
+	}
+	io.WriteString(observer.stdin, "q")
+	if !observer.waitClosed() {
+		t.Errorf("observer did not detach on q")
+	}
+
+	writer, err := openTestShell(t, host, SESSION_OBSERVER_PREFIX+session.address+SESSION_OBSERVER_WRITE_SUFFIX, proxy.ObserverKey)
+	if err != nil {
+		t.Fatalf("Error when joining with the observer key: %s", err)
+	}
+	defer writer.close()
+	io.WriteString(writer.stdin, "admin-typed")
+	if !waitForOutput(user.output, "admin-typed") {
+		t.Errorf("observer input did not reach the session; user got %q", user.output.String())
+	}
+	writer.stdin.Write([]byte{observerDetachKey})
+	if !writer.waitClosed() {
+		t.Errorf("observer did not detach on Ctrl-]")
+	}
+
+	time.Sleep(100*time.Millisecond)
+	joined := make([]string, 0)
+	session.event_mutex.Lock()
+	for _, event := range session.events {
+		entry := event.Type+":"+event.Operator
+		if event.Type != EVENT_OBSERVER_JOIN && event.Type != EVENT_OBSERVER_LEAVE && event.Type != EVENT_OPERATOR_INPUT {
+			continue
+		}
+		// input may arrive in more than one read
+		if len(joined) == 0 || joined[len(joined)-1] != entry {
+			joined = append(joined, entry)
+		}
+	}
+	session.event_mutex.Unlock()
+	expected := "observer-join:viewer observer-leave:viewer observer-join:admin operator-input:admin observer-leave:admin"
+	if strings.Join(joined, " ") != expected {
+		t.Errorf("watch() recorded %v, expected %v", joined, expected)
+	}
+}
@@ -0,0 +1,215 @@
+package sshproxyplus
+
+
+import (
+	"sync"
+)
+
+/*
+ sessionRegistry holds the sessions of a proxy,
+ by key and by user. It is shared by the accept
+ loop, the authentication callback, the
+ controller and the web server, so the maps are
+ only reached through its methods. Reads return
+ copies that stay valid after the lock is
+ released.
+
+ A session is pending while its client is
+ authenticating; it is only listed once the
+ handshake succeeds.
+
+ Sessions used to be keyed by their address
+ pair, with "_old" added when a port was
+ reused. Those keys are kept as aliases of the
+ session ID so existing URLs still work.
+*/
+type sessionRegistry struct {
+	mutex			sync.RWMutex
+	pending			map[string]*SessionContext
+	all				map[string]*SessionContext
+	by_user			map[string]map[string]*SessionContext
+	aliases			map[string]string
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		pending: map[string]*SessionContext{},
+		all: map[string]*SessionContext{},
+		by_user: map[string]map[string]*SessionContext{},
+		aliases: map[string]string{},
+	}
+}
+
+func (registry *sessionRegistry) addPending(key string, session *SessionContext) {
+	registry.mutex.Lock()
+	registry.pending[key] = session
+	registry.mutex.Unlock()
+}
+
+// removePendingAddress drops the pending sessions
+// of a connection whose handshake failed
+func (registry *sessionRegistry) removePendingAddress(address string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for key, session := range registry.pending {
+		if session.address == address {
+			delete(registry.pending, key)
+		}
+	}
+}
+
+// activate lists a pending session under its key
+func (registry *sessionRegistry) activate(key string) *SessionContext {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	session, ok := registry.pending[key]
+	if !ok {
+		return nil
+	}
+	delete(registry.pending, key)
+	registry.all[key] = session
+	registry.addAliasLocked(session.address, key)
+	return session
+}
+
+/*
+ addAlias points the address key of a session
+ at its ID. The session that held the address
+ before is kept as address_old.
+*/
+func (registry *sessionRegistry) addAlias(address string, key string) {
+	registry.mutex.Lock()
+	registry.addAliasLocked(address, key)
+	registry.mutex.Unlock()
+}
+
+func (registry *sessionRegistry) addAliasLocked(address string, key string) {
+	if address == "" || address == key {
+		return
+	}
+	if previous, ok := registry.aliases[address]; ok && previous != key {
+		registry.aliases[address+"_old"] = previous
+	}
+	registry.aliases[address] = key
+}
+
+// resolve turns an address key into the ID of
+// its session; other keys are returned as is
+func (registry *sessionRegistry) resolve(key string) string {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.resolveLocked(key)
+}
+
+func (registry *sessionRegistry) resolveLocked(key string) string {
+	if _, ok := registry.all[key]; ok {
+		return key
+	}
+	if id, ok := registry.aliases[key]; ok {
+		return id
+	}
+	return key
+}
+
+func (registry *sessionRegistry) add(key string, session *SessionContext) {
+	registry.mutex.Lock()
+	registry.all[key] = session
+	registry.mutex.Unlock()
+}
+
+// addIfAbsent adds the session unless the key
+// is taken, and reports whether it was added
+func (registry *sessionRegistry) addIfAbsent(key string, session *SessionContext) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, ok := registry.all[key]; ok {
+		return false
+	}
+	registry.all[key] = session
+	return true
+}
+
+func (registry *sessionRegistry) addToUser(user_key string, session *SessionContext) {
+	registry.mutex.Lock()
+	if _, ok := registry.by_user[user_key]; !ok {
+		registry.by_user[user_key] = make(map[string]*SessionContext)
+	}
+	registry.by_user[user_key][session.GetID()] = session
+	registry.mutex.Unlock()
+}
+
+func (registry *sessionRegistry) get(key string) (*SessionContext, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	session, ok := registry.all[registry.resolveLocked(key)]
+	return session, ok
+}
+
+func (registry *sessionRegistry) getUserSession(user_key string, key string) (*SessionContext, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	session, ok := registry.by_user[user_key][registry.resolveLocked(key)]
+	return session, ok
+}
+
+/*
+ remove drops the session from every list it
+ is in, along with the address aliases that
+ point at it, and returns the keys it was
+ under.
+*/
+func (registry *sessionRegistry) remove(session *SessionContext) []string {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	keys := make([]string, 0)
+	removed := make(map[string]bool)
+	for key, current := range registry.all {
+		if current == session {
+			delete(registry.all, key)
+			keys = append(keys, key)
+			removed[key] = true
+		}
+	}
+	for alias, key := range registry.aliases {
+		if removed[key] {
+			delete(registry.aliases, alias)
+		}
+	}
+	for _, sessions := range registry.by_user {
+		for key, current := range sessions {
+			if current == session {
+				delete(sessions, key)
+			}
+		}
+	}
+	return keys
+}
+
+// snapshot copies the sessions by key
+func (registry *sessionRegistry) snapshot() map[string]*SessionContext {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	sessions := make(map[string]*SessionContext, len(registry.all))
+	for key, session := range registry.all {
+		sessions[key] = session
+	}
+	return sessions
+}
+
+// userSnapshot copies the sessions of one user
+func (registry *sessionRegistry) userSnapshot(user_key string) (map[string]*SessionContext, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	user_sessions, ok := registry.by_user[user_key]
+	sessions := make(map[string]*SessionContext, len(user_sessions))
+	for key, session := range user_sessions {
+		sessions[key] = session
+	}
+	return sessions, ok
+}
+
+func (registry *sessionRegistry) len() int {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return len(registry.all)
+}
@@ -0,0 +1,91 @@
+package sshproxyplus
+
+import (
+	"testing"
+)
+
+
+func TestSessionRegistryActivate(t *testing.T) {
+	registry := newSessionRegistry()
+	first := &SessionContext{sessionID: "p0-first", address: "addr"}
+	registry.addPending("p0-first", first)
+	if _, ok := registry.get("p0-first"); ok {
+		t.Fatalf("get() found a session that is still pending")
+	}
+	if registry.activate("p0-first") != first {
+		t.Fatalf("activate() did not return the pending session")
+	}
+	if current, _ := registry.get("addr"); current != first {
+		t.Errorf("get() did not find the session by its address")
+	}
+
+	second := &SessionContext{sessionID: "p0-second", address: "addr"}
+	registry.addPending("p0-second", second)
+	registry.activate("p0-second")
+	if current, _ := registry.get("p0-first"); current != first {
+		t.Errorf("activate() replaced a session that reused the address")
+	}
+	if current, _ := registry.get("addr"); current != second {
+		t.Errorf("get() did not find the newest session by its address")
+	}
+	if old, _ := registry.get("addr_old"); old != first {
+		t.Errorf("activate() did not keep the earlier address as addr_old")
+	}
+	if registry.activate("missing") != nil {
+		t.Errorf("activate() returned a session that was never pending")
+	}
+
+	failed := &SessionContext{sessionID: "p0-failed", address: "other"}
+	registry.addPending("p0-failed", failed)
+	registry.removePendingAddress("other")
+	if registry.activate("p0-failed") != nil {
+		t.Errorf("removePendingAddress() kept the pending session")
+	}
+}
+
+func TestSessionRegistryRemove(t *testing.T) {
+	registry := newSessionRegistry()
+	session := &SessionContext{sessionID: "key"}
+	registry.add("key", session)
+	registry.addToUser("test:", session)
+
+	snapshot := registry.snapshot()
+	keys := registry.remove(session)
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("remove() = %v, expected [key]", keys)
+	}
+	if registry.len() != 0 {
+		t.Errorf("remove() left %v sessions", registry.len())
+	}
+	if _, ok := registry.getUserSession("test:", "key"); ok {
+		t.Errorf("remove() left the session in the user list")
+	}
+	if len(snapshot) != 1 {
+		t.Errorf("remove() changed an earlier snapshot")
+	}
+	if registry.addIfAbsent("key", session) != true || registry.addIfAbsent("key", session) != false {
+		t.Errorf("addIfAbsent() did not report whether the key was taken")
+	}
+}
+
+func TestSessionRegistryRemoveAliases(t *testing.T) {
+	registry := newSessionRegistry()
+	first := &SessionContext{sessionID: "p0-first", address: "addr"}
+	second := &SessionContext{sessionID: "p0-second", address: "addr"}
+	registry.addPending("p0-first", first)
+	registry.activate("p0-first")
+	registry.addPending("p0-second", second)
+	registry.activate("p0-second")
+
+	registry.remove(first)
+	if _, ok := registry.get("addr_old"); ok {
+		t.Errorf("remove() left an alias to the removed session")
+	}
+	if current, _ := registry.get("addr"); current != second {
+		t.Errorf("remove() dropped the alias of another session")
+	}
+	registry.remove(second)
+	if len(registry.aliases) != 0 {
+		t.Errorf("remove() left aliases: %v", registry.aliases)
+	}
+}
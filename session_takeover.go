@@ -0,0 +1,220 @@
+package sshproxyplus
+
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+const SESSION_TAKEOVER_SHARED		string = "shared"
+const SESSION_TAKEOVER_EXCLUSIVE	string = "exclusive"
+const SESSION_TAKEOVER_RELEASE		string = "takeover-release"
+
+/*
+ A clientChannel is a session channel the
+ client opened, along with the channel to the
+ server it is forwarded to. While an operator
+ holds the channel their input is sent
+ upstream too, and with locked set the
+ client's own input is dropped.
+*/
+type clientChannel struct {
+	client		ssh.Channel
+	upstream	ssh.Channel
+	tty			bool
+	operator	string
+	locked		bool
+}
+
+/*
+ A sessionTakeover lets an operator type into
+ the tty of a live session. Only one operator
+ can hold a channel at a time.
+*/
+type sessionTakeover struct {
+	session		*SessionContext
+	channel_id	int
+	operator	string
+}
+
+func (session *SessionContext) markClientChannelTTY(channel_id int) {
+	session.mutex.Lock()
+	if channel, ok := session.client_channels[channel_id]; ok {
+		channel.tty = true
+	}
+	session.mutex.Unlock()
+}
+
+// clientInputLocked reports whether an operator
+// has locked out the client on the channel
+func (session *SessionContext) clientInputLocked(channel_id int) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if channel, ok := session.client_channels[channel_id]; ok {
+		return channel.locked
+	}
+	return false
+}
+
+/*
+ StartTakeover gives the operator write access
+ to the newest tty channel of the session. With
+ exclusive set the user's own keystrokes are
+ dropped until the takeover is released.
+*/
+func (session *SessionContext) StartTakeover(operator string, exclusive bool) (*sessionTakeover, error) {
+	if operator == "" {
+		return nil, errors.New("no operator provided")
+	}
+	if !session.isActive() || session.archived {
+		return nil, newKindError(ErrConflict, "session is not active")
+	}
+	session.mutex.Lock()
+	channel_id := -1
+	for id, channel := range session.client_channels {
+		if channel.tty && id > channel_id {
+			channel_id = id
+		}
+	}
+	if channel_id < 0 {
+		session.mutex.Unlock()
+		return nil, errors.New("session has no tty channel")
+	}
+	channel := session.client_channels[channel_id]
+	if channel.operator != "" {
+		session.mutex.Unlock()
+		return nil, newKindError(ErrConflict, "session is already taken over by %v", channel.operator)
+	}
+	channel.operator = operator
+	channel.locked = exclusive
+	session.mutex.Unlock()
+
+	session.HandleEvent(
+		&SessionEvent{
+			Type: EVENT_TAKEOVER_START,
+			Operator: operator,
+			Exclusive: exclusive,
+			ChannelID: channel_id,
+		})
+	return &sessionTakeover{session: session, channel_id: channel_id, operator: operator}, nil
+}
+
+/*
+ Write sends operator keystrokes to the server.
+ They are logged as operator-input events so
+ they can be told apart from the user's.
+*/
+func (takeover *sessionTakeover) Write(data []byte) (int, error) {
+	session := takeover.session
+	session.mutex.Lock()
+	channel, ok := session.client_channels[takeover.channel_id]
+	held := ok && channel.operator == takeover.operator
+	session.mutex.Unlock()
+	if !held {
+		return 0, errors.New("takeover has ended")
+	}
+	bytes_written, err := channel.upstream.Write(data)
+	if err != nil {
+		return bytes_written, err
+	}
+	session.markActivity()
+	data_copy := make([]byte, len(data))
+	copy(data_copy, data)
+	redacted := session.redactChannelData(data_copy, "outgoing", takeover.channel_id)
+	session.HandleEvent(
+		&SessionEvent{
+			Type: EVENT_OPERATOR_INPUT,
+			Direction: "outgoing",
+			ChannelType: "stdout",
+			Size: len(redacted),
+			Data: redacted,
+			ChannelID: takeover.channel_id,
+			Operator: takeover.operator,
+		})
+	return bytes_written, nil
+}
+
+// Release hands the channel back to the user
+func (takeover *sessionTakeover) Release() {
+	session := takeover.session
+	session.mutex.Lock()
+	channel, ok := session.client_channels[takeover.channel_id]
+	released := ok && channel.operator == takeover.operator
+	if released {
+		channel.operator = ""
+		channel.locked = false
+	}
+	session.mutex.Unlock()
+	if released && session.isActive() {
+		session.HandleEvent(
+			&SessionEvent{
+				Type: EVENT_TAKEOVER_STOP,
+				Operator: takeover.operator,
+				ChannelID: takeover.channel_id,
+			})
+	}
+}
+
+/*
+ sessionViewerSocketTakeover handles the
+ viewer-takeover command. After the viewer
+ secret, the session key and the mode (shared
+ or exclusive), every message is typed into
+ the session until takeover-release is sent
+ or the socket closes.
+*/
+func (server *proxyWebServer) sessionViewerSocketTakeover(conn *websocket.Conn) {
+	_, viewerKey, err := conn.ReadMessage()
+	if err != nil {
+		log.Println("Error during message reading:", err)
+		return
+	}
+	_, sessionKey, err := conn.ReadMessage()
+	if err != nil {
+		log.Println("Error during message reading:", err)
+		return
+	}
+	_, mode, err := conn.ReadMessage()
+	if err != nil {
+		log.Println("Error during message reading:", err)
+		return
+	}
+	viewer := server.proxy.GetSessionViewer(string(viewerKey))
+	if viewer == nil || viewer.getOperator() == "" {
+		conn.WriteMessage(websocket.TextMessage,[]byte("viewer may not take over sessions"))
+		return
+	}
+	operator := viewer.getOperator()
+	session, ok := viewer.getSession(string(sessionKey))
+	if !ok {
+		conn.WriteMessage(websocket.TextMessage,[]byte("could not find session"))
+		return
+	}
+	takeover, err := session.StartTakeover(operator, string(mode) == SESSION_TAKEOVER_EXCLUSIVE)
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage,[]byte(err.Error()))
+		return
+	}
+	defer takeover.Release()
+	server.proxy.Log.Printf("operator %v took over session %v\n", operator, session.GetID())
+	conn.WriteMessage(websocket.TextMessage,[]byte("takeover-started"))
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Println("Error during message reading:", err)
+			return
+		}
+		if string(data) == SESSION_TAKEOVER_RELEASE {
+			conn.WriteMessage(websocket.TextMessage,[]byte("takeover-released"))
+			return
+		}
+		if _, err := takeover.Write(data); err != nil {
+			conn.WriteMessage(websocket.TextMessage,[]byte("takeover-ended"))
+			return
+		}
+	}
+}
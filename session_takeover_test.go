@@ -0,0 +1,184 @@
+package sshproxyplus
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+
+func waitForOutput(output *lockedBuffer, text string) bool {
+	for count := 0; count < 30; count++ {
+		if strings.Contains(output.String(), text) {
+			return true
+		}
+		time.Sleep(100*time.Millisecond)
+	}
+	return false
+}
+
+func startTakeover(t *testing.T, host string, secret string, sessionKey string, mode string) (*websocket.Conn, string) {
+	connectURL := url.URL{Scheme: "ws", Host: host, Path: "/proxysocket/?id=0"}
+	conn, _, err := websocket.DefaultDialer.Dial(connectURL.String(), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to websocket: %s", err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("viewer-takeover"))
+	conn.WriteMessage(websocket.TextMessage, []byte(secret))
+	conn.WriteMessage(websocket.TextMessage, []byte(sessionKey))
+	conn.WriteMessage(websocket.TextMessage, []byte(mode))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, reply, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read from websocket failed: %s", err)
+	}
+	return conn, string(reply)
+}
+
+func TestWebServerRouteViewerTakeover(t *testing.T) {
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	controller := makeNewController()
+	controller.InitializeSocket()
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.ListenPort = int(newRandomPort().Int64())
+	proxy.SessionFolder = t.TempDir()
+	proxy.active = true
+	proxyID := controller.AddExistingProxy(proxy)
+	proxy.AddProxyUser(&ProxyUser{
+		Username: "user",
+		Password: "password",
+		RemoteHost: "127.0.0.1:"+dummyServer.port.Text(10),
+		RemoteUsername: "user",
+		RemotePassword: "password"})
+	go proxy.StartProxy()
+	defer proxy.Stop()
+	go controller.StartWebServer()
+	defer controller.StopWebServer()
+	time.Sleep(500*time.Millisecond)
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxy.ListenPort), &ssh.ClientConfig{
+		User: "user",
+		Auth: []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout: time.Second * 3,
+	})
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer client.Close()
+	clientSession, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Error when opening session: %s", err)
+	}
+	var output lockedBuffer
+	clientSession.Stdout = &output
+	stdin, _ := clientSession.StdinPipe()
+	if err := clientSession.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatalf("Error when requesting pty: %s", err)
+	}
+	if err := clientSession.Shell(); err != nil {
+		t.Fatalf("Error when starting shell: %s", err)
+	}
+	time.Sleep(300*time.Millisecond)
+	var session *SessionContext
+	for _, current := range proxy.sessions.snapshot() {
+		session = current
+	}
+	if session == nil {
+		t.Fatalf("Proxy did not store the session")
+	}
+
+	reply := simulateMessage(&ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_NEW_PROXY_VIEWER,
+		ProxyID: proxyID,
+		Username: "user",
+		Password: "password",
+		Operator: "alice",
+	}, controller, t)
+	viewerData, _ := base64.StdEncoding.DecodeString(reply["Viewer"].(string))
+	var viewer proxySessionViewer
+	json.Unmarshal(viewerData, &viewer)
+	if viewer.Operator != "alice" {
+		t.Fatalf("*ControllerMessage handleMessage() did not make an operator viewer: %s", viewerData)
+	}
+	_, watcher := proxy.MakeSessionViewerForUser("user", "password")
+
+	server := &proxyWebServer{proxy: proxy}
+	if listed := server.getUserSessionInfo(proxy.GetSessionViewer(viewer.Secret)); len(listed) != 1 || !listed[0].Operator {
+		t.Errorf("getUserSessionInfo() = %+v, expected the session marked for the operator viewer", listed)
+	}
+	if listed := server.getUserSessionInfo(watcher); len(listed) != 1 || listed[0].Operator {
+		t.Errorf("getUserSessionInfo() = %+v, expected no operator controls for a plain viewer", listed)
+	}
+
+	conn, result := startTakeover(t, controller.WebHost, watcher.Secret, session.GetID(), SESSION_TAKEOVER_SHARED)
+	conn.Close()
+	if result != "viewer may not take over sessions" {
+		t.Errorf("sessionViewerSocketTakeover() let a viewer without an operator take over: %v", result)
+	}
+
+	conn, result = startTakeover(t, controller.WebHost, viewer.Secret, session.address, SESSION_TAKEOVER_EXCLUSIVE)
+	defer conn.Close()
+	if result != "takeover-started" {
+		t.Fatalf("sessionViewerSocketTakeover() = %v, expected takeover-started", result)
+	}
+	other, second := startTakeover(t, controller.WebHost, viewer.Secret, session.GetID(), SESSION_TAKEOVER_SHARED)
+	other.Close()
+	if !strings.Contains(second, "already taken over by alice") {
+		t.Errorf("sessionViewerSocketTakeover() let two operators take over: %v", second)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("operator-typed"))
+	if !waitForOutput(&output, "operator-typed") {
+		t.Errorf("operator input did not reach the server; client got %q", output.String())
+	}
+	io.WriteString(stdin, "user-blocked")
+	time.Sleep(300*time.Millisecond)
+	if strings.Contains(output.String(), "user-blocked") {
+		t.Errorf("exclusive takeover did not block the user's input")
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(SESSION_TAKEOVER_RELEASE))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, released, _ := conn.ReadMessage(); string(released) != "takeover-released" {
+		t.Errorf("sessionViewerSocketTakeover() did not release the session: %s", released)
+	}
+	io.WriteString(stdin, "user-typed")
+	if !waitForOutput(&output, "user-typed") {
+		t.Errorf("user input was still blocked after the takeover was released")
+	}
+
+	types := make(map[string]*SessionEvent)
+	session.event_mutex.Lock()
+	for _, event := range session.events {
+		if _, ok := types[event.Type]; !ok {
+			types[event.Type] = event
+		}
+	}
+	session.event_mutex.Unlock()
+	if start := types[EVENT_TAKEOVER_START]; start == nil || start.Operator != "alice" || !start.Exclusive {
+		t.Errorf("StartTakeover() did not record the operator taking over: %#v", start)
+	}
+	if input := types[EVENT_OPERATOR_INPUT]; input == nil || input.Operator != "alice" || string(input.Data) != "operator-typed" {
+		t.Errorf("Write() did not record the operator input: %#v", input)
+	}
+	if stop := types[EVENT_TAKEOVER_STOP]; stop == nil || stop.Operator != "alice" {
+		t.Errorf("Release() did not record the end of the takeover: %#v", stop)
+	}
+}
@@ -0,0 +1,99 @@
+package sshproxyplus
+
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ Terminate ends a live session from outside:
+ the notice, if any, is written to the user's
+ terminal, a session-terminated event records
+ who ended the session and why, and then the
+ client and upstream connections are closed.
+*/
+func (session *SessionContext) Terminate(terminatedBy string, reason string, notice string) error {
+	if !session.isActive() {
+		return newKindError(ErrConflict, "session is not active")
+	}
+	session.HandleEvent(
+		&SessionEvent{
+			Type: EVENT_SESSION_TERMINATED,
+			TerminatedBy: terminatedBy,
+			Reason: reason,
+		})
+	if notice != "" {
+		session.sendNotice(notice)
+	}
+	session.closeConnections()
+	return nil
+}
+
+// closeConnections closes the client and upstream
+// connections and ends the session
+func (session *SessionContext) closeConnections() {
+	session.mutex.Lock()
+	client_conn := session.client_conn
+	remote_conn := session.remote_conn
+	session.mutex.Unlock()
+	if client_conn != nil {
+		client_conn.Close()
+	}
+	if remote_conn != nil {
+		(*remote_conn).Close()
+	}
+	session.End()
+}
+
+// sendNotice writes a message to every session
+// channel the client opened
+func (session *SessionContext) sendNotice(notice string) {
+	notice = "\r\n" + strings.ReplaceAll(strings.TrimRight(notice, "\r\n"), "\n", "\r\n") + "\r\n"
+	session.mutex.Lock()
+	channels := make([]ssh.Channel, 0, len(session.client_channels))
+	for _, channel := range session.client_channels {
+		channels = append(channels, channel.client)
+	}
+	session.mutex.Unlock()
+	for _, channel := range channels {
+		if _, err := channel.Write([]byte(notice)); err != nil {
+			session.proxy.Log.Printf("unable to send notice to client: %v\n", err)
+		}
+	}
+}
+
+// trackClientChannel remembers a session channel
+// the client opened so a notice or an operator
+// can reach it
+func (session *SessionContext) trackClientChannel(dest_conn ssh.Conn, channel_type string, channel_id int, client ssh.Channel, upstream ssh.Channel) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if channel_type != "session" || dest_conn == session.client_conn {
+		return
+	}
+	if session.client_channels == nil {
+		session.client_channels = make(map[int]*clientChannel)
+	}
+	session.client_channels[channel_id] = &clientChannel{client: client, upstream: upstream}
+}
+
+func (session *SessionContext) untrackClientChannel(channel_id int) {
+	session.mutex.Lock()
+	delete(session.client_channels, channel_id)
+	session.mutex.Unlock()
+}
+
+/*
+ TerminateSession ends a live session of the
+ proxy, looked up by its ID or address key.
+*/
+func (proxy *ProxyContext) TerminateSession(sessionKey string, terminatedBy string, reason string, notice string) error {
+	session, ok := proxy.sessions.get(sessionKey)
+	if !ok {
+		return newKindError(ErrNotFound, "could not find session")
+	}
+	proxy.Log.Printf("terminating session %v for %v: %v\n", session.GetID(), terminatedBy, reason)
+	return session.Terminate(terminatedBy, reason, notice)
+}
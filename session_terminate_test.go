@@ -0,0 +1,115 @@
+package sshproxyplus
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+
+func TestMessageKillSession(t *testing.T) {
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	controller := makeNewController()
+	proxy := MakeNewProxy(controller.DefaultSigner)
+	proxy.DefaultRemotePort = int(dummyServer.port.Int64())
+	proxy.ListenPort = int(newRandomPort().Int64())
+	proxy.SessionFolder = t.TempDir()
+	proxy.active = true
+	proxyID := controller.AddExistingProxy(proxy)
+	go proxy.StartProxy()
+	defer proxy.Stop()
+	time.Sleep(500*time.Millisecond)
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxy.ListenPort), &ssh.ClientConfig{
+		User: "user",
+		Auth: []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout: time.Second * 3,
+	})
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer client.Close()
+	clientSession, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Error when opening session: %s", err)
+	}
+	var output lockedBuffer
+	clientSession.Stdout = &output
+	stdin, _ := clientSession.StdinPipe()
+	if err := clientSession.Shell(); err != nil {
+		t.Fatalf("Error when starting shell: %s", err)
+	}
+	stdin.Write([]byte("hello"))
+	time.Sleep(500*time.Millisecond)
+
+	sessions := proxy.sessions.snapshot()
+	if len(sessions) != 1 {
+		t.Fatalf("Proxy stored %v sessions, expected 1", len(sessions))
+	}
+	var session *SessionContext
+	for _, current := range sessions {
+		session = current
+	}
+
+	message := &ControllerMessage{
+		MessageType: CONTROLLER_MESSAGE_KILL_SESSION,
+		ProxyID: proxyID,
+		SessionKey: session.address,
+		Reason: "policy violation",
+		Notice: "Your session was ended by an administrator.",
+	}
+	reply := simulateMessage(message, controller, t)
+	if reply["Error"] != nil {
+		t.Fatalf("*ControllerMessage handleMessage() returned an error: %v", reply["Error"])
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- clientSession.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("TerminateSession() did not close the client connection")
+	}
+	if !strings.Contains(output.String(), message.Notice) {
+		t.Errorf("TerminateSession() did not send the notice; client got %q", output.String())
+	}
+	if session.isActive() {
+		t.Errorf("TerminateSession() left the session active")
+	}
+
+	found := false
+	session.event_mutex.Lock()
+	for _, event := range session.events {
+		if event.Type == EVENT_SESSION_TERMINATED {
+			found = event.TerminatedBy == "controller" && event.Reason == message.Reason
+		}
+	}
+	session.event_mutex.Unlock()
+	if !found {
+		t.Errorf("TerminateSession() did not record who ended the session and why")
+	}
+
+	reply = simulateMessage(message, controller, t)
+	if reply["Error"] == nil {
+		t.Errorf("*ControllerMessage handleMessage() did not return an error for an ended session")
+	}
+	message.SessionKey = "missing"
+	reply = simulateMessage(message, controller, t)
+	if reply["Error"] == nil {
+		t.Errorf("*ControllerMessage handleMessage() did not return an error for an unknown session")
+	}
+}
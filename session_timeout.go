@@ -0,0 +1,143 @@
+package sshproxyplus
+
+
+import (
+	"time"
+)
+
+const SESSION_TIMEOUT_WARNING_DEFAULT	int64 = 60
+
+const SESSION_IDLE_WARNING		string = "This session has been idle and will be disconnected soon."
+const SESSION_MAX_WARNING		string = "This session has reached its time limit and will be disconnected soon."
+
+const SESSION_TIMEOUT_IDLE		string = "idle"
+const SESSION_TIMEOUT_MAX		string = "max-duration"
+
+// how often enforceTimeouts checks the session
+var sessionTimeoutInterval = time.Second
+
+func (session *SessionContext) markActivity() {
+	session.last_activity.Store(time.Now().UnixNano())
+}
+
+func (session *SessionContext) lastActivity() time.Time {
+	return time.Unix(0, session.last_activity.Load())
+}
+
+/*
+ the user's timeout wins over the proxy's when it
+ is set; zero or less means no timeout
+*/
+func chooseTimeout(user_seconds int64, proxy_seconds int64) time.Duration {
+	seconds := proxy_seconds
+	if user_seconds != 0 {
+		seconds = user_seconds
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// the proxy's timeout settings are read under
+// its mutex since a config reload can change them
+// while sessions are running
+func (session *SessionContext) idleTimeout() time.Duration {
+	session.proxy.mutex.Lock()
+	defer session.proxy.mutex.Unlock()
+	return chooseTimeout(session.user.IdleTimeoutSeconds, session.proxy.IdleTimeoutSeconds)
+}
+
+func (session *SessionContext) maxDuration() time.Duration {
+	session.proxy.mutex.Lock()
+	defer session.proxy.mutex.Unlock()
+	return chooseTimeout(session.user.MaxSessionSeconds, session.proxy.MaxSessionSeconds)
+}
+
+func (session *SessionContext) timeoutWarning() time.Duration {
+	session.proxy.mutex.Lock()
+	warning_seconds := session.proxy.TimeoutWarningSeconds
+	session.proxy.mutex.Unlock()
+	if warning_seconds == 0 {
+		return time.Duration(SESSION_TIMEOUT_WARNING_DEFAULT) * time.Second
+	}
+	if warning_seconds < 0 {
+		return 0
+	}
+	return time.Duration(warning_seconds) * time.Second
+}
+
+func (session *SessionContext) timeoutMessage(kind string) string {
+	session.proxy.mutex.Lock()
+	defer session.proxy.mutex.Unlock()
+	if kind == SESSION_TIMEOUT_IDLE {
+		if session.proxy.IdleWarningMessage != "" {
+			return session.proxy.IdleWarningMessage
+		}
+		return SESSION_IDLE_WARNING
+	}
+	if session.proxy.MaxSessionWarningMessage != "" {
+		return session.proxy.MaxSessionWarningMessage
+	}
+	return SESSION_MAX_WARNING
+}
+
+/*
+ enforceTimeouts closes the session once it has
+ been idle, with no input from the client or an
+ operator, for the idle timeout, or once it has been forwarded
+ for the max duration. The client is warned
+ TimeoutWarningSeconds beforehand; a negative
+ TimeoutWarningSeconds turns the warning off.
+*/
+func (session *SessionContext) enforceTimeouts() {
+	idle := session.idleTimeout()
+	max_duration := session.maxDuration()
+	if idle == 0 && max_duration == 0 {
+		return
+	}
+	warning := session.timeoutWarning()
+	started := time.Now()
+	session.markActivity()
+	idle_warned, max_warned := false, false
+
+	ticker := time.NewTicker(sessionTimeoutInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !session.isActive() {
+			return
+		}
+		now := time.Now()
+		idle_for := now.Sub(session.lastActivity())
+		if idle > 0 && idle_for < idle - warning {
+			idle_warned = false
+		}
+		switch {
+		case max_duration > 0 && now.Sub(started) >= max_duration:
+			session.timeOut(SESSION_TIMEOUT_MAX, max_duration)
+			return
+		case idle > 0 && idle_for >= idle:
+			session.timeOut(SESSION_TIMEOUT_IDLE, idle)
+			return
+		case max_duration > 0 && warning > 0 && !max_warned && now.Sub(started) >= max_duration - warning:
+			max_warned = true
+			session.sendNotice(session.timeoutMessage(SESSION_TIMEOUT_MAX))
+		case idle > 0 && warning > 0 && !idle_warned && idle_for >= idle - warning:
+			idle_warned = true
+			session.sendNotice(session.timeoutMessage(SESSION_TIMEOUT_IDLE))
+		}
+	}
+}
+
+// timeOut records why the session timed out and
+// closes it
+func (session *SessionContext) timeOut(kind string, timeout time.Duration) {
+	session.HandleEvent(
+		&SessionEvent{
+			Type: EVENT_SESSION_TIMEOUT,
+			Reason: kind,
+			Timeout: int64(timeout.Seconds()),
+		})
+	session.proxy.Log.Printf("session %v timed out: %v after %v\n", session.GetID(), kind, timeout)
+	session.closeConnections()
+}
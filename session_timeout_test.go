@@ -0,0 +1,140 @@
+package sshproxyplus
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+
+func TestSessionTimeouts(t *testing.T) {
+	interval := sessionTimeoutInterval
+	sessionTimeoutInterval = 100*time.Millisecond
+	defer func() {
+		sessionTimeoutInterval = interval
+	}()
+
+	dummyServer := testSSHServer{
+		port: newRandomPort(),
+		t: t,
+		active: true,
+	}
+	go dummyServer.listen()
+	time.Sleep(500*time.Millisecond)
+	defer dummyServer.stop()
+
+	signer, _ := GenerateSigner()
+	proxy := MakeNewProxy(signer)
+	proxy.ListenPort = int(newRandomPort().Int64())
+	proxy.SessionFolder = t.TempDir()
+	proxy.IdleTimeoutSeconds = 2
+	proxy.TimeoutWarningSeconds = 1
+	proxy.IdleWarningMessage = "idle-warning"
+	proxy.active = true
+	proxy.AddProxyUser(&ProxyUser{
+		Username: "user",
+		Password: "password",
+		RemoteHost: "127.0.0.1:"+dummyServer.port.Text(10),
+		RemoteUsername: "user",
+		RemotePassword: "password"})
+	proxy.AddProxyUser(&ProxyUser{
+		Username: "limited",
+		Password: "password",
+		RemoteHost: "127.0.0.1:"+dummyServer.port.Text(10),
+		RemoteUsername: "user",
+		RemotePassword: "password",
+		IdleTimeoutSeconds: -1,
+		MaxSessionSeconds: 2})
+	go proxy.StartProxy()
+	defer proxy.Stop()
+	time.Sleep(500*time.Millisecond)
+	host := "127.0.0.1:"+strconv.Itoa(proxy.ListenPort)
+
+	idle, err := openTestShell(t, host, "user", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer idle.close()
+	for count := 0; count < 4; count++ {
+		time.Sleep(600*time.Millisecond)
+		io.WriteString(idle.stdin, "typing")
+	}
+	if !waitForOutput(idle.output, "typing") {
+		t.Fatalf("session was not forwarded; client got %q", idle.output.String())
+	}
+	if !idle.waitClosed() {
+		t.Errorf("enforceTimeouts() did not close an idle session")
+	}
+	if !waitForOutput(idle.output, "idle-warning") {
+		t.Errorf("enforceTimeouts() did not warn before closing an idle session; client got %q", idle.output.String())
+	}
+
+	limited, err := openTestShell(t, host, "limited", "password")
+	if err != nil {
+		t.Fatalf("Error when connecting to proxy: %s", err)
+	}
+	defer limited.close()
+	started := time.Now()
+	closed := make(chan bool, 1)
+	go func() {
+		closed <- limited.waitClosed()
+	}()
+	go func() {
+		for time.Since(started) < 4*time.Second {
+			if _, err := io.WriteString(limited.stdin, "busy"); err != nil {
+				return
+			}
+			time.Sleep(200*time.Millisecond)
+		}
+	}()
+	if !<-closed {
+		t.Errorf("enforceTimeouts() did not close a session past its max duration")
+	}
+	if !waitForOutput(limited.output, SESSION_MAX_WARNING) {
+		t.Errorf("enforceTimeouts() did not warn before the max duration; client got %q", limited.output.String())
+	}
+
+	reasons := make(map[string]*SessionEvent)
+	for _, session := range proxy.sessions.snapshot() {
+		if event := findSessionEvent(session, EVENT_SESSION_TIMEOUT); event != nil {
+			reasons[event.Reason] = event
+		}
+	}
+	if event := reasons[SESSION_TIMEOUT_IDLE]; event == nil || event.Timeout != 2 {
+		t.Errorf("enforceTimeouts() did not record the idle timeout: %#v", event)
+	}
+	if event := reasons[SESSION_TIMEOUT_MAX]; event == nil || event.Timeout != 2 {
+		t.Errorf("enforceTimeouts() did not record the max duration: %#v", event)
+	}
+}
+
+func TestSessionIdleCountsClientInput(t *testing.T) {
+	signer, _ := GenerateSigner()
+	proxy := MakeNewProxy(signer)
+	session := &SessionContext{
+		proxy: proxy,
+		active: true,
+		start_time: time.Now(),
+		user: makeNewTestProxyUser(),
+	}
+	buff := make([]byte, 64)
+
+	server := newChannelWrapper(bytes.NewBufferString("tail -f output"), session, "incoming", "stdout", time.Now(), "session", 0)
+	if _, err := server.Read(buff); err != nil {
+		t.Fatalf("Error reading server output: %s", err)
+	}
+	if !session.lastActivity().Equal(time.Unix(0, 0)) {
+		t.Errorf("channelWrapper.Read() counted server output as activity")
+	}
+
+	before := time.Now()
+	client := newChannelWrapper(bytes.NewBufferString("ls\r"), session, "outgoing", "stdout", time.Now(), "session", 0)
+	if _, err := client.Read(buff); err != nil {
+		t.Fatalf("Error reading client input: %s", err)
+	}
+	if session.lastActivity().Before(before) {
+		t.Errorf("channelWrapper.Read() did not count client input as activity")
+	}
+}
@@ -37,6 +37,11 @@ associated with a username, or
 with a specific session specified
 in the SessionKey
 
+A viewer with an Operator may also
+take over the live sessions it can
+see; the Operator is recorded with
+everything typed.
+
 At this time the expiration field is
 not used. 
 
@@ -47,11 +52,15 @@ type proxySessionViewer struct {
 	proxy *ProxyContext
 	User  *ProxyUser
 	SessionKey string
+	Operator string `json:",omitempty"`
 	expiration int64
 }
 
 func (viewer *proxySessionViewer) BuildSignedURL(proxyID uint64) string {
-	return fmt.Sprintf("%v/?id=%v#signed-viewer&%v", viewer.proxy.BaseURI,proxyID,viewer.Secret)
+	viewer.proxy.mutex.Lock()
+	base_uri := viewer.proxy.BaseURI
+	viewer.proxy.mutex.Unlock()
+	return fmt.Sprintf("%v/?id=%v#signed-viewer&%v", base_uri,proxyID,viewer.Secret)
 }
 
 func createNewSessionViewer(ViewerType int, proxy *ProxyContext, user *ProxyUser) *proxySessionViewer {
@@ -81,16 +90,16 @@ func (viewer *proxySessionViewer) typeIsList() bool {
 func (viewer *proxySessionViewer) getSessions() (map[string]*SessionContext, []string) {
 	session_keys := make([]string, 0)
 	user_key := viewer.User.GetKey()
-	if  _, ok := viewer.proxy.userSessions[user_key]; ok {
+	if user_sessions, ok := viewer.proxy.sessions.userSnapshot(user_key); ok {
 		if viewer.typeIsSingle() {
 			finalMap := make(map[string]*SessionContext)
-			if _, ok := viewer.proxy.userSessions[user_key][viewer.SessionKey]; ok {
-				finalMap[viewer.SessionKey] = viewer.proxy.userSessions[user_key][viewer.SessionKey]
+			if session, ok := user_sessions[viewer.proxy.sessions.resolve(viewer.SessionKey)]; ok {
+				finalMap[viewer.SessionKey] = session
 				session_keys = append(session_keys,viewer.SessionKey)
 			}
 			return finalMap, session_keys
 		} else {
-			return viewer.proxy.userSessions[user_key], viewer.proxy.ListAllUserSessions(user_key)
+			return user_sessions, makeListOfSessionKeys(user_sessions, true)
 		}
 	} else {
 		//viewer.proxy.Log.Println("could not find user_key in user session", user_key, viewer.proxy.userSessions)
@@ -98,6 +107,26 @@ func (viewer *proxySessionViewer) getSessions() (map[string]*SessionContext, []s
 	}
 }
 
+/*
+ getSession finds one of the sessions of the
+ viewer by its ID, or by the address key it
+ had before session IDs were added.
+*/
+func (viewer *proxySessionViewer) getSession(key string) (*SessionContext, bool) {
+	sessions, _ := viewer.getSessions()
+	if session, ok := sessions[key]; ok {
+		return session, ok
+	}
+	session, ok := sessions[viewer.proxy.sessions.resolve(key)]
+	return session, ok
+}
+
+func (viewer *proxySessionViewer) getOperator() string {
+	viewer.proxy.users_mutex.RLock()
+	defer viewer.proxy.users_mutex.RUnlock()
+	return viewer.Operator
+}
+
 func (viewer *proxySessionViewer) isExpired() bool {
 	return false
 }
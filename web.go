@@ -31,6 +31,10 @@ type session_info struct {
 	Length		int64 `json:"length"`
 	User		string `json:"user,omitempty"`
 	Secret		string `json:"secret,omitempty"`
+	Pending		bool `json:"pending,omitempty"`
+	// the viewer may take over and approve the
+	// session, so the page shows those controls
+	Operator	bool `json:"operator,omitempty"`
 }
 
 func buildWebSessionInfoList(sessions map[string]*SessionContext, sessions_keys []string, user string, secret string) []session_info {
@@ -47,11 +51,12 @@ func buildWebSessionInfoList(sessions map[string]*SessionContext, sessions_keys
 		session_list[index].Key = session_key
 		session_list[index].User = user
 		session_list[index].Secret = secret
-		session_list[index].Active = cur_session.active
+		session_list[index].Active = cur_session.isActive()
+		session_list[index].Pending = cur_session.isPendingApproval()
 		session_list[index].Start_time = cur_session.getStartTimeAsUnix()
 		
-		stop_time := cur_session.stop_time
-		if cur_session.active {
+		stop_time := cur_session.getStopTime()
+		if session_list[index].Active {
 			stop_time = time.Now()
 		}
 		session_list[index].Length = int64(stop_time.Sub(cur_session.start_time).Seconds())
@@ -62,18 +67,19 @@ func buildWebSessionInfoList(sessions map[string]*SessionContext, sessions_keys
 func (server *proxyWebServer) getUserSessionInfo(viewer *proxySessionViewer) []session_info {
 	sessions, sessions_keys := viewer.getSessions()
 
-	return buildWebSessionInfoList(sessions, sessions_keys, viewer.User.GetKey(), viewer.Secret)
+	session_list := buildWebSessionInfoList(sessions, sessions_keys, viewer.User.GetKey(), viewer.Secret)
+	operator := viewer.getOperator() != ""
+	for index := range session_list {
+		session_list[index].Operator = operator
+	}
+	return session_list
 }
 
 func (server *proxyWebServer) getAllSessionInfo(active_only bool) []session_info {
 	var sessions_keys []string
 
-	if active_only {
-		sessions_keys = server.proxy.ListAllActiveSessions()
-	} else {
-		sessions_keys = server.proxy.ListAllSessions()
-	}
-	sessions := server.proxy.allSessions
+	sessions := server.proxy.sessions.snapshot()
+	sessions_keys = makeListOfSessionKeys(sessions, !active_only)
 
 	
 	return buildWebSessionInfoList(sessions, sessions_keys,"","")
@@ -109,6 +115,24 @@ func send_window_update(rows uint32, columns uint32,  conn * websocket.Conn){
 }
 */
 
+func send_event_data(conn * websocket.Conn, data []byte) error {
+	log.Println("sending",data)
+	ack := []byte("")
+	for string(ack) != "ack" {
+		conn.WriteMessage(websocket.TextMessage,data)
+		var err error
+		_, ack, err = conn.ReadMessage()
+		if err != nil {
+			log.Println("Error during message reading:", err)
+			return err
+		}
+		if string(ack) != "ack" {
+			log.Println("Error: client did not ack last message.")
+		}
+	}
+	return nil
+}
+
 func send_latest_events(prev_index int, new_index int, conn * websocket.Conn, events []*SessionEvent){
 
 	for _, event := range events[prev_index:new_index] {
@@ -117,21 +141,7 @@ func send_latest_events(prev_index int, new_index int, conn * websocket.Conn, ev
 			log.Println("Error during marshaling json: ", err)
 			break
 		}
-		log.Println("sending",data)
-		ack := []byte("")
-		for string(ack) != "ack" {
-			conn.WriteMessage(websocket.TextMessage,data)
-			_, ack, err = conn.ReadMessage()
-			if err != nil {
-				log.Println("Error during message reading:", err)
-				break
-				
-			}
-			if string(ack) != "ack" {
-				log.Println("Error: client did not ack last message.")
-				
-			}
-		}
+		send_event_data(conn, data)
 	}
 }
 
@@ -151,10 +161,8 @@ func (server *proxyWebServer) sessionViewerSocketGet(conn * websocket.Conn) {
 		log.Println("Error during message reading:", err)
 		return
 	}
-	viewer_sessions, _ := viewer.getSessions()
-
-	if session, ok := viewer_sessions[string(sessionKey)]; ok {
-		playSession(conn,session)
+	if session, ok := viewer.getSession(string(sessionKey)); ok {
+		server.playSession(conn,session)
 	} else {
 		log.Printf("could not find session %v\n",sessionKey)
 		conn.WriteMessage(websocket.TextMessage,[]byte("could not find session"))
@@ -182,18 +190,40 @@ func (server *proxyWebServer) sessionViewerSocketList(conn * websocket.Conn) {
 	err = conn.WriteMessage(websocket.TextMessage,sessions_json)	
 }
 
-func playSession(conn *websocket.Conn, session *SessionContext) {
-	last_event_index := 0
-	new_event_index := len(session.events)
+/*
+ playSession sends a session to the viewer.
+ Archived sessions are streamed from their
+ recording; live ones are followed until
+ they end.
+*/
+func (server *proxyWebServer) playSession(conn *websocket.Conn, session *SessionContext) {
+	if session.archived {
+		identity, err := server.loadRecordingIdentity()
+		if err == nil {
+			err = playArchivedSession(conn, session, identity)
+		}
+		if err != nil {
+			log.Println("Error playing archived session:", err)
+		}
+		return
+	}
+	server.playLiveSession(conn, session)
+}
+
+func (server *proxyWebServer) loadRecordingIdentity() (*RecordingIdentity, error) {
+	if server.recordingIdentityFile == "" {
+		return nil, nil
+	}
+	return LoadRecordingIdentity(server.recordingIdentityFile)
+}
+
+func (server *proxyWebServer) playLiveSession(conn *websocket.Conn, session *SessionContext) {
 	fmt.Println("found session")
 	client_signal :=  session.MakeNewSignal()
 	defer session.RemoveSignal(client_signal)
 	fmt.Println("have signal")
 	//send_window_update(session.term_rows,session.term_cols, conn)
-	send_latest_events(last_event_index, 
-			new_event_index, conn, session.events)
-		
-	last_event_index = new_event_index				
+	next_event_index := server.sendEventsFrom(conn, session, 0)
 	for true {
 		switch <-client_signal {
 			case SIGNAL_SESSION_END:
@@ -201,12 +231,7 @@ func playSession(conn *websocket.Conn, session *SessionContext) {
 				return
 			case SIGNAL_NEW_MESSAGE: 
 				fmt.Println("new message signal")
-				new_event_index := len(session.events)
-				send_latest_events(last_event_index, 
-					new_event_index, conn, session.events)
-				
-				last_event_index = new_event_index	
-			
+				next_event_index = server.sendEventsFrom(conn, session, next_event_index)
 		}
 	}
 	fmt.Println("no more messages")
@@ -221,8 +246,8 @@ func (server *proxyWebServer) getActiveSession(conn *websocket.Conn) {
 	session := string(session_keyname)
 	fmt.Printf("selecting %v\n",session)
 	
-	if context, ok := server.proxy.allSessions[session]; ok {
-		playSession(conn,context)
+	if context, ok := server.proxy.sessions.get(session); ok {
+		server.playSession(conn,context)
 	} else {
 		log.Printf("could not find session %v\n",session)
 		conn.WriteMessage(websocket.TextMessage,[]byte("could not find session"))
@@ -254,7 +279,7 @@ func (server *proxyWebServer) socketHandler(w http.ResponseWriter, r *http.Reque
         }
 		switch string(message) {
 			case "list-active":
-				if server.proxy.PublicAccess {
+				if server.proxy.isPublic() {
 					sessions_json, err := json.Marshal(server.getAllSessionInfo(true))
 					if err != nil {
 						log.Println("Error during marshaling json: ", err)
@@ -273,7 +298,7 @@ func (server *proxyWebServer) socketHandler(w http.ResponseWriter, r *http.Reque
 					}
 				}				
 			case "list-all":
-				if server.proxy.PublicAccess {
+				if server.proxy.isPublic() {
 					sessions_json, err := json.Marshal(server.getAllSessionInfo(false))
 					if err != nil {
 						log.Println("Error during marshaling json: ", err)
@@ -297,6 +322,12 @@ func (server *proxyWebServer) socketHandler(w http.ResponseWriter, r *http.Reque
 			case "viewer-list":
 				server.sessionViewerSocketList(conn)
 				break;
+			case "viewer-takeover":
+				server.sessionViewerSocketTakeover(conn)
+				break;
+			case "viewer-approval":
+				server.sessionViewerSocketApproval(conn)
+				break;
 			case "get":
 				server.getActiveSession(conn) 
 				break;
@@ -354,4 +385,5 @@ type proxyWebServer struct {
 	proxy	*ProxyContext
 	listenHost	string
 	BaseURI		string
+	recordingIdentityFile	string
 }
@@ -43,8 +43,8 @@ func TestWebServerRouteListActive(t *testing.T) {
 		sessionID: proxySessionInactiveKey,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
-	proxy.allSessions[proxySessionInactiveKey] = inactiveSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
+	proxy.sessions.add(proxySessionInactiveKey, inactiveSession)
 
 	go controller.StartWebServer()
 	defer controller.StopWebServer()
@@ -103,7 +103,7 @@ func TestWebServerRouteListActivePublicAccessDisabled(t *testing.T) {
 		sessionID: proxySessionActiveKey,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
 
 	go controller.StartWebServer()
 	defer controller.StopWebServer()
@@ -156,8 +156,8 @@ func TestWebServerRouteListAll(t *testing.T) {
 		sessionID: proxySessionInactiveKey,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
-	proxy.allSessions[proxySessionInactiveKey] = inactiveSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
+	proxy.sessions.add(proxySessionInactiveKey, inactiveSession)
 
 	go controller.StartWebServer()
 	defer controller.StopWebServer()
@@ -211,7 +211,7 @@ func TestWebServerRouteListAllPublicAccessDisabled(t *testing.T) {
 		sessionID: proxySessionActiveKey,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
 
 	go controller.StartWebServer()
 	defer controller.StopWebServer()
@@ -281,8 +281,8 @@ func TestWebServerRouteViewerList(t *testing.T) {
 		user: testUser2,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
-	proxy.allSessions[proxySessionInactiveKey] = inactiveSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
+	proxy.sessions.add(proxySessionInactiveKey, inactiveSession)
 
 	proxy.AddSessionToUserList(activeSession)
 	proxy.AddSessionToUserList(inactiveSession)
@@ -389,8 +389,8 @@ func TestWebServerRouteViewerGet(t *testing.T) {
 		user: testUser2,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
-	proxy.allSessions[proxySessionInactiveKey] = inactiveSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
+	proxy.sessions.add(proxySessionInactiveKey, inactiveSession)
 
 	proxy.AddSessionToUserList(activeSession)
 	proxy.AddSessionToUserList(inactiveSession)
@@ -520,8 +520,8 @@ func TestWebServerRouteViewerGetSingle(t *testing.T) {
 		user: testUser2,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
-	proxy.allSessions[proxySessionInactiveKey] = inactiveSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
+	proxy.sessions.add(proxySessionInactiveKey, inactiveSession)
 
 	proxy.AddSessionToUserList(activeSession)
 	proxy.AddSessionToUserList(inactiveSession)
@@ -654,8 +654,8 @@ func TestWebServerRouteGet(t *testing.T) {
 		user: testUser2,
 	}
 
-	proxy.allSessions[proxySessionActiveKey] = activeSession
-	proxy.allSessions[proxySessionInactiveKey] = otherSession
+	proxy.sessions.add(proxySessionActiveKey, activeSession)
+	proxy.sessions.add(proxySessionInactiveKey, otherSession)
 
 	proxy.AddSessionToUserList(activeSession)
 	proxy.AddSessionToUserList(otherSession)